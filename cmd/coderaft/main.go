@@ -5,11 +5,12 @@ import (
 	"os"
 
 	"coderaft/internal/commands"
+	"coderaft/internal/errdefs"
 )
 
 func main() {
 	if err := commands.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		os.Exit(errdefs.ExitCode(err))
 	}
 }
@@ -1,33 +1,61 @@
 package commands
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
+	"coderaft/internal/errdefs"
+	"coderaft/internal/parallel"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
 
 type applyLockFile struct {
 	Version    int            `json:"version"`
+	Minimal    bool           `json:"minimal"`
 	Project    string         `json:"project"`
 	IslandName string         `json:"ISLAND_NAME"`
 	Container  lockContainer  `json:"container"`
 	Packages   lockPackages   `json:"packages"`
 	Registries lockRegistries `json:"registries"`
 	AptSources lockAptSources `json:"apt_sources"`
+	System     *lockSystem    `json:"system"`
+
+	VSCodeExtensions []string          `json:"vscode_extensions"`
+	TrackedFiles     map[string]string `json:"tracked_files"`
 }
 
 var applyDryRun bool
 var applyTimeout int
+var applyParallelWorkers int
+var applyVerifyAfter bool
+var applyAllowDowngrade bool
+var applyYes bool
+var applyAutoRollback bool
+var applyInteractive bool
+var applyLockWait time.Duration
+var applyBackupDir string
+var applyRollbackDir string
+
+// errApplyCancelled is returned when the user declines the downgrade prompt
+var errApplyCancelled = errors.New("apply cancelled")
+
+const aptInstallChunkSize = 25
 
 var applyCmd = &cobra.Command{
 	Use:   "apply <project>",
@@ -36,19 +64,95 @@ var applyCmd = &cobra.Command{
 
 Configures registries (pip, npm, yarn, pnpm) and apt sources to match the
 lock file, then reconciles every package set so the island ends up with
-exactly the versions recorded in the lock.
+exactly the versions recorded in the lock. Go binaries and cargo-installed
+tools are reinstalled with 'go install pkg@version' and
+'cargo install --version'. VS Code server extensions recorded in the lock are
+reinstalled once VS Code has attached to the island.
+
+A minimal lock (written by 'coderaft lock --minimal') is applied the same
+way, except that only the packages it lists are installed or pinned: other
+packages, and managers the lock doesn't mention, are left alone.
 
 Container-level configuration (ports, volumes, environment, capabilities,
 resources) cannot be reconciled in-place — you will be warned if they
 differ. Use 'coderaft destroy' + 'coderaft up' to recreate if needed.
 
-Use --dry-run to preview the changes without modifying the island.`,
+Use --dry-run to preview the changes without modifying the island.
+Use --parallel-workers to control how many reconcile commands run at once.
+
+After reconciling, the island is re-queried and compared with the lock the
+same way 'coderaft verify' does. Any drift that remains (a package that
+refused to install at the locked version, or container-level differences)
+is listed and apply exits non-zero. Use --verify-after=false to skip it.
+
+apt packages the lock pins to an older version than the island has are
+listed before anything changes. System-critical packages (libc6, dpkg, apt,
+bash, coreutils and others, plus settings.protected_packages) are never
+downgraded and stay at their installed version. Any other downgrade needs
+--allow-downgrade and a confirmation, which --yes skips.
+
+Before changing anything, apply commits the island to a snapshot image. If
+a step fails, the island is recreated from the snapshot with the same
+workspace and coderaft.json settings, leaving it as it was before apply.
+With --auto-rollback=false the island is left as is and the snapshot is
+kept for a manual rollback.
+
+--backup-dir writes a backup instead of the snapshot: every package list
+plus the config files apply rewrites (apt sources, release pin and
+preferences, pip.conf, and the global npm, yarn and pnpm configs). A failed
+step restores it the same way, and it is kept after a successful apply, so
+'coderaft apply --rollback <dir>' can undo the apply later. It is small, fast
+to take and still works after the island has been recreated, but it only
+covers packages and those files; other changes made to the island are not
+rolled back the way the snapshot would.
+
+With --interactive, each package install, upgrade or removal is shown before
+anything runs and can be approved, skipped or used to abort the apply.
+Registries, apt sources and locale settings are still applied. Skipped
+actions are listed at the end, and --verify-after doesn't run since the
+island is known to drift for them. It needs a terminal and has no overall
+timeout, since it waits on your answers.
+
+Only one apply runs against an island at a time, including the auto-apply
+of 'coderaft up'. A second apply fails right away with "apply already in
+progress", or with --lock-wait waits that long for the first to finish.
+--dry-run and 'coderaft verify' only read the island and don't take the
+lock. A lock left by an apply that crashed is taken over after two minutes.
+
+Examples:
+  coderaft apply myproject
+  coderaft apply myproject --dry-run
+  coderaft apply myproject --allow-downgrade --yes
+  coderaft apply myproject --auto-rollback=false
+  coderaft apply myproject --interactive
+  coderaft apply myproject --backup-dir ~/backups/myproject-1
+  coderaft apply myproject --rollback ~/backups/myproject-1
+  coderaft apply myproject --lock-wait 5m`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		projectName := args[0]
 
+		if applyParallelWorkers < 0 {
+			return fmt.Errorf("--parallel-workers must be 0 (use defaults) or a positive number")
+		}
+		if applyRollbackDir != "" && (applyBackupDir != "" || applyInteractive) {
+			return fmt.Errorf("--rollback cannot be combined with --backup-dir or --interactive")
+		}
+		if applyInteractive {
+			if applyDryRun {
+				return fmt.Errorf("--interactive cannot be combined with --dry-run")
+			}
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return fmt.Errorf("--interactive needs a terminal to prompt on; use --dry-run to preview the changes instead")
+			}
+		}
+
 		timeout := security.Timeouts.Apply
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if applyInteractive {
+			cancel()
+			ctx, cancel = context.WithCancel(context.Background())
+		}
 		defer cancel()
 
 		type applyResult struct {
@@ -56,7 +160,24 @@ Use --dry-run to preview the changes without modifying the island.`,
 		}
 		resultCh := make(chan applyResult, 1)
 		go func() {
-			resultCh <- applyResult{err: runApply(ctx, projectName)}
+			if applyRollbackDir != "" {
+				resultCh <- applyResult{err: runApplyRollback(projectName, applyRollbackDir)}
+				return
+			}
+			skipped, err := runApply(ctx, projectName)
+			if errors.Is(err, errApplyCancelled) {
+				ui.Info("apply cancelled.")
+				err = nil
+			} else if err == nil && len(skipped) > 0 {
+				ui.Warning("skipped %d action(s); the island still drifts from the lock for:", len(skipped))
+				for _, a := range skipped {
+					ui.Item(a)
+				}
+				ui.Info("hint: run 'coderaft verify %s' to see the remaining drift.", projectName)
+			} else if err == nil && applyVerifyAfter && !applyDryRun {
+				err = verifyAfterApply(projectName)
+			}
+			resultCh <- applyResult{err: err}
 		}()
 
 		select {
@@ -68,6 +189,66 @@ Use --dry-run to preview the changes without modifying the island.`,
 	},
 }
 
+// verifyAfterApply re-checks the island against the lock once apply is done
+// and fails if anything is still out of line
+func verifyAfterApply(projectName string) error {
+	ui.Status("verifying the island against coderaft.lock.json...")
+	report, err := runVerify(projectName)
+	if err != nil {
+		return fmt.Errorf("apply finished but verification failed: %w", err)
+	}
+	if !report.Matches {
+		return fmt.Errorf("apply finished but %d drift(s) remain", len(report.Drifts))
+	}
+	return nil
+}
+
+// checkDowngrades reports the apt downgrades the lock asks for. Protected
+// packages are only warned about since they are already held back; other
+// held downgrades fail the apply, and allowed ones need confirmation.
+func checkDowngrades(projectName string, downgrades []aptDowngrade) error {
+	protected, needAllow, allowed := splitDowngrades(downgrades)
+
+	if len(protected) > 0 {
+		ui.Warning("refusing to downgrade %d protected package(s); they stay at their installed version:", len(protected))
+		for _, d := range protected {
+			ui.Item(d.String())
+		}
+		ui.Info("hint: run 'coderaft lock %s' to record the installed versions.", projectName)
+	}
+
+	if len(needAllow) > 0 {
+		ui.Warning("the lock would downgrade %d package(s):", len(needAllow))
+		for _, d := range needAllow {
+			ui.Item(d.String())
+		}
+		if !applyDryRun {
+			return fmt.Errorf("refusing to downgrade %d package(s); re-run with --allow-downgrade to allow it", len(needAllow))
+		}
+		ui.Info("hint: these need --allow-downgrade.")
+	}
+
+	if len(allowed) > 0 {
+		ui.Warning("%d package(s) will be downgraded:", len(allowed))
+		for _, d := range allowed {
+			ui.Item(d.String())
+		}
+		if !applyDryRun && !applyYes {
+			ui.Prompt("Downgrade these packages? (y/N): ")
+			reader := bufio.NewReader(os.Stdin)
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read confirmation: %w", err)
+			}
+			response = strings.ToLower(strings.TrimSpace(response))
+			if response != "y" && response != "yes" {
+				return errApplyCancelled
+			}
+		}
+	}
+	return nil
+}
+
 func validateRegistryURL(name, rawURL string) error {
 	if rawURL == "" {
 		return nil
@@ -82,25 +263,37 @@ func validateRegistryURL(name, rawURL string) error {
 	return nil
 }
 
-func runApply(ctx context.Context, projectName string) error {
+// runApply reconciles the island with its lock file. It returns the actions
+// --interactive skipped.
+func runApply(ctx context.Context, projectName string) ([]string, error) {
 	cfg, err := configManager.Load()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return nil, errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	lockPath := filepath.Join(proj.WorkspacePath, "coderaft.lock.json")
 	data, err := os.ReadFile(lockPath)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %w", security.SanitizePathForError(lockPath), err)
+		return nil, fmt.Errorf("failed to read %s: %w", security.SanitizePathForError(lockPath), err)
 	}
 
 	var lf applyLockFile
 	if err := json.Unmarshal(data, &lf); err != nil {
-		return fmt.Errorf("invalid lockfile: %w", err)
+		return nil, fmt.Errorf("invalid lockfile: %w", err)
+	}
+
+	// A dry run only reads the island
+	if !applyDryRun {
+		lock, err := lockIslandForApply(proj.IslandName, "coderaft apply "+projectName, applyLockWait)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+		invalidateVerifyCache(proj.IslandName)
 	}
 
 	registryChecks := []struct{ name, url string }{
@@ -111,29 +304,29 @@ func runApply(ctx context.Context, projectName string) error {
 	}
 	for _, rc := range registryChecks {
 		if err := validateRegistryURL(rc.name, rc.url); err != nil {
-			return fmt.Errorf("lock file contains invalid registry: %w", err)
+			return nil, fmt.Errorf("lock file contains invalid registry: %w", err)
 		}
 	}
 	for _, u := range lf.Registries.PipExtraIndex {
 		if err := validateRegistryURL("pip extra-index", u); err != nil {
-			return fmt.Errorf("lock file contains invalid registry: %w", err)
+			return nil, fmt.Errorf("lock file contains invalid registry: %w", err)
 		}
 	}
 
 	exists, err := dockerClient.IslandExists(proj.IslandName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
+		return nil, errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
 	}
 	status, err := dockerClient.GetIslandStatus(proj.IslandName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if status != "running" {
 		if err := dockerClient.StartIsland(proj.IslandName); err != nil {
-			return fmt.Errorf("failed to start island: %w", err)
+			return nil, fmt.Errorf("failed to start island: %w", err)
 		}
 	}
 
@@ -168,6 +361,12 @@ func runApply(ctx context.Context, projectName string) error {
 			}
 		}
 	}
+	if lf.System != nil && len(lf.System.Ulimits) > 0 {
+		live := dockerClient.GetSystemSettings(proj.IslandName)
+		if !maps.Equal(lf.System.Ulimits, live.Ulimits) {
+			containerWarnings = append(containerWarnings, fmt.Sprintf("ulimits differ (lock=%v current=%v)", lf.System.Ulimits, live.Ulimits))
+		}
+	}
 	if len(containerWarnings) > 0 {
 		ui.Warning("container-level config drift detected (%d items). These cannot be reconciled in-place:", len(containerWarnings))
 		for _, w := range containerWarnings {
@@ -176,6 +375,17 @@ func runApply(ctx context.Context, projectName string) error {
 		ui.Info("hint: run 'coderaft destroy %s && coderaft up' to recreate with correct config.", projectName)
 	}
 
+	if len(lf.TrackedFiles) > 0 {
+		live := dockerClient.GetFileChecksums(proj.IslandName, sortedKeys(lf.TrackedFiles))
+		if changes := trackedFileChanges(lf.TrackedFiles, live); len(changes) > 0 {
+			ui.Warning("%d tracked file(s) differ from the lock. apply doesn't restore files:", len(changes))
+			for _, c := range changes {
+				ui.Item(c)
+			}
+			ui.Info("hint: restore them by hand or recreate the island, then run 'coderaft verify %s'.", projectName)
+		}
+	}
+
 	var applyCmds []string
 
 	if len(lf.AptSources.SourcesLists) > 0 {
@@ -189,6 +399,11 @@ func runApply(ctx context.Context, projectName string) error {
 	if lf.AptSources.PinnedRelease != "" {
 		applyCmds = append(applyCmds, fmt.Sprintf("echo 'APT::Default-Release \"%s\";' > /etc/apt/apt.conf.d/99defaultrelease", escapeBash(lf.AptSources.PinnedRelease)))
 	}
+	prefCmds, err := aptPreferencesCommands(lf.AptSources.Preferences)
+	if err != nil {
+		return nil, err
+	}
+	applyCmds = append(applyCmds, prefCmds...)
 	if len(lf.AptSources.SourcesLists) > 0 {
 		applyCmds = append(applyCmds, "apt update -y")
 	}
@@ -223,8 +438,48 @@ func runApply(ctx context.Context, projectName string) error {
 		applyCmds = append(applyCmds, fmt.Sprintf("pnpm config set registry %s -g", shellQuote(lf.Registries.PnpmRegistry)))
 	}
 
+	// Excluded packages are left as they are in the island, in both directions
+	exclude := newPackageExclusions(cfg.Settings)
+	lockPkgs := exclude.filterPackages(lf.Packages)
 	curApt, curPip, curNpm, curYarn, curPnpm := dockerClient.QueryPackagesParallel(proj.IslandName)
-	actions := buildReconcileActions(lf.Packages, curApt, curPip, curNpm, curYarn, curPnpm)
+	cur := exclude.filterPackages(lockPackages{Apt: curApt, Pip: curPip, Npm: curNpm, Yarn: curYarn, Pnpm: curPnpm})
+	// A minimal lock leaves packages it doesn't list where they are
+	if lf.Minimal {
+		cur = restrictToLock(lockPkgs, cur)
+	}
+	actions, downgrades := buildReconcileActions(lockPkgs, cur.Apt, cur.Pip, cur.Npm, cur.Yarn, cur.Pnpm, newDowngradeGuard(cfg.Settings, applyAllowDowngrade))
+	actions = append(systemReconcileActions(proj.IslandName, lockPkgs, exclude, lf.Minimal), actions...)
+	if len(lockPkgs.Go) > 0 || len(lockPkgs.Cargo) > 0 {
+		curGo, goFiles, curCargo := queryToolBinaries(proj.IslandName)
+		tools := lockPackages{Go: exclude.filter("go", "@", curGo), Cargo: exclude.filter("cargo", "=", curCargo)}
+		if lf.Minimal {
+			tools = restrictToLock(lockPkgs, tools)
+		}
+		actions = append(actions, buildToolReconcileActions(lockPkgs, tools.Go, tools.Cargo, goFiles)...)
+	}
+	if len(lf.VSCodeExtensions) > 0 {
+		if _, _, err := dockerClient.ExecCapture(proj.IslandName, "test -n "+parallel.VSCodeServerCLI); err != nil {
+			ui.Warning("lock file lists %d VS Code extension(s) but the VS Code server is not installed in the island; attach VS Code to it and re-run apply", len(lf.VSCodeExtensions))
+		} else {
+			actions = append(actions, buildVSCodeReconcileActions(exclude.filter("vscode", "@", lf.VSCodeExtensions), exclude.filter("vscode", "@", queryVSCodeExtensions(proj.IslandName)))...)
+		}
+	}
+
+	systemCmds, err := systemSettingsCommands(lf.System)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDowngrades(projectName, downgrades); err != nil {
+		return nil, err
+	}
+
+	var skipped []string
+	if applyInteractive && len(actions) > 0 {
+		if actions, skipped, err = approveActions(actions, bufio.NewReader(os.Stdin)); err != nil {
+			return nil, err
+		}
+	}
 
 	if applyDryRun {
 		ui.Status("dry run — the following changes would be applied:")
@@ -241,45 +496,118 @@ func runApply(ctx context.Context, projectName string) error {
 				ui.Item(a)
 			}
 		}
-		if len(applyCmds) == 0 && len(actions) == 0 {
+		if len(systemCmds) > 0 {
+			ui.Detail("locale/timezone commands", fmt.Sprintf("%d", len(systemCmds)))
+			for _, c := range systemCmds {
+				ui.Item(c)
+			}
+		}
+		if len(applyCmds) == 0 && len(actions) == 0 && len(systemCmds) == 0 {
 			ui.Success("island already matches lockfile — nothing to do")
 		}
-		return nil
+		return nil, nil
 	}
 
-	ui.Status("creating pre-apply snapshot for rollback safety...")
-	snapshotTag := fmt.Sprintf("coderaft-snapshot/%s:pre-apply-%d", projectName, time.Now().Unix())
-	_, snapshotErr := dockerClient.CommitContainer(proj.IslandName, snapshotTag)
-	if snapshotErr != nil {
-		ui.Warning("failed to create rollback snapshot: %v (continuing without rollback support)", snapshotErr)
-		snapshotTag = ""
+	var undo applyUndo
+	if applyBackupDir != "" {
+		backup, err := takeApplyBackup(proj, applyBackupDir)
+		if err != nil {
+			return nil, err
+		}
+		undo = backup
+	} else {
+		undo = takeApplySnapshot(dockerClient, proj)
 	}
 
 	if err := dockerClient.ExecuteSetupCommandsWithOutput(proj.IslandName, applyCmds, false); err != nil {
-		if snapshotTag != "" {
-			ui.Warning("registry/source configuration failed, snapshot available at %s for manual rollback", snapshotTag)
-		}
-		return fmt.Errorf("failed applying registries/sources: %w", err)
+		return nil, undo.fail("registry/source configuration", fmt.Errorf("failed applying registries/sources: %w", err), applyAutoRollback)
 	}
 
 	if len(actions) > 0 {
-		if err := dockerClient.ExecuteSetupCommandsWithOutput(proj.IslandName, actions, true); err != nil {
-			if snapshotTag != "" {
-				ui.Warning("package reconciliation failed, snapshot available at %s for manual rollback", snapshotTag)
-			}
-			return fmt.Errorf("failed to reconcile packages: %w", err)
+		if err := reconcileWithProgress(proj.IslandName, actions, applyParallelWorkers); err != nil {
+			return nil, undo.fail("package reconciliation", fmt.Errorf("failed to reconcile packages: %w", err), applyAutoRollback)
 		}
 	}
 
-	if snapshotTag != "" {
-		ui.Status("cleaning up pre-apply snapshot...")
-		_ = dockerClient.RunDockerCommand([]string{"rmi", snapshotTag})
+	// After reconciling, so a locales package the lock doesn't list isn't removed again
+	if err := dockerClient.ExecuteSetupCommandsWithOutput(proj.IslandName, systemCmds, false); err != nil {
+		return nil, undo.fail("locale/timezone configuration", fmt.Errorf("failed to configure locale/timezone: %w", err), applyAutoRollback)
 	}
 
+	undo.discard()
+
 	ui.Success("applied lockfile: registries/sources configured and packages reconciled")
+	return skipped, nil
+}
+
+// reconcileWithProgress runs reconcile actions in a single pass and reports
+// progress as each one finishes, so a failure says how far reconciling got.
+// workers only sets how many actions run at once.
+func reconcileWithProgress(islandName string, actions []string, workers int) error {
+	total := 0
+	for _, a := range actions {
+		total += reconcilePackageCount(a)
+	}
+
+	done := 0
+	err := dockerClient.ExecuteSetupCommandsWithProgress(islandName, actions, workers, func(action string) {
+		n := reconcilePackageCount(action)
+		if n == 0 {
+			return
+		}
+		done += n
+		ui.Info("reconciling %d/%d packages", done, total)
+	})
+	if err != nil {
+		return fmt.Errorf("reconcile stopped after %d/%d packages: %w", done, total, err)
+	}
 	return nil
 }
 
+var reconcileCommandPrefixes = []string{
+	"DEBIAN_FRONTEND=noninteractive apt-get install -y ",
+	"apt-get remove -y ",
+	"python3 -m pip install ",
+	"python3 -m pip uninstall -y ",
+	"npm i -g ",
+	"npm rm -g ",
+	"yarn global add ",
+	"yarn global remove ",
+	"pnpm add -g ",
+	"pnpm remove -g ",
+	"go install ",
+	"rm -f \"$(go env GOPATH)/bin/",
+	"cargo install ",
+	"cargo uninstall ",
+	parallel.VSCodeServerCLI + " --install-extension ",
+	parallel.VSCodeServerCLI + " --uninstall-extension ",
+}
+
+// reconcilePackageCount returns how many packages a reconcile action touches.
+// Housekeeping commands like 'apt update' count as zero.
+func reconcilePackageCount(action string) int {
+	for _, prefix := range reconcileCommandPrefixes {
+		if !strings.HasPrefix(action, prefix) {
+			continue
+		}
+		count := 0
+		skipNext := false
+		for _, f := range strings.Fields(strings.TrimPrefix(action, prefix)) {
+			switch {
+			case skipNext:
+				skipNext = false
+			case f == "--version":
+				skipNext = true
+			case strings.HasPrefix(f, "-"):
+			default:
+				count++
+			}
+		}
+		return count
+	}
+	return 0
+}
+
 func escapeBash(s string) string {
 	s = strings.ReplaceAll(s, `\`, `\\`)
 	s = strings.ReplaceAll(s, "'", "'\\''")
@@ -291,6 +619,69 @@ func escapeBash(s string) string {
 	return s
 }
 
+var aptPreferencesPathPattern = regexp.MustCompile(`^/etc/apt/preferences(\.d/[A-Za-z0-9_.-]+)?$`)
+
+// aptPreferencesCommands replaces the island's apt pinning files with the ones
+// recorded in the lock. Nothing is touched when the lock recorded none.
+func aptPreferencesCommands(prefs map[string]string) ([]string, error) {
+	if len(prefs) == 0 {
+		return nil, nil
+	}
+	paths := make([]string, 0, len(prefs))
+	for p := range prefs {
+		if !aptPreferencesPathPattern.MatchString(p) || strings.Contains(p, "..") {
+			return nil, fmt.Errorf("invalid apt preferences path '%s' in lock file", p)
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	cmds := []string{"rm -f /etc/apt/preferences /etc/apt/preferences.d/* 2>/dev/null || true"}
+	for _, p := range paths {
+		cmds = append(cmds, fmt.Sprintf("printf '%%s\\n' %s > %s", shellQuote(prefs[p]), shellQuote(p)))
+	}
+	return cmds, nil
+}
+
+var (
+	timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	localePattern   = regexp.MustCompile(`^([A-Za-z]+_[A-Za-z]+)(\.([A-Za-z0-9-]+))?(@[A-Za-z]+)?$`)
+)
+
+// systemSettingsCommands sets the island's timezone and locale to the ones
+// recorded in the lock. Ulimits live in the container's host config and can't
+// be changed in place, so they are only reported as drift.
+func systemSettingsCommands(sys *lockSystem) ([]string, error) {
+	if sys == nil {
+		return nil, nil
+	}
+	var cmds []string
+	if sys.Timezone != "" {
+		if !timezonePattern.MatchString(sys.Timezone) {
+			return nil, fmt.Errorf("invalid timezone '%s' in lock file", sys.Timezone)
+		}
+		tz := shellQuote(sys.Timezone)
+		cmds = append(cmds, fmt.Sprintf("ln -sf /usr/share/zoneinfo/%s /etc/localtime && echo %s > /etc/timezone", tz, tz))
+	}
+	if sys.Locale != "" {
+		m := localePattern.FindStringSubmatch(sys.Locale)
+		if m == nil {
+			return nil, fmt.Errorf("invalid locale '%s' in lock file", sys.Locale)
+		}
+		charset := m[3]
+		if charset == "" {
+			charset = "ISO-8859-1"
+		}
+		locale := shellQuote(sys.Locale)
+		define := fmt.Sprintf("localedef -i %s -f %s %s", shellQuote(m[1]+m[4]), shellQuote(charset), locale)
+		cmds = append(cmds,
+			fmt.Sprintf("%s 2>/dev/null || (apt-get update -y >/dev/null && DEBIAN_FRONTEND=noninteractive apt-get install -y locales >/dev/null && %s)", define, define),
+			fmt.Sprintf("printf 'export LANG=%%s\\nexport LC_ALL=%%s\\n' %s %s > /etc/profile.d/coderaft-locale.sh", locale, locale),
+		)
+	}
+	return cmds, nil
+}
+
 // shellQuote returns a single-quoted shell string safe for use in bash commands.
 // The result includes the surrounding single quotes.
 func shellQuote(s string) string {
@@ -336,6 +727,123 @@ func parseMap(list []string, sep string) map[string]string {
 	return m
 }
 
+// parsePackageList parses a lock or live package list using the version
+// format of the given manager. Go module paths are case-sensitive, and cargo
+// reports versions with a leading "v" that 'cargo install --version' rejects.
+func parsePackageList(manager string, list []string, sep string) map[string]string {
+	switch manager {
+	case "go":
+		m := map[string]string{}
+		for _, line := range list {
+			s := strings.TrimSpace(line)
+			if idx := strings.LastIndex(s, "@"); idx > 0 {
+				m[s[:idx]] = strings.TrimSpace(s[idx+1:])
+			}
+		}
+		return m
+	case "cargo":
+		m := parseMap(list, "=")
+		for name, ver := range m {
+			m[name] = strings.TrimPrefix(ver, "v")
+		}
+		return m
+	}
+	return parseMap(list, sep)
+}
+
+// queryToolBinaries returns the Go binaries and cargo-installed crates in an
+// island, and the file name each Go binary's package path is installed as
+func queryToolBinaries(islandName string) (goList []string, goFiles map[string]string, cargoList []string) {
+	if out, _, err := dockerClient.ExecCapture(islandName, parallel.GoBinariesQuery); err == nil {
+		goList, goFiles = parallel.ParseGoBinaries(out)
+	}
+	if out, _, err := dockerClient.ExecCapture(islandName, parallel.CargoInstallQuery); err == nil {
+		cargoList = parallel.ParseLineList(out)
+	}
+	sort.Strings(goList)
+	sort.Strings(cargoList)
+	return goList, goFiles, cargoList
+}
+
+// buildToolReconcileActions reconciles globally installed Go binaries and
+// cargo crates against the lock
+func buildToolReconcileActions(lockPkgs lockPackages, curGo, curCargo []string, goFiles map[string]string) []string {
+	var cmds []string
+
+	lockG := parsePackageList("go", lockPkgs.Go, "@")
+	curG := parsePackageList("go", curGo, "@")
+	var goInstall []string
+	for path, ver := range lockG {
+		if curVer, ok := curG[path]; !ok || curVer != ver {
+			goInstall = append(goInstall, fmt.Sprintf("go install %s@%s", path, ver))
+		}
+	}
+	sort.Strings(goInstall)
+	cmds = append(cmds, goInstall...)
+	extraGo := keysNotIn(curG, lockG)
+	sort.Strings(extraGo)
+	for _, path := range extraGo {
+		cmds = append(cmds, fmt.Sprintf("rm -f \"$(go env GOPATH)/bin/%s\"", goBinaryName(path, goFiles)))
+	}
+
+	lockC := parsePackageList("cargo", lockPkgs.Cargo, "=")
+	curC := parsePackageList("cargo", curCargo, "=")
+	var cargoInstall []string
+	for name, ver := range lockC {
+		if curVer, ok := curC[name]; !ok || curVer != ver {
+			cargoInstall = append(cargoInstall, fmt.Sprintf("cargo install --force --version %s %s", ver, name))
+		}
+	}
+	sort.Strings(cargoInstall)
+	cmds = append(cmds, cargoInstall...)
+	extraCargo := keysNotIn(curC, lockC)
+	sort.Strings(extraCargo)
+	for _, name := range extraCargo {
+		cmds = append(cmds, fmt.Sprintf("cargo uninstall %s", name))
+	}
+
+	return cmds
+}
+
+// goBinaryName returns the file 'go install' wrote for a package path: the
+// name the island reported, or else the last path element that isn't a
+// module's "/vN" major version suffix, which Go leaves out of binary names
+func goBinaryName(path string, goFiles map[string]string) string {
+	if file := goFiles[path]; file != "" {
+		return file
+	}
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && name[1] != '0' && name != "v1" && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	return name
+}
+
+// buildVSCodeReconcileActions installs locked VS Code server extensions at
+// their recorded versions and removes ones the lock doesn't list
+func buildVSCodeReconcileActions(locked, current []string) []string {
+	var cmds []string
+
+	lockV := parsePackageList("vscode", locked, "@")
+	curV := parsePackageList("vscode", current, "@")
+	var install []string
+	for id, ver := range lockV {
+		if curVer, ok := curV[id]; !ok || curVer != ver {
+			install = append(install, fmt.Sprintf("%s --install-extension %s --force", parallel.VSCodeServerCLI, shellQuote(id+"@"+ver)))
+		}
+	}
+	sort.Strings(install)
+	cmds = append(cmds, install...)
+	extra := keysNotIn(curV, lockV)
+	sort.Strings(extra)
+	for _, id := range extra {
+		cmds = append(cmds, fmt.Sprintf("%s --uninstall-extension %s", parallel.VSCodeServerCLI, shellQuote(id)))
+	}
+
+	return cmds
+}
+
 func keysNotIn(a, b map[string]string) []string {
 	var out []string
 	for k := range a {
@@ -346,8 +854,12 @@ func keysNotIn(a, b map[string]string) []string {
 	return out
 }
 
-func buildReconcileActions(lockPkgs lockPackages, curApt, curPip, curNpm, curYarn, curPnpm []string) []string {
+// buildReconcileActions returns the commands that bring the island's packages
+// in line with the lock. apt packages the lock would downgrade are reported,
+// and those the guard holds back are left at their installed version.
+func buildReconcileActions(lockPkgs lockPackages, curApt, curPip, curNpm, curYarn, curPnpm []string, guard downgradeGuard) ([]string, []aptDowngrade) {
 	var cmds []string
+	var downgrades []aptDowngrade
 
 	lockA := parseMap(lockPkgs.Apt, "=")
 	curA := parseMap(curApt, "=")
@@ -362,12 +874,31 @@ func buildReconcileActions(lockPkgs lockPackages, curApt, curPip, curNpm, curYar
 
 	var aptInstall []string
 	for name, ver := range lockA {
-		if curVer, ok := curA[name]; !ok || curVer != ver {
-			aptInstall = append(aptInstall, fmt.Sprintf("%s=%s", name, ver))
+		curVer, ok := curA[name]
+		if ok && curVer == ver {
+			continue
+		}
+		if ok {
+			if d, isDowngrade := guard.check(name, curVer, ver); isDowngrade {
+				downgrades = append(downgrades, d)
+				if d.Held {
+					continue
+				}
+			}
 		}
+		aptInstall = append(aptInstall, fmt.Sprintf("%s=%s", name, ver))
 	}
+	sort.Slice(downgrades, func(i, j int) bool { return downgrades[i].Name < downgrades[j].Name })
 	if len(aptInstall) > 0 {
-		cmds = append(cmds, "apt update -y", "DEBIAN_FRONTEND=noninteractive apt-get install -y "+strings.Join(aptInstall, " "))
+		sort.Strings(aptInstall)
+		cmds = append(cmds, "apt update -y")
+		for i := 0; i < len(aptInstall); i += aptInstallChunkSize {
+			end := i + aptInstallChunkSize
+			if end > len(aptInstall) {
+				end = len(aptInstall)
+			}
+			cmds = append(cmds, "DEBIAN_FRONTEND=noninteractive apt-get install -y "+strings.Join(aptInstall[i:end], " "))
+		}
 	}
 
 	extraApt := keysNotIn(curA, lockA)
@@ -412,10 +943,50 @@ func buildReconcileActions(lockPkgs lockPackages, curApt, curPip, curNpm, curYar
 		cmds = append(cmds, fmt.Sprintf("pnpm remove -g %s", extra))
 	}
 
-	return cmds
+	return cmds, downgrades
 }
 
 func init() {
 	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "Preview changes without modifying the island")
 	applyCmd.Flags().IntVar(&applyTimeout, "timeout", 600, "Timeout in seconds for the apply operation")
+	applyCmd.Flags().BoolVar(&applyVerifyAfter, "verify-after", true, "Re-check the island against the lock after applying and fail on remaining drift")
+	applyCmd.Flags().IntVar(&applyParallelWorkers, "parallel-workers", 0, "Number of reconcile commands to run concurrently (0 uses the parallel config defaults)")
+	applyCmd.Flags().BoolVar(&applyAllowDowngrade, "allow-downgrade", false, "Allow apt packages to be downgraded to the locked version (protected packages never are)")
+	applyCmd.Flags().BoolVarP(&applyYes, "yes", "y", false, "Downgrade packages without a confirmation prompt")
+	applyCmd.Flags().BoolVar(&applyAutoRollback, "auto-rollback", true, "Undo a failed step from the pre-apply snapshot, or the --backup-dir backup")
+	applyCmd.Flags().DurationVar(&applyLockWait, "lock-wait", 0, "If another apply to the island is running, wait this long for it to finish instead of failing right away")
+	applyCmd.Flags().StringVar(&applyBackupDir, "backup-dir", "", "Back up package lists and config files to this directory instead of snapshotting the island, and keep the backup for --rollback")
+	applyCmd.Flags().StringVar(&applyRollbackDir, "rollback", "", "Restore the packages and config files of a --backup-dir backup instead of applying the lock")
+	applyCmd.Flags().BoolVar(&applyInteractive, "interactive", false, "Approve, skip or abort each package install, upgrade and removal before it runs (needs a terminal)")
+}
+
+// approveActions asks about each reconcile action in turn and returns the
+// approved and skipped ones. Aborting, or running out of input, cancels the
+// apply.
+func approveActions(actions []string, in *bufio.Reader) (approved, skipped []string, err error) {
+	for i, a := range actions {
+		ui.Info("[%d/%d] %s", i+1, len(actions), a)
+		for {
+			ui.Prompt("Apply this change? (y)es/(s)kip/(a)bort: ")
+			response, err := in.ReadString('\n')
+			if err != nil && response == "" {
+				if errors.Is(err, io.EOF) {
+					return nil, nil, errApplyCancelled
+				}
+				return nil, nil, fmt.Errorf("failed to read confirmation: %w", err)
+			}
+			switch strings.ToLower(strings.TrimSpace(response)) {
+			case "y", "yes":
+				approved = append(approved, a)
+			case "s", "skip", "n", "no":
+				skipped = append(skipped, a)
+			case "a", "abort", "q", "quit":
+				return nil, nil, errApplyCancelled
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return approved, skipped, nil
 }
@@ -0,0 +1,306 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/security"
+	"coderaft/internal/ui"
+)
+
+// applyBackupFile is the file apply --backup-dir writes into the directory
+const applyBackupFile = "apply-backup.json"
+
+const applyBackupVersion = 1
+
+// applyBackupPaths are the config files apply rewrites: apt sources, release
+// pin and preferences, pip.conf, and the global npm, yarn and pnpm configs.
+// A backup holds whichever of them exist; restoring it also removes the ones
+// that didn't.
+var applyBackupPaths = []string{
+	"/etc/apt/sources.list",
+	"/etc/apt/sources.list.d/*.list",
+	"/etc/apt/apt.conf.d/99defaultrelease",
+	"/etc/apt/preferences",
+	"/etc/apt/preferences.d/*",
+	"/etc/pip.conf",
+	"/usr/local/etc/npmrc",
+	"/usr/etc/npmrc",
+	"/root/.yarnrc.yml",
+	"/root/.config/pnpm/rc",
+}
+
+// applyBackup is what apply --backup-dir records before it changes the
+// island: every package list and the config files in applyBackupPaths. Unlike
+// the snapshot image it is a few kilobytes and can be restored into an island
+// that has been recreated since, but it doesn't cover anything else.
+type applyBackup struct {
+	Version   int               `json:"version"`
+	Project   string            `json:"project"`
+	Island    string            `json:"island"`
+	CreatedAt time.Time         `json:"created_at"`
+	Packages  lockPackages      `json:"packages"`
+	Files     map[string]string `json:"files,omitempty"`
+
+	dir string
+}
+
+// takeApplyBackup writes the island's packages and config files to dir. It
+// refuses to overwrite an earlier backup, which may be the only way back.
+func takeApplyBackup(project *config.Project, dir string) (*applyBackup, error) {
+	file := filepath.Join(dir, applyBackupFile)
+	if _, err := os.Stat(file); err == nil {
+		return nil, fmt.Errorf("%s already holds a backup; remove it or pick another --backup-dir", security.SanitizePathForError(dir))
+	}
+
+	ui.Status("backing up packages and config files to %s...", dir)
+	files, err := dockerClient.GetIslandFiles(project.IslandName, applyBackupPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up config files: %w", err)
+	}
+	b := &applyBackup{
+		Version:   applyBackupVersion,
+		Project:   project.Name,
+		Island:    project.IslandName,
+		CreatedAt: time.Now().UTC(),
+		Files:     files,
+		dir:       dir,
+	}
+	b.Packages.Apt, b.Packages.Pip, b.Packages.Npm, b.Packages.Yarn, b.Packages.Pnpm = dockerClient.QueryPackagesParallel(project.IslandName)
+	_, b.Packages.Apk = dockerClient.QuerySystemPackages(project.IslandName)
+	b.Packages.Go, _, b.Packages.Cargo = queryToolBinaries(project.IslandName)
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode backup: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	return b, nil
+}
+
+// readApplyBackup loads the backup apply --backup-dir wrote into dir
+func readApplyBackup(dir string) (*applyBackup, error) {
+	file := filepath.Join(dir, applyBackupFile)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", security.SanitizePathForError(file), err)
+	}
+	var b applyBackup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid backup %s: %w", security.SanitizePathForError(file), err)
+	}
+	if b.Version != applyBackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d in %s", b.Version, security.SanitizePathForError(file))
+	}
+	b.dir = dir
+	return &b, nil
+}
+
+// discard keeps the backup, since unlike a snapshot it costs nothing to keep
+// and is how this apply is undone later
+func (b *applyBackup) discard() {
+	ui.Info("pre-apply backup kept in %s; undo this apply with 'coderaft apply %s --rollback %s'", b.dir, b.Project, b.dir)
+}
+
+// fail handles a failed apply step. With autoRollback the backup is restored
+// into the island; otherwise, or if that doesn't work, it is named for a
+// manual rollback.
+func (b *applyBackup) fail(step string, err error, autoRollback bool) error {
+	hint := fmt.Sprintf("'coderaft apply %s --rollback %s'", b.Project, b.dir)
+	if !autoRollback {
+		ui.Warning("%s failed, roll back with %s", step, hint)
+		return err
+	}
+
+	ui.Warning("%s failed, restoring the island from the backup in %s...", step, b.dir)
+	if rbErr := b.restore(); rbErr != nil {
+		ui.Warning("rollback failed, retry it with %s", hint)
+		return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+	}
+	ui.Info("island '%s' has its packages and config files from before apply again", b.Island)
+	return fmt.Errorf("%w; the island was rolled back", err)
+}
+
+// restore puts the backed-up config files back and reconciles the packages
+// to the backed-up lists
+func (b *applyBackup) restore() error {
+	fileCmds, actions, err := b.plan()
+	if err != nil {
+		return err
+	}
+	if err := dockerClient.ExecuteSetupCommandsWithOutput(b.Island, fileCmds, false); err != nil {
+		return fmt.Errorf("failed to restore config files: %w", err)
+	}
+	if len(actions) > 0 {
+		if err := reconcileWithProgress(b.Island, actions, applyParallelWorkers); err != nil {
+			return fmt.Errorf("failed to restore packages: %w", err)
+		}
+	}
+	return nil
+}
+
+// plan returns the commands that restore the config files and the reconcile
+// actions that bring the packages back. Downgrades are allowed, since undoing
+// an upgrade is the point, but protected packages are still held back.
+func (b *applyBackup) plan() (fileCmds, actions []string, err error) {
+	var present []string
+	for p := range dockerClient.GetFileChecksums(b.Island, applyBackupPaths) {
+		present = append(present, p)
+	}
+	if fileCmds, err = applyBackupRestoreCommands(b.Files, present); err != nil {
+		return nil, nil, err
+	}
+
+	var settings *config.GlobalSettings
+	if cfg, err := configManager.Load(); err == nil {
+		settings = cfg.Settings
+	}
+	exclude := newPackageExclusions(settings)
+	want := exclude.filterPackages(b.Packages)
+
+	var cur lockPackages
+	cur.Apt, cur.Pip, cur.Npm, cur.Yarn, cur.Pnpm = dockerClient.QueryPackagesParallel(b.Island)
+	sys, apk := dockerClient.QuerySystemPackages(b.Island)
+	cur.Apk = apk
+	var goFiles map[string]string
+	cur.Go, goFiles, cur.Cargo = queryToolBinaries(b.Island)
+	cur = exclude.filterPackages(cur)
+
+	actions, downgrades := buildReconcileActions(want, cur.Apt, cur.Pip, cur.Npm, cur.Yarn, cur.Pnpm, newDowngradeGuard(settings, true))
+	if sys.Manager == "apk" {
+		actions = append(buildSystemReconcileActions(sys, want.Apk, cur.Apk), actions...)
+	}
+	actions = append(actions, buildToolReconcileActions(want, cur.Go, cur.Cargo, goFiles)...)
+	if protected, _, _ := splitDowngrades(downgrades); len(protected) > 0 {
+		ui.Warning("not downgrading %d protected package(s) back to their backed-up version:", len(protected))
+		for _, d := range protected {
+			ui.Item(d.String())
+		}
+	}
+	return fileCmds, actions, nil
+}
+
+// applyBackupRestoreCommands writes each backed-up file back and removes the
+// present ones the backup didn't have. Only paths apply manages are touched,
+// since the backup is a file anyone could have edited.
+func applyBackupRestoreCommands(files map[string]string, present []string) ([]string, error) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		if !isApplyBackupPath(p) {
+			return nil, fmt.Errorf("backup contains %s, which apply doesn't manage", p)
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var cmds []string
+	for _, p := range paths {
+		cmds = append(cmds, fmt.Sprintf("mkdir -p %s && printf '%%s' %s | base64 -d > %s",
+			shellQuote(path.Dir(p)), shellQuote(base64.StdEncoding.EncodeToString([]byte(files[p]))), shellQuote(p)))
+	}
+	var extra []string
+	for _, p := range present {
+		if _, ok := files[p]; !ok && isApplyBackupPath(p) {
+			extra = append(extra, shellQuote(p))
+		}
+	}
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		cmds = append(cmds, "rm -f "+strings.Join(extra, " "))
+	}
+	return cmds, nil
+}
+
+func isApplyBackupPath(p string) bool {
+	if path.Clean(p) != p {
+		return false
+	}
+	for _, pattern := range applyBackupPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runApplyRollback restores a project's island from an apply --backup-dir
+// backup
+func runApplyRollback(projectName, dir string) error {
+	cfg, err := configManager.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	proj, ok := cfg.GetProject(projectName)
+	if !ok {
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+	}
+	b, err := readApplyBackup(dir)
+	if err != nil {
+		return err
+	}
+	if b.Project != projectName {
+		return fmt.Errorf("%s is a backup of project '%s', not '%s'", dir, b.Project, projectName)
+	}
+	// The island may have been recreated, or renamed, since the backup
+	b.Island = proj.IslandName
+
+	exists, err := dockerClient.IslandExists(b.Island)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", b.Island, projectName)
+	}
+
+	ui.Detail("backup", fmt.Sprintf("%s (taken %s)", dir, b.CreatedAt.Local().Format(time.RFC1123)))
+	if applyDryRun {
+		fileCmds, actions, err := b.plan()
+		if err != nil {
+			return err
+		}
+		ui.Status("dry run — the following changes would be rolled back:")
+		if len(fileCmds) > 0 {
+			ui.Detail("config file commands", fmt.Sprintf("%d", len(fileCmds)))
+			for _, p := range sortedKeys(b.Files) {
+				ui.Item("restore " + p)
+			}
+			if last := fileCmds[len(fileCmds)-1]; strings.HasPrefix(last, "rm -f ") {
+				ui.Item(last)
+			}
+		}
+		if len(actions) > 0 {
+			ui.Detail("package reconciliation commands", fmt.Sprintf("%d", len(actions)))
+			for _, a := range actions {
+				ui.Item(a)
+			}
+		}
+		return nil
+	}
+
+	lock, err := lockIslandForApply(b.Island, "coderaft apply "+projectName+" --rollback", applyLockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	invalidateVerifyCache(b.Island)
+
+	if err := b.restore(); err != nil {
+		return err
+	}
+	ui.Success("rolled island '%s' back to the backup in %s", b.Island, dir)
+	return nil
+}
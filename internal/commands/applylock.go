@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+const (
+	// applyLockHeartbeat is how often a running apply touches its lock file
+	applyLockHeartbeat = 15 * time.Second
+	// applyLockStaleAfter is how long a lock file can go untouched before it
+	// is taken to belong to an apply that crashed or was killed
+	applyLockStaleAfter = 2 * time.Minute
+	// applyLockPoll is how often a waiting apply checks the lock again
+	applyLockPoll = 250 * time.Millisecond
+)
+
+// errApplyInProgress is returned when another apply holds the island's lock
+var errApplyInProgress = errors.New("apply already in progress")
+
+// applyLockInfo is what a lock file records about the apply holding it
+type applyLockInfo struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+	// Token makes every lock file's contents unique, so a lock can be told
+	// apart from one taken after it by the same process
+	Token string `json:"token,omitempty"`
+}
+
+// applyLock is a held per-island apply lock. Release it when the apply ends.
+type applyLock struct {
+	path string
+	// info is what this lock wrote, so Release only removes its own file
+	info []byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+// applyLockPath returns the lock file for applies to an island:
+// locks/<island>.apply.lock in coderaft's state directory, ~/.coderaft by
+// default
+func applyLockPath(islandName string) (string, error) {
+	return config.StatePath("locks", islandName+".apply.lock")
+}
+
+// acquireApplyLock takes the apply lock at path. If another apply holds it,
+// it waits up to wait for it to be released, then fails with
+// errApplyInProgress; a wait of 0 fails right away. A lock whose holder
+// stopped touching it for applyLockStaleAfter is taken over.
+func acquireApplyLock(path, command string, wait time.Duration) (*applyLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	host, _ := os.Hostname()
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to create apply lock: %w", err)
+	}
+	info, err := json.Marshal(applyLockInfo{PID: os.Getpid(), Host: host, Command: command, StartedAt: time.Now().UTC(), Token: hex.EncodeToString(token)})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, writeErr := f.Write(info)
+			if closeErr := f.Close(); writeErr == nil {
+				writeErr = closeErr
+			}
+			if writeErr != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write apply lock: %w", writeErr)
+			}
+			lock := &applyLock{path: path, info: info, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create apply lock: %w", err)
+		}
+
+		if removeStaleApplyLock(path) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, applyInProgressError(path)
+		}
+		time.Sleep(applyLockPoll)
+	}
+}
+
+// removeStaleApplyLock removes the lock file at path if its holder stopped
+// touching it, reporting whether it did
+func removeStaleApplyLock(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// released in the meantime
+		return errors.Is(err, os.ErrNotExist)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	if time.Since(st.ModTime()) < applyLockStaleAfter {
+		return false
+	}
+	return removeLockFile(path, data)
+}
+
+// removeLockFile removes the lock file at path if it still holds want, the
+// contents of one particular lock. Every removal, a takeover or a release,
+// goes through here. It first claims a marker file named after want, so each
+// lock is removed at most once, and a waiter that saw a stale lock can't
+// remove the fresh one taken after it: the check and the removal can only
+// race with another removal of the same lock, which the marker rules out.
+func removeLockFile(path string, want []byte) bool {
+	sum := sha256.Sum256(want)
+	marker := fmt.Sprintf("%s.%x.release", path, sum[:8])
+	f, err := os.OpenFile(marker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		// Someone else is removing this lock. A marker left by a crash in
+		// the middle is cleared once it's stale, so the lock can be taken
+		// over on a later try.
+		if st, statErr := os.Stat(marker); statErr == nil && time.Since(st.ModTime()) >= applyLockStaleAfter {
+			os.Remove(marker)
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(marker)
+
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, want) {
+		return false
+	}
+	return os.Remove(path) == nil
+}
+
+// applyInProgressError describes the apply holding the lock at path
+func applyInProgressError(path string) error {
+	return lockHeldError(errApplyInProgress, path)
+}
+
+// lockHeldError wraps sentinel with what the lock file at path says about
+// the command holding it
+func lockHeldError(sentinel error, path string) error {
+	var info applyLockInfo
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &info) != nil || info.PID == 0 {
+		return fmt.Errorf("%w (lock file %s)", sentinel, path)
+	}
+	return fmt.Errorf("%w: '%s' (pid %d on %s) started %s ago; wait for it to finish or pass --lock-wait",
+		sentinel, info.Command, info.PID, info.Host, time.Since(info.StartedAt).Round(time.Second))
+}
+
+// heartbeat keeps the lock file fresh so it isn't taken for stale while the
+// apply is still running
+func (l *applyLock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(applyLockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			_ = os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// Release removes the lock file, unless it was taken over as stale and now
+// belongs to someone else
+func (l *applyLock) Release() {
+	close(l.stop)
+	<-l.done
+	removeLockFile(l.path, l.info)
+}
+
+// lockIslandForApply takes the apply lock for islandName, telling the user
+// when it has to wait for another apply
+func lockIslandForApply(islandName, command string, wait time.Duration) (*applyLock, error) {
+	path, err := applyLockPath(islandName)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := acquireApplyLock(path, command, 0)
+	if errors.Is(err, errApplyInProgress) && wait > 0 {
+		ui.Status("another apply to '%s' is running, waiting up to %s...", islandName, wait)
+		lock, err = acquireApplyLock(path, command, wait)
+	}
+	return lock, err
+}
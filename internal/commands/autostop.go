@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"time"
+
+	"coderaft/internal/ui"
+)
+
+// autoStopGrace is how long an island that was just (re)started is left
+// running before auto-stop may judge it idle, so 'up' doesn't stop an island
+// it has only just brought up
+const autoStopGrace = 2 * time.Minute
+
+// withinAutoStopGrace reports whether an island that has been running for
+// uptime is still too fresh to auto-stop. An uptime of 0 means the island
+// isn't running, which leaves nothing to stop.
+func withinAutoStopGrace(uptime, grace time.Duration) bool {
+	return uptime <= 0 || uptime < grace
+}
+
+// autoStopIdleIsland stops an island auto-stop judges idle: past the grace
+// period, with no published ports and no process besides its init. It says
+// why it stopped the island and how to keep it running next time.
+func autoStopIdleIsland(islandName string) {
+	uptime, err := dockerClient.GetUptime(islandName)
+	if err != nil {
+		return
+	}
+	if withinAutoStopGrace(uptime, autoStopGrace) {
+		ui.Status("leaving island '%s' running (auto-stop: started %s ago, within the %s grace period)", islandName, uptime.Round(time.Second), autoStopGrace)
+		return
+	}
+	idle, err := dockerClient.IsContainerIdle(islandName)
+	if err != nil || !idle {
+		return
+	}
+	ui.Info("stopping island '%s': it looks idle (no published ports and no processes besides init)", islandName)
+	if err := dockerClient.StopIsland(islandName); err != nil {
+		ui.Warning("failed to stop island: %v", err)
+		return
+	}
+	ui.Info("hint: keep it running with --keep-running or --no-auto-stop, or set settings.auto_stop_on_exit to false in ~/.coderaft/config.json")
+}
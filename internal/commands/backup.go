@@ -11,6 +11,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"coderaft/internal/config"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
@@ -42,7 +43,7 @@ var backupCmd = &cobra.Command{
 		}
 		proj, ok := cfg.GetProject(projectName)
 		if !ok {
-			return fmt.Errorf("project '%s' not found", projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 		}
 
 		exists, err := dockerClient.IslandExists(proj.IslandName)
@@ -50,7 +51,7 @@ var backupCmd = &cobra.Command{
 			return err
 		}
 		if !exists {
-			return fmt.Errorf("island '%s' does not exist", proj.IslandName)
+			return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' does not exist", proj.IslandName)
 		}
 
 		ts := time.Now().UTC().Format("20060102-150405")
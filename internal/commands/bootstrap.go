@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"coderaft/internal/config"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/ui"
+)
+
+// bootstrapDir is the directory a repository can ship to describe its island
+// in more detail than coderaft.json. Every file in it is optional.
+const bootstrapDir = ".coderaft"
+
+var aptRepoNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// aptRepo is one entry in .coderaft/apt-repos.json
+type aptRepo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	KeyURL string `json:"key_url,omitempty"`
+}
+
+// repoBootstrap is what clone found in a repository's .coderaft directory
+type repoBootstrap struct {
+	// Profile is the raw profile.json, merged under coderaft.json
+	Profile []byte
+	// AptRepoCommand adds the apt-repos.json sources, or is empty
+	AptRepoCommand string
+	// SetupScript is setup.sh relative to the workspace, or empty
+	SetupScript string
+}
+
+// loadRepoBootstrap reads the .coderaft directory in workspacePath. It
+// returns nil when the repository doesn't have one.
+func loadRepoBootstrap(workspacePath string) (*repoBootstrap, error) {
+	dir := filepath.Join(workspacePath, bootstrapDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	b := &repoBootstrap{}
+
+	if data, err := readBootstrapFile(dir, "profile.json"); err != nil {
+		return nil, err
+	} else if data != nil {
+		if err := validateBootstrapProfile(data); err != nil {
+			return nil, fmt.Errorf("invalid %s/profile.json: %w", bootstrapDir, err)
+		}
+		b.Profile = data
+	}
+
+	if data, err := readBootstrapFile(dir, "apt-repos.json"); err != nil {
+		return nil, err
+	} else if data != nil {
+		var repos []aptRepo
+		if err := json.Unmarshal(data, &repos); err != nil {
+			return nil, fmt.Errorf("invalid %s/apt-repos.json: %w", bootstrapDir, err)
+		}
+		cmd, err := aptRepoCommand(repos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s/apt-repos.json: %w", bootstrapDir, err)
+		}
+		b.AptRepoCommand = cmd
+	}
+
+	if data, err := readBootstrapFile(dir, "setup.sh"); err != nil {
+		return nil, err
+	} else if data != nil {
+		b.SetupScript = path.Join(bootstrapDir, "setup.sh")
+	}
+
+	if b.Profile == nil && b.AptRepoCommand == "" && b.SetupScript == "" {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// readBootstrapFile returns the contents of name in dir, or nil if it doesn't
+// exist. Symlinks are refused so a repository can't point clone at files
+// outside its checkout.
+func readBootstrapFile(dir, name string) ([]byte, error) {
+	p := filepath.Join(dir, name)
+	info, err := os.Lstat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s: %w", bootstrapDir, name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s/%s must be a regular file", bootstrapDir, name)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s: %w", bootstrapDir, name, err)
+	}
+	return data, nil
+}
+
+// validateBootstrapProfile checks that profile.json is a JSON object holding
+// only container settings. The project name and setup commands belong to
+// coderaft.json and setup.sh.
+func validateBootstrapProfile(data []byte) error {
+	var profile map[string]interface{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return err
+	}
+	for _, key := range []string{"name", "setup_commands"} {
+		if _, ok := profile[key]; ok {
+			return fmt.Errorf("'%s' is not allowed here, set it in coderaft.json", key)
+		}
+	}
+	return nil
+}
+
+// applyBootstrapProfile merges profile.json under projectConfig: coderaft.json
+// wins key by key, and objects such as environment and labels are merged.
+func applyBootstrapProfile(projectConfig *config.ProjectConfig, profile []byte) (*config.ProjectConfig, error) {
+	overlay, err := json.Marshal(projectConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal project config: %w", err)
+	}
+	merged, err := config.MergeProjectConfigJSON(profile, overlay)
+	if err != nil {
+		return nil, err
+	}
+	var out config.ProjectConfig
+	if err := json.Unmarshal(merged, &out); err != nil {
+		return nil, fmt.Errorf("invalid %s/profile.json: %w", bootstrapDir, err)
+	}
+	return &out, nil
+}
+
+// aptRepoCommand builds one shell command that installs each repository's
+// signing key and source list, then refreshes the package index. It is a
+// single command so the setup executor can't reorder the steps.
+func aptRepoCommand(repos []aptRepo) (string, error) {
+	if len(repos) == 0 {
+		return "", nil
+	}
+
+	steps := []string{"mkdir -p /etc/apt/keyrings"}
+	seen := map[string]bool{}
+	for _, r := range repos {
+		if !aptRepoNamePattern.MatchString(r.Name) {
+			return "", fmt.Errorf("invalid repository name '%s' (use lowercase letters, digits, '.', '_' and '-')", r.Name)
+		}
+		if seen[r.Name] {
+			return "", fmt.Errorf("duplicate repository name '%s'", r.Name)
+		}
+		seen[r.Name] = true
+
+		source := strings.TrimSpace(r.Source)
+		if !strings.HasPrefix(source, "deb ") && !strings.HasPrefix(source, "deb-src ") {
+			return "", fmt.Errorf("repository '%s': source must start with 'deb ' or 'deb-src '", r.Name)
+		}
+		if strings.ContainsAny(source, "\n\r") {
+			return "", fmt.Errorf("repository '%s': source must be a single line", r.Name)
+		}
+
+		if r.KeyURL != "" {
+			if !strings.HasPrefix(r.KeyURL, "https://") {
+				return "", fmt.Errorf("repository '%s': key_url must use https", r.Name)
+			}
+			keyring := "/etc/apt/keyrings/" + r.Name + ".gpg"
+			steps = append(steps, fmt.Sprintf("curl -fsSL %s | gpg --dearmor --yes -o %s", shellQuote(r.KeyURL), keyring))
+			if !strings.Contains(source, "signed-by=") {
+				kind, rest, _ := strings.Cut(source, " ")
+				source = fmt.Sprintf("%s [signed-by=%s] %s", kind, keyring, rest)
+			}
+		}
+		steps = append(steps, fmt.Sprintf("echo %s > /etc/apt/sources.list.d/coderaft-%s.list", shellQuote(source), r.Name))
+	}
+	steps = append(steps, "apt-get update -y")
+	return strings.Join(steps, " && "), nil
+}
+
+// bootstrapSetupCommand runs setup.sh from the island's workspace directory
+func bootstrapSetupCommand(workspaceIsland, script string) string {
+	return fmt.Sprintf("cd %s && bash %s", shellQuote(workspaceIsland), shellQuote(script))
+}
+
+// runRepoBootstrap runs the in-island parts of .coderaft in order: apt
+// repositories, any setup_commands held back until they were added, then
+// setup.sh. All of it goes through the same setup executor as setup_commands.
+func runRepoBootstrap(client DockerEngine, islandName, workspaceIsland string, b *repoBootstrap, deferredSetup []string) error {
+	if b.AptRepoCommand != "" {
+		ui.Status("adding apt repositories from %s/apt-repos.json...", bootstrapDir)
+		if err := client.ExecuteSetupCommandsWithOutput(islandName, []string{b.AptRepoCommand}, false); err != nil {
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to add apt repositories: %w", err)
+		}
+	}
+
+	if len(deferredSetup) > 0 {
+		ui.Status("installing packages (%d commands)...", len(deferredSetup))
+		if err := client.ExecuteSetupCommandsWithOutput(islandName, deferredSetup, false); err != nil {
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to execute setup commands: %w", err)
+		}
+	}
+
+	if b.SetupScript != "" {
+		ui.Status("running %s...", b.SetupScript)
+		cmd := bootstrapSetupCommand(workspaceIsland, b.SetupScript)
+		if err := client.ExecuteSetupCommandsWithOutput(islandName, []string{cmd}, false); err != nil {
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "%s failed: %w", b.SetupScript, err)
+		}
+	}
+	return nil
+}
@@ -1,36 +1,99 @@
 package commands
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
 var (
-	cloneForce        bool
-	cloneTemplate     string
-	cloneNoSetup      bool
-	cloneBranch       string
-	cloneDepth        int
-	cloneName         string
-	cloneSparse       bool
-	cloneNoSubmodules bool
-	cloneSingleBranch bool
+	cloneForce         bool
+	cloneTemplate      string
+	cloneEnvStack      string
+	cloneNoSetup       bool
+	cloneNoBootstrap   bool
+	clonePostTest      bool
+	cloneFailOnTest    bool
+	cloneBranch        string
+	cloneDepth         int
+	cloneFilter        string
+	cloneLFS           string
+	cloneGHAuth        bool
+	cloneResolveHead   bool
+	cloneExpectBranch  string
+	cloneOnMismatch    string
+	cloneName          string
+	cloneNameTemplate  string
+	cloneSparse        bool
+	cloneSparseHints   bool
+	cloneSubdir        string
+	cloneHooksDir      string
+	cloneNoSubmodules  bool
+	cloneSingleBranch  bool
+	cloneProgress      string
+	cloneArchive       bool
+	cloneDotfiles      string
+	cloneDotfilesPull  bool
+	cloneRecipe        string
+	cloneNewBranch     string
+	cloneTrackBranch   bool
+	cloneStageTimeout  string
+	cloneSubmodules    []string
+	cloneSkipSubs      []string
+	cloneMirrorSubs    bool
+	cloneConfigOnly    bool
+	cloneQuietGit      bool
+	clonePath          string
+	cloneWorkers       int
+	cloneSequential    bool
+	cloneWarnLarge     bool
+	cloneLargeSize     string
+	cloneSSHAgent      bool
+	cloneRetryAuth     bool
+	cloneKeepOnFailure bool
+	cloneAllowDirenv   bool
+	cloneFromPR        string
+	cloneReadOnly      bool
+	cloneShellInto     bool
+	cloneParallel      int
+)
+
+var (
+	clonePostSetupCommand  string
+	clonePostSetupRequired bool
+	cloneNoSecrets         bool
+	cloneLockWait          time.Duration
+	cloneStripLockfiles    bool
 )
 
 var cloneCmd = &cobra.Command{
-	Use:   "clone <repo>",
+	Use:   "clone [repo...]",
 	Short: "Clone a repository and create a ready-to-code island",
 	Long: `Clone a Git repository and automatically set up a coderaft island.
 
@@ -43,17 +106,46 @@ This command:
 Supported URL formats:
   - Full HTTPS URL: https://github.com/user/repo
   - Full SSH URL: git@github.com:user/repo.git
+  - SSH URL with a port: ssh://git@git.example.com:2222/group/repo.git
   - Shorthand: user/repo (assumes GitHub)
   - With host: github.com/user/repo
   - GitLab/Bitbucket: https://gitlab.com/user/repo
   - Browser URLs: https://github.com/user/repo/tree/main (branch auto-detected)
   - PR/Issue URLs: https://github.com/user/repo/pull/123
+  - Source archives: https://example.com/app-1.2.3.tar.gz (.tar.gz, .tgz, .tar, .zip)
+
+To review a GitHub pull request, pass --from-pr instead of a repository. The
+PR's head is checked out as branch pr-<number> and its base branch is
+fetched for diffing, in a project named <repo>-pr-<number> unless --name or
+--name-template says otherwise. Add --read-only to keep the island from
+changing the checkout.
+
+Several repositories can be given at once. Each is cloned and set up into
+its own island with the same flags, one at a time or --parallel N at once,
+and a summary lists which failed; a failure doesn't stop the rest.
+
+When the repository's coderaft.json sets inject_secrets and the vault holds
+secrets for the project, clone asks for the vault password and passes them
+to the island as environment variables, keeping them out of the lock file.
+--no-secrets skips them.
+
+--strip-lockfiles removes the repository's dependency lockfiles, such as
+package-lock.json, yarn.lock or poetry.lock, before setup, so the package
+manager resolves the newest versions the manifests allow (npm install
+instead of npm ci) and writes new lockfiles. The removal shows up in git
+status, and the lock file notes which lockfiles were stripped.
+
+Only one clone of a project runs at a time. A second clone to the same
+project name fails with "clone already in progress", or with --lock-wait
+waits that long for the first to finish and then checks again whether the
+project exists.
 
 Features:
   - Automatic submodule initialization
   - Branch detection from browser URLs
   - Sparse checkout support for large repositories
   - Retry logic for network issues
+  - Repository bootstrap files in .coderaft/ (profile.json, apt-repos.json, setup.sh)
 
 Examples:
   coderaft clone user/repo                          # GitHub shorthand
@@ -62,29 +154,201 @@ Examples:
   coderaft clone github.com/user/repo
   coderaft clone https://github.com/user/repo/tree/develop    # Auto-detects branch
   coderaft clone https://github.com/user/repo --template nodejs
+  coderaft clone user/fullstack-app --env-stack python,nodejs  # Set up both stacks
+  coderaft clone https://example.com/releases/app-1.2.3.tar.gz   # Release tarball, no git
   coderaft clone https://github.com/user/repo --branch develop
   coderaft clone https://github.com/user/repo --depth 1       # Shallow clone
   coderaft clone user/repo --name my-project
+  coderaft clone user/repo --name-template "{{.Owner}}-{{.Repo}}"
   coderaft clone user/repo --sparse                 # Sparse checkout (large repos)
+  coderaft clone user/monorepo --sparse --workspace-subdir packages/api  # Island one package
+  coderaft clone user/monorepo --sparse-from-gitattributes  # Check out what the repo recommends
   coderaft clone user/repo --single-branch          # Clone only one branch
-  coderaft clone user/repo --no-submodules          # Skip submodule init`,
-	Args: cobra.ExactArgs(1),
+  coderaft clone user/repo --no-submodules          # Skip submodule init
+  coderaft clone user/repo --archive --branch v1.2  # Tree only, no .git (CI)
+  coderaft clone user/private-repo --github-token-from-gh  # Use gh's login
+  coderaft clone user/private-repo --retry-auth=false  # Fail instead of prompting for credentials
+  coderaft clone user/repo --dotfiles gh:me/dotfiles # Mount a dotfiles repo
+  coderaft clone user/repo --hooks-dir ~/team/git-hooks  # Use the team's git hooks
+  coderaft clone user/private-deps --mount-ssh-agent  # git/ssh use the host's keys
+  coderaft clone user/repo --setup-workers 6        # More concurrent installs
+  coderaft clone user/repo --keep-on-setup-failure  # Debug a failing setup in the island
+  coderaft clone user/direnv-repo --allow-direnv     # Load the reviewed .envrc in the island
+  coderaft clone --from-pr facebook/react#12345 --read-only  # Review island for a PR
+  coderaft clone org/api org/web org/worker --parallel 3  # Several services at once
+  coderaft clone user/repo --shell-into             # Land in the island's shell when it's ready
+  coderaft clone user/repo --strip-lockfiles        # Test against the latest compatible deps
+  coderaft clone user/repo --post-setup-command "make seed"  # One-off step, not saved to coderaft.json
+  coderaft clone user/repo --config-only --path ~/src/repo  # Register an existing checkout`,
+	Args: cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		repoInput := args[0]
+		if cloneParallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+		if len(args) > 1 {
+			return cloneMany(cmd, args, cloneParallel)
+		}
 		startTime := time.Now()
 
+		var repoInput string
+		var pr *pullRequestRef
+		if cloneFromPR != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("--from-pr names the repository; don't pass one as well")
+			}
+			for _, name := range []string{"branch", "archive", "config-only", "resolve-default-branch"} {
+				if cmd.Flags().Changed(name) {
+					return fmt.Errorf("--%s cannot be used with --from-pr", name)
+				}
+			}
+			var err error
+			if pr, err = parsePullRequestRef(cloneFromPR); err != nil {
+				return err
+			}
+			repoInput = pr.RepoURL()
+		} else if len(args) == 0 {
+			return fmt.Errorf("requires a repository, e.g. 'coderaft clone user/repo', or --from-pr owner/repo#123")
+		} else {
+			repoInput = args[0]
+		}
+
+		if err := ui.SetProgressMode(cloneProgress); err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("quiet-git") {
+			// progress bars only make sense on a terminal
+			cloneQuietGit = !term.IsTerminal(int(os.Stderr.Fd()))
+		}
+		if !cmd.Flags().Changed("retry-auth") {
+			cloneRetryAuth = term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+		}
+
+		if err := overrideSetupConcurrency(cloneWorkers, cloneSequential); err != nil {
+			return err
+		}
+
+		// A release tarball or zip is downloaded and extracted instead of cloned
+		sourceFormat := sourceArchiveFormat(repoInput)
+		if sourceFormat != "" {
+			for _, name := range gitOnlyCloneFlags {
+				if cmd.Flags().Changed(name) {
+					return fmt.Errorf("--%s cannot be used when cloning from a source archive", name)
+				}
+			}
+		}
+
+		if cloneSparseHints {
+			cloneSparse = true
+		}
+
+		if cloneConfigOnly {
+			if cloneArchive || cloneNewBranch != "" {
+				return fmt.Errorf("--config-only cannot be combined with --archive or --new-branch")
+			}
+		} else if clonePath != "" {
+			return fmt.Errorf("--path requires --config-only")
+		}
+
+		if cloneAllowDirenv && (cloneNoSetup || cloneConfigOnly) {
+			return fmt.Errorf("--allow-direnv needs an island; it cannot be used with --no-setup or --config-only")
+		}
+
+		if cloneShellInto {
+			if cloneNoSetup || cloneConfigOnly {
+				return fmt.Errorf("--shell-into needs an island; it cannot be used with --no-setup or --config-only")
+			}
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return fmt.Errorf("--shell-into needs a terminal to attach the shell to")
+			}
+		}
+
+		if clonePostTest && (cloneNoSetup || cloneConfigOnly) {
+			return fmt.Errorf("--post-setup-test needs an island; it cannot be used with --no-setup or --config-only")
+		} else if cloneFailOnTest && !clonePostTest {
+			return fmt.Errorf("--fail-on-test requires --post-setup-test")
+		}
+
+		if clonePostSetupCommand != "" && (cloneNoSetup || cloneConfigOnly) {
+			return fmt.Errorf("--post-setup-command needs an island; it cannot be used with --no-setup or --config-only")
+		} else if clonePostSetupRequired && clonePostSetupCommand == "" {
+			return fmt.Errorf("--post-setup-required requires --post-setup-command")
+		}
+
+		if !isBranchMismatchPolicy(cloneOnMismatch) {
+			return fmt.Errorf("invalid --on-branch-mismatch '%s' (expected warn, fail or ignore)", cloneOnMismatch)
+		}
+		if cloneResolveHead && cloneConfigOnly {
+			return fmt.Errorf("--resolve-default-branch cannot be used with --config-only")
+		}
+
 		// Check if git is available
-		if _, err := exec.LookPath("git"); err != nil {
+		if _, err := exec.LookPath("git"); err != nil && !cloneConfigOnly && sourceFormat == "" {
 			return fmt.Errorf("git is not installed or not in PATH. Please install git first")
 		}
 
-		// Extract branch from URL before normalization (if user pasted browser URL like /tree/main)
-		urlBranch := extractBranchFromURL(repoInput)
+		if cloneNewBranch != "" {
+			if cloneArchive {
+				return fmt.Errorf("--new-branch cannot be used with --archive (archives have no git history)")
+			}
+			if err := validateNewBranchName(cloneNewBranch); err != nil {
+				return err
+			}
+		} else if cloneTrackBranch {
+			return fmt.Errorf("--track requires --new-branch")
+		}
+
+		if !isLFSMode(cloneLFS) {
+			return fmt.Errorf("invalid --lfs '%s' (expected auto, skip or fetch)", cloneLFS)
+		}
+		if cloneLFS != "auto" {
+			if cloneArchive || cloneConfigOnly {
+				return fmt.Errorf("--lfs cannot be used with --archive or --config-only")
+			}
+			if cloneLFS == "fetch" && !gitLFSAvailable() {
+				return fmt.Errorf("--lfs=fetch needs git-lfs; install it from https://git-lfs.com or use --lfs=skip")
+			}
+		}
 
-		// Normalize the repository URL (supports shorthand like user/repo)
-		repoURL, err := normalizeRepoURL(repoInput)
+		if cloneFilter != "" {
+			if cloneArchive {
+				return fmt.Errorf("--filter cannot be used with --archive (archives have no git objects to filter)")
+			}
+			if err := validateCloneFilter(cloneFilter); err != nil {
+				return err
+			}
+		}
+
+		submodulePins, err := parseSubmodulePins(cloneSubmodules, cloneSkipSubs)
 		if err != nil {
-			return fmt.Errorf("invalid repository: %w", err)
+			return err
+		}
+		if cloneNoSubmodules && (len(submodulePins) > 0 || len(cloneSkipSubs) > 0 || cloneMirrorSubs) {
+			return fmt.Errorf("--no-submodules cannot be combined with --submodule, --skip-submodule or --mirror-submodules")
+		}
+
+		if cloneSubdir != "" {
+			if cloneSubdir, err = config.CleanWorkspaceSubdir(cloneSubdir); err != nil {
+				return fmt.Errorf("invalid --workspace-subdir: %w", err)
+			}
+		}
+
+		urlBranch := ""
+		repoURL := strings.TrimSpace(repoInput)
+		if sourceFormat == "" {
+			// Extract branch from URL before normalization (if user pasted browser URL like /tree/main)
+			urlBranch = extractBranchFromURL(repoInput)
+
+			// Normalize the repository URL (supports shorthand like user/repo)
+			if repoURL, err = normalizeRepoURL(repoInput); err != nil {
+				return fmt.Errorf("invalid repository: %w", err)
+			}
+			if cloneConfigOnly {
+				if cloneGHAuth {
+					return fmt.Errorf("--github-token-from-gh cannot be used with --config-only")
+				}
+			} else {
+				resolveGHAuth(repoURL, cmd.Flags().Changed("github-token-from-gh"))
+			}
 		}
 
 		// Use branch from URL if not explicitly specified via --branch flag
@@ -94,11 +358,47 @@ Examples:
 			ui.Status("detected branch from URL: %s", effectiveBranch)
 		}
 
-		// Extract project name from repo URL or use --name flag
+		cfg, err := configManager.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		largeFileThreshold, err := resolveLargeFileThreshold(cloneLargeSize, cfg)
+		if err != nil {
+			return err
+		}
+		// Check the agent is there before cloning rather than after
+		var sshAgentSocket string
+		if sshAgentEnabled(cloneSSHAgent, cmd.Flags().Changed("mount-ssh-agent"), cfg) && !cloneConfigOnly {
+			if sshAgentSocket, err = hostSSHAgentSocket(); err != nil {
+				return fmt.Errorf("cannot forward the SSH agent: %w", err)
+			}
+		}
+
+		// Use --name, else render the name template, else the repository name
+		nameTemplate := cloneNameTemplate
+		if nameTemplate == "" && cfg.Settings != nil {
+			nameTemplate = cfg.Settings.NameTemplate
+		}
 		var projectName string
-		if cloneName != "" {
+		switch {
+		case cloneName != "":
 			projectName = cloneName
-		} else {
+		case sourceFormat != "":
+			projectName = sourceArchiveName(repoURL)
+		case pr != nil && cloneNameTemplate == "":
+			// settings.name_template rarely tells one PR from another
+			projectName = pr.ProjectName()
+		case pr != nil:
+			projectName, err = renderProjectName(nameTemplate, repoURL, pr.Branch())
+			if err != nil {
+				return err
+			}
+		case nameTemplate != "":
+			projectName, err = renderProjectName(nameTemplate, repoURL, effectiveBranch)
+			if err != nil {
+				return err
+			}
+		default:
 			projectName, err = extractProjectName(repoURL)
 			if err != nil {
 				return fmt.Errorf("failed to parse repository URL: %w", err)
@@ -109,8 +409,102 @@ Examples:
 			return fmt.Errorf("invalid project name '%s': %w", projectName, err)
 		}
 
-		cfg, err := configManager.Load()
+		stageTimeouts, err := resolveStageTimeouts(cloneStageTimeout, cfg)
 		if err != nil {
+			return err
+		}
+
+		if cloneResolveHead && effectiveBranch == "" {
+			var defaultBranch string
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				var resolveErr error
+				defaultBranch, resolveErr = resolveDefaultBranch(ctx, repoURL)
+				return resolveErr
+			})
+			if err != nil {
+				return err
+			}
+			ui.Detail("default branch", defaultBranch)
+			if msg := defaultBranchMismatch(defaultBranch, cloneExpectBranch); msg != "" {
+				switch cloneOnMismatch {
+				case "fail":
+					return fmt.Errorf("%s; pass --branch to clone it anyway", msg)
+				case "warn":
+					ui.Warning("%s", msg)
+				}
+			}
+		}
+
+		// settings.default_branches picks the branch when the remote doesn't
+		// say which is its default, or names one it doesn't have
+		if effectiveBranch == "" && pr == nil && sourceFormat == "" && !cloneConfigOnly && cfg.Settings != nil && len(cfg.Settings.DefaultBranches) > 0 {
+			var head string
+			var branches []string
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				var listErr error
+				head, branches, listErr = remoteBranches(ctx, repoURL)
+				return listErr
+			})
+			if err != nil {
+				ui.Warning("failed to list the remote's branches, leaving the branch to git: %v", err)
+			} else if branch := pickCloneBranch(head, branches, cfg.Settings.DefaultBranches); branch == "" {
+				ui.Warning("the remote's default branch is unknown and it has none of default_branches (%s); leaving the branch to git", strings.Join(cfg.Settings.DefaultBranches, ", "))
+			} else {
+				effectiveBranch = branch
+				if branch == head {
+					ui.Status("using the remote's default branch '%s'", branch)
+				} else if head == "" {
+					ui.Info("the remote doesn't report a default branch; using '%s' from default_branches", branch)
+				} else {
+					ui.Info("the remote's default branch '%s' doesn't exist; using '%s' from default_branches", head, branch)
+				}
+			}
+		}
+
+		// Check the hooks directory before cloning too. Archives have no .git
+		// to install into, so settings.hooks_dir doesn't apply to them.
+		hooksDir := cloneHooksDir
+		if hooksDir == "" && cfg.Settings != nil && !cloneArchive && sourceFormat == "" {
+			hooksDir = cfg.Settings.HooksDir
+		}
+		if hooksDir != "" {
+			if cloneArchive {
+				return fmt.Errorf("--hooks-dir cannot be used with --archive (archives have no .git)")
+			}
+			if hooksDir, _, err = resolveHooksDir(hooksDir); err != nil {
+				return err
+			}
+		}
+
+		var envStacks []string
+		if cloneEnvStack != "" {
+			if cloneTemplate != "" || cloneRecipe != "" {
+				return fmt.Errorf("--env-stack cannot be used with --template or --recipe")
+			}
+			if envStacks, err = parseEnvStacks(cloneEnvStack, configManager.GetAvailableTemplates()); err != nil {
+				return err
+			}
+		}
+
+		// Resolve the recipe before cloning so a bad reference fails fast
+		var recipe *config.Recipe
+		if cloneRecipe != "" {
+			if cloneTemplate != "" {
+				return fmt.Errorf("--recipe and --template cannot be used together")
+			}
+			recipe, err = loadRecipe(cloneRecipe, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to load recipe: %w", err)
+			}
+		}
+
+		lock, err := lockProjectForClone(projectName, "coderaft clone "+repoURL, cloneLockWait)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		// a clone we waited for may have registered the project meanwhile
+		if cfg, err = configManager.Load(); err != nil {
 			return fmt.Errorf("failed to load configuration: %w", err)
 		}
 
@@ -123,8 +517,21 @@ Examples:
 			return err
 		}
 
-		// Check if directory exists
-		if _, err := os.Stat(workspacePath); err == nil {
+		if cloneConfigOnly {
+			if clonePath != "" {
+				if workspacePath, err = filepath.Abs(clonePath); err != nil {
+					return fmt.Errorf("invalid --path: %w", err)
+				}
+			}
+			info, err := os.Stat(workspacePath)
+			if err != nil {
+				return fmt.Errorf("--config-only needs an existing checkout at '%s': %w", workspacePath, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("'%s' is not a directory", workspacePath)
+			}
+		} else if _, err := os.Stat(workspacePath); err == nil {
+			// The directory already exists
 			if !cloneForce {
 				return fmt.Errorf("directory '%s' already exists. Use --force to overwrite", workspacePath)
 			}
@@ -134,19 +541,122 @@ Examples:
 			}
 		}
 
-		// Step 1: Clone the repository
-		ui.Step(1, 4, "cloning repository")
-		if err := gitClone(repoURL, workspacePath, effectiveBranch); err != nil {
-			return fmt.Errorf("failed to clone repository: %w", err)
+		ui.Event("clone_start", map[string]interface{}{
+			"repo":      repoURL,
+			"project":   projectName,
+			"branch":    effectiveBranch,
+			"workspace": workspacePath,
+		})
+
+		// Step 1: Clone the repository (or fetch just the tree with --archive)
+		archived := false
+		if cloneConfigOnly {
+			ui.Step(1, 4, "using existing checkout")
+			ui.Status("registering '%s' without cloning", workspacePath)
+		} else if sourceFormat != "" {
+			ui.Step(1, 4, "downloading source archive")
+			ui.Status("downloading %s archive: %s", sourceFormat, repoURL)
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				return downloadSourceArchive(ctx, repoURL, workspacePath)
+			})
+			if err != nil {
+				os.RemoveAll(workspacePath)
+				return fmt.Errorf("failed to download source archive: %w", err)
+			}
+			archived = true
+		} else if cloneArchive {
+			ui.Step(1, 4, "fetching repository archive")
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				var fetchErr error
+				archived, fetchErr = fetchArchive(ctx, repoURL, workspacePath, effectiveBranch)
+				return fetchErr
+			})
+			if err != nil {
+				return fmt.Errorf("failed to fetch repository: %w", err)
+			}
+		} else {
+			ui.Step(1, 4, "cloning repository")
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				return cloneWithAuthRetry(ctx, repoURL, func(ctx context.Context) error {
+					return gitClone(ctx, repoURL, workspacePath, effectiveBranch, cloneDepth)
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("failed to clone repository: %w", err)
+			}
+		}
+
+		var prBase string
+		if pr != nil {
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				var checkoutErr error
+				prBase, checkoutErr = checkoutPullRequest(ctx, workspacePath, pr)
+				return checkoutErr
+			})
+			if err != nil {
+				return err
+			}
+			ui.Status("checked out %s as '%s' (base: %s)", pr, pr.Branch(), prBase)
+		}
+
+		if clonePinCommit != "" && !cloneConfigOnly && !archived {
+			err = runCloneStage("clone", stageTimeouts["clone"], func(ctx context.Context) error {
+				return checkoutPinnedCommit(ctx, workspacePath, clonePinCommit)
+			})
+			if err != nil {
+				return err
+			}
+			ui.Status("checked out recorded commit %s", shortCommit(clonePinCommit))
+		}
+
+		lfsMode := ""
+		if !cloneConfigOnly && !cloneArchive && sourceFormat == "" {
+			lfsMode = configureGitLFS(workspacePath, cloneLFS)
+		}
+		if !cloneConfigOnly {
+			warnLargeFiles(workspacePath, largeFileThreshold, cloneWarnLarge)
+		}
+
+		if cloneNewBranch != "" {
+			if err := createFeatureBranch(workspacePath, cloneNewBranch, cloneTrackBranch); err != nil {
+				return err
+			}
+			ui.Status("created branch '%s'", cloneNewBranch)
+		}
+
+		if hooksDir != "" {
+			hooks, err := installSharedHooks(workspacePath, hooksDir)
+			if err != nil {
+				return err
+			}
+			ui.Status("installed %d shared git hook(s): %s", len(hooks), strings.Join(hooks, ", "))
+		}
+
+		// With --workspace-subdir the island only sees that directory, so
+		// that's where the stack is detected
+		stackPath := workspacePath
+		if cloneSubdir != "" {
+			if stackPath, err = workspaceHostPath(workspacePath, cloneSubdir); err != nil {
+				return err
+			}
 		}
 
 		// Step 2: Detect project stack
 		ui.Step(2, 4, "detecting project stack")
 		detectedTemplate := cloneTemplate
-		if detectedTemplate == "" {
-			detectedTemplate = detectProjectStack(workspacePath)
+		if recipe != nil {
+			ui.Status("using recipe %s@%s", recipe.Name, recipe.Version)
+		} else if len(envStacks) > 0 {
+			detectedTemplate = envStacks[0]
+			ui.Status("using stacks: %s", strings.Join(envStacks, ", "))
+		} else if detectedTemplate == "" {
+			detectedTemplate = detectProjectStack(stackPath)
 			if detectedTemplate != "" {
 				ui.Status("detected stack: %s", detectedTemplate)
+				if hint := multiStackHint(stackPath, detectedTemplate); hint != "" {
+					ui.Warning("repository also looks like %s; only %s will be set up", strings.Join(strings.Split(hint, ",")[1:], ", "), detectedTemplate)
+					ui.Info("hint: use --env-stack %s to set up every stack", hint)
+				}
 			} else {
 				ui.Status("no specific stack detected, using base environment")
 			}
@@ -162,32 +672,120 @@ Examples:
 				ui.Status("workspace directories: %s", strings.Join(monorepoInfo.WorkspaceDirs, ", "))
 			}
 		}
+		ui.Event("stack_detected", map[string]interface{}{
+			"stack":    detectedTemplate,
+			"monorepo": monorepoInfo.Type,
+		})
+
+		// Stripped after detection, which looks at the lockfiles
+		var strippedLockfiles map[string]bool
+		if cloneStripLockfiles {
+			if strippedLockfiles, err = stripLockfiles(stackPath); err != nil {
+				return err
+			}
+			if names := strippedLockfileNames(strippedLockfiles); len(names) > 0 {
+				ui.Status("removed %s; dependencies will be resolved again", strings.Join(names, ", "))
+			} else {
+				ui.Warning("no lockfiles found to strip")
+			}
+		}
 
 		// Load or create project config
 		var projectConfig *config.ProjectConfig
 
 		// Check for existing coderaft.json in cloned repo
-		if existingConfig, err := configManager.LoadProjectConfig(workspacePath); err == nil && existingConfig != nil {
+		if existingConfig, err := configManager.LoadBaseProjectConfig(workspacePath); err == nil && existingConfig != nil {
 			ui.Info("found existing coderaft.json in repository")
 			projectConfig = existingConfig
+			if len(strippedLockfiles) > 0 {
+				ui.Warning("its setup_commands are used as written and may expect the stripped lockfiles (e.g. 'npm ci')")
+			}
 			// Override name to match our project name
 			projectConfig.Name = projectName
+			if recipe != nil {
+				ui.Warning("repository has its own coderaft.json, ignoring recipe %s", recipe.Name)
+			}
+		} else if recipe != nil {
+			projectConfig = applyRecipe(recipe, projectName)
 		} else if detectedTemplate != "" {
-			// Create config from detected/specified template
-			projectConfig, err = configManager.CreateProjectConfigFromTemplate(detectedTemplate, projectName)
+			// Create config from detected/specified template, or from every
+			// --env-stack template in turn
+			stacks := []string{detectedTemplate}
+			if len(envStacks) > 1 {
+				stacks = envStacks
+				projectConfig, err = multiStackConfig(configManager, projectName, envStacks)
+			} else {
+				projectConfig, err = configManager.CreateProjectConfigFromTemplate(detectedTemplate, projectName)
+			}
 			if err != nil {
 				ui.Warning("failed to create config from template: %v", err)
 				projectConfig = configManager.GetDefaultProjectConfig(projectName)
 			}
 
-			// Add auto-detected setup commands based on project files
-			additionalCommands := detectSetupCommands(workspacePath, detectedTemplate)
+			// Add auto-detected setup commands based on project files. A
+			// Makefile bootstrap target is the repo's own setup path, so it wins.
+			additionalCommands := stackSetupCommands(stackPath, stacks, strippedLockfiles)
+			if makeCmd := detectMakeSetupCommand(stackPath, makeSetupTargets(cfg)); makeCmd != "" {
+				ui.Info("using '%s' from the Makefile instead of %s dependency detection", makeCmd, strings.Join(stacks, "+"))
+				additionalCommands = []string{makeCmd}
+			}
 			if len(additionalCommands) > 0 {
 				projectConfig.SetupCommands = append(projectConfig.SetupCommands, additionalCommands...)
 			}
 		} else {
 			projectConfig = configManager.GetDefaultProjectConfig(projectName)
 		}
+		if cloneSubdir != "" {
+			projectConfig.WorkspaceSubdir = cloneSubdir
+		}
+		if cloneReadOnly {
+			projectConfig.ReadOnly = true
+		}
+		workspaceHost, err := workspaceHostPath(workspacePath, projectConfig.WorkspaceSubdir)
+		if err != nil {
+			return err
+		}
+		if workspaceHost != workspacePath {
+			ui.Status("island will only see %s", projectConfig.WorkspaceSubdir)
+		}
+
+		// A .coderaft directory in the repo adds to whichever config we ended
+		// up with. setup.sh has to be visible in the island, so with a
+		// workspace_subdir the directory is read from there.
+		var bootstrap *repoBootstrap
+		if !cloneNoBootstrap {
+			bootstrap, err = loadRepoBootstrap(workspaceHost)
+			if err != nil {
+				return err
+			}
+		}
+		if bootstrap != nil && bootstrap.Profile != nil {
+			ui.Info("applying %s/profile.json", bootstrapDir)
+			projectConfig, err = applyBootstrapProfile(projectConfig, bootstrap.Profile)
+			if err != nil {
+				return err
+			}
+			if err := configManager.ValidateProjectConfig(projectConfig); err != nil {
+				return fmt.Errorf("invalid config after applying %s/profile.json: %w", bootstrapDir, err)
+			}
+		}
+
+		// Repositories using direnv get it installed; the island's bashrc
+		// hooks it in. The .envrc is only trusted with --allow-direnv.
+		usesDirenv := hasDirenvFile(workspaceHost)
+		if usesDirenv {
+			if addDirenvSetup(projectConfig) {
+				ui.Status("found %s, adding direnv to the setup commands", direnvFile)
+			}
+		} else if cloneAllowDirenv {
+			ui.Warning("no %s in the repository; ignoring --allow-direnv", direnvFile)
+		}
+
+		if cloneConfigOnly {
+			if err := configManager.ValidateProjectConfig(projectConfig); err != nil {
+				return fmt.Errorf("invalid coderaft.json: %w", err)
+			}
+		}
 
 		// Save the generated config
 		if err := configManager.SaveProjectConfig(workspacePath, projectConfig); err != nil {
@@ -196,31 +794,78 @@ Examples:
 			ui.Status("generated coderaft.json")
 		}
 
+		if cloneConfigOnly {
+			return registerConfigOnlyProject(cfg, &config.Project{
+				Name:          projectName,
+				WorkspacePath: workspacePath,
+				Stack:         detectedTemplate,
+				HooksDir:      hooksDir,
+			}, projectConfig)
+		}
+
+		IslandName := fmt.Sprintf("coderaft_%s", projectName)
+		baseImage := cfg.GetEffectiveBaseImage(&config.Project{
+			Name:      projectName,
+			BaseImage: "buildpack-deps:bookworm",
+		}, projectConfig)
+		if clonePinImage != "" {
+			baseImage = clonePinImage
+		}
+
+		state := &cloneState{
+			Version:  cloneStateVersion,
+			Project:  projectName,
+			Repo:     repoURL,
+			Branch:   effectiveBranch,
+			Commit:   gitHeadCommit(workspacePath),
+			Stack:    detectedTemplate,
+			Image:    baseImage,
+			Flags:    cloneStateFlags(cmd.Flags()),
+			ClonedAt: time.Now().UTC(),
+			Coderaft: Version,
+		}
+		if len(projectConfig.Stacks) > 1 {
+			state.Stacks = projectConfig.Stacks
+		}
+
 		if cloneNoSetup {
+			recordCloneState(workspacePath, state)
 			ui.Success("repository cloned to '%s'", workspacePath)
 			ui.Detail("workspace", workspacePath)
 			ui.Info("run 'coderaft up' in the project directory to start the island")
+			ui.Event("ready", map[string]interface{}{
+				"project":         projectName,
+				"workspace":       workspacePath,
+				"elapsed_seconds": time.Since(startTime).Seconds(),
+			})
 			return nil
 		}
 
 		// Step 3: Create and start the island
 		ui.Step(3, 4, "creating island")
 
-		IslandName := fmt.Sprintf("coderaft_%s", projectName)
-		baseImage := cfg.GetEffectiveBaseImage(&config.Project{
-			Name:      projectName,
-			BaseImage: "buildpack-deps:bookworm",
-		}, projectConfig)
-
 		workspaceIsland := "/island"
 		if projectConfig != nil && projectConfig.WorkingDir != "" {
 			workspaceIsland = projectConfig.WorkingDir
 		}
 
+		var secretEnv map[string]string
+		if projectConfig != nil && projectConfig.InjectSecrets {
+			if cloneNoSecrets {
+				ui.Status("not injecting vault secrets (--no-secrets)")
+			} else if secretEnv, err = loadSecretEnv(projectName); err != nil {
+				return err
+			}
+		}
+
 		// Pull the image
-		if err := dockerClient.PullImage(baseImage); err != nil {
+		err = runCloneStage("pull", stageTimeouts["pull"], func(ctx context.Context) error {
+			return stageDockerClient(ctx).PullImage(baseImage)
+		})
+		if err != nil {
 			return fmt.Errorf("failed to pull base image: %w", err)
 		}
+		ui.Event("image_pulled", map[string]interface{}{"image": baseImage})
 
 		// Handle force flag - remove existing island
 		if cloneForce {
@@ -258,23 +903,77 @@ Examples:
 			}
 		}
 
-		// Use optimized setup
-		optimizedSetup := NewOptimizedSetup(dockerClient, configManager)
-		if err := optimizedSetup.FastUp(projectConfig, projectName, IslandName, baseImage, workspacePath, workspaceIsland, configMap); err != nil {
-			return fmt.Errorf("failed to start island: %w", err)
+		// Mount dotfiles from --dotfiles or settings.dotfiles_repo at /dotfiles
+		dotfilesPath, dotfilesFromRepo, err := resolveDotfilesSource(cloneDotfiles, cfg, cloneDotfilesPull)
+		if err != nil {
+			return fmt.Errorf("failed to prepare dotfiles: %w", err)
+		}
+		if dotfilesPath != "" {
+			configMap = prependDotfiles(configMap, dotfilesPath)
+		}
+		if sshAgentSocket != "" {
+			configMap = withSSHAgent(configMap, sshAgentSocket)
+			ui.Status("forwarding SSH agent %s", sshAgentSocket)
+		}
+		configMap = withSecretEnv(configMap, secretEnv)
+
+		// Apt repositories have to be in place before setup_commands install
+		// from them, so in that case setup runs after the island is up rather
+		// than in the cached image build
+		setupConfig := projectConfig
+		var deferredSetup []string
+		if bootstrap != nil && bootstrap.AptRepoCommand != "" && projectConfig != nil {
+			stripped := *projectConfig
+			stripped.SetupCommands = nil
+			setupConfig = &stripped
+			deferredSetup = projectConfig.SetupCommands
 		}
 
-		// Step 4: Finalize
-		ui.Step(4, 4, "finalizing setup")
-
-		// Save project to global config
 		project := &config.Project{
 			Name:          projectName,
 			IslandName:    IslandName,
 			BaseImage:     baseImage,
 			WorkspacePath: workspacePath,
 			Status:        "running",
+			Archive:       archived,
+			LFS:           lfsMode,
+			Stack:         detectedTemplate,
+			HooksDir:      hooksDir,
 		}
+
+		// Use optimized setup
+		err = runCloneStage("setup", stageTimeouts["setup"], func(ctx context.Context) error {
+			client := stageDockerClient(ctx)
+			optimizedSetup := NewOptimizedSetup(client, configManager)
+			if err := optimizedSetup.FastUp(setupConfig, projectName, IslandName, baseImage, workspacePath, workspaceHost, workspaceIsland, configMap); err != nil {
+				return err
+			}
+			if bootstrap == nil {
+				return nil
+			}
+			return runRepoBootstrap(client, IslandName, workspaceIsland, bootstrap, deferredSetup)
+		})
+		if err != nil {
+			if cloneKeepOnFailure {
+				return keepFailedIsland(cfg, project, projectConfig, workspaceIsland, err)
+			}
+			return fmt.Errorf("failed to start island: %w", err)
+		}
+		if dotfilesFromRepo {
+			runDotfilesInstall(IslandName, dotfilesPath)
+		}
+		if usesDirenv && cloneAllowDirenv {
+			if err := dockerClient.ExecuteSetupCommandsWithOutput(IslandName, []string{direnvAllowCommand(workspaceIsland)}, false); err != nil {
+				ui.Warning("failed to allow %s: %v", direnvFile, err)
+			} else {
+				ui.Status("allowed %s in the island", direnvFile)
+			}
+		}
+
+		// Step 4: Finalize
+		ui.Step(4, 4, "finalizing setup")
+
+		// Save project to global config
 		cfg.MergeProjectConfig(project, projectConfig)
 		cfg.AddProject(project)
 		if err := configManager.Save(cfg); err != nil {
@@ -282,25 +981,63 @@ Examples:
 		}
 
 		// Generate lock file
-		_ = WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, "")
+		if err := WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, ""); err == nil {
+			noteStrippedLockfiles(workspacePath, strippedLockfiles)
+		}
+
+		if digest, _, err := dockerClient.GetImageDigestInfo(baseImage); err == nil {
+			state.ImageDigest = digest
+		}
+		recordCloneState(workspacePath, state)
+
+		if clonePostSetupCommand != "" {
+			if err := runPostSetupCommand(IslandName, workspaceIsland, clonePostSetupCommand, clonePostSetupRequired); err != nil {
+				return errdefs.Wrap(errdefs.ErrSetupFailed, err)
+			}
+		}
+
+		if clonePostTest {
+			if err := runPostSetupTest(IslandName, workspaceIsland, postSetupTestCommand(detectedTemplate, projectConfig)); err != nil && cloneFailOnTest {
+				return errdefs.Wrap(errdefs.ErrSetupFailed, err)
+			}
+		}
 
 		elapsed := time.Since(startTime).Round(time.Second)
+		ui.Event("ready", map[string]interface{}{
+			"project":         projectName,
+			"island":          IslandName,
+			"workspace":       workspacePath,
+			"stack":           detectedTemplate,
+			"elapsed_seconds": time.Since(startTime).Seconds(),
+		})
 		ui.Blank()
 		ui.Success("ready to code in %s!", elapsed)
 		ui.Detail("project", projectName)
 		ui.Detail("workspace", workspacePath)
 		ui.Detail("island", IslandName)
-		if detectedTemplate != "" {
+		if len(projectConfig.Stacks) > 1 {
+			ui.Detail("stacks", strings.Join(projectConfig.Stacks, ", "))
+		} else if detectedTemplate != "" {
 			ui.Detail("stack", detectedTemplate)
 		}
 		if monorepoInfo.IsMonorepo {
 			ui.Detail("monorepo", monorepoInfo.Type)
 		}
 
-		ui.Blank()
-		ui.Info("Next steps:")
-		ui.Info("  coderaft shell %s       # open interactive shell", projectName)
-		ui.Info("  coderaft run %s <cmd>   # run a command", projectName)
+		if !cloneShellInto {
+			ui.Blank()
+			ui.Info("Next steps:")
+			ui.Info("  coderaft shell %s       # open interactive shell", projectName)
+			ui.Info("  coderaft run %s <cmd>   # run a command", projectName)
+			if pr != nil {
+				ui.Info("  git diff origin/%s...%s   # the pull request's changes", prBase, pr.Branch())
+			}
+		}
+
+		if usesDirenv && !cloneAllowDirenv {
+			ui.Blank()
+			ui.Info("hint: the repository has an %s; review it, then run 'direnv allow' in 'coderaft shell %s' to load it", direnvFile, projectName)
+		}
 
 		// Show monorepo-specific hints
 		if hint := getMonorepoSetupHint(monorepoInfo); hint != "" {
@@ -308,26 +1045,273 @@ Examples:
 			ui.Info("Monorepo tip: %s", hint)
 		}
 
+		if cloneShellInto {
+			return shellIntoClone(IslandName, projectName)
+		}
 		return nil
 	},
 }
 
 func init() {
 	cloneCmd.Flags().BoolVarP(&cloneForce, "force", "f", false, "Force clone, overwriting existing project")
+	cloneCmd.Flags().StringVar(&cloneRecipe, "recipe", "", "Use a recipe from the configured recipe source instead of auto-detection (owner/name[@version])")
 	cloneCmd.Flags().StringVarP(&cloneTemplate, "template", "t", "", "Use specific template instead of auto-detection (python, nodejs, go, rust, java, ruby, php, web)")
+	cloneCmd.Flags().StringVar(&cloneEnvStack, "env-stack", "", "Set up several stacks instead of auto-detection, primary first (e.g. python,nodejs); recorded as stacks in coderaft.json")
 	cloneCmd.Flags().BoolVar(&cloneNoSetup, "no-setup", false, "Clone only, don't create the island")
+	cloneCmd.Flags().BoolVar(&cloneNoBootstrap, "no-bootstrap", false, "Ignore the repository's .coderaft directory (profile.json, apt-repos.json, setup.sh)")
+	cloneCmd.Flags().BoolVar(&cloneKeepOnFailure, "keep-on-setup-failure", false, "If setup fails, keep the island for inspection, register the project and save a diagnostics report")
+	cloneCmd.Flags().StringVar(&cloneFromPR, "from-pr", "", "Clone a GitHub pull request for review (owner/repo#123 or its URL): check out its head as pr-<number> and fetch its base")
+	cloneCmd.Flags().BoolVar(&cloneReadOnly, "read-only", false, "Mount the checkout read-only in the island; recorded as read_only in coderaft.json")
+	cloneCmd.Flags().IntVar(&cloneParallel, "parallel", 1, "When cloning several repositories, how many to clone and set up at once")
+	cloneCmd.Flags().BoolVar(&cloneStripLockfiles, "strip-lockfiles", false, "Remove dependency lockfiles (package-lock.json, poetry.lock, ...) after cloning so setup resolves the latest compatible versions")
+	cloneCmd.Flags().BoolVar(&cloneShellInto, "shell-into", false, "Open a shell in the island as soon as setup completes, as 'coderaft shell' would")
+	cloneCmd.Flags().BoolVar(&cloneAllowDirenv, "allow-direnv", false, "Trust the repository's .envrc with 'direnv allow' once the island is set up (direnv is installed whenever there is one)")
+	cloneCmd.Flags().BoolVar(&clonePostTest, "post-setup-test", false, "Run the project's tests in the island after setup as a smoke check (test_command, else detected from the stack)")
+	cloneCmd.Flags().BoolVar(&cloneFailOnTest, "fail-on-test", false, "With --post-setup-test, fail the clone when the tests fail")
+	cloneCmd.Flags().StringVar(&clonePostSetupCommand, "post-setup-command", "", "Run this command once in the island after setup, e.g. \"make seed\"; it isn't saved to coderaft.json, the history or the lock")
+	cloneCmd.Flags().BoolVar(&clonePostSetupRequired, "post-setup-required", false, "Fail the clone when the --post-setup-command fails instead of only warning")
+	cloneCmd.Flags().DurationVar(&cloneLockWait, "lock-wait", 0, "If another clone of the same project is running, wait this long for it to finish instead of failing right away")
+	cloneCmd.Flags().BoolVar(&cloneNoSecrets, "no-secrets", false, "Don't inject vault secrets into the island, even with inject_secrets in coderaft.json")
 	cloneCmd.Flags().StringVarP(&cloneBranch, "branch", "b", "", "Branch to clone")
 	cloneCmd.Flags().IntVar(&cloneDepth, "depth", 0, "Create a shallow clone with specified depth")
+	cloneCmd.Flags().StringVar(&cloneLFS, "lfs", "auto", "Git LFS files: auto (git's default), skip (check out pointers only) or fetch (always download)")
+	cloneCmd.Flags().BoolVar(&cloneGHAuth, "github-token-from-gh", false, "Authenticate HTTPS clones with the gh CLI's token ('gh auth token'); used automatically for github.com when git has no credential helper, =false turns that off")
+	cloneCmd.Flags().StringVar(&cloneFilter, "filter", "", "Partial clone object filter passed to git (blob:none, tree:0, blob:limit=1m); missing objects are fetched on demand")
 	cloneCmd.Flags().StringVarP(&cloneName, "name", "n", "", "Override the project name (defaults to repository name)")
+	cloneCmd.Flags().StringVar(&cloneNameTemplate, "name-template", "", "Go template for the project name over the repository URL: {{.Host}}, {{.Owner}}, {{.Repo}}, {{.Branch}} (default: settings.name_template)")
+	cloneCmd.Flags().BoolVar(&cloneWarnLarge, "warn-large-files", false, "List the largest files over the large file threshold after cloning")
+	cloneCmd.Flags().StringVar(&cloneLargeSize, "large-file-threshold", "", "Warn about checked out files bigger than this, e.g. 100MB; 0 turns the check off (default: settings.large_file_threshold, else 50MB)")
 	cloneCmd.Flags().BoolVar(&cloneSparse, "sparse", false, "Use sparse checkout (only checkout root files initially) - useful for large repos")
+	cloneCmd.Flags().BoolVar(&cloneSparseHints, "sparse-from-gitattributes", false, "Sparse checkout of the directories the repository recommends in .coderaft/sparse-paths or .sparse-checkout, else its monorepo workspace directories (implies --sparse)")
+	cloneCmd.Flags().StringVar(&cloneHooksDir, "hooks-dir", "", "Directory of shared git hooks to copy into the clone and use via core.hooksPath (default: settings.hooks_dir)")
+	cloneCmd.Flags().StringVar(&cloneSubdir, "workspace-subdir", "", "Mount only this directory of the repository into the island and work from it (e.g. packages/api); recorded as workspace_subdir in coderaft.json")
 	cloneCmd.Flags().BoolVar(&cloneNoSubmodules, "no-submodules", false, "Don't initialize submodules")
+	cloneCmd.Flags().StringArrayVar(&cloneSubmodules, "submodule", nil, "Check out a submodule at the tip of a branch instead of its recorded commit (path=branch, repeatable)")
+	cloneCmd.Flags().StringArrayVar(&cloneSkipSubs, "skip-submodule", nil, "Don't initialize the submodule at this path (repeatable)")
+	cloneCmd.Flags().BoolVar(&cloneMirrorSubs, "mirror-submodules", false, "Check out every submodule at the tip of its upstream branch instead of its recorded commit")
 	cloneCmd.Flags().BoolVar(&cloneSingleBranch, "single-branch", false, "Clone only the specified branch (reduces clone size)")
+	cloneCmd.Flags().BoolVar(&cloneResolveHead, "resolve-default-branch", false, "Look up and show the remote's default branch before cloning (when --branch isn't given)")
+	cloneCmd.Flags().StringVar(&cloneExpectBranch, "expect-branch", "", "Default branch the remote is expected to have (default: main or master)")
+	cloneCmd.Flags().StringVar(&cloneOnMismatch, "on-branch-mismatch", "warn", "With --resolve-default-branch, what to do when the default branch isn't the expected one: warn, fail or ignore")
+	cloneCmd.Flags().StringVar(&cloneNewBranch, "new-branch", "", "Create and check out a new branch off the cloned branch (e.g. feature/x)")
+	cloneCmd.Flags().BoolVar(&cloneTrackBranch, "track", false, "With --new-branch, configure origin/<branch> as its upstream for push and pull")
+	cloneCmd.Flags().BoolVar(&cloneArchive, "archive", false, "Download only the tree at the requested ref (no git history); falls back to a shallow clone")
+	cloneCmd.Flags().StringVar(&cloneDotfiles, "dotfiles", "", "Dotfiles repository (e.g. gh:user/dotfiles) or local path to mount at /dotfiles (default: settings.dotfiles_repo)")
+	cloneCmd.Flags().BoolVar(&cloneDotfilesPull, "update-dotfiles", false, "Pull the latest dotfiles repository before mounting it")
+	cloneCmd.Flags().BoolVar(&cloneSSHAgent, "mount-ssh-agent", false, "Forward the host's SSH agent into the island so git and ssh there use the host's keys (default: settings.mount_ssh_agent)")
+	cloneCmd.Flags().BoolVar(&cloneConfigOnly, "config-only", false, "Generate coderaft.json and register the project without running git or creating the island")
+	cloneCmd.Flags().StringVar(&clonePath, "path", "", "With --config-only, the existing checkout to register (default: ~/coderaft/<name>)")
+	cloneCmd.Flags().BoolVar(&cloneRetryAuth, "retry-auth", false, "On an HTTPS authentication failure, prompt for a username and token and retry the clone once (default: on when attached to a terminal)")
+	cloneCmd.Flags().BoolVar(&cloneQuietGit, "quiet-git", false, "Hide git's progress output, showing it only if git fails (default: on when stderr isn't a terminal)")
+	cloneCmd.Flags().IntVar(&cloneWorkers, "setup-workers", 0, "Number of setup commands to run concurrently for this clone (overrides CODERAFT_SETUP_WORKERS; 0 uses the defaults)")
+	cloneCmd.Flags().BoolVar(&cloneSequential, "no-parallel-setup", false, "Run setup commands one at a time, e.g. to debug a failing setup")
+	cloneCmd.Flags().StringVar(&cloneProgress, "progress", ui.ProgressPretty, "Progress output format: pretty or json (one JSON event per line on stdout)")
+	cloneCmd.Flags().StringVar(&cloneStageTimeout, "timeout-per-stage", "", "Deadline per stage, e.g. 10m for all stages or clone=5m,pull=10m,setup=30m (default: settings.clone_timeouts)")
+}
+
+// shellIntoClone opens a shell in a freshly cloned island for --shell-into.
+// The island stays up while the shell is open; once it exits, auto-stop
+// applies as it does after 'coderaft shell'.
+func shellIntoClone(islandName, projectName string) error {
+	ui.Blank()
+	ui.Status("opening a shell in island '%s'...", islandName)
+	if err := docker.AttachShell(islandName, projectName); err != nil {
+		return fmt.Errorf("failed to attach shell: %w", err)
+	}
+	autoStopAfterShell(islandName)
+	return nil
+}
+
+// cloneStages are the stages of a clone that can be given their own deadline
+var cloneStages = []string{"clone", "pull", "setup"}
+
+// parseStageTimeouts parses a --timeout-per-stage value: either one duration
+// applied to every stage, or comma separated stage=duration pairs
+func parseStageTimeouts(spec string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return timeouts, nil
+	}
+
+	if !strings.Contains(spec, "=") {
+		d, err := parseStageDuration(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range cloneStages {
+			timeouts[stage] = d
+		}
+		return timeouts, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		stage, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid stage timeout '%s' (expected stage=duration)", part)
+		}
+		stage = strings.TrimSpace(stage)
+		if !isCloneStage(stage) {
+			return nil, fmt.Errorf("unknown stage '%s' (expected one of: %s)", stage, strings.Join(cloneStages, ", "))
+		}
+		d, err := parseStageDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		timeouts[stage] = d
+	}
+	return timeouts, nil
+}
+
+func parseStageDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid stage timeout '%s' (expected a positive duration such as 90s or 10m)", value)
+	}
+	return d, nil
+}
+
+func isCloneStage(stage string) bool {
+	for _, s := range cloneStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveStageTimeouts layers --timeout-per-stage over settings.clone_timeouts
+func resolveStageTimeouts(flag string, cfg *config.Config) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if cfg != nil && cfg.Settings != nil {
+		for stage, value := range cfg.Settings.CloneTimeouts {
+			if !isCloneStage(stage) {
+				return nil, fmt.Errorf("settings.clone_timeouts: unknown stage '%s'", stage)
+			}
+			d, err := parseStageDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("settings.clone_timeouts: %w", err)
+			}
+			timeouts[stage] = d
+		}
+	}
+
+	overrides, err := parseStageTimeouts(flag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --timeout-per-stage: %w", err)
+	}
+	for stage, d := range overrides {
+		timeouts[stage] = d
+	}
+	return timeouts, nil
+}
+
+// runCloneStage runs fn with a context that is cancelled once the stage's
+// timeout (if any) passes. A stage that overruns reports itself by name rather
+// than whatever error the cancelled operation surfaced.
+func runCloneStage(stage string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := fn(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		ui.Event("stage_timeout", map[string]interface{}{
+			"stage":           stage,
+			"timeout_seconds": timeout.Seconds(),
+		})
+		return fmt.Errorf("%s stage timed out after %s (raise it with --timeout-per-stage %s=<duration>)", stage, timeout, stage)
+	}
+	return err
+}
+
+// keepFailedIsland handles a setup failure under --keep-on-setup-failure. If
+// the island was created, it is started if need be, a diagnostics report is
+// printed and saved next to the setup log, and the project is registered so
+// 'coderaft shell' can get into it. setupErr is still returned, so the clone
+// fails.
+func keepFailedIsland(cfg *config.Config, project *config.Project, projectConfig *config.ProjectConfig, workspaceIsland string, setupErr error) error {
+	failErr := fmt.Errorf("failed to start island: %w", setupErr)
+	exists, err := dockerClient.IslandExists(project.IslandName)
+	if err != nil || !exists {
+		ui.Warning("island '%s' was not created, so there is nothing to keep", project.IslandName)
+		return failErr
+	}
+	if status, err := dockerClient.GetIslandStatus(project.IslandName); err == nil && status != "running" {
+		if err := dockerClient.StartIsland(project.IslandName); err != nil {
+			ui.Warning("failed to start island for diagnostics: %v", err)
+		}
+	}
+
+	ui.Status("gathering diagnostics from '%s'...", project.IslandName)
+	report := gatherSetupDiagnostics(dockerClient, project.IslandName, workspaceIsland, setupErr, readSetupLog(project.IslandName))
+	ui.Blank()
+	fmt.Fprint(ui.Writer(), report)
+
+	reportPath, err := writeSetupDiagnostics(project.IslandName, report, time.Now())
+	if err != nil {
+		ui.Warning("failed to save diagnostics: %v", err)
+	}
+
+	cfg.MergeProjectConfig(project, projectConfig)
+	cfg.AddProject(project)
+	if err := configManager.Save(cfg); err != nil {
+		ui.Warning("failed to save configuration: %v", err)
+	}
+
+	ui.Warning("setup failed; kept island '%s' for inspection", project.IslandName)
+	if reportPath != "" {
+		ui.Detail("diagnostics", reportPath)
+	}
+	ui.Info("  coderaft shell %s       # look around in the island", project.Name)
+	ui.Info("  coderaft destroy %s     # remove it when done", project.Name)
+	ui.Event("setup_failed", map[string]interface{}{
+		"project":     project.Name,
+		"island":      project.IslandName,
+		"diagnostics": reportPath,
+	})
+	return failErr
+}
+
+// stageDockerClient returns a Docker client whose calls are cancelled with ctx
+func stageDockerClient(ctx context.Context) DockerEngine {
+	if c, ok := dockerClient.(*docker.Client); ok {
+		return c.WithContext(ctx)
+	}
+	return dockerClient
+}
+
+// registerConfigOnlyProject records a project for an existing checkout without
+// creating its island; 'coderaft up' in the workspace creates it later. The
+// island name and base image are filled in from the project name and config.
+func registerConfigOnlyProject(cfg *config.Config, project *config.Project, projectConfig *config.ProjectConfig) error {
+	projectName, workspacePath := project.Name, project.WorkspacePath
+	project.IslandName = fmt.Sprintf("coderaft_%s", projectName)
+	project.BaseImage = cfg.GetEffectiveBaseImage(&config.Project{Name: projectName}, projectConfig)
+	cfg.MergeProjectConfig(project, projectConfig)
+	cfg.AddProject(project)
+	if err := configManager.Save(cfg); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	ui.Event("ready", map[string]interface{}{
+		"project":   projectName,
+		"workspace": workspacePath,
+	})
+	ui.Success("registered project '%s'", projectName)
+	ui.Detail("workspace", workspacePath)
+	ui.Info("hint: run 'coderaft up' in %s to create the island.", workspacePath)
+	return nil
 }
 
 // normalizeRepoURL converts various repository formats to a full Git URL
 // Supports:
 //   - Full HTTPS: https://github.com/user/repo
 //   - Full SSH: git@github.com:user/repo.git
+//   - SSH scheme: ssh://git@git.example.com:2222/group/repo.git
 //   - Shorthand: user/repo (assumes GitHub)
 //   - Host prefix: github.com/user/repo, gitlab.com/user/repo
 //   - Protocol prefix: github:user/repo, gh:user/repo
@@ -365,6 +1349,16 @@ func normalizeRepoURL(input string) (string, error) {
 		return input, nil
 	}
 
+	// SSH URL with a scheme, possibly on a non-standard port
+	// (ssh://git@host:2222/group/repo.git); git takes it as is
+	if strings.HasPrefix(input, "ssh://") {
+		parsed, err := url.Parse(input)
+		if err != nil || parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+			return "", fmt.Errorf("invalid SSH repository URL '%s' (expected ssh://[user@]host[:port]/path/repo.git)", input)
+		}
+		return input, nil
+	}
+
 	// Handle protocol shortcuts (github:user/repo, gh:user/repo, gitlab:user/repo)
 	protocolShortcuts := map[string]string{
 		"github:":    "https://github.com/",
@@ -613,7 +1607,7 @@ func extractProjectName(repoURL string) (string, error) {
 		return cleanRepoName(path), nil
 	}
 
-	// Handle HTTP(S) URLs
+	// Handle HTTP(S), ssh:// and git:// URLs
 	parsed, err := url.Parse(repoURL)
 	if err != nil {
 		return "", err
@@ -623,6 +1617,46 @@ func extractProjectName(repoURL string) (string, error) {
 	return cleanRepoName(path), nil
 }
 
+// projectNameFields are the parts of a repository URL a name template can
+// use. Characters a project name can't contain, such as '.' and '/', are
+// replaced with '-'.
+type projectNameFields struct {
+	Host   string
+	Owner  string
+	Repo   string
+	Branch string
+}
+
+var nameFieldUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// renderProjectName renders a --name-template for repoURL. Dashes and
+// underscores left dangling at either end, e.g. by an empty {{.Branch}}, are
+// trimmed.
+func renderProjectName(nameTemplate, repoURL, branch string) (string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid --name-template: %w", err)
+	}
+
+	host, repoPath := splitRepoHostPath(repoURL)
+	owner, repo := "", repoPath
+	if i := strings.LastIndex(repoPath, "/"); i >= 0 {
+		owner, repo = repoPath[:i], repoPath[i+1:]
+	}
+	fields := projectNameFields{
+		Host:   nameFieldUnsafe.ReplaceAllString(host, "-"),
+		Owner:  nameFieldUnsafe.ReplaceAllString(owner, "-"),
+		Repo:   nameFieldUnsafe.ReplaceAllString(repo, "-"),
+		Branch: nameFieldUnsafe.ReplaceAllString(branch, "-"),
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", fmt.Errorf("invalid --name-template: %w", err)
+	}
+	return strings.Trim(b.String(), "-_"), nil
+}
+
 // cleanRepoName extracts a clean project name from a repo path
 func cleanRepoName(path string) string {
 	// Remove .git suffix
@@ -635,126 +1669,532 @@ func cleanRepoName(path string) string {
 	return path
 }
 
-// gitClone clones a repository to the specified path with retry logic and submodule support
-func gitClone(repoURL, destPath, branch string) error {
-	// Handle sparse checkout separately (requires different git workflow)
-	if cloneSparse {
-		return gitCloneSparse(repoURL, destPath, branch)
-	}
-
-	args := []string{"clone", "--progress"}
+// gitCloneArgs builds the arguments for a regular (non-sparse) git clone,
+// shallow when depth is above zero
+func gitCloneArgs(repoURL, destPath, branch string, depth int) []string {
+	args := []string{"clone", gitProgressFlag()}
 
 	if branch != "" {
 		args = append(args, "-b", branch)
 	}
 
-	if cloneSingleBranch || cloneDepth > 0 {
+	if cloneSingleBranch || depth > 0 {
 		args = append(args, "--single-branch")
 	}
 
-	if cloneDepth > 0 {
-		args = append(args, "--depth", fmt.Sprintf("%d", cloneDepth))
+	if depth > 0 {
+		args = append(args, "--depth", fmt.Sprintf("%d", depth))
+	}
+
+	if cloneFilter != "" {
+		args = append(args, "--filter="+cloneFilter)
 	}
 
-	// Handle submodules
-	if !cloneNoSubmodules {
+	// Handle submodules; per-submodule control updates them after the clone instead
+	selective := len(cloneSubmodules) > 0 || len(cloneSkipSubs) > 0 || cloneMirrorSubs
+	if !cloneNoSubmodules && !selective {
 		args = append(args, "--recurse-submodules")
-		if cloneDepth > 0 {
+		if depth > 0 {
 			args = append(args, "--shallow-submodules")
 		}
 	}
 
-	args = append(args, repoURL, destPath)
+	return append(args, repoURL, destPath)
+}
+
+var (
+	treeFilterPattern = regexp.MustCompile(`^tree:[0-9]+$`)
+	blobLimitPattern  = regexp.MustCompile(`^blob:limit=[0-9]+[kKmMgG]?$`)
+)
+
+// validateCloneFilter accepts the partial clone filters that make sense for a
+// workspace: blob:none, tree:<depth> and blob:limit=<size>[k|m|g]
+func validateCloneFilter(filter string) error {
+	if filter == "blob:none" || treeFilterPattern.MatchString(filter) || blobLimitPattern.MatchString(filter) {
+		return nil
+	}
+	return fmt.Errorf("invalid --filter '%s' (expected blob:none, tree:<depth> or blob:limit=<size>, e.g. blob:limit=1m)", filter)
+}
+
+// gitClone clones a repository to the specified path with retry logic and submodule support
+func gitClone(ctx context.Context, repoURL, destPath, branch string, depth int) error {
+	// Handle sparse checkout separately (requires different git workflow)
+	if cloneSparse {
+		return gitCloneSparse(ctx, repoURL, destPath, branch, depth)
+	}
+
+	args := gitCloneArgs(repoURL, destPath, branch, depth)
+	selective := len(cloneSubmodules) > 0 || len(cloneSkipSubs) > 0 || cloneMirrorSubs
 
 	// Retry logic for transient network errors
 	maxRetries := 3
 	var lastErr error
+	var lastStderr string
+	resuming := false
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		cmd := exec.Command("git", args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		lastErr = cmd.Run()
+		// git's own stderr decides whether a failure is worth retrying
+		var stderr bytes.Buffer
+		stdoutW, stderrW := gitOutput(&stderr)
+		if resuming {
+			lastErr = resumeClone(ctx, destPath, stdoutW, stderrW)
+		} else {
+			cmd := exec.CommandContext(ctx, "git", args...)
+			cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+			applyGitEnv(cmd)
+			lastErr = cmd.Run()
+		}
+		lastStderr = stderr.String()
 		if lastErr == nil {
-			// Initialize any submodules that weren't cloned (in case --recurse-submodules partially failed)
-			if !cloneNoSubmodules {
-				if err := initSubmodules(destPath); err != nil {
+			switch {
+			case cloneNoSubmodules:
+			case selective:
+				if err := updateSubmodulesSelectively(ctx, destPath); err != nil {
+					return err
+				}
+				reportSubmoduleCommits(ctx, destPath)
+			default:
+				// Initialize any submodules that weren't cloned (in case --recurse-submodules partially failed)
+				if err := initSubmodules(ctx, destPath); err != nil {
 					ui.Warning("some submodules may not have been initialized: %v", err)
 				}
+				reportSubmoduleCommits(ctx, destPath)
 			}
 			return nil
 		}
 
-		// Clean up partial clone on failure
-		os.RemoveAll(destPath)
-
-		// Check if it's a retryable error
-		errStr := lastErr.Error()
-		isRetryable := strings.Contains(errStr, "Connection reset") ||
-			strings.Contains(errStr, "Connection timed out") ||
-			strings.Contains(errStr, "Could not resolve host") ||
-			strings.Contains(errStr, "SSL") ||
-			strings.Contains(errStr, "early EOF") ||
-			strings.Contains(errStr, "RPC failed") ||
-			strings.Contains(errStr, "fetch-pack")
+		if ctx.Err() != nil {
+			os.RemoveAll(destPath)
+			return ctx.Err()
+		}
 
-		if !isRetryable || attempt == maxRetries {
+		action := nextCloneAction(lastErr.Error()+"\n"+lastStderr, depth > 0, hasClonedRepo(destPath), resuming)
+		if action != cloneResume || attempt == maxRetries {
+			// Clean up partial clone on failure
+			os.RemoveAll(destPath)
+		}
+		if action == cloneGiveUp || attempt == maxRetries {
 			break
 		}
-
-		ui.Warning("clone attempt %d failed, retrying... (%v)", attempt, lastErr)
-		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+
+		resuming = action == cloneResume
+		if resuming {
+			ui.Warning("clone attempt %d failed, resuming in the existing checkout... (%v)", attempt, lastErr)
+		} else {
+			ui.Warning("clone attempt %d failed, retrying... (%v)", attempt, lastErr)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+	}
+
+	// Provide helpful error messages
+	return formatGitError(gitError(lastErr, lastStderr), repoURL, branch)
+}
+
+// cloneRetryAction is what gitClone does after a failed attempt
+type cloneRetryAction int
+
+const (
+	cloneGiveUp cloneRetryAction = iota
+	cloneRestart
+	cloneResume
+)
+
+// nextCloneAction decides how to follow up a failed clone attempt, given git's
+// error output. git keeps the repository when the fetch finished and only the
+// checkout or submodules failed; a full clone in that state is resumed in place
+// instead of fetched again. If the resume fails too, or nothing usable is left,
+// the directory is removed and the clone restarts.
+func nextCloneAction(output string, shallow, repoLeft, resumeFailed bool) cloneRetryAction {
+	if !isRetryableGitError(output) {
+		return cloneGiveUp
+	}
+	if !shallow && repoLeft && !resumeFailed {
+		return cloneResume
+	}
+	return cloneRestart
+}
+
+func isRetryableGitError(output string) bool {
+	for _, s := range []string{
+		"Connection reset",
+		"Connection timed out",
+		"Could not resolve host",
+		"SSL",
+		"early EOF",
+		"RPC failed",
+		"fetch-pack",
+	} {
+		if strings.Contains(output, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasClonedRepo reports whether a failed clone left a repository with fetched
+// refs behind
+func hasClonedRepo(destPath string) bool {
+	if _, err := os.Stat(filepath.Join(destPath, ".git")); err != nil {
+		return false
+	}
+	out, err := exec.Command("git", "-C", destPath, "for-each-ref", "--count=1", "refs/remotes", "refs/tags").Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// resumeClone finishes a clone whose objects were fetched but whose checkout
+// failed, by checking out HEAD again instead of fetching everything anew
+func resumeClone(ctx context.Context, destPath string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", destPath, "reset", "--hard", "HEAD")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	applyGitEnv(cmd)
+	return cmd.Run()
+}
+
+var lfsModes = []string{"auto", "skip", "fetch"}
+
+func isLFSMode(mode string) bool {
+	for _, m := range lfsModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// gitLFSEnv returns the environment git needs for an --lfs mode. skip checks
+// LFS files out as pointers, fetch downloads them even when the user's
+// environment sets GIT_LFS_SKIP_SMUDGE, and auto leaves git's default alone.
+func gitLFSEnv(mode string) []string {
+	switch mode {
+	case "skip":
+		return []string{"GIT_LFS_SKIP_SMUDGE=1"}
+	case "fetch":
+		return []string{"GIT_LFS_SKIP_SMUDGE=0"}
+	}
+	return nil
+}
+
+// applyGitEnv sets the environment for a git command clone runs against the
+// repository: the --lfs mode and, when one is in use, the gh token
+func applyGitEnv(cmd *exec.Cmd) {
+	env := append(gitLFSEnv(cloneLFS), cloneAuthEnv...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+}
+
+func gitLFSAvailable() bool {
+	return exec.Command("git", "lfs", "version").Run() == nil
+}
+
+// usesGitLFS reports whether the checkout's .gitattributes routes any paths
+// through the LFS filter
+func usesGitLFS(repoPath string) bool {
+	data, err := os.ReadFile(filepath.Join(repoPath, ".gitattributes"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, attr := range strings.Fields(line)[1:] {
+			if attr == "filter=lfs" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configureGitLFS follows up a clone of an LFS repository. It warns when
+// git-lfs is missing, since the checkout then holds pointer files, and with
+// --lfs=skip configures the repository so later checkouts skip LFS downloads
+// too. It returns the mode to record for the project, or "" if the repository
+// doesn't use LFS.
+func configureGitLFS(repoPath, mode string) string {
+	if !usesGitLFS(repoPath) {
+		return ""
+	}
+	if !gitLFSAvailable() {
+		ui.Warning("repository uses Git LFS but git-lfs is not installed; LFS files were checked out as pointers")
+		ui.Info("hint: install git-lfs, then run 'git lfs install && git lfs pull' in %s", repoPath)
+		return mode
+	}
+	if mode == "skip" {
+		if out, err := exec.Command("git", "-C", repoPath, "lfs", "install", "--local", "--skip-smudge").CombinedOutput(); err != nil {
+			ui.Warning("failed to configure LFS skip-smudge: %s", strings.TrimSpace(string(out)))
+		}
+		ui.Info("LFS files were left as pointers; run 'git lfs pull' in %s to download them", repoPath)
+	}
+	return mode
+}
+
+// cloneAuthEnv, cloneAuthUser and cloneAuthToken are set when clone
+// authenticates with the gh CLI's token or credentials entered after
+// --retry-auth. The token only ever reaches git through the environment.
+var (
+	cloneAuthEnv   []string
+	cloneAuthUser  string
+	cloneAuthToken string
+)
+
+// resolveGHAuth decides whether clone uses 'gh auth token' for repoURL. With
+// --github-token-from-gh it always tries; without the flag it tries for
+// github.com when gh is installed and git has no credential helper. A missing
+// or logged-out gh never fails the clone, which then goes ahead with git's
+// own authentication.
+func resolveGHAuth(repoURL string, explicit bool) {
+	cloneAuthEnv, cloneAuthUser, cloneAuthToken = nil, "", ""
+	if explicit && !cloneGHAuth {
+		return
+	}
+
+	host, _ := splitRepoHostPath(repoURL)
+	if !strings.HasPrefix(repoURL, "https://") || host == "" {
+		if cloneGHAuth {
+			ui.Warning("--github-token-from-gh only applies to HTTPS URLs; using git's own authentication")
+		}
+		return
+	}
+	if !cloneGHAuth {
+		if host != "github.com" || gitHasCredentialHelper() {
+			return
+		}
+		if _, err := exec.LookPath("gh"); err != nil {
+			return
+		}
+	}
+
+	token, err := ghAuthToken(host)
+	if err != nil {
+		if cloneGHAuth {
+			ui.Warning("%v; cloning without it", err)
+			ui.Info("hint: run 'gh auth login --hostname %s' to authenticate gh", host)
+		}
+		return
+	}
+	cloneAuthEnv = gitAuthEnv(os.Environ(), host, token)
+	cloneAuthUser, cloneAuthToken = tokenAuthUser, token
+	ui.Status("authenticating to %s with the gh CLI's token", host)
+}
+
+// ghAuthToken asks the gh CLI for its token for host
+func ghAuthToken(host string) (string, error) {
+	if _, err := exec.LookPath("gh"); err != nil {
+		return "", fmt.Errorf("gh is not installed")
+	}
+	out, err := exec.Command("gh", "auth", "token", "--hostname", host).Output()
+	token := strings.TrimSpace(string(out))
+	if err != nil || token == "" {
+		return "", fmt.Errorf("gh is not authenticated to %s", host)
+	}
+	return token, nil
+}
+
+// gitHasCredentialHelper reports whether the user's git config already
+// provides credentials
+func gitHasCredentialHelper() bool {
+	out, err := exec.Command("git", "config", "--get-all", "credential.helper").Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// gitAuthEnv returns the environment that makes git send token as an HTTP
+// Authorization header to host. It goes through GIT_CONFIG_* so the token
+// isn't on git's command line or written to the clone's .git/config, and
+// follows any GIT_CONFIG_* entries already in environ.
+func gitAuthEnv(environ []string, host, token string) []string {
+	return gitBasicAuthEnv(environ, host, tokenAuthUser, token)
+}
+
+// tokenAuthUser is the user name sent with a token that needs none
+const tokenAuthUser = "x-access-token"
+
+// gitBasicAuthEnv is gitAuthEnv for an explicit user name and password or token
+func gitBasicAuthEnv(environ []string, host, user, token string) []string {
+	n := 0
+	for _, kv := range environ {
+		if v, ok := strings.CutPrefix(kv, "GIT_CONFIG_COUNT="); ok {
+			n, _ = strconv.Atoi(v)
+		}
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.https://%s/.extraheader", n, host),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: Basic %s", n, creds),
+	}
+}
+
+// redactCloneToken masks the clone's token in text that is about to be shown
+func redactCloneToken(s string) string {
+	if cloneAuthToken == "" {
+		return s
+	}
+	user := cloneAuthUser
+	if user == "" {
+		user = tokenAuthUser
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + cloneAuthToken))
+	s = strings.ReplaceAll(s, creds, "***")
+	return strings.ReplaceAll(s, cloneAuthToken, "***")
+}
+
+func gitProgressFlag() string {
+	if cloneQuietGit {
+		return "-q"
+	}
+	return "--progress"
+}
+
+// gitOutput returns the stdout and stderr for a git command: shown live and
+// captured into buf, or with --quiet-git only captured
+func gitOutput(buf *bytes.Buffer) (stdout, stderr io.Writer) {
+	if cloneQuietGit {
+		return io.Discard, buf
+	}
+	return ui.Writer(), io.MultiWriter(os.Stderr, buf)
+}
+
+// runGit runs a git command with output per gitOutput
+func runGit(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = gitOutput(&stderr)
+	if err := cmd.Run(); err != nil {
+		return gitError(err, stderr.String())
+	}
+	return nil
+}
+
+// gitError adds the end of git's stderr to err when --quiet-git kept it from
+// the terminal, so the failure can still be diagnosed
+func gitError(err error, stderr string) error {
+	if !cloneQuietGit {
+		return err
+	}
+	if tail := gitStderrTail(stderr, 5); tail != "" {
+		return fmt.Errorf("%w\n%s", err, redactCloneToken(tail))
+	}
+	return err
+}
+
+// gitStderrTail returns the last n lines of git's stderr, skipping progress
+// updates that were overwritten with a carriage return
+func gitStderrTail(stderr string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if i := strings.LastIndex(line, "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateNewBranchName checks a branch name against git's ref rules
+func validateNewBranchName(name string) error {
+	out, err := exec.Command("git", "check-ref-format", "--branch", name).CombinedOutput()
+	if err != nil || strings.HasPrefix(name, "-") {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = "not a valid git branch name"
+		}
+		return fmt.Errorf("invalid branch name '%s': %s", name, strings.TrimPrefix(msg, "fatal: "))
+	}
+	return nil
+}
+
+// createFeatureBranch creates and checks out name at the cloned HEAD. With
+// track, origin/<name> becomes its upstream so a later push/pull needs no flags.
+func createFeatureBranch(workspacePath, name string, track bool) error {
+	out, err := exec.Command("git", "-C", workspacePath, "checkout", "-b", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create branch '%s': %s", name, strings.TrimSpace(string(out)))
+	}
+	if !track {
+		return nil
+	}
+	for _, kv := range [][2]string{
+		{"branch." + name + ".remote", "origin"},
+		{"branch." + name + ".merge", "refs/heads/" + name},
+	} {
+		if out, err := exec.Command("git", "-C", workspacePath, "config", kv[0], kv[1]).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set upstream for '%s': %s", name, strings.TrimSpace(string(out)))
+		}
 	}
-
-	// Provide helpful error messages
-	return formatGitError(lastErr, repoURL, branch)
+	return nil
 }
 
 // gitCloneSparse performs a sparse checkout - clones only root files initially
 // This is useful for very large repositories
-func gitCloneSparse(repoURL, destPath, branch string) error {
+func gitCloneSparse(ctx context.Context, repoURL, destPath, branch string, depth int) error {
 	// Step 1: Clone with no checkout
-	args := []string{"clone", "--no-checkout", "--filter=blob:none", "--progress"}
+	filter := "blob:none"
+	if cloneFilter != "" {
+		filter = cloneFilter
+	}
+	args := []string{"clone", "--no-checkout", "--filter=" + filter, gitProgressFlag()}
 
 	if branch != "" {
 		args = append(args, "-b", branch)
 	}
 
-	if cloneSingleBranch || cloneDepth > 0 {
+	if cloneSingleBranch || depth > 0 {
 		args = append(args, "--single-branch")
 	}
 
-	if cloneDepth > 0 {
-		args = append(args, "--depth", fmt.Sprintf("%d", cloneDepth))
+	if depth > 0 {
+		args = append(args, "--depth", fmt.Sprintf("%d", depth))
 	}
 
 	args = append(args, repoURL, destPath)
 
 	ui.Status("sparse clone: fetching repository metadata...")
-	cmd := exec.Command("git", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	applyGitEnv(cmd)
+	if err := runGit(cmd); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return formatGitError(err, repoURL, branch)
 	}
 
 	// Step 2: Enable sparse checkout
 	ui.Status("sparse clone: enabling sparse checkout...")
-	cmd = exec.Command("git", "sparse-checkout", "init", "--cone")
+	cmd = exec.CommandContext(ctx, "git", "sparse-checkout", "init", "--cone")
 	cmd.Dir = destPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := runGit(cmd); err != nil {
 		return fmt.Errorf("failed to initialize sparse checkout: %w", err)
 	}
 
-	// Step 3: Set sparse checkout to root only (empty set means top-level files only)
-	cmd = exec.Command("git", "sparse-checkout", "set")
+	// Step 3: Set sparse checkout to root only (empty set means top-level
+	// files only), or the directories the repository's hint file lists,
+	// plus the --workspace-subdir the island needs
+	var hints []string
+	if cloneSparseHints {
+		var hintFile string
+		var err error
+		if hints, hintFile, err = readSparseHints(ctx, destPath); err != nil {
+			return err
+		} else if hintFile != "" {
+			ui.Status("sparse clone: using %d director(ies) from %s", len(hints), hintFile)
+		}
+	}
+	setArgs := append([]string{"sparse-checkout", "set"}, sparseCheckoutSet(hints, cloneSubdir)...)
+	cmd = exec.CommandContext(ctx, "git", setArgs...)
 	cmd.Dir = destPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := runGit(cmd); err != nil {
 		return fmt.Errorf("failed to set sparse checkout: %w", err)
 	}
 
@@ -764,20 +2204,36 @@ func gitCloneSparse(repoURL, destPath, branch string) error {
 	if branch != "" {
 		checkoutArgs = append(checkoutArgs, branch)
 	}
-	cmd = exec.Command("git", checkoutArgs...)
+	cmd = exec.CommandContext(ctx, "git", checkoutArgs...)
 	cmd.Dir = destPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	applyGitEnv(cmd)
+	if err := runGit(cmd); err != nil {
 		return fmt.Errorf("failed to checkout: %w", err)
 	}
 
+	// Without a hint file, a monorepo's workspace directories are the next
+	// best guess; its marker files are among the root files just checked out
+	if cloneSparseHints && len(hints) == 0 && detectMonorepo(destPath).IsMonorepo {
+		topDirs, err := gitTopLevelDirs(ctx, destPath)
+		if err != nil {
+			ui.Warning("failed to list the repository's directories: %v", err)
+		} else if dirs := monorepoSparseDirs(topDirs); len(dirs) > 0 {
+			ui.Status("sparse clone: no sparse hints, adding workspace directories %s", strings.Join(dirs, ", "))
+			cmd = exec.CommandContext(ctx, "git", append([]string{"sparse-checkout", "add"}, dirs...)...)
+			cmd.Dir = destPath
+			applyGitEnv(cmd)
+			if err := runGit(cmd); err != nil {
+				return fmt.Errorf("failed to add workspace directories to the sparse checkout: %w", err)
+			}
+		}
+	}
+
 	ui.Info("sparse checkout complete. Use 'git sparse-checkout add <dir>' to add directories")
 	return nil
 }
 
 // initSubmodules initializes and updates git submodules
-func initSubmodules(repoPath string) error {
+func initSubmodules(ctx context.Context, repoPath string) error {
 	// Check if .gitmodules exists
 	gitmodulesPath := filepath.Join(repoPath, ".gitmodules")
 	if _, err := os.Stat(gitmodulesPath); os.IsNotExist(err) {
@@ -786,12 +2242,209 @@ func initSubmodules(repoPath string) error {
 
 	ui.Status("initializing submodules...")
 
-	cmd := exec.Command("git", "submodule", "update", "--init", "--recursive")
+	cmd := exec.CommandContext(ctx, "git", "submodule", "update", "--init", "--recursive")
 	cmd.Dir = repoPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	applyGitEnv(cmd)
+	return runGit(cmd)
+}
 
-	return cmd.Run()
+// parseSubmodulePins parses repeated --submodule path=branch values, rejecting
+// paths that are also passed to --skip-submodule
+func parseSubmodulePins(pins, skips []string) (map[string]string, error) {
+	skipped := map[string]bool{}
+	for _, path := range skips {
+		path = cleanSubmodulePath(path)
+		if path == "" {
+			return nil, fmt.Errorf("--skip-submodule needs a submodule path")
+		}
+		skipped[path] = true
+	}
+
+	out := map[string]string{}
+	for _, pin := range pins {
+		path, branch, ok := strings.Cut(pin, "=")
+		path, branch = cleanSubmodulePath(path), strings.TrimSpace(branch)
+		if !ok || path == "" || branch == "" {
+			return nil, fmt.Errorf("invalid --submodule '%s' (expected path=branch)", pin)
+		}
+		if err := validateNewBranchName(branch); err != nil {
+			return nil, fmt.Errorf("invalid --submodule '%s': %w", pin, err)
+		}
+		if skipped[path] {
+			return nil, fmt.Errorf("submodule '%s' is both pinned with --submodule and skipped with --skip-submodule", path)
+		}
+		if prev, dup := out[path]; dup && prev != branch {
+			return nil, fmt.Errorf("submodule '%s' is pinned to both '%s' and '%s'", path, prev, branch)
+		}
+		out[path] = branch
+	}
+	return out, nil
+}
+
+func cleanSubmodulePath(p string) string {
+	p = strings.Trim(path.Clean(filepath.ToSlash(strings.TrimSpace(p))), "/")
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// parseGitmodulesPaths maps submodule paths to their names from
+// 'git config -f .gitmodules --get-regexp ^submodule\..*\.path$' output
+func parseGitmodulesPaths(output string) map[string]string {
+	paths := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		key, path, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok || !strings.HasPrefix(key, "submodule.") || !strings.HasSuffix(key, ".path") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+		paths[cleanSubmodulePath(path)] = name
+	}
+	return paths
+}
+
+// submoduleUpdateCommands turns the per-submodule flags into git invocations
+// (run from the repository root). Skipped submodules stay uninitialized;
+// pinned ones have their branch set in .git/config so 'update --remote'
+// checks out its tip without touching .gitmodules. Unknown paths are returned
+// so the caller can report them.
+func submoduleUpdateCommands(paths map[string]string, pins map[string]string, skips []string, mirror bool) ([][]string, []string) {
+	skipped := map[string]bool{}
+	for _, path := range skips {
+		skipped[cleanSubmodulePath(path)] = true
+	}
+
+	var unknown []string
+	for path := range pins {
+		if _, ok := paths[path]; !ok {
+			unknown = append(unknown, path)
+		}
+	}
+	for path := range skipped {
+		if _, ok := paths[path]; !ok {
+			unknown = append(unknown, path)
+		}
+	}
+	sort.Strings(unknown)
+
+	ordered := make([]string, 0, len(paths))
+	for path := range paths {
+		ordered = append(ordered, path)
+	}
+	sort.Strings(ordered)
+
+	var cmds [][]string
+	for _, path := range ordered {
+		if skipped[path] {
+			continue
+		}
+		if branch, ok := pins[path]; ok {
+			cmds = append(cmds,
+				[]string{"submodule", "init", "--", path},
+				[]string{"config", "submodule." + paths[path] + ".branch", branch},
+				[]string{"submodule", "update", "--remote", "--recursive", "--", path},
+			)
+			continue
+		}
+		args := []string{"submodule", "update", "--init", "--recursive"}
+		if mirror {
+			args = append(args, "--remote")
+		}
+		cmds = append(cmds, append(args, "--", path))
+	}
+	return cmds, unknown
+}
+
+// updateSubmodulesSelectively initializes submodules one at a time, honoring
+// --submodule, --skip-submodule and --mirror-submodules
+func updateSubmodulesSelectively(ctx context.Context, repoPath string) error {
+	if _, err := os.Stat(filepath.Join(repoPath, ".gitmodules")); os.IsNotExist(err) {
+		ui.Warning("repository has no submodules; ignoring submodule flags")
+		return nil
+	}
+
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "config", "-f", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`).Output()
+	if err != nil {
+		return fmt.Errorf("failed to read .gitmodules: %w", err)
+	}
+
+	pins, _ := parseSubmodulePins(cloneSubmodules, cloneSkipSubs)
+	cmds, unknown := submoduleUpdateCommands(parseGitmodulesPaths(string(out)), pins, cloneSkipSubs, cloneMirrorSubs)
+	missing := map[string]bool{}
+	for _, path := range unknown {
+		missing[path] = true
+		ui.Warning("no submodule at '%s' in .gitmodules", path)
+	}
+	for _, path := range cloneSkipSubs {
+		if path = cleanSubmodulePath(path); !missing[path] {
+			ui.Status("skipping submodule %s", path)
+		}
+	}
+
+	for _, args := range cmds {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = repoPath
+		applyGitEnv(cmd)
+		if err := runGit(cmd); err != nil {
+			return fmt.Errorf("failed to update submodule %s (git %s): %w", args[len(args)-1], strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
+
+type submoduleState struct {
+	Path   string
+	Commit string
+	State  string
+}
+
+// parseSubmoduleStatus parses 'git submodule status --recursive' output. State
+// is "" when checked out at the recorded commit, "uninitialized", "modified"
+// (a different commit than recorded, e.g. a branch tip) or "conflict".
+func parseSubmoduleStatus(output string) []submoduleState {
+	var states []submoduleState
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		state := ""
+		switch line[0] {
+		case '-':
+			state = "uninitialized"
+		case '+':
+			state = "modified"
+		case 'U':
+			state = "conflict"
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 {
+			continue
+		}
+		states = append(states, submoduleState{Path: fields[1], Commit: fields[0], State: state})
+	}
+	return states
+}
+
+// reportSubmoduleCommits prints the commit each submodule ended up at
+func reportSubmoduleCommits(ctx context.Context, repoPath string) {
+	if _, err := os.Stat(filepath.Join(repoPath, ".gitmodules")); os.IsNotExist(err) {
+		return
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "submodule", "status", "--recursive").Output()
+	if err != nil {
+		return
+	}
+	for _, sm := range parseSubmoduleStatus(string(out)) {
+		switch sm.State {
+		case "uninitialized":
+			ui.Detail("submodule "+sm.Path, "not initialized")
+		case "modified":
+			ui.Detail("submodule "+sm.Path, sm.Commit[:min(12, len(sm.Commit))]+" (differs from the commit recorded by the repository)")
+		default:
+			ui.Detail("submodule "+sm.Path, sm.Commit[:min(12, len(sm.Commit))])
+		}
+	}
 }
 
 // formatGitError provides user-friendly error messages for common git errors
@@ -809,7 +2462,7 @@ func formatGitError(err error, repoURL, branch string) error {
 
 	// Authentication errors
 	if strings.Contains(errStr, "Authentication failed") || strings.Contains(errStr, "Permission denied") {
-		return fmt.Errorf("authentication failed for: %s\n  • For HTTPS: check your credentials or use a personal access token\n  • For SSH: ensure your SSH key is added to your Git provider", repoURL)
+		return fmt.Errorf("%w for: %s\n  • For HTTPS: check your credentials or use a personal access token\n  • For SSH: ensure your SSH key is added to your Git provider", errGitAuthFailed, repoURL)
 	}
 
 	// Network errors
@@ -839,6 +2492,358 @@ func formatGitError(err error, repoURL, branch string) error {
 	return fmt.Errorf("git clone failed: %w", err)
 }
 
+// fetchArchive downloads the repository tree at a ref without git history.
+// It tries the provider's archive endpoint (GitHub/GitLab codeload) or
+// 'git archive --remote', and falls back to a shallow clone when neither is
+// available. Returns true when the workspace was populated from an archive.
+func fetchArchive(ctx context.Context, repoURL, destPath, branch string) (bool, error) {
+	ref, err := resolveArchiveRef(ctx, repoURL, branch)
+	if err != nil {
+		return false, err
+	}
+
+	if archive := archiveURL(repoURL, ref); archive != "" {
+		ui.Status("downloading archive: %s", archive)
+		err = downloadArchive(ctx, archive, destPath)
+	} else {
+		ui.Status("fetching archive with 'git archive' at %s", ref)
+		err = gitArchiveRemote(ctx, repoURL, destPath, ref)
+	}
+	if err == nil {
+		return true, nil
+	}
+	os.RemoveAll(destPath)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	ui.Warning("archive endpoint unavailable (%v), falling back to shallow clone", err)
+	depth := cloneDepth
+	if depth == 0 {
+		depth = 1
+	}
+	return false, gitClone(ctx, repoURL, destPath, branch, depth)
+}
+
+// resolveArchiveRef validates the requested ref against the remote, or resolves
+// the remote's default branch when no ref was given
+func resolveArchiveRef(ctx context.Context, repoURL, branch string) (string, error) {
+	if branch == "" {
+		return resolveDefaultBranch(ctx, repoURL)
+	}
+
+	// Commit SHAs can't be listed by ls-remote; let the archive fetch validate them
+	if commitSHAPattern.MatchString(branch) {
+		return branch, nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--exit-code", repoURL, branch)
+	applyGitEnv(cmd)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ref '%s' not found in repository: %s", branch, repoURL)
+	}
+	return branch, nil
+}
+
+// resolveDefaultBranch asks the remote which branch its HEAD points at
+func resolveDefaultBranch(ctx context.Context, repoURL string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--symref", repoURL, "HEAD")
+	applyGitEnv(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", formatGitError(err, repoURL, "")
+	}
+	ref := parseSymrefHead(string(out))
+	if ref == "" {
+		return "", fmt.Errorf("could not determine default branch of %s; use --branch", repoURL)
+	}
+	return ref, nil
+}
+
+// remoteBranches lists the remote's branches and the one its HEAD points at,
+// which is "" when the server doesn't say
+func remoteBranches(ctx context.Context, repoURL string) (string, []string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--symref", repoURL, "HEAD", "refs/heads/*")
+	applyGitEnv(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, formatGitError(err, repoURL, "")
+	}
+	head, branches := parseRemoteBranches(string(out))
+	return head, branches, nil
+}
+
+// parseRemoteBranches reads 'git ls-remote --symref <url> HEAD refs/heads/*'
+// output into the default branch and the list of branches
+func parseRemoteBranches(output string) (string, []string) {
+	var branches []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/heads/") {
+			branches = append(branches, strings.TrimPrefix(fields[1], "refs/heads/"))
+		}
+	}
+	return parseSymrefHead(output), branches
+}
+
+// pickCloneBranch returns the branch to clone when none was asked for: the
+// remote's default if it has that branch, else the first of fallbacks it
+// has, else "" to leave it to git
+func pickCloneBranch(head string, branches, fallbacks []string) string {
+	exists := make(map[string]bool, len(branches))
+	for _, b := range branches {
+		exists[b] = true
+	}
+	if head != "" && exists[head] {
+		return head
+	}
+	for _, b := range fallbacks {
+		if exists[b] {
+			return b
+		}
+	}
+	return ""
+}
+
+func isBranchMismatchPolicy(policy string) bool {
+	return policy == "warn" || policy == "fail" || policy == "ignore"
+}
+
+// defaultBranchMismatch describes how the remote's default branch differs
+// from the expected one (main or master when none is given), or returns ""
+func defaultBranchMismatch(defaultBranch, expected string) string {
+	if expected != "" {
+		if defaultBranch == expected {
+			return ""
+		}
+		return fmt.Sprintf("remote default branch is '%s', expected '%s'", defaultBranch, expected)
+	}
+	if defaultBranch == "main" || defaultBranch == "master" {
+		return ""
+	}
+	return fmt.Sprintf("remote default branch is '%s', not main or master", defaultBranch)
+}
+
+var commitSHAPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// parseSymrefHead extracts the branch name from 'git ls-remote --symref <url> HEAD' output
+func parseSymrefHead(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "ref: ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "ref: "))
+		if len(fields) > 0 {
+			return strings.TrimPrefix(fields[0], "refs/heads/")
+		}
+	}
+	return ""
+}
+
+// archiveURL returns the tarball URL for a repository at ref on hosts with a
+// known archive endpoint, or "" if the host isn't supported
+func archiveURL(repoURL, ref string) string {
+	host, path := splitRepoHostPath(repoURL)
+	if host == "" || path == "" {
+		return ""
+	}
+
+	switch host {
+	case "github.com":
+		return fmt.Sprintf("https://codeload.github.com/%s/tar.gz/%s", path, ref)
+	case "gitlab.com":
+		name := path[strings.LastIndex(path, "/")+1:]
+		return fmt.Sprintf("https://gitlab.com/%s/-/archive/%s/%s-%s.tar.gz", path, ref, name, strings.ReplaceAll(ref, "/", "-"))
+	}
+	return ""
+}
+
+// splitRepoHostPath splits an HTTPS or SSH repository URL into host and owner/repo path
+func splitRepoHostPath(repoURL string) (string, string) {
+	var host, path string
+	if strings.HasPrefix(repoURL, "git@") {
+		rest := strings.TrimPrefix(repoURL, "git@")
+		parts := strings.SplitN(rest, ":", 2)
+		if len(parts) != 2 {
+			return "", ""
+		}
+		host, path = parts[0], parts[1]
+	} else {
+		parsed, err := url.Parse(repoURL)
+		if err != nil {
+			return "", ""
+		}
+		host, path = parsed.Host, parsed.Path
+	}
+
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, ".git")
+	return strings.ToLower(host), path
+}
+
+// downloadArchive fetches a .tar.gz archive over HTTP and extracts it into destPath
+func downloadArchive(ctx context.Context, archiveURL, destPath string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL, nil)
+	if err != nil {
+		return err
+	}
+	if cloneAuthToken != "" && req.URL.Host == "codeload.github.com" {
+		req.Header.Set("Authorization", "token "+cloneAuthToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("archive request returned %s", resp.Status)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	defer gz.Close()
+
+	return extractTar(gz, destPath, 1)
+}
+
+// gitArchiveRemote uses 'git archive --remote' for hosts that allow it
+func gitArchiveRemote(ctx context.Context, repoURL, destPath, ref string) error {
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar", "--remote="+repoURL, ref)
+	applyGitEnv(cmd)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	extractErr := extractTar(stdout, destPath, 0)
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", redactCloneToken(msg))
+		}
+		return err
+	}
+	return extractErr
+}
+
+// extractTar unpacks a tar stream into destPath, dropping the first strip path
+// components (archive endpoints wrap the tree in a '<repo>-<ref>/' directory)
+func extractTar(r io.Reader, destPath string, strip int) error {
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		parts := strings.Split(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if len(parts) <= strip {
+			continue
+		}
+		rel := filepath.Join(parts[strip:]...)
+		if rel == "" || rel == "." {
+			continue
+		}
+
+		target := filepath.Join(destPath, rel)
+		if !strings.HasPrefix(target, filepath.Clean(destPath)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry escapes workspace: %s", hdr.Name)
+		}
+		// An earlier entry may have made a directory on the way a symlink,
+		// which would carry this one out of the workspace
+		if throughSymlink(destPath, target) {
+			return fmt.Errorf("archive entry escapes workspace through a symlink: %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		case tar.TypeSymlink:
+			if !symlinkStaysInside(destPath, target, hdr.Linkname) {
+				return fmt.Errorf("archive symlink escapes workspace: %s -> %s", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", rel, err)
+			}
+		}
+	}
+}
+
+// throughSymlink reports whether target, or a directory between destPath and
+// target, is a symlink, so writing there wouldn't stay in destPath
+func throughSymlink(destPath, target string) bool {
+	rel, err := filepath.Rel(destPath, target)
+	if err != nil {
+		return true
+	}
+	cur := destPath
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		if info, err := os.Lstat(cur); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkStaysInside reports whether a symlink at target pointing at linkname
+// resolves inside destPath. linkname must be relative, and ".." is only
+// allowed at its start: after a name, which may itself be a symlink, ".."
+// resolves from wherever that leads rather than where it looks.
+func symlinkStaysInside(destPath, target, linkname string) bool {
+	if linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return false
+	}
+	named := false
+	for _, part := range strings.Split(linkname, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if named {
+				return false
+			}
+		default:
+			named = true
+		}
+	}
+	resolved := filepath.Join(filepath.Dir(target), filepath.FromSlash(linkname))
+	root := filepath.Clean(destPath)
+	return resolved == root || strings.HasPrefix(resolved, root+string(os.PathSeparator))
+}
+
 // detectProjectStack analyzes project files to determine the tech stack
 func detectProjectStack(projectPath string) string {
 	// Define detection rules (order matters - more specific first)
@@ -955,7 +2960,7 @@ func detectProjectStack(projectPath string) string {
 }
 
 // detectSetupCommands generates additional setup commands based on detected project files
-func detectSetupCommands(projectPath, template string) []string {
+func detectSetupCommands(projectPath, template string, strippedLockfiles map[string]bool) []string {
 	var commands []string
 
 	// Helper to check if file exists
@@ -963,6 +2968,11 @@ func detectSetupCommands(projectPath, template string) []string {
 		_, err := os.Stat(filepath.Join(projectPath, name))
 		return err == nil
 	}
+	// A lockfile removed by --strip-lockfiles still picks the package
+	// manager, which then resolves versions instead of installing pinned ones
+	hasLock := func(name string) bool {
+		return fileExists(name) || strippedLockfiles[name]
+	}
 
 	switch template {
 	case "python":
@@ -976,9 +2986,9 @@ func detectSetupCommands(projectPath, template string) []string {
 		}
 		// Check for pyproject.toml (poetry or pip)
 		if fileExists("pyproject.toml") {
-			if fileExists("poetry.lock") {
+			if hasLock("poetry.lock") {
 				commands = append(commands, "pip3 install poetry && poetry install")
-			} else if fileExists("pdm.lock") {
+			} else if hasLock("pdm.lock") {
 				commands = append(commands, "pip3 install pdm && pdm install")
 			} else {
 				commands = append(commands, "pip3 install -e .")
@@ -991,13 +3001,19 @@ func detectSetupCommands(projectPath, template string) []string {
 
 	case "nodejs":
 		// Check for package-lock.json (npm)
-		if fileExists("package-lock.json") {
+		if strippedLockfiles["package-lock.json"] {
+			commands = append(commands, "npm install")
+		} else if fileExists("package-lock.json") {
 			commands = append(commands, "npm ci")
+		} else if strippedLockfiles["yarn.lock"] {
+			commands = append(commands, "npm install -g yarn && yarn install")
 		} else if fileExists("yarn.lock") {
 			commands = append(commands, "npm install -g yarn && yarn install --frozen-lockfile")
+		} else if strippedLockfiles["pnpm-lock.yaml"] {
+			commands = append(commands, "npm install -g pnpm && pnpm install")
 		} else if fileExists("pnpm-lock.yaml") {
 			commands = append(commands, "npm install -g pnpm && pnpm install --frozen-lockfile")
-		} else if fileExists("bun.lockb") {
+		} else if hasLock("bun.lockb") {
 			commands = append(commands, "curl -fsSL https://bun.sh/install | bash && bun install")
 		} else if fileExists("package.json") {
 			commands = append(commands, "npm install")
@@ -1089,6 +3105,122 @@ func detectSetupCommands(projectPath, template string) []string {
 	return commands
 }
 
+// stackTestCommands are quick, fail-fast test runs for --post-setup-test
+var stackTestCommands = map[string]string{
+	"python": "pytest -x -q",
+	"nodejs": "npm test",
+	"go":     "go test ./... -count=1 -short",
+	"rust":   "cargo test",
+}
+
+// runPostSetupCommand runs a one-off command given on the command line in
+// the island's working directory once setup is done. A failure is only
+// returned when required; otherwise it is a warning.
+func runPostSetupCommand(islandName, workdir, command string, required bool) error {
+	ui.Status("running post-setup command: %s", command)
+	start := time.Now()
+	err := dockerClient.ExecuteSetupCommandsWithOutput(islandName, []string{"cd " + shellQuote(workdir) + " && " + command}, true)
+	elapsed := time.Since(start).Round(time.Second)
+	ui.Event("post_setup_command", map[string]interface{}{
+		"command":         command,
+		"succeeded":       err == nil,
+		"elapsed_seconds": elapsed.Seconds(),
+	})
+	if err == nil {
+		ui.Success("post-setup command finished in %s", elapsed)
+		return nil
+	}
+	if required {
+		return fmt.Errorf("post-setup command '%s' failed: %w", command, err)
+	}
+	ui.Warning("post-setup command failed after %s: %v", elapsed, err)
+	ui.Info("hint: run it again with 'coderaft run' once you've fixed it, or pass --post-setup-required to fail instead")
+	return nil
+}
+
+// postSetupTestCommand returns the project's test_command, or the command for
+// its stack, or "" when there is nothing to run
+func postSetupTestCommand(stack string, projectConfig *config.ProjectConfig) string {
+	if projectConfig != nil && strings.TrimSpace(projectConfig.TestCommand) != "" {
+		return strings.TrimSpace(projectConfig.TestCommand)
+	}
+	return stackTestCommands[stack]
+}
+
+// runPostSetupTest runs the smoke test in the island's working directory and
+// reports the outcome. The returned error is only fatal with --fail-on-test.
+func runPostSetupTest(islandName, workdir, testCommand string) error {
+	if testCommand == "" {
+		ui.Warning("no test command known for this project; set test_command in coderaft.json to enable --post-setup-test")
+		return nil
+	}
+
+	ui.Status("running post-setup test: %s", testCommand)
+	start := time.Now()
+	err := dockerClient.ExecuteSetupCommandsWithOutput(islandName, []string{"cd " + shellQuote(workdir) + " && " + testCommand}, true)
+	elapsed := time.Since(start).Round(time.Second)
+	ui.Event("post_setup_test", map[string]interface{}{
+		"command":         testCommand,
+		"passed":          err == nil,
+		"elapsed_seconds": elapsed.Seconds(),
+	})
+	if err != nil {
+		ui.Warning("post-setup test failed after %s: %v", elapsed, err)
+		return fmt.Errorf("post-setup test '%s' failed: %w", testCommand, err)
+	}
+	ui.Success("post-setup test passed in %s", elapsed)
+	return nil
+}
+
+// defaultMakeSetupTargets are the Makefile targets treated as a repo's setup
+// entry point, in order of preference
+var defaultMakeSetupTargets = []string{"setup", "bootstrap", "deps", "install-deps", "install", "dev"}
+
+// makeTargetPattern matches a rule line like "setup deps: foo" but not
+// variable assignments such as "CC := gcc"
+var makeTargetPattern = regexp.MustCompile(`^([A-Za-z0-9_.-]+(?:[ \t]+[A-Za-z0-9_.-]+)*)[ \t]*::?(?:[^=]|$)`)
+
+// makeSetupTargets returns settings.make_setup_targets, or the defaults
+func makeSetupTargets(cfg *config.Config) []string {
+	if cfg != nil && cfg.Settings != nil && len(cfg.Settings.MakeSetupTargets) > 0 {
+		return cfg.Settings.MakeSetupTargets
+	}
+	return defaultMakeSetupTargets
+}
+
+// detectMakeSetupCommand returns "make <target>" for the first of targets
+// defined in the project's Makefile, or "" if there is none
+func detectMakeSetupCommand(projectPath string, targets []string) string {
+	var data []byte
+	for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+		if b, err := os.ReadFile(filepath.Join(projectPath, name)); err == nil {
+			data = b
+			break
+		}
+	}
+	if data == nil {
+		return ""
+	}
+
+	defined := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		m := makeTargetPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		for _, target := range strings.Fields(m[1]) {
+			defined[target] = true
+		}
+	}
+
+	for _, target := range targets {
+		if defined[target] {
+			return "make " + target
+		}
+	}
+	return ""
+}
+
 // MonorepoInfo contains information about detected monorepo structure
 type MonorepoInfo struct {
 	IsMonorepo    bool
@@ -1187,11 +3319,13 @@ func detectMonorepo(projectPath string) *MonorepoInfo {
 }
 
 // findWorkspaceDirectories finds common workspace directories
+// workspaceDirNames are the directories monorepos commonly keep packages in
+var workspaceDirNames = []string{"packages", "apps", "libs", "services", "modules", "projects", "crates"}
+
 func findWorkspaceDirectories(projectPath string) []string {
-	commonDirs := []string{"packages", "apps", "libs", "services", "modules", "projects", "crates"}
 	var found []string
 
-	for _, dir := range commonDirs {
+	for _, dir := range workspaceDirNames {
 		dirPath := filepath.Join(projectPath, dir)
 		if info, err := os.Stat(dirPath); err == nil && info.IsDir() {
 			found = append(found, dir)
@@ -0,0 +1,169 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"coderaft/internal/ui"
+)
+
+// errGitAuthFailed is wrapped by formatGitError when git was refused
+// credentials, so clone can tell an authentication failure from the rest
+var errGitAuthFailed = errors.New("authentication failed")
+
+// cloneWithAuthRetry runs clone and, when it fails authenticating to an HTTPS
+// remote and --retry-auth is on, asks for a username and token and runs it
+// once more with those. Credentials saved in the vault for the host are
+// offered first. Without a terminal to prompt on, the original error is
+// returned as is.
+func cloneWithAuthRetry(ctx context.Context, repoURL string, clone func(context.Context) error) error {
+	err := clone(ctx)
+	if err == nil || !shouldRetryAuth(err, repoURL, cloneRetryAuth, term.IsTerminal(int(os.Stdin.Fd()))) {
+		return err
+	}
+	host, _ := splitRepoHostPath(repoURL)
+
+	ui.Warning("authentication to %s failed", host)
+	reader := bufio.NewReader(os.Stdin)
+	user, token, saved := vaultGitCredentials(host)
+	if token == "" {
+		var promptErr error
+		if user, token, promptErr = promptGitCredentials(reader, host); promptErr != nil {
+			ui.Warning("%v", promptErr)
+			return err
+		}
+		if token == "" {
+			return err
+		}
+	}
+
+	cloneAuthEnv = gitBasicAuthEnv(os.Environ(), host, user, token)
+	cloneAuthUser, cloneAuthToken = user, token
+	ui.Status("retrying clone with the credentials for %s", host)
+	if err := clone(ctx); err != nil {
+		return err
+	}
+	if !saved {
+		offerSaveGitCredentials(reader, host, user, token)
+	}
+	return nil
+}
+
+// shouldRetryAuth reports whether a failed clone is worth retrying with
+// prompted credentials: an authentication failure on an HTTPS URL, with
+// --retry-auth on and a terminal to prompt on. SSH failures are left to the
+// user's keys.
+func shouldRetryAuth(err error, repoURL string, enabled, interactive bool) bool {
+	if !enabled || !interactive || !errors.Is(err, errGitAuthFailed) {
+		return false
+	}
+	host, _ := splitRepoHostPath(repoURL)
+	return strings.HasPrefix(repoURL, "https://") && host != ""
+}
+
+// promptGitCredentials asks for a username and token for host. The token is
+// read without echo; a blank username sends the token on its own, which is
+// what GitHub and GitLab personal access tokens expect.
+func promptGitCredentials(reader *bufio.Reader, host string) (string, string, error) {
+	ui.Prompt("Username for https://%s (leave empty for a token): ", host)
+	user, err := reader.ReadString('\n')
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read username: %w", err)
+	}
+	user = strings.TrimSpace(user)
+	if user == "" {
+		user = tokenAuthUser
+	}
+
+	token, err := readSecret(fmt.Sprintf("Password or token for https://%s: ", host))
+	if err != nil {
+		return "", "", err
+	}
+	return user, strings.TrimSpace(token), nil
+}
+
+// readSecret reads a line from the terminal without echoing it
+func readSecret(prompt string) (string, error) {
+	ui.Prompt("%s", prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return string(secret), nil
+}
+
+// gitCredentialsVaultProject is the vault entry clone keeps credentials for
+// host under. The colon keeps it apart from project names.
+func gitCredentialsVaultProject(host string) string {
+	return "git:" + host
+}
+
+// vaultGitCredentials returns the credentials saved in the vault for host, if
+// there are any and the user unlocks it. saved reports whether they came from
+// the vault.
+func vaultGitCredentials(host string) (user, token string, saved bool) {
+	vault, err := openVault()
+	if err != nil || !vault.IsInitialized() || len(vault.List(gitCredentialsVaultProject(host))) == 0 {
+		return "", "", false
+	}
+	ui.Status("the vault has saved credentials for %s", host)
+	password, err := readSecret("Vault password (leave empty to enter credentials instead): ")
+	if err != nil || password == "" {
+		return "", "", false
+	}
+	if err := vault.Unlock(password); err != nil {
+		ui.Warning("failed to unlock vault: %v", err)
+		return "", "", false
+	}
+	project := gitCredentialsVaultProject(host)
+	user, userErr := vault.Get(project, "username")
+	token, tokenErr := vault.Get(project, "token")
+	if userErr != nil || tokenErr != nil || token == "" {
+		return "", "", false
+	}
+	return user, token, true
+}
+
+// offerSaveGitCredentials asks whether to keep credentials that worked in the
+// vault, so the next clone from host can reuse them
+func offerSaveGitCredentials(reader *bufio.Reader, host, user, token string) {
+	vault, err := openVault()
+	if err != nil || !vault.IsInitialized() {
+		ui.Info("hint: run 'coderaft secrets init' to be able to save credentials for reuse")
+		return
+	}
+	ui.Prompt("Save these credentials for %s to the secrets vault? (y/N): ", host)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if response = strings.ToLower(strings.TrimSpace(response)); response != "y" && response != "yes" {
+		return
+	}
+	password, err := readSecret("Vault password: ")
+	if err != nil {
+		ui.Warning("%v", err)
+		return
+	}
+	if err := vault.Unlock(password); err != nil {
+		ui.Warning("failed to unlock vault: %v", err)
+		return
+	}
+	project := gitCredentialsVaultProject(host)
+	if err := vault.Set(project, "username", user); err != nil {
+		ui.Warning("failed to save credentials: %v", err)
+		return
+	}
+	if err := vault.Set(project, "token", token); err != nil {
+		ui.Warning("failed to save credentials: %v", err)
+		return
+	}
+	ui.Success("saved credentials for %s to the vault", host)
+}
@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"coderaft/internal/parallel"
+)
+
+// setupDiagnosticsLines is how much of the setup log and apt's log the
+// report keeps
+const setupDiagnosticsLines = 50
+
+// diagnosticsExecer is the part of DockerEngine the diagnostics need
+type diagnosticsExecer interface {
+	ExecCapture(islandName, command string) (string, string, error)
+}
+
+// diagnosticCheck is one command run in the island for the report
+type diagnosticCheck struct {
+	title   string
+	command string
+}
+
+// setupDiagnosticChecks are the commands run in an island whose setup failed:
+// apt's own log, disk space, and whether the package registries resolve
+func setupDiagnosticChecks(workspaceIsland string) []diagnosticCheck {
+	return []diagnosticCheck{
+		{"apt log", fmt.Sprintf("tail -n %d /var/log/apt/term.log 2>/dev/null || echo 'no apt log'", setupDiagnosticsLines)},
+		{"dpkg errors", "grep -hiE 'error|half-installed|half-configured' /var/log/dpkg.log 2>/dev/null | tail -n 20 || true"},
+		{"disk space", fmt.Sprintf("df -h / %s /tmp", shellQuote(workspaceIsland))},
+		{"network", "for h in deb.debian.org pypi.org registry.npmjs.org proxy.golang.org; do if timeout 5 getent hosts $h >/dev/null; then echo \"$h: resolves\"; else echo \"$h: does not resolve\"; fi; done"},
+	}
+}
+
+// gatherSetupDiagnostics builds the report for an island whose setup failed:
+// the error, the end of the setup log, and the output of each check run in
+// the island. A check that fails to run is noted instead of its output.
+func gatherSetupDiagnostics(client diagnosticsExecer, islandName, workspaceIsland string, setupErr error, setupLog string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "coderaft setup diagnostics for %s\n", islandName)
+	fmt.Fprintf(&b, "generated %s\n\n", time.Now().UTC().Format(time.RFC3339))
+
+	fmt.Fprintf(&b, "== error\n%v\n\n", setupErr)
+
+	fmt.Fprintf(&b, "== setup output (last %d lines)\n", setupDiagnosticsLines)
+	if tail := lastLines(setupLog, setupDiagnosticsLines); tail != "" {
+		b.WriteString(tail + "\n\n")
+	} else {
+		b.WriteString("(no setup output recorded)\n\n")
+	}
+
+	for _, check := range setupDiagnosticChecks(workspaceIsland) {
+		fmt.Fprintf(&b, "== %s\n", check.title)
+		stdout, stderr, err := client.ExecCapture(islandName, check.command)
+		out := strings.TrimSpace(stdout + "\n" + stderr)
+		switch {
+		case err != nil && out == "":
+			fmt.Fprintf(&b, "(could not run: %v)\n\n", err)
+		case out == "":
+			b.WriteString("(no output)\n\n")
+		default:
+			b.WriteString(out + "\n\n")
+		}
+	}
+	return b.String()
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeSetupDiagnostics saves report next to the island's setup log and
+// returns its path
+func writeSetupDiagnostics(islandName, report string, now time.Time) (string, error) {
+	logPath, err := parallel.SetupLogPath(islandName)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(filepath.Dir(logPath), fmt.Sprintf("diagnostics-%s.txt", now.Format("20060102-150405")))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create log directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(report), 0644); err != nil {
+		return "", fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+	return path, nil
+}
+
+// readSetupLog returns the island's setup log, or "" if there is none
+func readSetupLog(islandName string) string {
+	path, err := parallel.SetupLogPath(islandName)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
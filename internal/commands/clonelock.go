@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// cloneLockPath returns the lock file for clones of a project:
+// locks/<project>.clone.lock in coderaft's state directory
+func cloneLockPath(projectName string) (string, error) {
+	return config.StatePath("locks", projectName+".clone.lock")
+}
+
+// lockProjectForClone keeps two clones of the same project from racing on
+// its workspace directory and config entry. It takes the same kind of lock
+// as apply, so a clone that crashes or is killed stops holding it once the
+// lock goes stale. With wait it waits that long for the other clone to
+// finish, telling the user; otherwise it fails right away.
+func lockProjectForClone(projectName, command string, wait time.Duration) (*applyLock, error) {
+	path, err := cloneLockPath(projectName)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := acquireApplyLock(path, command, 0)
+	if errors.Is(err, errApplyInProgress) && wait > 0 {
+		ui.Status("another clone of '%s' is running, waiting up to %s...", projectName, wait)
+		lock, err = acquireApplyLock(path, command, wait)
+	}
+	if errors.Is(err, errApplyInProgress) {
+		return nil, lockHeldError(fmt.Errorf("clone already in progress for project '%s'", projectName), path)
+	}
+	return lock, err
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"coderaft/internal/ui"
+)
+
+// strippedLockfilesNote is the lock file note naming the dependency lockfiles
+// clone --strip-lockfiles removed
+const strippedLockfilesNote = "stripped_lockfiles"
+
+// dependencyLockfiles are the lockfiles clone --strip-lockfiles removes from
+// the top of the checkout so the package manager resolves dependencies again
+var dependencyLockfiles = []string{
+	"package-lock.json",
+	"npm-shrinkwrap.json",
+	"yarn.lock",
+	"pnpm-lock.yaml",
+	"bun.lockb",
+	"poetry.lock",
+	"pdm.lock",
+	"Pipfile.lock",
+	"uv.lock",
+	"Cargo.lock",
+	"Gemfile.lock",
+	"composer.lock",
+	"mix.lock",
+}
+
+// stripLockfiles removes the dependencyLockfiles found in dir and returns the
+// removed names, as a set for detectSetupCommands
+func stripLockfiles(dir string) (map[string]bool, error) {
+	stripped := map[string]bool{}
+	for _, name := range dependencyLockfiles {
+		err := os.Remove(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		stripped[name] = true
+	}
+	return stripped, nil
+}
+
+// strippedLockfileNames lists stripped in dependencyLockfiles order
+func strippedLockfileNames(stripped map[string]bool) []string {
+	var names []string
+	for _, name := range dependencyLockfiles {
+		if stripped[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// noteStrippedLockfiles records in the workspace's lock file which lockfiles
+// were stripped, so whoever reads it knows the versions weren't the pinned ones
+func noteStrippedLockfiles(workspacePath string, stripped map[string]bool) {
+	if len(stripped) == 0 {
+		return
+	}
+	if err := setLockNote(filepath.Join(workspacePath, "coderaft.lock.json"), strippedLockfilesNote, strings.Join(strippedLockfileNames(stripped), ", ")); err != nil {
+		ui.Warning("failed to note the stripped lockfiles in the lock file: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"coderaft/internal/parallel"
+	"coderaft/internal/ui"
+)
+
+// cloneManyTimeout bounds a whole batch of parallel clones. Each clone has
+// its own per-stage deadlines; this only keeps a hung one from blocking the
+// summary forever.
+const cloneManyTimeout = 6 * time.Hour
+
+// cloneManyExclusiveFlags name one project or one terminal, so they can't be
+// shared by several repositories
+var cloneManyExclusiveFlags = []string{"name", "path", "from-pr", "shell-into"}
+
+// cloneMany clones each repository as a 'coderaft clone' of its own, with
+// the same flags, so each goes through the full pipeline into its own island
+// without sharing state with the others. Clones run one at a time with their
+// output shown live, or up to workers at once with each one's output shown
+// when it finishes. A failed clone doesn't stop the rest; the summary lists
+// what failed.
+func cloneMany(cmd *cobra.Command, repos []string, workers int) error {
+	for _, name := range cloneManyExclusiveFlags {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--%s cannot be used when cloning more than one repository", name)
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the coderaft executable: %w", err)
+	}
+	flags := cloneChildFlags(cmd.Flags())
+	childArgs := func(repo string) []string {
+		return append([]string{"clone", repo}, flags...)
+	}
+
+	results := make([]error, len(repos))
+	if workers <= 1 {
+		for i, repo := range repos {
+			ui.Header("==> [%d/%d] %s", i+1, len(repos), repo)
+			child := exec.Command(self, childArgs(repo)...)
+			child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+			results[i] = child.Run()
+			ui.Blank()
+		}
+	} else {
+		ui.Status("cloning %d repositories, %d at a time...", len(repos), workers)
+		var mu sync.Mutex
+		tasks := make([]parallel.Task, len(repos))
+		for i, repo := range repos {
+			tasks[i] = func() error {
+				var out bytes.Buffer
+				child := exec.Command(self, childArgs(repo)...)
+				child.Stdout, child.Stderr = &out, &out
+				err := child.Run()
+				mu.Lock()
+				defer mu.Unlock()
+				ui.Header("==> %s", repo)
+				os.Stdout.Write(out.Bytes())
+				ui.Blank()
+				return err
+			}
+		}
+		results = parallel.NewWorkerPool(workers, cloneManyTimeout).Execute(tasks)
+	}
+
+	failed := 0
+	for i, repo := range repos {
+		if results[i] != nil {
+			ui.Error("%s: %v", repo, results[i])
+			failed++
+		} else {
+			ui.Info("cloned %s", repo)
+		}
+	}
+	ui.Blank()
+	ui.Summary("%d cloned, %d failed", len(repos)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to clone %d of %d repositories", failed, len(repos))
+	}
+	return nil
+}
+
+// cloneChildFlags are the flags each clone of a batch is given: everything
+// set on the command line except --parallel
+func cloneChildFlags(flags *pflag.FlagSet) []string {
+	return visitedFlagArgs(flags, map[string]bool{"parallel": true})
+}
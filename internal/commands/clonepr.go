@@ -0,0 +1,144 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"coderaft/internal/ui"
+)
+
+// githubAPIURL is where clone --from-pr looks up a pull request's base branch
+const githubAPIURL = "https://api.github.com"
+
+// pullRequestRef is a GitHub pull request given to clone --from-pr
+type pullRequestRef struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+var pullRequestShorthand = regexp.MustCompile(`^([A-Za-z0-9_.-]+)/([A-Za-z0-9_.-]+)#([0-9]+)$`)
+
+// parsePullRequestRef reads owner/repo#123 or a github.com pull request URL
+// such as https://github.com/owner/repo/pull/123/files
+func parsePullRequestRef(s string) (*pullRequestRef, error) {
+	s = strings.TrimSpace(s)
+	if m := pullRequestShorthand.FindStringSubmatch(s); m != nil {
+		return newPullRequestRef(m[1], strings.TrimSuffix(m[2], ".git"), m[3])
+	}
+
+	raw := s
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	if u, err := url.Parse(raw); err == nil {
+		host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) >= 4 && parts[2] == "pull" {
+			if host != "github.com" {
+				return nil, fmt.Errorf("invalid --from-pr '%s': only GitHub pull requests are supported", s)
+			}
+			return newPullRequestRef(parts[0], parts[1], parts[3])
+		}
+	}
+	return nil, fmt.Errorf("invalid --from-pr '%s' (expected owner/repo#123 or a GitHub pull request URL)", s)
+}
+
+func newPullRequestRef(owner, repo, number string) (*pullRequestRef, error) {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid pull request number '%s'", number)
+	}
+	return &pullRequestRef{Owner: owner, Repo: repo, Number: n}, nil
+}
+
+// RepoURL is the repository the pull request was opened against
+func (pr *pullRequestRef) RepoURL() string {
+	return "https://github.com/" + pr.Owner + "/" + pr.Repo
+}
+
+// Branch is the local branch the pull request's head is checked out as
+func (pr *pullRequestRef) Branch() string {
+	return fmt.Sprintf("pr-%d", pr.Number)
+}
+
+// ProjectName is the default project name for a review island, e.g.
+// react-pr-12345
+func (pr *pullRequestRef) ProjectName() string {
+	return strings.Trim(nameFieldUnsafe.ReplaceAllString(pr.Repo, "-"), "-_") + "-" + pr.Branch()
+}
+
+func (pr *pullRequestRef) String() string {
+	return fmt.Sprintf("%s/%s#%d", pr.Owner, pr.Repo, pr.Number)
+}
+
+// pullRequestBase asks the GitHub API which branch the pull request targets
+func pullRequestBase(ctx context.Context, pr *pullRequestRef) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	apiURL := fmt.Sprintf("%s/repos/%s/%s/pulls/%d", githubAPIURL, pr.Owner, pr.Repo, pr.Number)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if cloneAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cloneAuthToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub API returned %s", resp.Status)
+	}
+	var body struct {
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid GitHub API response: %w", err)
+	}
+	if body.Base.Ref == "" {
+		return "", fmt.Errorf("GitHub API response has no base branch")
+	}
+	return body.Base.Ref, nil
+}
+
+// checkoutPullRequest fetches the pull request's head and its base branch
+// into a fresh clone and checks the head out as pr-<number>, returning the
+// base branch. When the API can't name the base, the default branch the
+// clone checked out stands in for it.
+func checkoutPullRequest(ctx context.Context, repoPath string, pr *pullRequestRef) (string, error) {
+	base, err := pullRequestBase(ctx, pr)
+	if err != nil {
+		if base, _ = cloneGit(ctx, repoPath, "rev-parse", "--abbrev-ref", "HEAD"); base == "" || base == "HEAD" {
+			return "", fmt.Errorf("failed to look up the base branch of %s: %w", pr, err)
+		}
+		ui.Warning("failed to look up the base branch of %s (%v); using the default branch %s", pr, err, base)
+	}
+
+	fetch := []string{"fetch", "--quiet", "origin",
+		fmt.Sprintf("+refs/pull/%d/head:refs/heads/%s", pr.Number, pr.Branch()),
+		fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", base, base),
+	}
+	if cloneDepth > 0 {
+		fetch = append(fetch, "--depth", strconv.Itoa(cloneDepth))
+	}
+	if _, err := cloneGit(ctx, repoPath, fetch...); err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %w", pr, err)
+	}
+	if _, err := cloneGit(ctx, repoPath, "checkout", "--quiet", pr.Branch()); err != nil {
+		return "", fmt.Errorf("failed to check out %s: %w", pr, err)
+	}
+	return base, nil
+}
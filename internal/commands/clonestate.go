@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"coderaft/internal/ui"
+)
+
+// cloneStateFile records, relative to the workspace, what a clone was made
+// from so 'coderaft reclone' can make it again
+const cloneStateFile = bootstrapDir + "/state.json"
+
+const cloneStateVersion = 1
+
+// cloneStateSkipFlags are clone flags that only change how a clone reports
+// or prompts, run one-off steps, or that reclone sets itself, so they aren't
+// recorded
+var cloneStateSkipFlags = map[string]bool{
+	"force":               true,
+	"name":                true,
+	"parallel":            true,
+	"post-setup-command":  true,
+	"post-setup-required": true,
+	"progress":            true,
+	"quiet-git":           true,
+	"retry-auth":          true,
+	"shell-into":          true,
+}
+
+// Set by reclone to check out the recorded commit and use the recorded image
+// instead of whatever the branch and the image tag point at now
+var (
+	clonePinCommit string
+	clonePinImage  string
+)
+
+// cloneState is the inputs a clone was made from. The lock file records the
+// island that came out of it; this records what went in.
+type cloneState struct {
+	Version int    `json:"version"`
+	Project string `json:"project"`
+	// Repo is the normalized repository URL or source archive URL
+	Repo   string `json:"repo"`
+	Branch string `json:"branch,omitempty"`
+	// Commit is HEAD right after cloning; archives without history have none
+	Commit      string   `json:"commit,omitempty"`
+	Stack       string   `json:"stack,omitempty"`
+	Stacks      []string `json:"stacks,omitempty"`
+	Image       string   `json:"image,omitempty"`
+	ImageDigest string   `json:"image_digest,omitempty"`
+	// Flags are the clone flags given on the command line, as --name=value
+	Flags    []string  `json:"flags,omitempty"`
+	ClonedAt time.Time `json:"cloned_at"`
+	Coderaft string    `json:"coderaft_version,omitempty"`
+}
+
+// cloneStateFlags returns the flags set on the command line as --name=value
+// arguments, sorted, with repeatable flags once per value
+func cloneStateFlags(flags *pflag.FlagSet) []string {
+	return visitedFlagArgs(flags, cloneStateSkipFlags)
+}
+
+// visitedFlagArgs returns the flags set on the command line, except those in
+// skip, as sorted --name=value arguments with repeatable flags once per value
+func visitedFlagArgs(flags *pflag.FlagSet, skip map[string]bool) []string {
+	var args []string
+	flags.Visit(func(f *pflag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range slice.GetSlice() {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	sort.Strings(args)
+	return args
+}
+
+// hasCloneFlag reports whether args sets any of the named flags
+func hasCloneFlag(args []string, names ...string) bool {
+	for _, arg := range args {
+		for _, name := range names {
+			if arg == "--"+name || strings.HasPrefix(arg, "--"+name+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gitHeadCommit returns the commit checked out in repoPath, or "" if it
+// isn't a git checkout
+func gitHeadCommit(repoPath string) string {
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeCloneState saves state to the workspace's .coderaft/state.json and
+// keeps it out of git, since it describes this machine's clone rather than
+// the repository
+func writeCloneState(workspacePath string, state *cloneState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(workspacePath, cloneStateFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", bootstrapDir, err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", cloneStateFile, err)
+	}
+	return excludeFromGit(workspacePath, "/"+cloneStateFile)
+}
+
+// readCloneState loads the workspace's .coderaft/state.json
+func readCloneState(workspacePath string) (*cloneState, error) {
+	data, err := os.ReadFile(filepath.Join(workspacePath, cloneStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var state cloneState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", cloneStateFile, err)
+	}
+	if state.Version > cloneStateVersion {
+		return nil, fmt.Errorf("%s is version %d; this coderaft reads up to version %d", cloneStateFile, state.Version, cloneStateVersion)
+	}
+	if state.Repo == "" {
+		return nil, fmt.Errorf("invalid %s: no repository recorded", cloneStateFile)
+	}
+	return &state, nil
+}
+
+// recordCloneState writes the state file, warning rather than failing the
+// clone when it can't
+func recordCloneState(workspacePath string, state *cloneState) {
+	if err := writeCloneState(workspacePath, state); err != nil {
+		ui.Warning("failed to record clone state: %v", err)
+	}
+}
+
+// excludeFromGit adds pattern to the repository's .git/info/exclude, once.
+// Checkouts without a .git directory are left alone.
+func excludeFromGit(repoPath, pattern string) error {
+	gitDir := filepath.Join(repoPath, ".git")
+	if info, err := os.Stat(gitDir); err != nil || !info.IsDir() {
+		return nil
+	}
+	path := filepath.Join(gitDir, "info", "exclude")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	data = append(data, pattern+"\n"...)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// checkoutPinnedCommit checks out commit in a fresh clone, fetching it first
+// when a shallow or single-branch clone didn't bring it along
+func checkoutPinnedCommit(ctx context.Context, repoPath, commit string) error {
+	if _, err := cloneGit(ctx, repoPath, "cat-file", "-e", commit+"^{commit}"); err != nil {
+		fetch := []string{"fetch", "--quiet", "origin", commit}
+		if shallow, _ := cloneGit(ctx, repoPath, "rev-parse", "--is-shallow-repository"); shallow == "true" {
+			fetch = append(fetch, "--depth", "1")
+		}
+		if _, err := cloneGit(ctx, repoPath, fetch...); err != nil {
+			return fmt.Errorf("failed to fetch commit %s: %w", commit, err)
+		}
+	}
+	if _, err := cloneGit(ctx, repoPath, "checkout", "--quiet", "--detach", commit); err != nil {
+		return fmt.Errorf("failed to check out commit %s: %w", commit, err)
+	}
+	return nil
+}
+
+// cloneGit runs git in a fresh clone with the clone's environment, returning
+// its trimmed output. Errors carry the end of git's stderr, token redacted.
+func cloneGit(ctx context.Context, repoPath string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoPath}, args...)...)
+	applyGitEnv(cmd)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if tail := gitStderrTail(stderr.String(), 5); tail != "" {
+			return "", fmt.Errorf("%w\n%s", err, redactCloneToken(tail))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
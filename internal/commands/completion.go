@@ -97,6 +97,8 @@ func init() {
 
 	shellCmd.ValidArgsFunction = getProjectNames
 	runCmd.ValidArgsFunction = getProjectNames
+	searchCmd.ValidArgsFunction = getProjectNames
+	installCmd.ValidArgsFunction = getProjectNames
 	stopCmd.ValidArgsFunction = getProjectNames
 	destroyCmd.ValidArgsFunction = getProjectNames
 	lockCmd.ValidArgsFunction = getProjectNames
@@ -105,6 +107,8 @@ func init() {
 	applyCmd.ValidArgsFunction = getProjectNames
 	verifyCmd.ValidArgsFunction = getProjectNames
 	statusCmd.ValidArgsFunction = getProjectNames
+	logsCmd.ValidArgsFunction = getProjectNames
+	rebuildCmd.ValidArgsFunction = getProjectNames
 
 	templatesShowCmd.ValidArgsFunction = getTemplateNames
 	templatesDeleteCmd.ValidArgsFunction = getTemplateNames
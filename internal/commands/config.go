@@ -1,18 +1,23 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"coderaft/internal/config"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
 var configForce bool
+var configJSON bool
 
 var configCmd = &cobra.Command{
 	Use:   "config <command>",
@@ -21,11 +26,12 @@ var configCmd = &cobra.Command{
 
 Available commands:
   generate <project>    Generate coderaft.json for project
-  validate <project>    Validate project configuration
+  validate [path]       Check a coderaft.json (file, directory or project; default: current directory)
 	schema                Print JSON Schema for coderaft.json
   show <project>        Show project configuration
   templates             List available templates
-  global               Show global configuration`,
+  global               Show global configuration
+  migrate [project]     Upgrade the global config and lock files to the current format`,
 	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		subCommand := args[0]
@@ -37,10 +43,11 @@ Available commands:
 			}
 			return generateProjectConfig(args[1])
 		case "validate":
-			if len(args) < 2 {
-				return fmt.Errorf("project name required for validate command")
+			target := ""
+			if len(args) > 1 {
+				target = args[1]
 			}
-			return validateProjectConfig(args[1])
+			return validateProjectConfig(target)
 		case "schema":
 			fmt.Println(config.ProjectConfigJSONSchema)
 			return nil
@@ -53,6 +60,12 @@ Available commands:
 			return showTemplates()
 		case "global":
 			return showGlobalConfig()
+		case "migrate":
+			project := ""
+			if len(args) > 1 {
+				project = args[1]
+			}
+			return migrateConfigFiles(project)
 		default:
 			return fmt.Errorf("unknown config command: %s", subCommand)
 		}
@@ -71,7 +84,7 @@ func generateProjectConfig(projectName string) error {
 
 	project, exists := cfg.GetProject(projectName)
 	if !exists {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	configPath := filepath.Join(project.WorkspacePath, "coderaft.json")
@@ -95,39 +108,92 @@ func generateProjectConfig(projectName string) error {
 	return nil
 }
 
-func validateProjectConfig(projectName string) error {
-	if err := validateProjectName(projectName); err != nil {
-		return err
+// configValidateReport is what 'config validate --json' prints
+type configValidateReport struct {
+	Path     string   `json:"path"`
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
+
+// resolveConfigFile finds the coderaft.json 'config validate' checks: the
+// given file, the config file in the given directory, or the workspace of
+// the named project. With no target it looks in the current directory.
+func resolveConfigFile(target string) (string, error) {
+	dir := target
+	if target == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get current directory: %w", err)
+		}
+		dir = wd
+	} else if info, err := os.Stat(target); err == nil {
+		if !info.IsDir() {
+			return target, nil
+		}
+	} else if validateProjectName(target) == nil {
+		cfg, err := configManager.Load()
+		if err != nil {
+			return "", fmt.Errorf("failed to load configuration: %w", err)
+		}
+		project, exists := cfg.GetProject(target)
+		if !exists {
+			return "", errdefs.Errorf(errdefs.ErrProjectNotFound, "'%s' is neither a file, a directory nor a project", target)
+		}
+		dir = project.WorkspacePath
+	} else {
+		return "", fmt.Errorf("'%s' not found: %w", target, err)
 	}
 
-	cfg, err := configManager.Load()
-	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
+	path := config.FindProjectConfigFile(dir)
+	if path == "" {
+		return "", fmt.Errorf("no coderaft.json found in %s", dir)
 	}
+	return path, nil
+}
 
-	project, exists := cfg.GetProject(projectName)
-	if !exists {
-		return fmt.Errorf("project '%s' not found", projectName)
+func validateProjectConfig(target string) error {
+	if configJSON {
+		// keep stdout for the report
+		if err := ui.SetProgressMode(ui.ProgressJSON); err != nil {
+			return err
+		}
 	}
 
-	projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
+	path, err := resolveConfigFile(target)
 	if err != nil {
-		return fmt.Errorf("failed to load project configuration: %w", err)
+		return err
+	}
+	problems, err := configManager.ValidateProjectConfigFile(path)
+	if err != nil {
+		return err
 	}
 
-	if projectConfig == nil {
-		ui.Info("no coderaft.json found for project '%s'", projectName)
-		ui.Info("generate one with: coderaft config generate %s", projectName)
-		return nil
+	if configJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(configValidateReport{Path: path, Valid: len(problems) == 0, Problems: append([]string{}, problems...)}); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+	if len(problems) > 0 {
+		if !configJSON {
+			ui.Error("%s has %d problem(s):", path, len(problems))
+			for _, p := range problems {
+				ui.Item(p)
+			}
+		}
+		return fmt.Errorf("project config validation failed: %d problem(s) in %s", len(problems), filepath.Base(path))
 	}
 
-	if err := configManager.ValidateProjectConfig(projectConfig); err != nil {
-		ui.Error("configuration validation failed:")
-		ui.Item(err.Error())
-		return fmt.Errorf("project config validation failed: %w", err)
+	if configJSON {
+		return nil
 	}
+	ui.Success("%s is valid", path)
 
-	ui.Success("configuration for project '%s' is valid", projectName)
+	// the file has just been validated, so it parses
+	var projectConfig config.ProjectConfig
+	data, _ := os.ReadFile(path)
+	_ = json.Unmarshal(data, &projectConfig)
 
 	ui.Blank()
 	ui.Header("configuration summary")
@@ -165,7 +231,7 @@ func showProjectConfig(projectName string) error {
 
 	project, exists := cfg.GetProject(projectName)
 	if !exists {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
@@ -334,6 +400,12 @@ func showGlobalConfig() error {
 		if cfg.Settings.ConfigTemplatesPath != "" {
 			ui.Detail("templates path", cfg.Settings.ConfigTemplatesPath)
 		}
+		if cfg.Settings.DotfilesRepo != "" {
+			ui.Detail("dotfiles repo", cfg.Settings.DotfilesRepo)
+		}
+		if cfg.Settings.RecipeSource != "" {
+			ui.Detail("recipe source", cfg.Settings.RecipeSource)
+		}
 
 		if len(cfg.Settings.DefaultEnvironment) > 0 {
 			ui.Info("default environment:")
@@ -353,6 +425,85 @@ func showGlobalConfig() error {
 	return nil
 }
 
+// migrateConfigFiles upgrades the global config and the lock files of every
+// project (or just one) in place, keeping a backup of each file it rewrites
+func migrateConfigFiles(projectName string) error {
+	var migrated, current int
+
+	migrate := func(path string, perm os.FileMode, fn func([]byte) ([]byte, []string, error)) error {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		out, changes, err := fn(data)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", path, err)
+		}
+		if len(changes) == 0 {
+			ui.Status("%s is already current", path)
+			current++
+			return nil
+		}
+		backup := fmt.Sprintf("%s.bak-%s", path, time.Now().Format("20060102-150405"))
+		if err := os.WriteFile(backup, data, perm); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+		if err := os.WriteFile(path, out, perm); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		ui.Success("migrated %s (backup: %s)", path, backup)
+		for _, c := range changes {
+			ui.Item(c)
+		}
+		migrated++
+		return nil
+	}
+
+	if projectName == "" {
+		if err := migrate(configManager.ConfigPath(), 0600, config.MigrateConfig); err != nil {
+			return err
+		}
+	} else if err := validateProjectName(projectName); err != nil {
+		return err
+	}
+
+	cfg, err := configManager.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	var names []string
+	if projectName != "" {
+		if _, ok := cfg.GetProject(projectName); !ok {
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+		}
+		names = []string{projectName}
+	} else {
+		for name := range cfg.GetProjects() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		project, _ := cfg.GetProject(name)
+		if project.WorkspacePath == "" {
+			continue
+		}
+		lockPath := filepath.Join(project.WorkspacePath, "coderaft.lock.json")
+		if err := migrate(lockPath, 0644, migrateLockData); err != nil {
+			return err
+		}
+	}
+
+	ui.Summary("%d migrated, %d already current", migrated, current)
+	return nil
+}
+
 func init() {
 	configCmd.Flags().BoolVarP(&configForce, "force", "f", false, "Force operation, overwriting existing files")
+	configCmd.Flags().BoolVar(&configJSON, "json", false, "With validate, print the result as JSON on stdout")
 }
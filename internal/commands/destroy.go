@@ -11,6 +11,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
@@ -49,7 +50,7 @@ Special usage:
 
 		project, exists := cfg.GetProject(projectName)
 		if !exists {
-			return fmt.Errorf("project '%s' not found", projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 		}
 
 		if !destroyForce {
@@ -10,6 +10,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
@@ -40,7 +41,7 @@ func runDiff(projectName string) error {
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	lockPath := filepath.Join(proj.WorkspacePath, "coderaft.lock.json")
@@ -58,7 +59,7 @@ func runDiff(projectName string) error {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found — run 'coderaft up %s' first", proj.IslandName, projectName)
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found — run 'coderaft up %s' first", proj.IslandName, projectName)
 	}
 	status, err := dockerClient.GetIslandStatus(proj.IslandName)
 	if err != nil {
@@ -71,6 +72,7 @@ func runDiff(projectName string) error {
 	}
 
 	envMap, workdir, user, restart, labels, capabilities, resources, network := dockerClient.GetContainerMeta(proj.IslandName)
+	envMap, labels = withoutSecretEnv(envMap, labels)
 	livePorts, _ := dockerClient.GetPortMappings(proj.IslandName)
 	liveMounts, _ := dockerClient.GetMounts(proj.IslandName)
 	liveDigest, _, _ := dockerClient.GetImageDigestInfo(lf.BaseImage.Name)
@@ -78,6 +80,7 @@ func runDiff(projectName string) error {
 	pipIndex, pipExtras := dockerClient.GetPipRegistries(proj.IslandName)
 	npmReg, yarnReg, pnpmReg := dockerClient.GetNodeRegistries(proj.IslandName)
 	aptList, pipList, npmList, yarnList, pnpmList := dockerClient.QueryPackagesParallel(proj.IslandName)
+	_, apkList := dockerClient.QuerySystemPackages(proj.IslandName)
 
 	var sections []string
 
@@ -105,18 +108,20 @@ func runDiff(projectName string) error {
 		sections = append(sections, sec)
 	}
 
+	exclude := newPackageExclusions(cfg.Settings)
 	for _, pm := range []struct {
 		name, sep string
 		locked    []string
 		live      []string
 	}{
 		{"apt", "=", lf.Packages.Apt, aptList},
+		{"apk", "=", lf.Packages.Apk, apkList},
 		{"pip", "==", lf.Packages.Pip, pipList},
 		{"npm", "@", lf.Packages.Npm, npmList},
 		{"yarn", "@", lf.Packages.Yarn, yarnList},
 		{"pnpm", "@", lf.Packages.Pnpm, pnpmList},
 	} {
-		drifts := packageDiff(pm.name, pm.sep, pm.locked, pm.live)
+		drifts := packageDiff(pm.name, pm.sep, pm.locked, pm.live, exclude)
 		if len(drifts) > 0 {
 			sections = append(sections, strings.Join(drifts, "\n"))
 		}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+
+	"coderaft/internal/config"
+)
+
+// direnvFile is the file direnv loads the environment from
+const direnvFile = ".envrc"
+
+// hasDirenvFile reports whether the workspace the island sees has an .envrc
+// at its root
+func hasDirenvFile(workspaceHost string) bool {
+	info, err := os.Stat(filepath.Join(workspaceHost, direnvFile))
+	return err == nil && !info.IsDir()
+}
+
+// direnvSetupCommand installs direnv in the island unless the image already
+// has it. The island's bashrc hooks it in once it's installed.
+func direnvSetupCommand() string {
+	return "command -v direnv >/dev/null 2>&1 || { " + islandInstallScript("direnv") + "; }"
+}
+
+// addDirenvSetup adds the direnv install to the project's setup commands,
+// once, reporting whether it was added
+func addDirenvSetup(projectConfig *config.ProjectConfig) bool {
+	cmd := direnvSetupCommand()
+	if slices.Contains(projectConfig.SetupCommands, cmd) {
+		return false
+	}
+	projectConfig.SetupCommands = append(projectConfig.SetupCommands, cmd)
+	return true
+}
+
+// direnvAllowCommand trusts the .envrc in the island's working directory.
+// direnv keeps the approval inside the island, so it doesn't outlive it.
+func direnvAllowCommand(workdir string) string {
+	return "cd " + shellQuote(workdir) + " && direnv allow ."
+}
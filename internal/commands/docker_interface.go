@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"coderaft/internal/docker"
@@ -12,6 +13,7 @@ type DockerEngine interface {
 	IsDockerAvailableWith() error
 
 	PullImage(ref string) error
+	PullImageWithPolicy(ref, policy string) error
 	ImageExists(ref string) bool
 	GetImageDigestInfo(ref string) (digest string, imageID string, err error)
 	CommitContainer(containerName, imageTag string) (string, error)
@@ -31,22 +33,37 @@ type DockerEngine interface {
 	GetContainerID(islandName string) (string, error)
 	GetContainerStats(islandName string) (*docker.ContainerStats, error)
 	GetUptime(islandName string) (time.Duration, error)
+	GetHealthStatus(islandName string) (docker.HealthStatus, error)
 	GetPortMappings(islandName string) ([]string, error)
 	GetMounts(islandName string) ([]string, error)
 	GetContainerMeta(islandName string) (env map[string]string, workdir, user, restart string, labels map[string]string, capabilities []string, resources map[string]string, network string)
 	IsIslandInitialized(islandName string) bool
 	IsContainerIdle(islandName string) (bool, error)
+	GetIslandGeneration(islandName string) (string, error)
+	PackageStateMarker(islandName string) (string, error)
 
 	GetAptSources(islandName string) (snapshotURL string, sources []string, release string)
+	GetAptPreferences(islandName string) map[string]string
+	GetSystemSettings(islandName string) docker.SystemSettings
+	GetFileChecksums(islandName string, patterns []string) map[string]string
+	GetIslandFiles(islandName string, patterns []string) (map[string]string, error)
+	StartBackgroundSetup(islandName string, commands []string) error
+	GetSetupState(islandName string) docker.SetupState
+	IslandLogs(islandName string, opts docker.LogOptions, stdout, stderr io.Writer) error
 	GetPipRegistries(islandName string) (indexURL string, extra []string)
 	GetNodeRegistries(islandName string) (npmReg, yarnReg, pnpmReg string)
 	QueryPackagesParallel(islandName string) (aptList, pipList, npmList, yarnList, pnpmList []string)
 	QueryAllPackages(islandName string) *docker.PackageLists
+	QuerySystemPackages(islandName string) (docker.SystemPackages, []string)
 
 	SetupCoderaftOnIsland(islandName, projectName string) error
 	SetupCoderaftOnIslandWithUpdate(islandName, projectName string) error
 	ExecuteSetupCommandsWithOutput(islandName string, commands []string, showOutput bool) error
+	ExecuteSetupCommandsWithWorkers(islandName string, commands []string, showOutput bool, workers int) error
+	ExecuteSetupCommandsWithProgress(islandName string, commands []string, workers int, onDone func(command string)) error
 	ExecCapture(islandName, command string) (stdout string, stderr string, err error)
+	CopyFromIsland(islandName, srcPath, destPath string) (int, error)
+	ExpandIslandPaths(islandName, pattern string) ([]string, error)
 	RunDockerCommand(args []string) error
 	SDKExecFunc() func(ctx context.Context, containerID string, cmd []string, showOutput bool) (string, string, int, error)
 }
@@ -0,0 +1,481 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/config"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/ui"
+)
+
+var (
+	doctorFix       bool
+	doctorYes       bool
+	doctorContainer string
+)
+
+// doctorProbeHost is looked up and fetched from inside an island to check its
+// DNS and outbound HTTPS
+const doctorProbeHost = "github.com"
+
+// stackToolchains are the commands an island of each stack should have; "a|b"
+// accepts either one
+var stackToolchains = map[string][]string{
+	"python": {"python3", "pip3|pip"},
+	"nodejs": {"node", "npm"},
+	"web":    {"node", "npm"},
+	"go":     {"go"},
+	"rust":   {"cargo", "rustc"},
+	"java":   {"java", "mvn|gradle"},
+	"ruby":   {"ruby", "gem", "bundle"},
+	"php":    {"php", "composer"},
+	"dotnet": {"dotnet"},
+	"elixir": {"elixir", "mix"},
+}
+
+// islandProber is the part of the Docker client the in-island checks need
+type islandProber interface {
+	GetIslandStatus(islandName string) (string, error)
+	ExecCapture(islandName, command string) (string, string, error)
+}
+
+// doctorIssue is a problem found by doctor. Fix is nil when the issue can't be
+// repaired automatically; Confirm is set for fixes that discard something.
+type doctorIssue struct {
+	Check   string
+	Problem string
+	Hint    string
+	Confirm string
+	Fix     func() (string, error)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose and repair the local coderaft setup",
+	Long: `Check the local tooling and configuration coderaft depends on and report
+anything that is broken.
+
+Checks Docker, git, the global config file, the workspace root, and every
+tracked project's workspace directory, base image, and island state.
+
+With --container <project>, checks inside that project's island instead:
+the coderaft wrapper is installed and initialized, the workspace is mounted
+and writable, DNS and outbound HTTPS work, and the stack's tools (python3
+and pip, node and npm, go, ...) are on PATH. The probes only read, and
+each takes a few seconds at most.
+
+With --fix, safe repairs are applied automatically:
+  - create a missing workspace root or project workspace
+  - pull a missing base image
+  - start a stopped island that is still tracked
+  - replace an unreadable config file with an empty one (after backing it up;
+    asks for confirmation unless --yes is given)
+
+Examples:
+  coderaft doctor
+  coderaft doctor --fix
+  coderaft doctor --fix --yes
+  coderaft doctor --container myproject`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var issues []doctorIssue
+		if doctorContainer != "" {
+			var err error
+			if issues, err = runIslandDoctorChecks(doctorContainer); err != nil {
+				return err
+			}
+		} else {
+			issues = runDoctorChecks()
+		}
+
+		if len(issues) == 0 {
+			ui.Success("no problems found")
+			return nil
+		}
+
+		ui.Header("found %d problem(s):", len(issues))
+		for _, issue := range issues {
+			ui.Item("%s: %s", issue.Check, issue.Problem)
+		}
+		ui.Blank()
+
+		if !doctorFix {
+			for _, issue := range issues {
+				if issue.Hint != "" {
+					ui.Info("hint: %s", issue.Hint)
+				}
+			}
+			ui.Info("hint: run 'coderaft doctor --fix' to repair what can be fixed automatically.")
+			return fmt.Errorf("%d problem(s) found", len(issues))
+		}
+
+		var fixed, skipped, failed int
+		for _, issue := range issues {
+			if issue.Fix == nil {
+				ui.Warning("cannot fix automatically: %s: %s", issue.Check, issue.Problem)
+				if issue.Hint != "" {
+					ui.Info("hint: %s", issue.Hint)
+				}
+				skipped++
+				continue
+			}
+			if issue.Confirm != "" && !doctorYes && !confirmDoctorFix(issue.Confirm) {
+				ui.Info("skipped: %s", issue.Check)
+				skipped++
+				continue
+			}
+			msg, err := issue.Fix()
+			if err != nil {
+				ui.Error("failed to fix %s: %v", issue.Check, err)
+				failed++
+				continue
+			}
+			ui.Success("%s", msg)
+			fixed++
+		}
+
+		ui.Blank()
+		ui.Summary("%d fixed, %d skipped, %d failed", fixed, skipped, failed)
+		if skipped > 0 || failed > 0 {
+			return fmt.Errorf("%d problem(s) remain", skipped+failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorFix, "fix", false, "Attempt safe automatic repairs")
+	doctorCmd.Flags().BoolVarP(&doctorYes, "yes", "y", false, "Apply fixes that need confirmation without prompting")
+	doctorCmd.Flags().StringVar(&doctorContainer, "container", "", "Diagnose inside this project's island instead of the host")
+}
+
+func runDoctorChecks() []doctorIssue {
+	var issues []doctorIssue
+
+	if dockerClient == nil {
+		issues = append(issues, doctorIssue{
+			Check:   "docker",
+			Problem: "Docker is not available",
+			Hint:    "start Docker (or Docker Desktop) and re-run 'coderaft doctor'",
+		})
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		issues = append(issues, doctorIssue{
+			Check:   "git",
+			Problem: "git is not installed or not in PATH",
+			Hint:    "install git; 'coderaft clone' needs it",
+		})
+	}
+
+	cfg, err := configManager.Load()
+	if err != nil {
+		issues = append(issues, doctorIssue{
+			Check:   "config",
+			Problem: err.Error(),
+			Confirm: fmt.Sprintf("Replace %s with an empty config (a backup is kept)? (y/N): ", configManager.ConfigPath()),
+			Fix: func() (string, error) {
+				backup, err := resetCorruptConfig(configManager.ConfigPath())
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("config reset, previous file saved as %s", backup), nil
+			},
+		})
+		cfg = nil
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		root := filepath.Join(home, "coderaft")
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			issues = append(issues, doctorIssue{
+				Check:   "workspace root",
+				Problem: fmt.Sprintf("%s does not exist", root),
+				Fix: func() (string, error) {
+					if err := os.MkdirAll(root, 0755); err != nil {
+						return "", err
+					}
+					return fmt.Sprintf("created %s", root), nil
+				},
+			})
+		}
+	}
+
+	if cfg != nil {
+		issues = append(issues, doctorProjectIssues(cfg)...)
+	}
+
+	return issues
+}
+
+func doctorProjectIssues(cfg *config.Config) []doctorIssue {
+	var issues []doctorIssue
+
+	projects := cfg.GetProjects()
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pulled := map[string]bool{}
+	for _, name := range names {
+		project := projects[name]
+		check := fmt.Sprintf("project '%s'", name)
+
+		if project.WorkspacePath != "" {
+			if _, err := os.Stat(project.WorkspacePath); os.IsNotExist(err) {
+				path := project.WorkspacePath
+				issues = append(issues, doctorIssue{
+					Check:   check,
+					Problem: fmt.Sprintf("workspace %s is missing", path),
+					Fix: func() (string, error) {
+						if err := os.MkdirAll(path, 0755); err != nil {
+							return "", err
+						}
+						return fmt.Sprintf("created workspace %s", path), nil
+					},
+				})
+			}
+		}
+
+		if dockerClient == nil {
+			continue
+		}
+
+		projectConfig, _ := configManager.LoadProjectConfig(project.WorkspacePath)
+		image := cfg.GetEffectiveBaseImage(project, projectConfig)
+		if image != "" && !pulled[image] && !dockerClient.ImageExists(image) {
+			pulled[image] = true
+			issues = append(issues, doctorIssue{
+				Check:   check,
+				Problem: fmt.Sprintf("base image '%s' is not present locally", image),
+				Fix: func() (string, error) {
+					if err := dockerClient.PullImage(image); err != nil {
+						return "", err
+					}
+					return fmt.Sprintf("pulled %s", image), nil
+				},
+			})
+		}
+
+		status, err := dockerClient.GetIslandStatus(project.IslandName)
+		if err != nil {
+			issues = append(issues, doctorIssue{
+				Check:   check,
+				Problem: fmt.Sprintf("failed to check island: %v", err),
+			})
+			continue
+		}
+		switch status {
+		case "running":
+		case "not found":
+			issues = append(issues, doctorIssue{
+				Check:   check,
+				Problem: fmt.Sprintf("island '%s' does not exist", project.IslandName),
+				Hint:    fmt.Sprintf("run 'coderaft up' in %s to recreate it", project.WorkspacePath),
+			})
+		default:
+			islandName := project.IslandName
+			issues = append(issues, doctorIssue{
+				Check:   check,
+				Problem: fmt.Sprintf("island '%s' is %s", islandName, status),
+				Fix: func() (string, error) {
+					if err := dockerClient.StartIsland(islandName); err != nil {
+						return "", err
+					}
+					return fmt.Sprintf("started %s (stop it again with 'coderaft stop %s')", islandName, name), nil
+				},
+			})
+		}
+	}
+
+	return issues
+}
+
+// runIslandDoctorChecks runs the in-island checks for one project
+func runIslandDoctorChecks(projectName string) ([]doctorIssue, error) {
+	if dockerClient == nil {
+		return nil, fmt.Errorf("docker is not available; run 'coderaft doctor' to check the host")
+	}
+	cfg, err := configManager.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	project, ok := cfg.GetProject(projectName)
+	if !ok {
+		return nil, errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+	}
+
+	projectConfig, _ := configManager.LoadProjectConfig(project.WorkspacePath)
+	stack := project.Stack
+	if stack == "" {
+		workspaceHost := project.WorkspacePath
+		if projectConfig != nil {
+			if p, err := workspaceHostPath(project.WorkspacePath, projectConfig.WorkspaceSubdir); err == nil {
+				workspaceHost = p
+			}
+		}
+		stack = detectProjectStack(workspaceHost)
+	}
+
+	ui.Status("checking island '%s'...", project.IslandName)
+	return doctorIslandIssues(dockerClient, project, projectConfig, stack), nil
+}
+
+// doctorIslandIssues probes a project's island from the inside. A stopped or
+// missing island is reported on its own since nothing else can be checked.
+func doctorIslandIssues(client islandProber, project *config.Project, projectConfig *config.ProjectConfig, stack string) []doctorIssue {
+	island := project.IslandName
+	check := fmt.Sprintf("island '%s'", island)
+
+	status, err := client.GetIslandStatus(island)
+	if err != nil {
+		return []doctorIssue{{Check: check, Problem: fmt.Sprintf("failed to check island: %v", err)}}
+	}
+	switch status {
+	case "running":
+	case "not found":
+		return []doctorIssue{{
+			Check:   check,
+			Problem: "island does not exist",
+			Hint:    fmt.Sprintf("run 'coderaft up' in %s to create it", project.WorkspacePath),
+		}}
+	default:
+		return []doctorIssue{{
+			Check:   check,
+			Problem: fmt.Sprintf("island is %s, so it can't be checked", status),
+			Fix: func() (string, error) {
+				if err := dockerClient.StartIsland(island); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("started %s; run 'coderaft doctor --container %s' again to check it", island, project.Name), nil
+			},
+		}}
+	}
+
+	var issues []doctorIssue
+	probe := func(command string) (string, bool) {
+		out, _, err := client.ExecCapture(island, command)
+		return strings.TrimSpace(out), err == nil
+	}
+	reinstallWrapper := func() (string, error) {
+		if err := dockerClient.SetupCoderaftOnIslandWithUpdate(island, project.Name); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("reinstalled the coderaft wrapper in %s", island), nil
+	}
+
+	if _, ok := probe("test -x /usr/local/bin/coderaft"); !ok {
+		issues = append(issues, doctorIssue{
+			Check:   "wrapper",
+			Problem: "the coderaft wrapper is not installed at /usr/local/bin/coderaft",
+			Fix:     reinstallWrapper,
+		})
+	} else if _, ok := probe("test -f /etc/coderaft-initialized"); !ok {
+		issues = append(issues, doctorIssue{
+			Check:   "wrapper",
+			Problem: "the island was never marked initialized (/etc/coderaft-initialized is missing)",
+			Fix:     reinstallWrapper,
+		})
+	}
+
+	workspaceIsland := "/island"
+	if projectConfig != nil && projectConfig.WorkingDir != "" {
+		workspaceIsland = projectConfig.WorkingDir
+	}
+	dir := shellQuote(workspaceIsland)
+	state, _ := probe(fmt.Sprintf(`if [ ! -d %s ]; then echo missing; elif ! awk '{print $5}' /proc/self/mountinfo | grep -qxF %s; then echo unmounted; elif [ ! -w %s ]; then echo readonly; fi`, dir, dir, dir))
+	switch state {
+	case "missing", "unmounted":
+		issues = append(issues, doctorIssue{
+			Check:   "workspace",
+			Problem: fmt.Sprintf("%s is not mounted from %s", workspaceIsland, project.WorkspacePath),
+			Hint:    fmt.Sprintf("recreate the island with 'coderaft up --recreate' in %s", project.WorkspacePath),
+		})
+	case "readonly":
+		issues = append(issues, doctorIssue{
+			Check:   "workspace",
+			Problem: fmt.Sprintf("%s is mounted read-only or not writable by the island user", workspaceIsland),
+			Hint:    fmt.Sprintf("check the permissions of %s and the 'user' in coderaft.json", project.WorkspacePath),
+		})
+	}
+
+	networkHint := "check the host's network and DNS settings, then restart Docker"
+	if projectConfig != nil && projectConfig.Network == "none" {
+		networkHint = "coderaft.json sets \"network\": \"none\"; remove it and recreate the island"
+	}
+	if _, ok := probe(fmt.Sprintf("getent hosts %[1]s >/dev/null 2>&1 || nslookup %[1]s >/dev/null 2>&1", doctorProbeHost)); !ok {
+		issues = append(issues, doctorIssue{
+			Check:   "network",
+			Problem: fmt.Sprintf("DNS lookup of %s failed", doctorProbeHost),
+			Hint:    networkHint,
+		})
+	} else if _, ok := probe(fmt.Sprintf("if command -v curl >/dev/null 2>&1; then curl -sS -o /dev/null --max-time 5 https://%[1]s; elif command -v wget >/dev/null 2>&1; then wget -q --spider -T 5 https://%[1]s; fi", doctorProbeHost)); !ok {
+		issues = append(issues, doctorIssue{
+			Check:   "network",
+			Problem: fmt.Sprintf("HTTPS request to %s failed", doctorProbeHost),
+			Hint:    "check proxy settings (HTTPS_PROXY in coderaft.json's environment) and the host firewall",
+		})
+	}
+
+	if tools := stackToolchains[stack]; len(tools) > 0 {
+		out, _ := probe(missingToolsScript(tools))
+		if missing := strings.Fields(out); len(missing) > 0 {
+			issues = append(issues, doctorIssue{
+				Check:   "toolchain",
+				Problem: fmt.Sprintf("%s project but %s not found on PATH", stack, strings.Join(missing, ", ")),
+				Hint:    fmt.Sprintf("add the install to setup_commands or use a %s base image, then 'coderaft update %s'", stack, project.Name),
+			})
+		}
+	}
+
+	return issues
+}
+
+// missingToolsScript prints each tool (or "a|b" group) of which no command is
+// on PATH
+func missingToolsScript(tools []string) string {
+	var checks []string
+	for _, tool := range tools {
+		var tests []string
+		for _, name := range strings.Split(tool, "|") {
+			tests = append(tests, "command -v "+shellQuote(name)+" >/dev/null 2>&1")
+		}
+		checks = append(checks, fmt.Sprintf("{ %s; } || echo %s", strings.Join(tests, " || "), shellQuote(tool)))
+	}
+	return strings.Join(checks, "; ")
+}
+
+// resetCorruptConfig moves an unreadable config aside and writes an empty one
+// in its place, returning the backup path
+func resetCorruptConfig(path string) (string, error) {
+	backup := fmt.Sprintf("%s.bak-%s", path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(path, backup); err != nil {
+		return "", fmt.Errorf("failed to back up config: %w", err)
+	}
+	if err := os.WriteFile(path, []byte("{\n  \"projects\": {}\n}\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write empty config: %w", err)
+	}
+	return backup, nil
+}
+
+func confirmDoctorFix(prompt string) bool {
+	ui.Prompt("%s", prompt)
+	reader := bufio.NewReader(os.Stdin)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	response = strings.ToLower(strings.TrimSpace(response))
+	return response == "y" || response == "yes"
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// resolveDotfilesSource turns a --dotfiles value (or settings.dotfiles_repo when
+// empty) into a host path to mount. Existing local directories are used as-is;
+// anything else is treated as a git repository and cached under
+// ~/.coderaft/dotfiles. fromRepo reports whether the path came from a repo.
+func resolveDotfilesSource(source string, cfg *config.Config, update bool) (hostPath string, fromRepo bool, err error) {
+	if source == "" && cfg != nil && cfg.Settings != nil {
+		source = cfg.Settings.DotfilesRepo
+	}
+	if source == "" {
+		return "", false, nil
+	}
+
+	local := source
+	if strings.HasPrefix(local, "~") {
+		if home, err := os.UserHomeDir(); err == nil {
+			local = filepath.Join(home, local[1:])
+		}
+	}
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		return local, false, nil
+	}
+
+	hostPath, err = ensureDotfilesRepo(source, update)
+	if err != nil {
+		return "", false, err
+	}
+	return hostPath, true, nil
+}
+
+// ensureDotfilesRepo clones a dotfiles repository into the managed cache on first
+// use and fast-forwards it when update is set
+func ensureDotfilesRepo(source string, update bool) (string, error) {
+	repoURL, err := normalizeRepoURL(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid dotfiles repository: %w", err)
+	}
+
+	dest, err := dotfilesCacheDir(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, ".git")); err == nil {
+		if update {
+			ui.Status("updating dotfiles repository...")
+			cmd := exec.Command("git", "-C", dest, "pull", "--ff-only")
+			cmd.Stdout = ui.Writer()
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				ui.Warning("failed to update dotfiles repository, using cached copy: %v", err)
+			}
+		}
+		return dest, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", fmt.Errorf("failed to create dotfiles cache: %w", err)
+	}
+
+	ui.Status("cloning dotfiles repository %s...", repoURL)
+	cmd := exec.Command("git", "clone", "--depth", "1", repoURL, dest)
+	cmd.Stdout = ui.Writer()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dest)
+		return "", formatGitError(err, repoURL, "")
+	}
+	return dest, nil
+}
+
+// dotfilesCacheDir returns dotfiles/<host>-<owner>-<repo> in coderaft's data
+// directory, under ~/.coderaft by default
+func dotfilesCacheDir(repoURL string) (string, error) {
+	host, path := splitRepoHostPath(repoURL)
+	if path == "" {
+		return "", fmt.Errorf("could not determine dotfiles repository path from '%s'", repoURL)
+	}
+	key := strings.ReplaceAll(host+"/"+path, "/", "-")
+	return config.DataPath("dotfiles", key)
+}
+
+// prependDotfiles mounts hostPath at /dotfiles, ahead of any dotfiles already
+// listed in the project config
+func prependDotfiles(configMap map[string]interface{}, hostPath string) map[string]interface{} {
+	if configMap == nil {
+		configMap = map[string]interface{}{}
+	}
+	arr := []interface{}{hostPath}
+	if existing, ok := configMap["dotfiles"].([]interface{}); ok {
+		arr = append(arr, existing...)
+	}
+	configMap["dotfiles"] = arr
+	return configMap
+}
+
+// runDotfilesInstall runs install.sh from a mounted dotfiles repo, if present
+func runDotfilesInstall(islandName, hostPath string) {
+	if _, err := os.Stat(filepath.Join(hostPath, "install.sh")); err != nil {
+		return
+	}
+
+	ui.Status("running dotfiles install.sh...")
+	if err := dockerClient.ExecuteSetupCommandsWithOutput(islandName, []string{"cd /dotfiles && bash ./install.sh"}, false); err != nil {
+		ui.Warning("dotfiles install.sh failed: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"coderaft/internal/config"
+)
+
+// builtinProtectedPackages are apt packages whose downgrade can leave the
+// island unable to run a shell or the package manager itself. apply never
+// downgrades them; settings.protected_packages adds to the list.
+var builtinProtectedPackages = []string{
+	"apt", "base-files", "bash", "coreutils", "dpkg", "gzip", "libc-bin",
+	"libc6", "libgcc-s1", "libssl3", "libstdc++6", "libsystemd0", "login",
+	"passwd", "perl-base", "systemd", "tar", "util-linux",
+}
+
+// downgradeGuard decides what buildReconcileActions does with apt packages
+// the lock pins to an older version than the island has
+type downgradeGuard struct {
+	// Protected packages are never downgraded
+	Protected map[string]bool
+	// Allow lets every other package be downgraded
+	Allow bool
+}
+
+// aptDowngrade is an apt package the lock would move to an older version
+type aptDowngrade struct {
+	Name      string
+	From      string
+	To        string
+	Protected bool
+	// Held downgrades were left out of the reconcile commands
+	Held bool
+}
+
+func (d aptDowngrade) String() string {
+	return fmt.Sprintf("%s %s -> %s", d.Name, d.From, d.To)
+}
+
+// newDowngradeGuard builds a guard from the built-in protected list plus
+// settings.protected_packages
+func newDowngradeGuard(settings *config.GlobalSettings, allow bool) downgradeGuard {
+	protected := make(map[string]bool, len(builtinProtectedPackages))
+	for _, name := range builtinProtectedPackages {
+		protected[name] = true
+	}
+	if settings != nil {
+		for _, name := range settings.ProtectedPackages {
+			if name = strings.TrimSpace(name); name != "" {
+				protected[name] = true
+			}
+		}
+	}
+	return downgradeGuard{Protected: protected, Allow: allow}
+}
+
+// check reports whether moving name from cur to want is a downgrade, and if
+// so whether the guard holds it back
+func (g downgradeGuard) check(name, cur, want string) (aptDowngrade, bool) {
+	if compareDebianVersions(want, cur) >= 0 {
+		return aptDowngrade{}, false
+	}
+	d := aptDowngrade{Name: name, From: cur, To: want, Protected: g.Protected[name]}
+	d.Held = d.Protected || !g.Allow
+	return d, true
+}
+
+// splitDowngrades separates held downgrades into protected ones and those
+// that only need --allow-downgrade, and returns the ones that will run
+func splitDowngrades(downgrades []aptDowngrade) (protected, needAllow, allowed []aptDowngrade) {
+	for _, d := range downgrades {
+		switch {
+		case d.Protected:
+			protected = append(protected, d)
+		case d.Held:
+			needAllow = append(needAllow, d)
+		default:
+			allowed = append(allowed, d)
+		}
+	}
+	return protected, needAllow, allowed
+}
+
+// compareDebianVersions orders two dpkg version strings the way
+// 'dpkg --compare-versions' does: epoch, then upstream version, then
+// revision, with '~' sorting before everything including the end of string.
+func compareDebianVersions(a, b string) int {
+	ae, au, ar := splitDebianVersion(a)
+	be, bu, br := splitDebianVersion(b)
+	if ae != be {
+		if ae < be {
+			return -1
+		}
+		return 1
+	}
+	if c := compareDebianPart(au, bu); c != 0 {
+		return c
+	}
+	return compareDebianPart(ar, br)
+}
+
+func splitDebianVersion(v string) (epoch int, upstream, revision string) {
+	v = strings.TrimSpace(v)
+	if e, rest, ok := strings.Cut(v, ":"); ok {
+		epoch, _ = strconv.Atoi(e)
+		v = rest
+	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// debianCharOrder is dpkg's ordering for the non-digit parts of a version
+func debianCharOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= '0' && c <= '9':
+		return 0
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// compareDebianPart is dpkg's verrevcmp: alternate runs of non-digits,
+// compared by debianCharOrder, and runs of digits, compared numerically
+func compareDebianPart(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = debianCharOrder(a[i])
+				i++
+			}
+			if j < len(b) {
+				bc = debianCharOrder(b[j])
+				j++
+			}
+			if ac != bc {
+				if ac < bc {
+					return -1
+				}
+				return 1
+			}
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			if firstDiff < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
@@ -42,7 +43,7 @@ func runExport(projectName string) error {
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	exists, err := dockerClient.IslandExists(proj.IslandName)
@@ -50,7 +51,7 @@ func runExport(projectName string) error {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
 	}
 
 	outPath := exportOutput
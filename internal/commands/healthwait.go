@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"coderaft/internal/docker"
+	"coderaft/internal/ui"
+)
+
+// healthProber is the part of the Docker client that --wait-healthy needs
+type healthProber interface {
+	GetHealthStatus(islandName string) (docker.HealthStatus, error)
+}
+
+// healthProgressEvery is how often waitForHealthy reports a status that
+// hasn't changed
+const healthProgressEvery = 10 * time.Second
+
+// waitForHealthy polls the island's healthcheck until it reports healthy. It
+// fails right away when the container has no healthcheck or turns unhealthy,
+// and after timeout otherwise.
+func waitForHealthy(client healthProber, islandName string, timeout, interval time.Duration) error {
+	start := time.Now()
+	var last string
+	var lastReport time.Time
+	for {
+		h, err := client.GetHealthStatus(islandName)
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+
+		switch h.Status {
+		case "":
+			return fmt.Errorf("island '%s' has no healthcheck; add health_check to coderaft.json to use --wait-healthy", islandName)
+		case "healthy":
+			ui.Status("island is healthy after %s", elapsed.Round(time.Second))
+			ui.Event("healthy", map[string]interface{}{"island": islandName, "elapsed_seconds": elapsed.Seconds()})
+			return nil
+		case "unhealthy":
+			if h.LastOutput != "" {
+				return fmt.Errorf("island '%s' is unhealthy after %d failed check(s): %s", islandName, h.FailingStreak, h.LastOutput)
+			}
+			return fmt.Errorf("island '%s' is unhealthy after %d failed check(s)", islandName, h.FailingStreak)
+		}
+
+		if elapsed >= timeout {
+			return fmt.Errorf("timed out after %s waiting for island '%s' to become healthy (status: %s)", timeout, islandName, h.Status)
+		}
+		if h.Status != last || time.Since(lastReport) >= healthProgressEvery {
+			ui.Status("waiting for island to become healthy (status: %s, %s elapsed)...", h.Status, elapsed.Round(time.Second))
+			ui.Event("health_wait", map[string]interface{}{"island": islandName, "status": h.Status, "elapsed_seconds": elapsed.Seconds()})
+			last, lastReport = h.Status, time.Now()
+		}
+		time.Sleep(interval)
+	}
+}
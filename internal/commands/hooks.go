@@ -8,6 +8,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
@@ -73,7 +74,7 @@ func runHooksInstall(projectName string) error {
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	gitDir := filepath.Join(proj.WorkspacePath, ".git")
@@ -81,6 +82,10 @@ func runHooksInstall(projectName string) error {
 		return fmt.Errorf("no .git directory found at %s — initialize a git repo first", proj.WorkspacePath)
 	}
 
+	if proj.HooksDir != "" {
+		ui.Warning("git runs the shared hooks from %s (core.hooksPath), so a hook in .git/hooks won't run", proj.HooksDir)
+	}
+
 	hooksDir := filepath.Join(gitDir, "hooks")
 	if err := os.MkdirAll(hooksDir, 0755); err != nil {
 		return fmt.Errorf("failed to create hooks directory: %w", err)
@@ -123,7 +128,7 @@ func runHooksRemove(projectName string) error {
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	hookPath := filepath.Join(proj.WorkspacePath, ".git", "hooks", "pre-commit")
@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sharedHooksDir is where a --hooks-dir is copied, relative to the workspace.
+// core.hooksPath points at it with a relative path, so the same setting works
+// on the host and in the island.
+const sharedHooksDir = ".git/coderaft-hooks"
+
+// gitHookNames are the hooks git runs (see githooks(5))
+var gitHookNames = map[string]bool{
+	"applypatch-msg": true, "pre-applypatch": true, "post-applypatch": true,
+	"pre-commit": true, "pre-merge-commit": true, "prepare-commit-msg": true,
+	"commit-msg": true, "post-commit": true, "pre-rebase": true,
+	"post-checkout": true, "post-merge": true, "pre-push": true,
+	"pre-receive": true, "update": true, "proc-receive": true,
+	"post-receive": true, "post-update": true, "reference-transaction": true,
+	"push-to-checkout": true, "pre-auto-gc": true, "post-rewrite": true,
+	"sendemail-validate": true, "fsmonitor-watchman": true, "p4-changelist": true,
+	"p4-prepare-changelist": true, "p4-post-changelist": true, "p4-pre-submit": true,
+	"post-index-change": true,
+}
+
+// resolveHooksDir expands a --hooks-dir or settings.hooks_dir path and checks
+// that it is a directory with at least one git hook in it. It returns the
+// absolute path and the hooks found.
+func resolveHooksDir(dir string) (string, []string, error) {
+	if strings.HasPrefix(dir, "~") {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, dir[1:])
+		}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid hooks directory: %w", err)
+	}
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read hooks directory: %w", err)
+	}
+
+	var hooks []string
+	for _, e := range entries {
+		if gitHookNames[e.Name()] && e.Type().IsRegular() {
+			hooks = append(hooks, e.Name())
+		}
+	}
+	if len(hooks) == 0 {
+		return "", nil, fmt.Errorf("hooks directory '%s' has no git hooks (expected files such as pre-commit or commit-msg)", abs)
+	}
+	sort.Strings(hooks)
+	return abs, hooks, nil
+}
+
+// installSharedHooks copies hooksDir into the workspace's sharedHooksDir,
+// replacing an earlier copy, and points core.hooksPath at it
+func installSharedHooks(workspacePath, hooksDir string) ([]string, error) {
+	src, hooks, err := resolveHooksDir(hooksDir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(workspacePath, ".git")); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("no .git directory found at %s", workspacePath)
+	}
+
+	dest := filepath.Join(workspacePath, filepath.FromSlash(sharedHooksDir))
+	if err := os.RemoveAll(dest); err != nil {
+		return nil, fmt.Errorf("failed to remove old hooks: %w", err)
+	}
+	if err := copyHooksTree(src, dest); err != nil {
+		return nil, fmt.Errorf("failed to copy hooks: %w", err)
+	}
+
+	if out, err := exec.Command("git", "-C", workspacePath, "config", "core.hooksPath", sharedHooksDir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to set core.hooksPath: %s", strings.TrimSpace(string(out)))
+	}
+	return hooks, nil
+}
+
+// copyHooksTree copies regular files and directories from src to dest. Hooks
+// are made executable; helper files keep their mode. Symlinks are skipped so
+// the copy can't reach outside the hooks directory.
+func copyHooksTree(src, dest string) error {
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm()
+		if rel == d.Name() && gitHookNames[d.Name()] {
+			mode |= 0755
+		}
+		return copyHookFile(p, target, mode)
+	})
+}
+
+func copyHookFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -60,7 +60,7 @@ Examples:
 
 		var projectConfig *config.ProjectConfig
 
-		if existingConfig, err := configManager.LoadProjectConfig(workspacePath); err == nil && existingConfig != nil {
+		if existingConfig, err := configManager.LoadBaseProjectConfig(workspacePath); err == nil && existingConfig != nil {
 			ui.Info("found existing coderaft.json configuration")
 			projectConfig = existingConfig
 		} else if templateFlag != "" {
@@ -173,7 +173,7 @@ Examples:
 		if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
 			stepCount = 5
 			ui.Step(nextStep, stepCount, "running setup commands (%d)", len(projectConfig.SetupCommands))
-			if err := dockerClient.ExecuteSetupCommandsWithOutput(IslandName, projectConfig.SetupCommands, false); err != nil {
+			if err := runProjectSetupCommands(dockerClient, IslandName, projectConfig); err != nil {
 				return fmt.Errorf("failed to execute setup commands: %w", err)
 			}
 			nextStep++
@@ -190,6 +190,7 @@ Examples:
 			BaseImage:     baseImage,
 			WorkspacePath: workspacePath,
 			Status:        "running",
+			Stack:         templateFlag,
 		}
 
 		cfg.MergeProjectConfig(project, projectConfig)
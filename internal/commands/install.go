@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/ui"
+)
+
+var (
+	installManager    string
+	installDev        bool
+	installUpdateLock bool
+)
+
+var plainPackageName = regexp.MustCompile(`^[A-Za-z0-9@._+/:=~^,-]+$`)
+
+// installManagers are the managers whose installs coderaft.history can replay
+var installManagers = []string{"apt", "pip", "npm", "yarn", "pnpm"}
+
+var installCmd = &cobra.Command{
+	Use:   "install <project> <package>...",
+	Short: "Install packages in the island and record them",
+	Long: `Install packages in a project's island with the package manager that fits
+its stack, and record the install in coderaft.history so rebuilds replay it.
+
+The manager is picked from the project files: pip for Python, yarn/pnpm/npm
+for Node.js (by lockfile), apt otherwise. Use --manager to choose one.
+
+Examples:
+  coderaft install myproject htop
+  coderaft install myproject requests flask
+  coderaft install myproject eslint --dev
+  coderaft install myproject jq --manager apt --update-lock`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName, packages := args[0], args[1:]
+
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+		for _, pkg := range packages {
+			if strings.TrimSpace(pkg) == "" || strings.HasPrefix(pkg, "-") {
+				return fmt.Errorf("invalid package name '%s'", pkg)
+			}
+		}
+
+		project, err := ensureProjectIslandRunning(projectName)
+		if err != nil {
+			return err
+		}
+
+		manager := installManager
+		if manager == "" {
+			manager = installManagerForWorkspace(project.WorkspacePath)
+		} else if !isInstallManager(manager) {
+			return fmt.Errorf("unsupported manager '%s' (supported: %s)", manager, strings.Join(installManagers, ", "))
+		}
+
+		record, err := installCommand(manager, packages, installDev)
+		if err != nil {
+			return err
+		}
+
+		workdir := "/island"
+		if projectConfig, _ := configManager.LoadProjectConfig(project.WorkspacePath); projectConfig != nil && projectConfig.WorkingDir != "" {
+			workdir = projectConfig.WorkingDir
+		}
+
+		run := record
+		switch manager {
+		case "apt":
+			run = "apt-get update -y >/dev/null && DEBIAN_FRONTEND=noninteractive " + record
+		case "npm", "yarn", "pnpm":
+			run = "cd " + shellQuote(workdir) + " && " + record
+		}
+
+		ui.Status("installing with %s: %s", manager, strings.Join(packages, " "))
+		invalidateVerifyCache(project.IslandName)
+		if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, []string{run}, true); err != nil {
+			return fmt.Errorf("failed to install packages: %w", err)
+		}
+
+		historyPath := filepath.Join(project.WorkspacePath, "coderaft.history")
+		if err := appendHistory(historyPath, record); err != nil {
+			ui.Warning("failed to record install in coderaft.history: %v", err)
+		}
+
+		if installUpdateLock {
+			if err := WriteLockFileForProject(projectName, ""); err != nil {
+				return fmt.Errorf("packages installed but failed to update lock file: %w", err)
+			}
+			ui.Status("updated coderaft.lock.json")
+		}
+
+		ui.Success("installed %s", strings.Join(packages, ", "))
+		return nil
+	},
+}
+
+func init() {
+	installCmd.Flags().StringVar(&installManager, "manager", "", "Package manager to use (apt, pip, npm, yarn, pnpm)")
+	installCmd.Flags().BoolVar(&installDev, "dev", false, "Install as a development dependency (npm, yarn, pnpm)")
+	installCmd.Flags().BoolVar(&installUpdateLock, "update-lock", false, "Regenerate coderaft.lock.json after installing")
+}
+
+func isInstallManager(manager string) bool {
+	for _, m := range installManagers {
+		if m == manager {
+			return true
+		}
+	}
+	return false
+}
+
+// installManagerForWorkspace picks a manager from the project's files
+func installManagerForWorkspace(workspacePath string) string {
+	switch detectProjectStack(workspacePath) {
+	case "python":
+		return "pip"
+	case "nodejs":
+		if _, err := os.Stat(filepath.Join(workspacePath, "pnpm-lock.yaml")); err == nil {
+			return "pnpm"
+		}
+		if _, err := os.Stat(filepath.Join(workspacePath, "yarn.lock")); err == nil {
+			return "yarn"
+		}
+		return "npm"
+	default:
+		return "apt"
+	}
+}
+
+// installCommand returns the install command in the form recorded to
+// coderaft.history
+func installCommand(manager string, packages []string, dev bool) (string, error) {
+	quoted := make([]string, len(packages))
+	for i, p := range packages {
+		if plainPackageName.MatchString(p) {
+			quoted[i] = p
+		} else {
+			quoted[i] = shellQuote(p)
+		}
+	}
+	pkgs := strings.Join(quoted, " ")
+
+	switch manager {
+	case "npm":
+		if dev {
+			return "npm install --save-dev " + pkgs, nil
+		}
+		return "npm install " + pkgs, nil
+	case "yarn":
+		if dev {
+			return "yarn add --dev " + pkgs, nil
+		}
+		return "yarn add " + pkgs, nil
+	case "pnpm":
+		if dev {
+			return "pnpm add --save-dev " + pkgs, nil
+		}
+		return "pnpm add " + pkgs, nil
+	}
+
+	if dev {
+		return "", fmt.Errorf("--dev is not supported for %s", manager)
+	}
+	switch manager {
+	case "pip":
+		return "pip install " + pkgs, nil
+	case "apt":
+		return "apt-get install -y " + pkgs, nil
+	}
+	return "", fmt.Errorf("unsupported manager '%s'", manager)
+}
+
+// appendHistory adds a command to coderaft.history unless it is already there,
+// matching the in-island recorder
+func appendHistory(path, command string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.TrimSpace(line) == command {
+				return nil
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, command)
+	return err
+}
@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-units"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// defaultLargeFileThreshold is the size above which clone reports a file
+const defaultLargeFileThreshold = "50MB"
+
+// largeFilesListed is how many of the largest files --warn-large-files lists
+const largeFilesListed = 10
+
+type largeFile struct {
+	Path string
+	Size int64
+}
+
+// resolveLargeFileThreshold picks --large-file-threshold over
+// settings.large_file_threshold and parses it. A threshold of 0 turns the
+// check off.
+func resolveLargeFileThreshold(flag string, cfg *config.Config) (int64, error) {
+	threshold := flag
+	if threshold == "" && cfg != nil && cfg.Settings != nil {
+		threshold = cfg.Settings.LargeFileThreshold
+	}
+	if threshold == "" {
+		threshold = defaultLargeFileThreshold
+	}
+	size, err := units.FromHumanSize(threshold)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid large file threshold '%s' (expected a size such as 50MB or 1GB)", threshold)
+	}
+	return size, nil
+}
+
+// findLargeFiles walks the checkout like detectProjectStack reads it, skipping
+// .git, and returns the regular files bigger than threshold, largest first
+func findLargeFiles(root string, threshold int64) ([]largeFile, error) {
+	var found []largeFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() <= threshold {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		found = append(found, largeFile{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Size != found[j].Size {
+			return found[i].Size > found[j].Size
+		}
+		return found[i].Path < found[j].Path
+	})
+	return found, nil
+}
+
+// dropLFSFiles removes the files git routes through the LFS filter, since
+// those are already stored the way the warning would suggest
+func dropLFSFiles(repoPath string, files []largeFile) []largeFile {
+	if len(files) == 0 || !usesGitLFS(repoPath) {
+		return files
+	}
+	args := []string{"-C", repoPath, "check-attr", "-z", "filter", "--"}
+	for _, f := range files {
+		args = append(args, f.Path)
+	}
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return files
+	}
+
+	// -z output is path NUL attribute NUL value NUL, per file
+	lfs := map[string]bool{}
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "lfs" {
+			lfs[fields[i]] = true
+		}
+	}
+	var kept []largeFile
+	for _, f := range files {
+		if !lfs[f.Path] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// warnLargeFiles reports the files in a fresh checkout bigger than threshold
+// and suggests Git LFS or a sparse checkout. With list it also names the
+// largest ones.
+func warnLargeFiles(workspacePath string, threshold int64, list bool) {
+	if threshold <= 0 {
+		return
+	}
+	files, err := findLargeFiles(workspacePath, threshold)
+	if err != nil {
+		ui.Warning("failed to scan for large files: %v", err)
+		return
+	}
+	files = dropLFSFiles(workspacePath, files)
+	if len(files) == 0 {
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	ui.Event("large_files", map[string]interface{}{
+		"count":     len(files),
+		"bytes":     total,
+		"threshold": threshold,
+	})
+	ui.Warning("repository has %d file(s) over %s outside Git LFS, %s in total", len(files), units.HumanSize(float64(threshold)), units.HumanSize(float64(total)))
+	if list {
+		for i, f := range files {
+			if i == largeFilesListed {
+				ui.Item("... and %d more", len(files)-largeFilesListed)
+				break
+			}
+			ui.Item("%s (%s)", f.Path, units.HumanSize(float64(f.Size)))
+		}
+	} else {
+		ui.Info("hint: use --warn-large-files to list the largest files")
+	}
+	ui.Info("hint: track large binaries with Git LFS ('git lfs track'), or clone with --sparse to check out only the directories you need")
+}
@@ -2,23 +2,76 @@ package commands
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/config"
 	"coderaft/internal/ui"
 )
 
 var (
 	verboseFlag bool
+	listSort    string
+	listFilters []string
 )
 
+var listSortKeys = []string{"name", "status", "uptime", "created"}
+
+// listFilterKeys are the fields --filter can match on
+var listFilterKeys = []string{"status", "stack"}
+
+// Island states --filter status= matches on
+const (
+	listStateRunning = "running"
+	listStateStopped = "stopped"
+	listStateMissing = "missing"
+)
+
+// listRow is one project's line in the list
+type listRow struct {
+	Project *config.Project
+	// Status is the island's status as Docker reports it, e.g. "Up 3 hours"
+	Status string
+	// State is Status reduced to running, stopped or missing
+	State  string
+	Uptime time.Duration
+}
+
+// listFilter holds the parsed --filter flags. Values given for the same key
+// are alternatives; different keys must all match.
+type listFilter map[string][]string
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all coderaft projects and their status",
-	Long:  `Display all managed coderaft projects along with their island status.`,
-	Args:  cobra.NoArgs,
+	Long: `Display all managed coderaft projects along with their island status.
+
+Rows are sorted by project name unless --sort is given: status lists
+running islands first, uptime the longest running first, and created the
+most recently created project first.
+
+--filter key=value narrows the list by island status (running, stopped or
+missing) or by the stack detected when the project was created. Repeat it to
+combine filters: values for the same key match either, different keys must
+all match.
+
+Examples:
+  coderaft list
+  coderaft list --sort uptime
+  coderaft list --filter status=running
+  coderaft list --filter stack=python --filter stack=go --filter status=stopped`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isListSortKey(listSort) {
+			return fmt.Errorf("unsupported --sort '%s' (supported: %s)", listSort, strings.Join(listSortKeys, ", "))
+		}
+		filter, err := parseListFilters(listFilters)
+		if err != nil {
+			return err
+		}
 
 		cfg, err := configManager.Load()
 		if err != nil {
@@ -46,6 +99,24 @@ var listCmd = &cobra.Command{
 			}
 		}
 
+		var rows []listRow
+		for _, project := range projects {
+			row := listRow{Project: project, Status: islandStatus[project.IslandName]}
+			row.State = listIslandState(row.Status)
+			if !filter.match(row) {
+				continue
+			}
+			if listSort == "uptime" && row.State == listStateRunning {
+				row.Uptime, _ = dockerClient.GetUptime(project.IslandName)
+			}
+			rows = append(rows, row)
+		}
+		sortListRows(rows, listSort)
+		if len(rows) == 0 {
+			ui.Info("no projects match the given filters (%d total).", len(projects))
+			return nil
+		}
+
 		ui.Header("coderaft projects")
 		if verboseFlag {
 			fmt.Printf("%-20s %-20s %-15s %-12s %s\n", "PROJECT", "island", "STATUS", "CONFIG", "WORKSPACE")
@@ -64,10 +135,11 @@ var listCmd = &cobra.Command{
 				strings.Repeat("-", 30))
 		}
 
-		for _, project := range projects {
+		for _, row := range rows {
+			project := row.Project
 			status := "not found"
-			if islandStatus[project.IslandName] != "" {
-				status = islandStatus[project.IslandName]
+			if row.Status != "" {
+				status = row.Status
 			}
 
 			configStatus := "none"
@@ -98,6 +170,12 @@ var listCmd = &cobra.Command{
 
 			if verboseFlag {
 				projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
+				if project.Stack != "" {
+					ui.Item("stack: %s", project.Stack)
+				}
+				if project.CreatedAt != "" {
+					ui.Item("created: %s", project.CreatedAt)
+				}
 				if err == nil && projectConfig != nil {
 					if projectConfig.BaseImage != "" && projectConfig.BaseImage != project.BaseImage {
 						ui.Item("base image: %s (override)", projectConfig.BaseImage)
@@ -113,7 +191,11 @@ var listCmd = &cobra.Command{
 		}
 
 		ui.Blank()
-		ui.Info("total projects: %d", len(projects))
+		if len(rows) != len(projects) {
+			ui.Info("showing %d of %d projects", len(rows), len(projects))
+		} else {
+			ui.Info("total projects: %d", len(projects))
+		}
 
 		if verboseFlag {
 
@@ -134,4 +216,104 @@ var listCmd = &cobra.Command{
 
 func init() {
 	listCmd.Flags().BoolVarP(&verboseFlag, "verbose", "v", false, "Show detailed information including configuration details")
+	listCmd.Flags().StringVar(&listSort, "sort", "name", "Sort projects by name, status, uptime, or created")
+	listCmd.Flags().StringArrayVar(&listFilters, "filter", nil, "Only show projects matching key=value, where key is status (running, stopped, missing) or stack (repeatable)")
+}
+
+func isListSortKey(key string) bool {
+	for _, k := range listSortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListFilters parses --filter key=value flags
+func parseListFilters(specs []string) (listFilter, error) {
+	filter := listFilter{}
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid --filter '%s' (expected key=value)", spec)
+		}
+		switch key {
+		case "status":
+			value = strings.ToLower(value)
+			if value != listStateRunning && value != listStateStopped && value != listStateMissing {
+				return nil, fmt.Errorf("invalid --filter status '%s' (expected running, stopped or missing)", value)
+			}
+		case "stack":
+			value = strings.ToLower(value)
+		default:
+			return nil, fmt.Errorf("unknown --filter key '%s' (supported: %s)", key, strings.Join(listFilterKeys, ", "))
+		}
+		filter[key] = append(filter[key], value)
+	}
+	return filter, nil
+}
+
+// match reports whether row passes every filter key
+func (f listFilter) match(row listRow) bool {
+	fields := map[string]string{
+		"status": row.State,
+		"stack":  strings.ToLower(row.Project.Stack),
+	}
+	for key, values := range f {
+		matched := false
+		for _, v := range values {
+			if fields[key] == v {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// listIslandState reduces a Docker status such as "Up 3 hours" or
+// "Exited (0) 2 days ago" to running, stopped or missing
+func listIslandState(status string) string {
+	switch {
+	case status == "":
+		return listStateMissing
+	case strings.HasPrefix(status, "Up"):
+		return listStateRunning
+	default:
+		return listStateStopped
+	}
+}
+
+var listStateOrder = map[string]int{listStateRunning: 0, listStateStopped: 1, listStateMissing: 2}
+
+// sortListRows orders rows by the given key. Ties, and projects created
+// before created_at was recorded, fall back to the project name.
+func sortListRows(rows []listRow, key string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch key {
+		case "status":
+			if a.State != b.State {
+				return listStateOrder[a.State] < listStateOrder[b.State]
+			}
+		case "uptime":
+			if a.Uptime != b.Uptime {
+				return a.Uptime > b.Uptime
+			}
+		case "created":
+			ta, errA := time.Parse(time.RFC3339, a.Project.CreatedAt)
+			tb, errB := time.Parse(time.RFC3339, b.Project.CreatedAt)
+			switch {
+			case errA == nil && errB == nil && !ta.Equal(tb):
+				return ta.After(tb)
+			case (errA == nil) != (errB == nil):
+				return errA == nil
+			}
+		}
+		return a.Project.Name < b.Project.Name
+	})
 }
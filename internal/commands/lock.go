@@ -7,18 +7,23 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/parallel"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
 
 type lockFile struct {
 	Version     int               `json:"version"`
+	Minimal     bool              `json:"minimal,omitempty"`
 	Project     string            `json:"project"`
 	IslandName  string            `json:"ISLAND_NAME"`
 	CreatedAt   string            `json:"created_at"`
@@ -28,8 +33,15 @@ type lockFile struct {
 	Packages    lockPackages      `json:"packages"`
 	Registries  lockRegistries    `json:"registries,omitempty"`
 	AptSources  lockAptSources    `json:"apt_sources,omitempty"`
+	System      *lockSystem       `json:"system,omitempty"`
 	SetupScript []string          `json:"setup_commands,omitempty"`
 	Notes       map[string]string `json:"notes,omitempty"`
+	Workspace   *lockWorkspace    `json:"workspace,omitempty"`
+	// TrackedFiles maps the island files matching the project's tracked_files
+	// to their "sha256:<hex>" checksums
+	TrackedFiles map[string]string `json:"tracked_files,omitempty"`
+
+	VSCodeExtensions []string `json:"vscode_extensions,omitempty"`
 }
 
 type lockImage struct {
@@ -92,10 +104,30 @@ type lockAptSources struct {
 	SnapshotURL   string   `json:"snapshot_url,omitempty"`
 	SourcesLists  []string `json:"sources_lists,omitempty"`
 	PinnedRelease string   `json:"pinned_release,omitempty"`
+	// Preferences maps /etc/apt/preferences{,.d/*} paths to their contents
+	Preferences map[string]string `json:"preferences,omitempty"`
+}
+
+// lockSystem holds OS-level settings that differ from the image defaults
+type lockSystem struct {
+	Locale   string            `json:"locale,omitempty"`
+	Timezone string            `json:"timezone,omitempty"`
+	Ulimits  map[string]string `json:"ulimits,omitempty"`
+}
+
+// lockSystemFrom returns the lock's system section, or nil when every
+// setting is at its default
+func lockSystemFrom(s docker.SystemSettings) *lockSystem {
+	if s.Locale == "" && s.Timezone == "" && len(s.Ulimits) == 0 {
+		return nil
+	}
+	return &lockSystem{Locale: s.Locale, Timezone: s.Timezone, Ulimits: s.Ulimits}
 }
 
 var (
-	lockOutput string
+	lockOutput          string
+	lockRecordWorkspace string
+	lockMinimal         bool
 )
 
 var lockCmd = &cobra.Command{
@@ -104,23 +136,51 @@ var lockCmd = &cobra.Command{
 	Long: `Generate a deterministic, checksummed environment snapshot as coderaft.lock.json.
 
 The lock file captures the full island state: base image digest, container
-configuration, every installed package (apt, pip, npm, yarn, pnpm) with
-pinned versions, registry URLs, and apt sources. Package lists are sorted
-alphabetically for deterministic output and a SHA-256 checksum is computed
+configuration, every installed package (apt, pip, npm, yarn, pnpm, and more)
+with pinned versions, Go binaries installed with 'go install' (module@version),
+cargo-installed tools, registry URLs, apt sources, non-default locale,
+timezone and ulimits, VS Code server extensions (when VS Code has
+attached to the island), and checksums of the files coderaft.json lists in
+tracked_files. Package lists are sorted alphabetically for
+deterministic output and a SHA-256 checksum is computed
 over the reproducibility-critical fields so teammates can quickly verify
 whether two lock files describe the same environment.
 
+With --record-workspace, the lock also ties the environment to the code:
+"commit" records the git HEAD commit and whether the tree has uncommitted
+changes, "content" also hashes every file git doesn't ignore. verify then
+reports when the workspace is at a different commit or its content changed.
+Later locks keep recording the workspace the same way.
+
+With --minimal, the lock holds only what a person would write by hand: the
+base image, the packages installed explicitly (from coderaft.history, plus
+any already listed in the lock) pinned to their installed versions,
+registries and setup commands. The full package inventory and the container
+metadata are left out, and apply and verify only check what the lock lists,
+so it can be reviewed and edited in a pull request. Later locks stay minimal.
+
 Commit coderaft.lock.json to your repository. Teammates can then run
 'coderaft apply <project>' to reconcile their island to match, or
-'coderaft verify <project>' to check for drift.`,
+'coderaft verify <project>' to check for drift.
+
+Examples:
+  coderaft lock myproject
+  coderaft lock myproject -o ./env/coderaft.lock.json
+  coderaft lock myproject --record-workspace commit
+  coderaft lock myproject --minimal`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateWorkspaceMode(lockRecordWorkspace); err != nil {
+			return err
+		}
 		return WriteLockFileForProject(args[0], lockOutput)
 	},
 }
 
 func init() {
 	lockCmd.Flags().StringVarP(&lockOutput, "output", "o", "", "Output path for lock file (default: <workspace>/coderaft.lock.json)")
+	lockCmd.Flags().BoolVar(&lockMinimal, "minimal", false, "Write a small, hand-editable lock: base image, explicitly installed packages, registries and setup commands")
+	lockCmd.Flags().StringVar(&lockRecordWorkspace, "record-workspace", "", "Record the workspace's code state in the lock: commit (git HEAD and dirty state) or content (also a hash of the files)")
 }
 
 func WriteLockFileForProject(projectName string, outPath string) error {
@@ -130,7 +190,7 @@ func WriteLockFileForProject(projectName string, outPath string) error {
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
 	}
 
 	return WriteLockFileForIsland(proj.IslandName, proj.Name, proj.WorkspacePath, proj.BaseImage, outPath)
@@ -142,7 +202,7 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' does not exist. Start it first", IslandName)
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' does not exist. Start it first", IslandName)
 	}
 	status, err := dockerClient.GetIslandStatus(IslandName)
 	if err != nil {
@@ -177,43 +237,26 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 	}
 
 	envMap, workdir, user, restart, labels, capabilities, resources, network := dockerClient.GetContainerMeta(IslandName)
+	envMap, labels = withoutSecretEnv(envMap, labels)
 
 	filteredEnvMap := security.FilterSensitiveEnvVars(envMap)
 
 	ui.Status("gathering package information...")
 	pkgs := dockerClient.QueryAllPackages(IslandName)
 
-	// Sort all package lists for deterministic output
-	sort.Strings(pkgs.Apt)
-	sort.Strings(pkgs.Apk)
-	sort.Strings(pkgs.Dnf)
-	sort.Strings(pkgs.Pacman)
-	sort.Strings(pkgs.Brew)
-	sort.Strings(pkgs.Snap)
-	sort.Strings(pkgs.Pip)
-	sort.Strings(pkgs.Pipx)
-	sort.Strings(pkgs.Conda)
-	sort.Strings(pkgs.Poetry)
-	sort.Strings(pkgs.Npm)
-	sort.Strings(pkgs.Yarn)
-	sort.Strings(pkgs.Pnpm)
-	sort.Strings(pkgs.Bun)
-	sort.Strings(pkgs.Cargo)
-	sort.Strings(pkgs.Go)
-	sort.Strings(pkgs.Gem)
-	sort.Strings(pkgs.Composer)
-
 	aptSnapshot, aptSources, aptRelease := dockerClient.GetAptSources(IslandName)
 	pipIndex, pipExtras := dockerClient.GetPipRegistries(IslandName)
 	npmReg, yarnReg, pnpmReg := dockerClient.GetNodeRegistries(IslandName)
 
 	var gpuConfig string
+	var trackedFiles []string
 	if pcfg, pcfgErr := configManager.LoadProjectConfig(workspacePath); pcfgErr == nil && pcfg != nil {
 		gpuConfig = pcfg.Gpus
+		trackedFiles = pcfg.TrackedFiles
 	}
 
 	lf := lockFile{
-		Version:    2,
+		Version:    currentLockVersion,
 		Project:    projectName,
 		IslandName: IslandName,
 		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
@@ -231,30 +274,7 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 			Resources:    resources,
 			Gpus:         gpuConfig,
 		},
-		Packages: lockPackages{
-			// System
-			Apt:    pkgs.Apt,
-			Apk:    pkgs.Apk,
-			Dnf:    pkgs.Dnf,
-			Pacman: pkgs.Pacman,
-			Brew:   pkgs.Brew,
-			Snap:   pkgs.Snap,
-			// Python
-			Pip:    pkgs.Pip,
-			Pipx:   pkgs.Pipx,
-			Conda:  pkgs.Conda,
-			Poetry: pkgs.Poetry,
-			// Node.js
-			Npm:  pkgs.Npm,
-			Yarn: pkgs.Yarn,
-			Pnpm: pkgs.Pnpm,
-			Bun:  pkgs.Bun,
-			// Language-specific
-			Cargo:    pkgs.Cargo,
-			Go:       pkgs.Go,
-			Gem:      pkgs.Gem,
-			Composer: pkgs.Composer,
-		},
+		Packages: lockPackagesFrom(pkgs),
 		Registries: lockRegistries{
 			PipIndexURL:   pipIndex,
 			PipExtraIndex: pipExtras,
@@ -266,7 +286,18 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 			SnapshotURL:   aptSnapshot,
 			SourcesLists:  aptSources,
 			PinnedRelease: aptRelease,
+			Preferences:   dockerClient.GetAptPreferences(IslandName),
 		},
+		System: lockSystemFrom(dockerClient.GetSystemSettings(IslandName)),
+	}
+
+	// Only present once VS Code has attached to the island and installed its server
+	lf.VSCodeExtensions = queryVSCodeExtensions(IslandName)
+
+	if cfg, cfgErr := configManager.Load(); cfgErr == nil {
+		exclude := newPackageExclusions(cfg.Settings)
+		lf.Packages = exclude.filterPackages(lf.Packages)
+		lf.VSCodeExtensions = exclude.filter("vscode", "@", lf.VSCodeExtensions)
 	}
 
 	if pcfg2, pcfg2Err := configManager.LoadProjectConfig(workspacePath); pcfg2Err == nil && pcfg2 != nil {
@@ -275,13 +306,35 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 		}
 	}
 
-	lf.Checksum = computeLockChecksum(&lf)
-
 	finalOut := strings.TrimSpace(outPath)
 	if finalOut == "" {
 		finalOut = filepath.Join(workspacePath, "coderaft.lock.json")
 	}
 
+	// Without --record-workspace or --minimal, keep writing the lock the way
+	// the existing one was written
+	prev, _ := readLockFile(finalOut)
+	if lockMinimal || (prev != nil && prev.Minimal) {
+		lf = minimalLockFile(lf, readHistoryPackages(workspacePath), prev)
+	}
+	if prev != nil {
+		lf.Notes = prev.Notes
+	}
+	workspaceMode := lockRecordWorkspace
+	if workspaceMode == "" && prev != nil {
+		workspaceMode = prev.Workspace.mode()
+	}
+	if workspaceMode != "" {
+		if lf.Workspace, err = readWorkspaceState(workspacePath, workspaceMode); err != nil {
+			ui.Warning("not recording the workspace state: %v", err)
+		}
+	}
+
+	// Tracked files are listed by hand, so even a minimal lock keeps them
+	lf.TrackedFiles = dockerClient.GetFileChecksums(IslandName, trackedFiles)
+
+	lf.Checksum = computeLockChecksum(&lf)
+
 	b, err := json.MarshalIndent(lf, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal lock file: %w", err)
@@ -294,6 +347,97 @@ func WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, o
 	return nil
 }
 
+// setLockNote sets a note in an existing lock file. Notes aren't part of the
+// checksum, so it stays valid.
+func setLockNote(path, key, value string) error {
+	lf, err := readLockFile(path)
+	if err != nil {
+		return err
+	}
+	if lf.Notes == nil {
+		lf.Notes = map[string]string{}
+	}
+	lf.Notes[key] = value
+	b, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock file: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return nil
+}
+
+// lockPackagesFrom converts the packages queried from an island, each list
+// sorted, so lock and verify hash them the same way
+func lockPackagesFrom(pkgs *docker.PackageLists) lockPackages {
+	lp := lockPackages{
+		Apt:      pkgs.Apt,
+		Apk:      pkgs.Apk,
+		Dnf:      pkgs.Dnf,
+		Pacman:   pkgs.Pacman,
+		Brew:     pkgs.Brew,
+		Snap:     pkgs.Snap,
+		Pip:      pkgs.Pip,
+		Pipx:     pkgs.Pipx,
+		Conda:    pkgs.Conda,
+		Poetry:   pkgs.Poetry,
+		Npm:      pkgs.Npm,
+		Yarn:     pkgs.Yarn,
+		Pnpm:     pkgs.Pnpm,
+		Bun:      pkgs.Bun,
+		Cargo:    pkgs.Cargo,
+		Go:       pkgs.Go,
+		Gem:      pkgs.Gem,
+		Composer: pkgs.Composer,
+	}
+	for _, list := range [][]string{
+		lp.Apt, lp.Apk, lp.Dnf, lp.Pacman, lp.Brew, lp.Snap,
+		lp.Pip, lp.Pipx, lp.Conda, lp.Poetry,
+		lp.Npm, lp.Yarn, lp.Pnpm, lp.Bun,
+		lp.Cargo, lp.Go, lp.Gem, lp.Composer,
+	} {
+		sort.Strings(list)
+	}
+	return lp
+}
+
+// currentLockVersion is the lock format written by 'coderaft lock'. Version 2
+// added the checksum that verify uses for its fast path.
+const currentLockVersion = 2
+
+// migrateLockData upgrades a lock file to currentLockVersion, returning the
+// rewritten file and a description of each change. A current lock is
+// returned unchanged with no changes.
+func migrateLockData(data []byte) ([]byte, []string, error) {
+	var lf lockFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return nil, nil, fmt.Errorf("invalid lockfile: %w", err)
+	}
+	if lf.Version > currentLockVersion {
+		return nil, nil, fmt.Errorf("lock version %d is newer than this coderaft supports (%d); upgrade coderaft", lf.Version, currentLockVersion)
+	}
+
+	var changes []string
+	if lf.Checksum == "" {
+		lf.Checksum = computeLockChecksum(&lf)
+		changes = append(changes, "added checksum "+lf.Checksum)
+	}
+	if lf.Version < currentLockVersion {
+		changes = append(changes, fmt.Sprintf("lock version %d → %d", lf.Version, currentLockVersion))
+		lf.Version = currentLockVersion
+	}
+	if len(changes) == 0 {
+		return data, nil, nil
+	}
+
+	out, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal lock file: %w", err)
+	}
+	return out, changes, nil
+}
+
 func computeLockChecksum(lf *lockFile) string {
 	h := sha256.New()
 
@@ -376,5 +520,78 @@ func computeLockChecksum(lf *lockFile) string {
 	}
 	h.Write([]byte(lf.AptSources.PinnedRelease))
 
+	// Hashed only when present so locks without these sections keep their checksum
+	if lf.Minimal {
+		h.Write([]byte("minimal\x00"))
+	}
+	if len(lf.VSCodeExtensions) > 0 {
+		writeList("vscode:", lf.VSCodeExtensions)
+	}
+	if len(lf.AptSources.Preferences) > 0 {
+		paths := make([]string, 0, len(lf.AptSources.Preferences))
+		for p := range lf.AptSources.Preferences {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		h.Write([]byte("apt-preferences:"))
+		for _, p := range paths {
+			h.Write([]byte(p + "\x00" + lf.AptSources.Preferences[p] + "\x00"))
+		}
+	}
+	if lf.System != nil {
+		h.Write([]byte("system:" + lf.System.Locale + "\x00" + lf.System.Timezone + "\x00"))
+		writeSortedMap("ulimits:", lf.System.Ulimits)
+	}
+	if lf.Workspace != nil {
+		h.Write([]byte(fmt.Sprintf("workspace:%s\x00%t\x00%s\x00", lf.Workspace.Commit, lf.Workspace.Dirty, lf.Workspace.ContentHash)))
+	}
+	if len(lf.TrackedFiles) > 0 {
+		writeSortedMap("tracked-files:", lf.TrackedFiles)
+	}
+
 	return "sha256:" + hex.EncodeToString(h.Sum(nil))
 }
+
+var vscodeExtensionDirPattern = regexp.MustCompile(`^([^.\s]+\.\S+?)-(\d+\.\d+\.\d+)(-[a-z0-9-]+)?$`)
+
+// queryVSCodeExtensions returns the island's VS Code server extensions as
+// sorted "publisher.name@version" entries, or nil when no server is installed
+func queryVSCodeExtensions(islandName string) []string {
+	out, _, err := dockerClient.ExecCapture(islandName, parallel.VSCodeExtensionsQuery)
+	if err != nil {
+		return nil
+	}
+	return parseVSCodeExtensions(out)
+}
+
+// parseVSCodeExtensions normalizes 'code-server --list-extensions
+// --show-versions' output or extension directory names. IDs are lowercased
+// because VS Code treats them case-insensitively.
+func parseVSCodeExtensions(output string) []string {
+	seen := map[string]bool{}
+	var exts []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var id, version string
+		if name, ver, ok := strings.Cut(line, "@"); ok {
+			id, version = name, ver
+		} else if m := vscodeExtensionDirPattern.FindStringSubmatch(line); m != nil {
+			id, version = m[1], m[2]
+		} else {
+			continue
+		}
+		if !strings.Contains(id, ".") || version == "" {
+			continue
+		}
+		entry := strings.ToLower(id) + "@" + version
+		if !seen[entry] {
+			seen[entry] = true
+			exts = append(exts, entry)
+		}
+	}
+	sort.Strings(exts)
+	return exts
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"path"
+	"strings"
+
+	"coderaft/internal/config"
+)
+
+// lockPackageSeps is the separator between name and version in each
+// manager's lock entries
+var lockPackageSeps = map[string]string{
+	"apt": "=", "apk": "=", "dnf": "=", "pacman": "=", "brew": "=", "snap": "=",
+	"pip": "==", "pipx": "==", "conda": "=", "poetry": "==",
+	"npm": "@", "yarn": "@", "pnpm": "@", "bun": "@",
+	"cargo": "=", "go": "@", "gem": "=", "composer": "=",
+	"vscode": "@",
+}
+
+// packageExclusions maps a package manager to the glob patterns of
+// settings.lock_exclude_packages. Packages they match are left out of the
+// lock and ignored by verify and apply.
+type packageExclusions map[string][]string
+
+// newPackageExclusions reads settings.lock_exclude_packages. Patterns are
+// lower-cased for every manager but go, whose module paths are
+// case-sensitive, to match how parsePackageList reads names.
+func newPackageExclusions(settings *config.GlobalSettings) packageExclusions {
+	if settings == nil || len(settings.LockExcludePackages) == 0 {
+		return nil
+	}
+	e := packageExclusions{}
+	for manager, patterns := range settings.LockExcludePackages {
+		manager = strings.ToLower(strings.TrimSpace(manager))
+		for _, p := range patterns {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			if manager != "go" {
+				p = strings.ToLower(p)
+			}
+			e[manager] = append(e[manager], p)
+		}
+	}
+	return e
+}
+
+// excludes reports whether a package name matches one of the manager's
+// patterns. Patterns use path.Match syntax, so '*' doesn't cross a '/'.
+func (e packageExclusions) excludes(manager, name string) bool {
+	for _, p := range e[manager] {
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter drops the entries of a lock or live package list that are excluded
+func (e packageExclusions) filter(manager, sep string, list []string) []string {
+	if len(e[manager]) == 0 {
+		return list
+	}
+	var kept []string
+	for _, entry := range list {
+		excluded := false
+		for name := range parsePackageList(manager, []string{entry}, sep) {
+			excluded = e.excludes(manager, name)
+		}
+		if !excluded {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// filterPackages drops excluded packages from every manager's list
+func (e packageExclusions) filterPackages(p lockPackages) lockPackages {
+	if len(e) == 0 {
+		return p
+	}
+	for manager, list := range map[string]*[]string{
+		"apt": &p.Apt, "apk": &p.Apk, "dnf": &p.Dnf, "pacman": &p.Pacman, "brew": &p.Brew, "snap": &p.Snap,
+		"pip": &p.Pip, "pipx": &p.Pipx, "conda": &p.Conda, "poetry": &p.Poetry,
+		"npm": &p.Npm, "yarn": &p.Yarn, "pnpm": &p.Pnpm, "bun": &p.Bun,
+		"cargo": &p.Cargo, "go": &p.Go, "gem": &p.Gem, "composer": &p.Composer,
+	} {
+		*list = e.filter(manager, lockPackageSeps[manager], *list)
+	}
+	return p
+}
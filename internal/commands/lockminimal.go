@@ -0,0 +1,265 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lockManagers are the package managers a minimal lock can pin, with the
+// separator between name and version in their package lists
+var lockManagers = []struct {
+	name string
+	sep  string
+}{
+	{"apt", "="},
+	{"apk", "="},
+	{"pip", "=="},
+	{"npm", "@"},
+	{"yarn", "@"},
+	{"pnpm", "@"},
+	{"go", "@"},
+	{"cargo", "="},
+}
+
+// list returns the package list of the given manager in p, or nil
+func (p *lockPackages) list(manager string) *[]string {
+	switch manager {
+	case "apt":
+		return &p.Apt
+	case "apk":
+		return &p.Apk
+	case "pip":
+		return &p.Pip
+	case "npm":
+		return &p.Npm
+	case "yarn":
+		return &p.Yarn
+	case "pnpm":
+		return &p.Pnpm
+	case "go":
+		return &p.Go
+	case "cargo":
+		return &p.Cargo
+	}
+	return nil
+}
+
+// historyPackages returns the packages coderaft.history shows were installed
+// by hand, by manager. npm, yarn and pnpm only count global installs, since
+// project dependencies are already pinned by the project's own lockfile.
+func historyPackages(history string) map[string][]string {
+	seen := map[string]map[string]bool{}
+	for _, line := range strings.Split(history, "\n") {
+		manager, names := parseHistoryInstall(strings.TrimSpace(line))
+		if manager == "" {
+			continue
+		}
+		if seen[manager] == nil {
+			seen[manager] = map[string]bool{}
+		}
+		for _, name := range names {
+			seen[manager][name] = true
+		}
+	}
+
+	pkgs := map[string][]string{}
+	for manager, names := range seen {
+		for name := range names {
+			pkgs[manager] = append(pkgs[manager], name)
+		}
+		sort.Strings(pkgs[manager])
+	}
+	return pkgs
+}
+
+// parseHistoryInstall returns the manager and package names of an install
+// command, or "" for anything else
+func parseHistoryInstall(line string) (string, []string) {
+	fields := strings.Fields(line)
+	// drop env assignments such as DEBIAN_FRONTEND=noninteractive, and sudo
+	for len(fields) > 0 && (fields[0] == "sudo" || (strings.Contains(fields[0], "=") && !strings.HasPrefix(fields[0], "-"))) {
+		fields = fields[1:]
+	}
+	if len(fields) >= 3 && strings.HasPrefix(fields[0], "python") && fields[1] == "-m" {
+		fields = fields[2:]
+	}
+	if len(fields) < 2 {
+		return "", nil
+	}
+
+	var manager string
+	var rest []string
+	global := false
+	switch cmd, sub := fields[0], fields[1]; {
+	case (cmd == "apt" || cmd == "apt-get") && sub == "install":
+		manager, rest = "apt", fields[2:]
+	case cmd == "apk" && sub == "add":
+		manager, rest = "apk", fields[2:]
+	case (cmd == "pip" || cmd == "pip3") && sub == "install":
+		manager, rest = "pip", fields[2:]
+	case cmd == "npm" && (sub == "install" || sub == "i" || sub == "add"):
+		manager, rest = "npm", fields[2:]
+	case cmd == "yarn" && sub == "global" && len(fields) > 2 && fields[2] == "add":
+		manager, rest, global = "yarn", fields[3:], true
+	case cmd == "pnpm" && (sub == "add" || sub == "install" || sub == "i"):
+		manager, rest = "pnpm", fields[2:]
+	case cmd == "go" && sub == "install":
+		manager, rest, global = "go", fields[2:], true
+	case cmd == "cargo" && sub == "install":
+		manager, rest, global = "cargo", fields[2:], true
+	default:
+		return "", nil
+	}
+
+	var names []string
+	for i := 0; i < len(rest); i++ {
+		arg := strings.Trim(rest[i], `'"`)
+		switch {
+		case arg == "-g" || arg == "--global":
+			global = true
+			continue
+		case arg == "--version" || arg == "-r" || arg == "--requirement" || arg == "-t" || arg == "--virtual":
+			// the next argument is the flag's value, not a package
+			i++
+			continue
+		case strings.HasPrefix(arg, "-"):
+			continue
+		case strings.Contains(arg, "/") && (manager == "apt" || manager == "apk" || manager == "pip" || manager == "cargo"):
+			// a local file, directory or URL rather than a package name
+			continue
+		}
+		if name := packageNameOf(manager, arg); name != "" {
+			names = append(names, name)
+		}
+	}
+	if manager != "apt" && manager != "apk" && manager != "pip" && !global {
+		return "", nil
+	}
+	return manager, names
+}
+
+// packageNameOf strips the version from a package argument such as
+// requests==2.31.0, jq=1.6-2 or eslint@8
+func packageNameOf(manager, arg string) string {
+	name := arg
+	switch manager {
+	case "pip":
+		if i := strings.IndexAny(name, "=<>!~;["); i >= 0 {
+			name = name[:i]
+		}
+	case "apt":
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+	case "apk":
+		if i := strings.IndexAny(name, "=<>~@"); i >= 0 {
+			name = name[:i]
+		}
+	case "npm", "yarn", "pnpm", "go":
+		if i := strings.LastIndex(name, "@"); i > 0 {
+			name = name[:i]
+		}
+	}
+	if manager == "go" {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// minimalPackages pins each explicitly installed package, and each package
+// the previous minimal lock listed, to the version the island has. A package
+// the island no longer has keeps its previous pin; one that was never pinned
+// is dropped.
+func minimalPackages(explicit map[string][]string, prev, live lockPackages) lockPackages {
+	var out lockPackages
+	for _, m := range lockManagers {
+		liveEntries := *live.list(m.name)
+		prevEntries := *prev.list(m.name)
+
+		liveByName := packageEntries(m.name, m.sep, liveEntries)
+		prevByName := packageEntries(m.name, m.sep, prevEntries)
+		names := map[string]bool{}
+		for _, name := range explicit[m.name] {
+			names[name] = true
+		}
+		for name := range prevByName {
+			names[name] = true
+		}
+
+		var pinned []string
+		for name := range names {
+			if entry, ok := liveByName[name]; ok {
+				pinned = append(pinned, entry)
+			} else if entry, ok := prevByName[name]; ok {
+				pinned = append(pinned, entry)
+			}
+		}
+		sort.Strings(pinned)
+		*out.list(m.name) = pinned
+	}
+	return out
+}
+
+// packageEntries maps each package's name to its entry in list
+func packageEntries(manager, sep string, list []string) map[string]string {
+	entries := map[string]string{}
+	for _, entry := range list {
+		for name := range parsePackageList(manager, []string{entry}, sep) {
+			entries[name] = entry
+		}
+	}
+	return entries
+}
+
+// restrictToLock keeps only the live packages the lock names. A minimal lock
+// lists just the packages it cares about, so apply and verify leave every
+// other package, and every manager the lock doesn't mention, alone.
+func restrictToLock(locked, live lockPackages) lockPackages {
+	out := live
+	for _, m := range lockManagers {
+		lockNames := parsePackageList(m.name, *locked.list(m.name), m.sep)
+		var kept []string
+		for name, entry := range packageEntries(m.name, m.sep, *live.list(m.name)) {
+			if _, ok := lockNames[name]; ok {
+				kept = append(kept, entry)
+			}
+		}
+		sort.Strings(kept)
+		*out.list(m.name) = kept
+	}
+	return out
+}
+
+// minimalLockFile trims a full lock down to what a person would write by
+// hand: the base image, the explicitly installed packages, registries and
+// setup commands. The container metadata, apt sources, system settings and
+// VS Code extensions are left out, so apply and verify don't check them.
+func minimalLockFile(full lockFile, explicit map[string][]string, prev *lockFile) lockFile {
+	var prevPkgs lockPackages
+	if prev != nil && prev.Minimal {
+		prevPkgs = prev.Packages
+	}
+	return lockFile{
+		Version:     full.Version,
+		Minimal:     true,
+		Project:     full.Project,
+		IslandName:  full.IslandName,
+		CreatedAt:   full.CreatedAt,
+		BaseImage:   lockImage{Name: full.BaseImage.Name, Digest: full.BaseImage.Digest},
+		Packages:    minimalPackages(explicit, prevPkgs, full.Packages),
+		Registries:  full.Registries,
+		SetupScript: full.SetupScript,
+	}
+}
+
+// readHistoryPackages reads the hand-installed packages from the workspace's
+// coderaft.history, if it has one
+func readHistoryPackages(workspacePath string) map[string][]string {
+	data, err := os.ReadFile(filepath.Join(workspacePath, "coderaft.history"))
+	if err != nil {
+		return nil
+	}
+	return historyPackages(string(data))
+}
@@ -0,0 +1,338 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/parallel"
+	"coderaft/internal/ui"
+)
+
+var (
+	logsSetup   bool
+	logsGrep    string
+	logsLevel   string
+	logsContext int
+	logsFollow  bool
+	logsTail    string
+	logsSince   string
+)
+
+const (
+	logLevelError   = "error"
+	logLevelWarning = "warning"
+)
+
+var (
+	logErrorPattern   = regexp.MustCompile(`(?i)(^E: |\berr!|\berror\b|\bfatal\b|\bfailed\b|\bfailure\b|\bpanic\b|traceback|exception\b|\bcannot\b|\bcould not\b|permission denied|no such file|not found|^<== exit [1-9])`)
+	logWarningPattern = regexp.MustCompile(`(?i)(^W: |\bwarn\b|\bwarning\b|\bdeprecated\b|\bdeprecation\b)`)
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <project>",
+	Short: "Show a project's island output, or its captured setup output",
+	Long: `Show what a project's island has printed, or with --setup the setup output
+captured the last time the island was created.
+
+Without --setup, logs shows the output of the island's main process, the way
+'docker logs' does: anything written to /proc/1/fd/1 or /proc/1/fd/2 inside
+the island, such as a server started with its output redirected there. --tail
+limits it to the last N lines, --since to output newer than a duration (10m)
+or timestamp, and --follow keeps streaming until you interrupt it. A stopped
+island shows its output up to when it stopped.
+
+Every setup command, cached image build, and reconcile step appends its output
+to ~/.coderaft/logs/<island>/setup.log. Use --grep and --level to narrow it
+down; levels are pattern based, so "error" matches lines such as "E: ...",
+"npm ERR!", "failed" or "Traceback", and "warning" additionally matches
+"W: ...", "warning" and "deprecated".
+
+If the island's setup was started in the background with 'coderaft up
+--detach-setup', its output is read from the island instead, and --follow
+keeps printing it until the setup finishes.
+
+Examples:
+  coderaft logs myproject
+  coderaft logs myproject -f --tail 100
+  coderaft logs myproject --since 10m --level error
+  coderaft logs myproject --setup
+  coderaft logs myproject --setup -f
+  coderaft logs myproject --setup --level error
+  coderaft logs myproject --setup --grep "error|warning" --context 3`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName := args[0]
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+		if logsSetup && (cmd.Flags().Changed("tail") || logsSince != "") {
+			return fmt.Errorf("--tail and --since apply to the island's output, not --setup")
+		}
+		if err := validateLogTail(logsTail); err != nil {
+			return err
+		}
+		if logsContext < 0 {
+			return fmt.Errorf("--context cannot be negative")
+		}
+		if logsLevel != "" && logsLevel != logLevelError && logsLevel != logLevelWarning {
+			return fmt.Errorf("invalid level '%s' (expected '%s' or '%s')", logsLevel, logLevelError, logLevelWarning)
+		}
+		if logsFollow && (logsGrep != "" || logsLevel != "" || logsContext > 0) {
+			return fmt.Errorf("--follow cannot be combined with --grep, --level or --context")
+		}
+
+		var grep *regexp.Regexp
+		if logsGrep != "" {
+			var err error
+			grep, err = regexp.Compile(logsGrep)
+			if err != nil {
+				return fmt.Errorf("invalid --grep pattern: %w", err)
+			}
+		}
+
+		cfg, err := configManager.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		if !logsSetup {
+			return showIslandLogs(cfg, projectName, grep)
+		}
+		islandName := fmt.Sprintf("coderaft_%s", projectName)
+		if project, ok := cfg.GetProject(projectName); ok && project.IslandName != "" {
+			islandName = project.IslandName
+		}
+
+		var background docker.SetupState
+		if status, err := dockerClient.GetIslandStatus(islandName); err == nil && status == "running" {
+			background = dockerClient.GetSetupState(islandName)
+		}
+
+		var path string
+		var lines []string
+		if background.State != docker.SetupStateNone {
+			if logsFollow {
+				return docker.FollowBackgroundSetupLog(islandName)
+			}
+			path = islandName + ":" + docker.BackgroundSetupLog
+			out, _, err := dockerClient.ExecCapture(islandName, "cat "+docker.BackgroundSetupLog)
+			if err != nil {
+				return fmt.Errorf("failed to read background setup log: %w", err)
+			}
+			if out = strings.TrimRight(out, "\n"); out != "" {
+				lines = strings.Split(out, "\n")
+			}
+		} else {
+			path, err = parallel.SetupLogPath(islandName)
+			if err != nil {
+				return err
+			}
+			lines, err = readLogLines(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return fmt.Errorf("no setup log for '%s'; it is written the next time the island is created with 'coderaft up' or 'coderaft clone'", projectName)
+				}
+				return fmt.Errorf("failed to read setup log: %w", err)
+			}
+			if logsFollow {
+				defer ui.Info("no background setup is running, nothing to follow")
+			}
+		}
+
+		filtered := filterLogLines(lines, grep, logsLevel, logsContext)
+		if len(filtered) == 0 && (grep != nil || logsLevel != "") {
+			ui.Info("no matching lines in %s", path)
+			return nil
+		}
+
+		printLogLines(filtered, grep != nil || logsLevel != "")
+		return nil
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVar(&logsSetup, "setup", false, "Show captured setup command output")
+	logsCmd.Flags().StringVar(&logsGrep, "grep", "", "Only show lines matching this regular expression")
+	logsCmd.Flags().StringVar(&logsLevel, "level", "", "Only show lines at or above a level: error or warning")
+	logsCmd.Flags().IntVarP(&logsContext, "context", "C", 0, "Show N lines of context around each match")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "Keep printing new output; with --setup, a background setup's output until it finishes")
+	logsCmd.Flags().StringVar(&logsTail, "tail", "all", "Number of lines to show from the end of the island's output, or \"all\"")
+	logsCmd.Flags().StringVar(&logsSince, "since", "", "Only show island output newer than a duration (e.g. 10m) or a timestamp (e.g. 2024-01-02T15:04:05Z)")
+}
+
+// showIslandLogs prints the output of a project's island. With a filter the
+// output is read in full and filtered like a setup log; otherwise it is
+// streamed as it is, stdout and stderr apart.
+func showIslandLogs(cfg *config.Config, projectName string, grep *regexp.Regexp) error {
+	project, ok := cfg.GetProject(projectName)
+	if !ok {
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+	}
+	exists, err := dockerClient.IslandExists(project.IslandName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", project.IslandName, projectName)
+	}
+	if status, err := dockerClient.GetIslandStatus(project.IslandName); err == nil && status != "running" {
+		if logsFollow {
+			ui.Warning("island '%s' is %s; showing its output up to when it stopped, nothing to follow", project.IslandName, status)
+		} else {
+			ui.Status("island '%s' is %s; showing its output up to when it stopped", project.IslandName, status)
+		}
+	}
+
+	opts := docker.LogOptions{Follow: logsFollow, Tail: logsTail, Since: logsSince}
+	if grep == nil && logsLevel == "" && logsContext == 0 {
+		return dockerClient.IslandLogs(project.IslandName, opts, os.Stdout, os.Stderr)
+	}
+
+	var out bytes.Buffer
+	if err := dockerClient.IslandLogs(project.IslandName, opts, &out, &out); err != nil {
+		return err
+	}
+	var lines []string
+	if text := strings.TrimRight(strings.ReplaceAll(out.String(), "\r\n", "\n"), "\n"); text != "" {
+		lines = strings.Split(text, "\n")
+	}
+	filtered := filterLogLines(lines, grep, logsLevel, logsContext)
+	if len(filtered) == 0 {
+		ui.Info("no matching lines in the output of island '%s'", project.IslandName)
+		return nil
+	}
+	printLogLines(filtered, true)
+	return nil
+}
+
+// validateLogTail accepts "all" or a number of lines
+func validateLogTail(tail string) error {
+	if tail == "all" {
+		return nil
+	}
+	if n, err := strconv.Atoi(tail); err != nil || n < 0 {
+		return fmt.Errorf("invalid --tail '%s' (expected a number of lines or \"all\")", tail)
+	}
+	return nil
+}
+
+// printLogLines prints filtered log lines, coloring errors and warnings on a
+// terminal and, when numbered, marking matches with ':' like grep
+func printLogLines(lines []logLine, numbered bool) {
+	color := term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == ""
+	for _, l := range lines {
+		if l.Separator {
+			fmt.Println("--")
+			continue
+		}
+		text := l.Text
+		if color {
+			switch classifyLogLine(l.Text) {
+			case logLevelError:
+				text = "\x1b[31m" + text + "\x1b[0m"
+			case logLevelWarning:
+				text = "\x1b[33m" + text + "\x1b[0m"
+			}
+		}
+		if numbered {
+			sep := "-"
+			if l.Match {
+				sep = ":"
+			}
+			fmt.Printf("%d%s%s\n", l.Number, sep, text)
+		} else {
+			fmt.Println(text)
+		}
+	}
+}
+
+type logLine struct {
+	Number    int
+	Text      string
+	Match     bool
+	Separator bool
+}
+
+func readLogLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+// classifyLogLine guesses a line's level from common tool output patterns
+func classifyLogLine(line string) string {
+	if logErrorPattern.MatchString(line) {
+		return logLevelError
+	}
+	if logWarningPattern.MatchString(line) {
+		return logLevelWarning
+	}
+	return ""
+}
+
+// filterLogLines keeps lines matching grep (if set) and at or above level (if
+// set), plus context lines around each match. Non-adjacent groups are split by
+// a separator entry, like grep -C.
+func filterLogLines(lines []string, grep *regexp.Regexp, level string, context int) []logLine {
+	if grep == nil && level == "" {
+		out := make([]logLine, len(lines))
+		for i, l := range lines {
+			out[i] = logLine{Number: i + 1, Text: l, Match: true}
+		}
+		return out
+	}
+
+	matches := make([]bool, len(lines))
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if grep != nil && !grep.MatchString(l) {
+			continue
+		}
+		if level != "" {
+			lvl := classifyLogLine(l)
+			if lvl == "" || (level == logLevelError && lvl != logLevelError) {
+				continue
+			}
+		}
+		matches[i] = true
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var out []logLine
+	last := -1
+	for i, l := range lines {
+		if !keep[i] {
+			continue
+		}
+		if last >= 0 && i > last+1 && context > 0 {
+			out = append(out, logLine{Separator: true})
+		}
+		out = append(out, logLine{Number: i + 1, Text: l, Match: matches[i]})
+		last = i
+	}
+	return out
+}
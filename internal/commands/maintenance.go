@@ -9,6 +9,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/config"
 	"coderaft/internal/ui"
 )
 
@@ -339,6 +340,7 @@ func updateAllislands() error {
 			"apt autoclean",
 		}
 
+		invalidateVerifyCache(project.IslandName)
 		if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, updateCommands, false); err != nil {
 			ui.Error("failed to update %s: %v", projectName, err)
 			failed++
@@ -444,84 +446,88 @@ func rebuildAllislands() error {
 		ui.Blank()
 		ui.Status("rebuilding %s...", projectName)
 
-		if exists, err := dockerClient.IslandExists(project.IslandName); err != nil {
-			ui.Error("failed to check if %s exists: %v", project.IslandName, err)
+		if err := rebuildProjectIsland(cfg, projectName, project, true); err != nil {
+			ui.Error("%v", err)
 			failed++
 			continue
-		} else if exists {
-			ui.Status("stopping and removing existing island...")
-			dockerClient.StopIsland(project.IslandName)
-			if err := dockerClient.RemoveIsland(project.IslandName); err != nil {
-				ui.Error("failed to remove %s: %v", project.IslandName, err)
-				failed++
-				continue
-			}
 		}
 
-		ui.Status("recreating island...")
+		ui.Success("%s rebuilt", projectName)
+		rebuilt++
+	}
 
-		projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
-		if err != nil {
-			ui.Warning("could not load project config: %v", err)
-		}
+	ui.Blank()
+	ui.Summary("%d rebuilt, %d failed", rebuilt, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to rebuild %d island(s)", failed)
+	}
 
-		baseImage := cfg.GetEffectiveBaseImage(project, projectConfig)
-		if err := dockerClient.PullImage(baseImage); err != nil {
-			ui.Error("failed to pull %s: %v", baseImage, err)
-			failed++
-			continue
-		}
+	return nil
+}
 
-		workspaceIsland := "/island"
-		if projectConfig != nil && projectConfig.WorkingDir != "" {
-			workspaceIsland = projectConfig.WorkingDir
+// rebuildProjectIsland stops and removes a project's island, recreates it from
+// the (re-pulled) base image, and runs its setup. With update, system packages
+// are upgraded before the project's setup commands run.
+func rebuildProjectIsland(cfg *config.Config, projectName string, project *config.Project, update bool) error {
+	if exists, err := dockerClient.IslandExists(project.IslandName); err != nil {
+		return fmt.Errorf("failed to check if %s exists: %w", project.IslandName, err)
+	} else if exists {
+		ui.Status("stopping and removing existing island...")
+		dockerClient.StopIsland(project.IslandName)
+		if err := dockerClient.RemoveIsland(project.IslandName); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", project.IslandName, err)
 		}
+	}
 
-		islandID, err := dockerClient.CreateIsland(project.IslandName, baseImage, project.WorkspacePath, workspaceIsland)
-		if err != nil {
-			ui.Error("failed to create %s: %v", project.IslandName, err)
-			failed++
-			continue
-		}
+	ui.Status("recreating island...")
 
-		if err := dockerClient.StartIsland(islandID); err != nil {
-			ui.Error("failed to start %s: %v", project.IslandName, err)
-			failed++
-			continue
-		}
+	projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
+	if err != nil {
+		ui.Warning("could not load project config: %v", err)
+	}
 
-		if err := dockerClient.WaitForIsland(project.IslandName, 30*time.Second); err != nil {
-			ui.Error("island %s failed to start: %v", project.IslandName, err)
-			failed++
-			continue
-		}
+	baseImage := cfg.GetEffectiveBaseImage(project, projectConfig)
+	if err := dockerClient.PullImage(baseImage); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", baseImage, err)
+	}
+
+	workspaceIsland := "/island"
+	if projectConfig != nil && projectConfig.WorkingDir != "" {
+		workspaceIsland = projectConfig.WorkingDir
+	}
+
+	islandID, err := dockerClient.CreateIsland(project.IslandName, baseImage, project.WorkspacePath, workspaceIsland)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", project.IslandName, err)
+	}
+
+	if err := dockerClient.StartIsland(islandID); err != nil {
+		return fmt.Errorf("failed to start %s: %w", project.IslandName, err)
+	}
 
+	if err := dockerClient.WaitForIsland(project.IslandName, 30*time.Second); err != nil {
+		return fmt.Errorf("island %s failed to start: %w", project.IslandName, err)
+	}
+
+	if update {
 		updateCommands := []string{
 			"apt update -y",
 			"DEBIAN_FRONTEND=noninteractive apt full-upgrade -y",
 		}
+		invalidateVerifyCache(project.IslandName)
 		if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, updateCommands, false); err != nil {
 			ui.Warning("failed to update system packages: %v", err)
 		}
+	}
 
-		if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
-			if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, projectConfig.SetupCommands, false); err != nil {
-				ui.Warning("failed to execute setup commands: %v", err)
-			}
-		}
-
-		if err := dockerClient.SetupCoderaftOnIslandWithUpdate(project.IslandName, projectName); err != nil {
-			ui.Warning("failed to setup coderaft on island: %v", err)
+	if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
+		if err := runProjectSetupCommands(dockerClient, project.IslandName, projectConfig); err != nil {
+			ui.Warning("failed to execute setup commands: %v", err)
 		}
-
-		ui.Success("%s rebuilt", projectName)
-		rebuilt++
 	}
 
-	ui.Blank()
-	ui.Summary("%d rebuilt, %d failed", rebuilt, failed)
-	if failed > 0 {
-		return fmt.Errorf("failed to rebuild %d island(s)", failed)
+	if err := dockerClient.SetupCoderaftOnIslandWithUpdate(project.IslandName, projectName); err != nil {
+		ui.Warning("failed to setup coderaft on island: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+
+	"coderaft/internal/config"
+)
+
+// Terminal multiplexers 'coderaft shell' can keep a session in
+const (
+	multiplexerTmux   = "tmux"
+	multiplexerScreen = "screen"
+)
+
+// defaultMuxSession is the session --tmux and --screen use when not given one
+const defaultMuxSession = "coderaft"
+
+var muxSessionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// resolveMultiplexer picks the multiplexer and session for 'coderaft shell'.
+// --tmux or --screen win over settings.shell_multiplexer, and --no-multiplexer
+// turns the setting off. It returns an empty multiplexer for a plain shell.
+func resolveMultiplexer(tmuxSession, screenSession string, noMultiplexer bool, cfg *config.Config) (string, string, error) {
+	if tmuxSession != "" && screenSession != "" {
+		return "", "", fmt.Errorf("--tmux and --screen can't be used together")
+	}
+	if noMultiplexer && (tmuxSession != "" || screenSession != "") {
+		return "", "", fmt.Errorf("--no-multiplexer can't be combined with --tmux or --screen")
+	}
+
+	mux, session := "", ""
+	switch {
+	case tmuxSession != "":
+		mux, session = multiplexerTmux, tmuxSession
+	case screenSession != "":
+		mux, session = multiplexerScreen, screenSession
+	case noMultiplexer:
+		return "", "", nil
+	case cfg != nil && cfg.Settings != nil && cfg.Settings.ShellMultiplexer != "":
+		mux, session = cfg.Settings.ShellMultiplexer, defaultMuxSession
+		if mux != multiplexerTmux && mux != multiplexerScreen {
+			return "", "", fmt.Errorf("invalid settings.shell_multiplexer '%s': use tmux or screen", mux)
+		}
+	default:
+		return "", "", nil
+	}
+
+	if !muxSessionName.MatchString(session) {
+		return "", "", fmt.Errorf("invalid %s session name '%s': use letters, digits, '-' and '_'", mux, session)
+	}
+	return mux, session, nil
+}
+
+// multiplexerAttachCommand starts the session, or attaches to it if it is
+// already running. screen detaches the session from any other terminal
+// first, such as one left behind by a dropped connection.
+func multiplexerAttachCommand(mux, session string) string {
+	if mux == multiplexerScreen {
+		return "exec screen -D -R -S " + session
+	}
+	return "exec tmux new-session -A -s " + session
+}
+
+// islandInstallScript installs a package with whichever package manager the
+// island's base image has
+func islandInstallScript(pkg string) string {
+	return fmt.Sprintf(`if command -v apt-get >/dev/null 2>&1; then apt-get update -y >/dev/null && DEBIAN_FRONTEND=noninteractive apt-get install -y %[1]s >/dev/null; `+
+		`elif command -v apk >/dev/null 2>&1; then apk add --no-cache %[1]s >/dev/null; `+
+		`elif command -v dnf >/dev/null 2>&1; then dnf install -y %[1]s >/dev/null; `+
+		`elif command -v yum >/dev/null 2>&1; then yum install -y %[1]s >/dev/null; `+
+		`elif command -v pacman >/dev/null 2>&1; then pacman -Sy --noconfirm %[1]s >/dev/null; `+
+		`else echo "no supported package manager to install %[1]s" >&2; exit 1; fi`, pkg)
+}
@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"coderaft/internal/config"
+)
+
+// stackManifests are the files that mark a directory as a project of a stack.
+// Unlike detectProjectStack's rules they leave out weak hints such as
+// index.html or a Rakefile, so finding two stacks here means the repository
+// really has both.
+var stackManifests = []struct {
+	stack string
+	files []string
+}{
+	{"python", []string{"requirements.txt", "pyproject.toml", "setup.py", "Pipfile", "environment.yml"}},
+	{"nodejs", []string{"package.json"}},
+	{"go", []string{"go.mod"}},
+	{"rust", []string{"Cargo.toml"}},
+	{"java", []string{"pom.xml", "build.gradle", "build.gradle.kts"}},
+	{"ruby", []string{"Gemfile"}},
+	{"php", []string{"composer.json"}},
+	{"dotnet", []string{"*.sln", "*.csproj", "*.fsproj"}},
+	{"elixir", []string{"mix.exs"}},
+}
+
+// detectStackSignals returns every stack with a manifest in projectPath
+func detectStackSignals(projectPath string) []string {
+	var stacks []string
+	for _, m := range stackManifests {
+		for _, file := range m.files {
+			matches, _ := filepath.Glob(filepath.Join(projectPath, file))
+			if len(matches) > 0 {
+				stacks = append(stacks, m.stack)
+				break
+			}
+		}
+	}
+	return stacks
+}
+
+// parseEnvStacks parses a comma separated --env-stack value. Each stack must
+// be one of the available templates; the first one is the primary stack.
+func parseEnvStacks(spec string, available []string) ([]string, error) {
+	known := map[string]bool{}
+	for _, name := range available {
+		known[name] = true
+	}
+
+	var stacks []string
+	seen := map[string]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		stack := strings.ToLower(strings.TrimSpace(part))
+		if stack == "" || seen[stack] {
+			continue
+		}
+		if !known[stack] {
+			return nil, fmt.Errorf("unknown stack '%s' in --env-stack (available: %s)", stack, strings.Join(available, ", "))
+		}
+		seen[stack] = true
+		stacks = append(stacks, stack)
+	}
+	if len(stacks) == 0 {
+		return nil, fmt.Errorf("--env-stack needs at least one stack, e.g. python,nodejs")
+	}
+	return stacks, nil
+}
+
+// multiStackConfig builds a project config that sets up the toolchain of every
+// stack: the first stack's template, followed by each further template's
+// setup commands, environment and ports. The stacks are recorded in the
+// config.
+func multiStackConfig(cm *config.ConfigManager, projectName string, stacks []string) (*config.ProjectConfig, error) {
+	projectConfig, err := cm.CreateProjectConfigFromTemplate(stacks[0], projectName)
+	if err != nil {
+		return nil, err
+	}
+	for _, stack := range stacks[1:] {
+		tpl, err := cm.CreateProjectConfigFromTemplate(stack, projectName)
+		if err != nil {
+			return nil, err
+		}
+		projectConfig.SetupCommands = append(projectConfig.SetupCommands, tpl.SetupCommands...)
+		projectConfig.Environment = mergeStackEnvironment(projectConfig.Environment, tpl.Environment)
+		for _, port := range tpl.Ports {
+			if !slices.Contains(projectConfig.Ports, port) {
+				projectConfig.Ports = append(projectConfig.Ports, port)
+			}
+		}
+	}
+	projectConfig.Stacks = stacks
+	return projectConfig, nil
+}
+
+// mergeStackEnvironment adds src's variables to dst. Where both set a
+// variable dst wins, except that PATH prefixes of the form "dir:$PATH" are
+// chained so every stack's tools stay on the path.
+func mergeStackEnvironment(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = map[string]string{}
+	}
+	for k, v := range src {
+		cur, ok := dst[k]
+		switch {
+		case !ok:
+			dst[k] = v
+		case k == "PATH" && strings.HasSuffix(cur, ":$PATH") && strings.HasSuffix(v, ":$PATH"):
+			dst[k] = strings.TrimSuffix(cur, "$PATH") + v
+		}
+	}
+	return dst
+}
+
+// stackSetupCommands returns the dependency install commands of every stack,
+// in order
+func stackSetupCommands(projectPath string, stacks []string, strippedLockfiles map[string]bool) []string {
+	var commands []string
+	for _, stack := range stacks {
+		commands = append(commands, detectSetupCommands(projectPath, stack, strippedLockfiles)...)
+	}
+	return commands
+}
+
+// multiStackHint returns the --env-stack value that would set up every stack
+// found in projectPath, primary first, or "" when there's only one
+func multiStackHint(projectPath, primary string) string {
+	signals := detectStackSignals(projectPath)
+	if len(signals) < 2 {
+		return ""
+	}
+	stacks := []string{primary}
+	for _, s := range signals {
+		if s != primary {
+			stacks = append(stacks, s)
+		}
+	}
+	return strings.Join(stacks, ",")
+}
@@ -10,6 +10,7 @@ import (
 
 	"coderaft/internal/config"
 	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/parallel"
 	"coderaft/internal/ui"
 )
@@ -18,6 +19,8 @@ type OptimizedSetup struct {
 	dockerClient  DockerClientInterface
 	configManager *config.ConfigManager
 	imageCache    *docker.ImageCache
+	// prebuiltRegistry is where FastUp looks for an image CI already built
+	prebuiltRegistry string
 }
 
 type DockerClientInterface interface {
@@ -27,6 +30,7 @@ type DockerClientInterface interface {
 	WaitForIsland(IslandName string, timeout time.Duration) error
 	SetupCoderaftOnIslandWithUpdate(IslandName, projectName string) error
 	ExecuteSetupCommandsWithOutput(IslandName string, commands []string, showOutput bool) error
+	ExecCapture(IslandName, command string) (string, string, error)
 	QueryPackagesParallel(IslandName string) (aptList, pipList, npmList, yarnList, pnpmList []string)
 	ImageExists(ref string) bool
 	SDKExecFunc() func(ctx context.Context, containerID string, cmd []string, showOutput bool) (string, string, int, error)
@@ -81,6 +85,7 @@ func (optSetup *OptimizedSetup) FastInit(projectName string, projectConfig *conf
 	}
 
 	ui.Status("fast initialization of '%s'...", IslandName)
+	_ = parallel.ResetSetupLog(IslandName)
 
 	effectiveImage := baseImage
 	if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
@@ -138,7 +143,7 @@ func (optSetup *OptimizedSetup) FastInit(projectName string, projectConfig *conf
 
 	ui.Status("setting up coderaft commands...")
 	if err := optSetup.dockerClient.SetupCoderaftOnIslandWithUpdate(IslandName, projectName); err != nil {
-		return fmt.Errorf("failed to setup coderaft in island: %w", err)
+		return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to setup coderaft in island: %w", err)
 	}
 
 	if effectiveImage == baseImage && projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
@@ -148,8 +153,8 @@ func (optSetup *OptimizedSetup) FastInit(projectName string, projectConfig *conf
 		}
 
 		ui.Status("installing packages (%d commands)...", len(projectConfig.SetupCommands))
-		if err := optSetup.dockerClient.ExecuteSetupCommandsWithOutput(IslandName, projectConfig.SetupCommands, false); err != nil {
-			return fmt.Errorf("failed to execute setup commands: %w", err)
+		if err := runProjectSetupCommands(optSetup.dockerClient, IslandName, projectConfig); err != nil {
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to execute setup commands: %w", err)
 		}
 
 		_ = WriteLockFileForIsland(IslandName, projectName, workspacePath, baseImage, "")
@@ -158,8 +163,12 @@ func (optSetup *OptimizedSetup) FastInit(projectName string, projectConfig *conf
 	return nil
 }
 
-func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, projectName, IslandName, baseImage, cwd, workspaceIsland string, configMap map[string]interface{}) error {
+// FastUp creates and starts the island for the project in cwd. workspaceHost
+// is the directory mounted at workspaceIsland: cwd itself, or the project's
+// workspace_subdir inside it.
+func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, projectName, IslandName, baseImage, cwd, workspaceHost, workspaceIsland string, configMap map[string]interface{}) error {
 	ui.Status("fast startup of island...")
+	_ = parallel.ResetSetupLog(IslandName)
 
 	effectiveImage := baseImage
 	if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
@@ -174,8 +183,9 @@ func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, proj
 			ProjectName:   projectName,
 		}
 
-		cachedImage, err := optSetup.imageCache.BuildCachedImage(buildCfg)
-		if err != nil {
+		if prebuilt := pullPrebuiltImage(optSetup.dockerClient, optSetup.prebuiltRegistry, buildCfg); prebuilt != "" {
+			effectiveImage = prebuilt
+		} else if cachedImage, err := optSetup.imageCache.BuildCachedImage(buildCfg); err != nil {
 			ui.Warning("cached build failed, using base image: %v", err)
 		} else {
 			effectiveImage = cachedImage
@@ -187,10 +197,15 @@ func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, proj
 	}
 
 	ui.Status("creating optimized island...")
-	islandID, err := optSetup.dockerClient.CreateIslandWithConfig(IslandName, effectiveImage, cwd, workspaceIsland, configMap)
+	islandID, err := optSetup.dockerClient.CreateIslandWithConfig(IslandName, effectiveImage, workspaceHost, workspaceIsland, configMap)
 	if err != nil {
 		return fmt.Errorf("failed to create island: %w", err)
 	}
+	ui.Event("island_created", map[string]interface{}{
+		"island": IslandName,
+		"id":     islandID,
+		"image":  effectiveImage,
+	})
 
 	if err := optSetup.dockerClient.StartIsland(islandID); err != nil {
 		return fmt.Errorf("failed to start island: %w", err)
@@ -201,8 +216,14 @@ func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, proj
 		return fmt.Errorf("island failed to start: %w", err)
 	}
 
+	if projectConfig != nil && len(projectConfig.Command) > 0 {
+		if err := optSetup.verifyExecAvailable(IslandName); err != nil {
+			return err
+		}
+	}
+
 	if err := optSetup.dockerClient.SetupCoderaftOnIslandWithUpdate(IslandName, projectName); err != nil {
-		return fmt.Errorf("failed to setup coderaft in island: %w", err)
+		return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to setup coderaft in island: %w", err)
 	}
 
 	lockfilePath := filepath.Join(cwd, "coderaft.history")
@@ -219,8 +240,8 @@ func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, proj
 		}
 
 		ui.Status("installing packages (%d commands)...", len(projectConfig.SetupCommands))
-		if err := optSetup.dockerClient.ExecuteSetupCommandsWithOutput(IslandName, projectConfig.SetupCommands, false); err != nil {
-			return fmt.Errorf("failed to execute setup commands: %w", err)
+		if err := runProjectSetupCommands(optSetup.dockerClient, IslandName, projectConfig); err != nil {
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to execute setup commands: %w", err)
 		}
 
 		_ = WriteLockFileForIsland(IslandName, projectName, cwd, baseImage, "")
@@ -229,6 +250,21 @@ func (optSetup *OptimizedSetup) FastUp(projectConfig *config.ProjectConfig, proj
 	return nil
 }
 
+func (optSetup *OptimizedSetup) verifyExecAvailable(IslandName string) error {
+	ui.Status("checking island accepts exec with custom command...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, stderr, exitCode, err := optSetup.dockerClient.SDKExecFunc()(ctx, IslandName, []string{"true"}, false)
+	if err != nil || exitCode != 0 {
+		if err == nil {
+			err = fmt.Errorf("exit code %d: %s", exitCode, strings.TrimSpace(stderr))
+		}
+		return fmt.Errorf("island is not accepting exec after starting its custom command (did the command exit?): %w", err)
+	}
+	return nil
+}
+
 var allowedHistoryPrefixes = []string{
 	"apt ", "apt-get ", "pip ", "pip3 ", "npm ", "yarn ", "pnpm ", "corepack ",
 }
@@ -308,3 +344,16 @@ func (optSetup *OptimizedSetup) OptimizeEnvironment(IslandName string) error {
 
 	return executor.ExecuteCommandGroups(optimizationGroups)
 }
+
+// overrideSetupConcurrency applies --setup-workers and --no-parallel-setup to
+// every setup command this invocation runs
+func overrideSetupConcurrency(workers int, sequential bool) error {
+	if workers < 0 {
+		return fmt.Errorf("--setup-workers must be a positive number")
+	}
+	if workers > 0 && sequential {
+		return fmt.Errorf("--setup-workers and --no-parallel-setup cannot be used together")
+	}
+	parallel.OverrideSetup(workers, sequential)
+	return nil
+}
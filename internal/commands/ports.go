@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"regexp"
 	"sort"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
@@ -168,7 +170,7 @@ func showProjectPorts(projectName string) error {
 		return fmt.Errorf("failed to check island: %w", err)
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found. Run 'coderaft up' first", projectName)
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found. Run 'coderaft up' first", projectName)
 	}
 
 	status, err := dockerClient.GetIslandStatus(islandName)
@@ -345,3 +347,168 @@ func watchPorts(project string) error {
 
 	return nil
 }
+
+type portRemap struct {
+	Spec    string
+	OldHost string
+	NewHost string
+	Owner   string
+}
+
+// splitPortSpec splits a docker port spec ("[ip:]host:container[/proto]") into
+// its host binding parts. ok is false for specs without a single fixed host
+// port (container-only ports, ranges), which docker assigns itself.
+func splitPortSpec(spec string) (ip, hostPort, container, proto string, ok bool) {
+	spec = strings.TrimSpace(spec)
+	proto = "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		proto = spec[i+1:]
+		spec = spec[:i]
+	}
+
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 2:
+		hostPort, container = parts[0], parts[1]
+	case 3:
+		ip, hostPort, container = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", "", false
+	}
+
+	if _, err := strconv.Atoi(hostPort); err != nil {
+		return "", "", "", "", false
+	}
+	return ip, hostPort, container, proto, true
+}
+
+// hostPortAvailable reports whether a host port can be bound right now
+func hostPortAvailable(ip, port, proto string) bool {
+	addr := net.JoinHostPort(ip, port)
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// findFreePort asks the OS for an unused port
+func findFreePort(ip, proto string) (string, error) {
+	addr := net.JoinHostPort(ip, "0")
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port), nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), nil
+}
+
+// resolvePortConflicts checks every fixed host port in specs before the island
+// is created. Busy ports fail with a message naming the owner (from ownerFn, if
+// known) or, with autoPort, are remapped to a free port.
+func resolvePortConflicts(specs []string, autoPort bool, available func(ip, port, proto string) bool, ownerFn func(port string) string) ([]string, []portRemap, error) {
+	if available == nil {
+		available = hostPortAvailable
+	}
+
+	result := make([]string, 0, len(specs))
+	var remaps []portRemap
+	claimed := map[string]bool{}
+
+	for _, spec := range specs {
+		ip, hostPort, container, proto, ok := splitPortSpec(spec)
+		if !ok {
+			result = append(result, spec)
+			continue
+		}
+
+		key := hostPort + "/" + proto
+		if !claimed[key] && available(ip, hostPort, proto) {
+			claimed[key] = true
+			result = append(result, spec)
+			continue
+		}
+
+		owner := "another process"
+		if claimed[key] {
+			owner = "another entry in coderaft.json"
+		} else if ownerFn != nil {
+			if o := ownerFn(hostPort); o != "" {
+				owner = o
+			}
+		}
+
+		if !autoPort {
+			return nil, nil, fmt.Errorf("port %s is already in use by %s", hostPort, owner)
+		}
+
+		var newPort string
+		for attempt := 0; attempt < 10; attempt++ {
+			p, err := findFreePort(ip, proto)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to find a free port to replace %s: %w", hostPort, err)
+			}
+			if !claimed[p+"/"+proto] {
+				newPort = p
+				break
+			}
+		}
+		if newPort == "" {
+			return nil, nil, fmt.Errorf("failed to find a free port to replace %s", hostPort)
+		}
+
+		claimed[newPort+"/"+proto] = true
+		newSpec := newPort + ":" + container
+		if ip != "" {
+			newSpec = ip + ":" + newSpec
+		}
+		if proto != "tcp" || strings.HasSuffix(spec, "/tcp") {
+			newSpec += "/" + proto
+		}
+		remaps = append(remaps, portRemap{Spec: spec, OldHost: hostPort, NewHost: newPort, Owner: owner})
+		result = append(result, newSpec)
+	}
+
+	return result, remaps, nil
+}
+
+// islandPortOwner returns "island '<name>'" for the island publishing hostPort
+func islandPortOwner(hostPort string) string {
+	islands, err := dockerClient.ListIslands()
+	if err != nil {
+		return ""
+	}
+	for _, isl := range islands {
+		if len(isl.Names) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(isl.Names[0], "/")
+		ports, err := dockerClient.GetPortMappings(name)
+		if err != nil {
+			continue
+		}
+		for _, m := range parsePorts(ports) {
+			if m.HostPort == hostPort {
+				return fmt.Sprintf("island '%s'", name)
+			}
+		}
+	}
+	return ""
+}
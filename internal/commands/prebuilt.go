@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/ui"
+)
+
+// prebuiltPuller is the part of the Docker client pullPrebuiltImage needs
+type prebuiltPuller interface {
+	ImageExists(ref string) bool
+	PullImage(ref string) error
+}
+
+// resolvePrebuiltRegistry returns settings.prebuilt_registry without a
+// trailing slash, or "" when it isn't set
+func resolvePrebuiltRegistry(cfg *config.Config) (string, error) {
+	if cfg == nil || cfg.Settings == nil {
+		return "", nil
+	}
+	registry := strings.TrimSuffix(strings.TrimSpace(cfg.Settings.PrebuiltRegistry), "/")
+	if registry == "" {
+		return "", nil
+	}
+	// a port is fine in the host, but not a tag or digest on the repository
+	last := registry[strings.LastIndex(registry, "/")+1:]
+	if strings.Contains(registry, "://") || strings.ContainsAny(registry, " @") || (strings.Contains(registry, "/") && strings.Contains(last, ":")) {
+		return "", fmt.Errorf("invalid settings.prebuilt_registry '%s': use a repository path such as ghcr.io/acme/coderaft, without a scheme or tag", registry)
+	}
+	return registry, nil
+}
+
+// prebuiltImageRef is the tag CI publishes an environment image under:
+// <registry>/<project>:<fingerprint>. The fingerprint is the one the local
+// image cache tags its builds with, so an image is only reused for the exact
+// base image, setup commands and environment it was built from.
+func prebuiltImageRef(registry string, buildCfg *docker.BuildImageConfig) string {
+	return fmt.Sprintf("%s/%s:%s", registry, buildCfg.ProjectName, buildCfg.Fingerprint())
+}
+
+// pullPrebuiltImage pulls the prebuilt image for buildCfg from registry and
+// returns its reference, or "" when the registry has none and the image has
+// to be built locally. An image already in the local cache is used as is
+// without asking the registry.
+func pullPrebuiltImage(client prebuiltPuller, registry string, buildCfg *docker.BuildImageConfig) string {
+	if registry == "" || client.ImageExists(buildCfg.CacheTag()) {
+		return ""
+	}
+	ref := prebuiltImageRef(registry, buildCfg)
+	ui.Status("checking %s for a prebuilt image...", registry)
+	if err := client.PullImage(ref); err != nil {
+		ui.Status("no prebuilt image %s, building locally", ref)
+		ui.Detail("reason", err.Error())
+		return ""
+	}
+	ui.Event("prebuilt_image", map[string]interface{}{"image": ref})
+	ui.Success("using prebuilt image %s", ref)
+	return ref
+}
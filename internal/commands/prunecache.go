@@ -0,0 +1,359 @@
+package commands
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/ui"
+)
+
+var (
+	pruneCacheOlderThan  string
+	pruneCacheCategories []string
+	pruneCacheDryRun     bool
+)
+
+// cacheEntry is one thing a cache holds that can be removed on its own
+type cacheEntry struct {
+	Name     string
+	Size     int64
+	LastUsed time.Time
+	// InUse names what still needs the entry; such entries are never removed
+	InUse  string
+	Remove func() error
+}
+
+// cacheCategory is a kind of cache prune-cache manages. Entries lists what
+// it holds right now.
+type cacheCategory struct {
+	Name        string
+	Description string
+	Entries     func(cfg *config.Config) ([]cacheEntry, error)
+}
+
+// cacheCategories are the caches prune-cache knows about. A new cache only
+// needs an entry here to be reported and pruned.
+var cacheCategories = []cacheCategory{
+	{
+		Name:        "images",
+		Description: "environment images built by up and clone, and prebuilt images pulled for them",
+		Entries:     cachedImageEntries,
+	},
+	{
+		Name:        "packages",
+		Description: "package state and verify results cached per island",
+		Entries: func(cfg *config.Config) ([]cacheEntry, error) {
+			return cacheDirEntries(config.StatePath, "verify-cache", false, nil)
+		},
+	},
+	{
+		Name:        "dotfiles",
+		Description: "dotfiles repositories cloned for --dotfiles and settings.dotfiles_repo",
+		Entries: func(cfg *config.Config) ([]cacheEntry, error) {
+			return cacheDirEntries(config.DataPath, "dotfiles", false, islandMountSources(cfg))
+		},
+	},
+	{
+		Name:        "recipes",
+		Description: "recipes downloaded for clone --recipe",
+		Entries: func(cfg *config.Config) ([]cacheEntry, error) {
+			return cacheDirEntries(config.DataPath, "recipes", true, nil)
+		},
+	},
+}
+
+var pruneCacheCmd = &cobra.Command{
+	Use:   "prune-cache",
+	Short: "Show and prune coderaft's caches",
+	Long: `Show how much disk space each of coderaft's caches uses and remove the
+entries that haven't been used for a while.
+
+The caches are:
+  images     environment images built by up and clone (coderaft-cache/*),
+             and prebuilt images pulled from settings.prebuilt_registry
+  packages   package state and verify results cached per island
+  dotfiles   dotfiles repositories cloned for --dotfiles and dotfiles_repo
+  recipes    recipes downloaded for clone --recipe
+
+Everything in them is fetched or rebuilt again when it's next needed. By
+default entries unused for 30 days are removed; --older-than changes that,
+and --older-than 0 empties the caches. Images an island was created from and
+dotfiles an island mounts are kept. Use --category to prune only some caches
+and --dry-run to see what would be removed.
+
+For Docker resources that aren't coderaft's caches, see 'coderaft cleanup'.
+
+Examples:
+  coderaft prune-cache --dry-run
+  coderaft prune-cache --older-than 7d
+  coderaft prune-cache --category images --older-than 0`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		maxAge, err := parseCacheAge(pruneCacheOlderThan)
+		if err != nil {
+			return err
+		}
+		categories, err := selectCacheCategories(pruneCacheCategories)
+		if err != nil {
+			return err
+		}
+		cfg, err := configManager.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		return pruneCaches(cfg, categories, maxAge, time.Now())
+	},
+}
+
+func init() {
+	pruneCacheCmd.Flags().StringVar(&pruneCacheOlderThan, "older-than", "30d", "Remove entries not used for this long, e.g. 7d or 12h (0 removes everything)")
+	pruneCacheCmd.Flags().StringSliceVar(&pruneCacheCategories, "category", nil, "Only prune these caches: images, packages, dotfiles, recipes (repeatable or comma separated)")
+	pruneCacheCmd.Flags().BoolVar(&pruneCacheDryRun, "dry-run", false, "Show what would be removed without removing anything")
+}
+
+// pruneCaches reports each category's size and removes its entries unused
+// for maxAge
+func pruneCaches(cfg *config.Config, categories []cacheCategory, maxAge time.Duration, now time.Time) error {
+	var reclaimed int64
+	removed, failed := 0, 0
+	for _, cat := range categories {
+		entries, err := cat.Entries(cfg)
+		if err != nil {
+			ui.Warning("skipping %s: %v", cat.Name, err)
+			continue
+		}
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+		}
+		ui.Header("%s: %d entr%s, %s", cat.Name, len(entries), pluralY(len(entries)), units.HumanSize(float64(total)))
+		ui.Status("%s", cat.Description)
+
+		for _, e := range staleCacheEntries(entries, maxAge, now) {
+			if e.InUse != "" {
+				ui.Item("keeping %s (used by %s)", e.Name, e.InUse)
+				continue
+			}
+			desc := fmt.Sprintf("%s (%s, last used %s)", e.Name, units.HumanSize(float64(e.Size)), e.LastUsed.Local().Format("2006-01-02"))
+			if pruneCacheDryRun {
+				ui.Item("would remove %s", desc)
+				reclaimed += e.Size
+				removed++
+				continue
+			}
+			if err := e.Remove(); err != nil {
+				ui.Warning("failed to remove %s: %v", e.Name, err)
+				failed++
+				continue
+			}
+			ui.Item("removed %s", desc)
+			reclaimed += e.Size
+			removed++
+		}
+	}
+
+	ui.Blank()
+	if pruneCacheDryRun {
+		ui.Summary("dry run: would remove %d entr%s and reclaim %s", removed, pluralY(removed), units.HumanSize(float64(reclaimed)))
+		return nil
+	}
+	ui.Summary("removed %d entr%s, reclaimed %s", removed, pluralY(removed), units.HumanSize(float64(reclaimed)))
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d cache entr%s", failed, pluralY(failed))
+	}
+	return nil
+}
+
+func pluralY(n int) string {
+	if n == 1 {
+		return "y"
+	}
+	return "ies"
+}
+
+// parseCacheAge parses --older-than: a Go duration such as 12h, or a number
+// of days such as 30d
+func parseCacheAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid --older-than '%s' (expected e.g. 30d or 12h)", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid --older-than '%s' (expected e.g. 30d or 12h)", s)
+	}
+	return d, nil
+}
+
+// selectCacheCategories returns the named categories, or all of them when
+// none are named
+func selectCacheCategories(names []string) ([]cacheCategory, error) {
+	if len(names) == 0 {
+		return cacheCategories, nil
+	}
+	var selected []cacheCategory
+	for _, cat := range cacheCategories {
+		for _, name := range names {
+			if cat.Name == strings.TrimSpace(name) {
+				selected = append(selected, cat)
+				break
+			}
+		}
+	}
+	for _, name := range names {
+		known := false
+		for _, cat := range cacheCategories {
+			known = known || cat.Name == strings.TrimSpace(name)
+		}
+		if !known {
+			valid := make([]string, len(cacheCategories))
+			for i, cat := range cacheCategories {
+				valid[i] = cat.Name
+			}
+			return nil, fmt.Errorf("unknown cache category '%s' (valid: %s)", name, strings.Join(valid, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// staleCacheEntries returns the entries last used at least maxAge before now,
+// oldest first
+func staleCacheEntries(entries []cacheEntry, maxAge time.Duration, now time.Time) []cacheEntry {
+	var stale []cacheEntry
+	for _, e := range entries {
+		if now.Sub(e.LastUsed) >= maxAge {
+			stale = append(stale, e)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].LastUsed.Before(stale[j].LastUsed) })
+	return stale
+}
+
+// cachedImageEntries lists the image cache's builds and, with
+// settings.prebuilt_registry, the prebuilt images pulled from it. Docker
+// refuses to remove an image an island was created from, so those stay.
+func cachedImageEntries(cfg *config.Config) ([]cacheEntry, error) {
+	patterns := []string{"coderaft-cache/*"}
+	if cfg != nil && cfg.Settings != nil && cfg.Settings.PrebuiltRegistry != "" {
+		patterns = append(patterns, strings.TrimSuffix(cfg.Settings.PrebuiltRegistry, "/")+"/*")
+	}
+	images, err := docker.ListCachedImages(patterns...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]cacheEntry, 0, len(images))
+	for _, img := range images {
+		ref := img.Ref
+		entries = append(entries, cacheEntry{
+			Name:     ref,
+			Size:     img.Size,
+			LastUsed: img.Created,
+			Remove:   func() error { return docker.RemoveCachedImage(ref) },
+		})
+	}
+	return entries, nil
+}
+
+// cacheDirEntries lists a cache directory under one of coderaft's base
+// directories. Each top-level file or directory is an entry, or with files
+// every file however deep, as for recipes stored as <name>/<version>.json.
+// A directory's size is its total and its last use the newest modification
+// inside it. Entries in inUse are marked with what uses them.
+func cacheDirEntries(base func(...string) (string, error), name string, files bool, inUse map[string]string) ([]cacheEntry, error) {
+	root, err := base(name)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	if files {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+	} else {
+		var children []os.DirEntry
+		children, err = os.ReadDir(root)
+		for _, c := range children {
+			paths = append(paths, filepath.Join(root, c.Name()))
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", root, err)
+	}
+
+	entries := make([]cacheEntry, 0, len(paths))
+	for _, p := range paths {
+		size, lastUsed := pathUsage(p)
+		rel, _ := filepath.Rel(root, p)
+		path := p
+		entries = append(entries, cacheEntry{
+			Name:     filepath.ToSlash(rel),
+			Size:     size,
+			LastUsed: lastUsed,
+			InUse:    inUse[p],
+			Remove:   func() error { return os.RemoveAll(path) },
+		})
+	}
+	return entries, nil
+}
+
+// pathUsage returns the total size of the files under p and the newest
+// modification time among them and their directories
+func pathUsage(p string) (int64, time.Time) {
+	var size int64
+	var newest time.Time
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return size, newest
+}
+
+// islandMountSources maps each host path bind mounted into a project's
+// island to that island
+func islandMountSources(cfg *config.Config) map[string]string {
+	sources := map[string]string{}
+	if cfg == nil || dockerClient == nil {
+		return sources
+	}
+	for _, proj := range cfg.Projects {
+		mounts, err := dockerClient.GetMounts(proj.IslandName)
+		if err != nil {
+			continue
+		}
+		for _, m := range mounts {
+			if source, _, ok := parseMountSpec(m); ok {
+				sources[filepath.Clean(source)] = proj.IslandName
+			}
+		}
+	}
+	return sources
+}
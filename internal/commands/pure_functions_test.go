@@ -1,9 +1,27 @@
 package commands
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/secrets"
 )
 
 func TestComputeLockChecksum_Deterministic(t *testing.T) {
@@ -83,6 +101,44 @@ func TestComputeLockChecksum_ChangesOnDifferentInput(t *testing.T) {
 	if csBase == computeLockChecksum(&altered4) {
 		t.Fatal("adding setup commands should change checksum")
 	}
+
+	altered5 := base
+	altered5.TrackedFiles = map[string]string{"/etc/pip.conf": "sha256:aa"}
+	csTracked := computeLockChecksum(&altered5)
+	if csBase == csTracked {
+		t.Fatal("tracking a file should change checksum")
+	}
+	altered5.TrackedFiles = map[string]string{"/etc/pip.conf": "sha256:bb"}
+	if csTracked == computeLockChecksum(&altered5) {
+		t.Fatal("changing a tracked file's checksum should change checksum")
+	}
+}
+
+func TestTrackedFilesDiff(t *testing.T) {
+	locked := map[string]string{"/etc/pip.conf": "sha256:aa", "/etc/ssl/certs/corp.pem": "sha256:bb", "/etc/apt/sources.list.d/extra.list": "sha256:cc"}
+	live := map[string]string{"/etc/pip.conf": "sha256:aa", "/etc/ssl/certs/corp.pem": "sha256:dd", "/etc/apt/sources.list.d/new.list": "sha256:ee"}
+
+	want := []string{
+		"tracked files drifted:",
+		"  - /etc/apt/sources.list.d/extra.list",
+		"  + /etc/apt/sources.list.d/new.list",
+		"  ~ /etc/ssl/certs/corp.pem",
+	}
+	if got := trackedFilesDiff(locked, live); !reflect.DeepEqual(got, want) {
+		t.Errorf("trackedFilesDiff = %q, want %q", got, want)
+	}
+	if got := trackedFilesDiff(locked, locked); got != nil {
+		t.Errorf("expected no drift for identical files, got %q", got)
+	}
+	if got := trackedFilesDiff(nil, live); got != nil {
+		t.Errorf("a lock without tracked files shouldn't report drift, got %q", got)
+	}
+
+	patterns := trackedFilePatterns([]string{"/etc/apt/sources.list.d/*", "/etc/pip.conf"}, locked)
+	wantPatterns := []string{"/etc/apt/sources.list.d/*", "/etc/pip.conf", "/etc/apt/sources.list.d/extra.list", "/etc/ssl/certs/corp.pem"}
+	if !reflect.DeepEqual(patterns, wantPatterns) {
+		t.Errorf("trackedFilePatterns = %q, want %q", patterns, wantPatterns)
+	}
 }
 
 func TestComputeLockChecksum_MapOrderInsensitive(t *testing.T) {
@@ -260,7 +316,7 @@ func TestStringSetEqual(t *testing.T) {
 func TestPackageDiff_NoDrift(t *testing.T) {
 	locked := []string{"git=1:2.39.2-1", "curl=7.88.1-10"}
 	live := []string{"git=1:2.39.2-1", "curl=7.88.1-10"}
-	if drifts := packageDiff("apt", "=", locked, live); len(drifts) != 0 {
+	if drifts := packageDiff("apt", "=", locked, live, nil); len(drifts) != 0 {
 		t.Errorf("expected no drift, got %v", drifts)
 	}
 }
@@ -268,7 +324,7 @@ func TestPackageDiff_NoDrift(t *testing.T) {
 func TestPackageDiff_Added(t *testing.T) {
 	locked := []string{"git=1:2.39.2-1"}
 	live := []string{"git=1:2.39.2-1", "vim=9.0.1-1"}
-	drifts := packageDiff("apt", "=", locked, live)
+	drifts := packageDiff("apt", "=", locked, live, nil)
 	if len(drifts) == 0 {
 		t.Fatal("expected drift")
 	}
@@ -286,7 +342,7 @@ func TestPackageDiff_Added(t *testing.T) {
 func TestPackageDiff_Removed(t *testing.T) {
 	locked := []string{"git=1:2.39.2-1", "curl=7.88.1-10"}
 	live := []string{"git=1:2.39.2-1"}
-	drifts := packageDiff("apt", "=", locked, live)
+	drifts := packageDiff("apt", "=", locked, live, nil)
 	found := false
 	for _, d := range drifts {
 		if strings.Contains(d, "- curl") {
@@ -301,7 +357,7 @@ func TestPackageDiff_Removed(t *testing.T) {
 func TestPackageDiff_Changed(t *testing.T) {
 	locked := []string{"flask==2.3.0"}
 	live := []string{"flask==2.4.0"}
-	drifts := packageDiff("pip", "==", locked, live)
+	drifts := packageDiff("pip", "==", locked, live, nil)
 	found := false
 	for _, d := range drifts {
 		if strings.Contains(d, "~ flask") {
@@ -313,11 +369,87 @@ func TestPackageDiff_Changed(t *testing.T) {
 	}
 }
 
+func TestPackageExclusions(t *testing.T) {
+	e := newPackageExclusions(&config.GlobalSettings{LockExcludePackages: map[string][]string{
+		"apt": {"linux-headers-*", " "},
+		"PIP": {"Pip", "setuptools"},
+		"npm": {"@types/*"},
+		"go":  {"github.com/Example/*"},
+	}})
+	cases := []struct {
+		manager, name string
+		want          bool
+	}{
+		{"apt", "linux-headers-6.1.0-18-amd64", true},
+		{"apt", "linux-image-amd64", false},
+		{"pip", "pip", true},
+		{"pip", "setuptools", true},
+		{"pip", "wheel", false},
+		{"npm", "@types/node", true},
+		{"npm", "typescript", false},
+		{"go", "github.com/Example/tool", true},
+		{"go", "github.com/example/tool", false},
+		// '*' doesn't cross a '/'
+		{"go", "github.com/Example/tool/cmd/x", false},
+		{"cargo", "ripgrep", false},
+	}
+	for _, c := range cases {
+		if got := e.excludes(c.manager, c.name); got != c.want {
+			t.Errorf("excludes(%q, %q) = %v, want %v", c.manager, c.name, got, c.want)
+		}
+	}
+	if newPackageExclusions(nil) != nil || newPackageExclusions(&config.GlobalSettings{}) != nil {
+		t.Error("expected no exclusions without settings")
+	}
+}
+
+func TestPackageExclusionsFilter(t *testing.T) {
+	e := packageExclusions{
+		"apt":    {"linux-headers-*"},
+		"pip":    {"pip"},
+		"npm":    {"@types/*"},
+		"cargo":  {"cargo-*"},
+		"vscode": {"ms-python.*"},
+	}
+	p := e.filterPackages(lockPackages{
+		Apt:   []string{"git=1:2.39.2-1", "linux-headers-amd64=6.1.76-1"},
+		Pip:   []string{"PIP==24.0", "requests==2.31.0"},
+		Npm:   []string{"@types/node@20.11.0", "typescript@5.3.3"},
+		Cargo: []string{"cargo-edit=v0.12.2", "ripgrep=v14.1.0"},
+		Go:    []string{"golang.org/x/tools/gopls@v0.15.0"},
+	})
+	want := lockPackages{
+		Apt:   []string{"git=1:2.39.2-1"},
+		Pip:   []string{"requests==2.31.0"},
+		Npm:   []string{"typescript@5.3.3"},
+		Cargo: []string{"ripgrep=v14.1.0"},
+		Go:    []string{"golang.org/x/tools/gopls@v0.15.0"},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("filterPackages = %+v, want %+v", p, want)
+	}
+	if got := e.filter("vscode", "@", []string{"ms-python.python@2024.2.1", "golang.go@0.41.0"}); !reflect.DeepEqual(got, []string{"golang.go@0.41.0"}) {
+		t.Errorf("filter(vscode) = %v", got)
+	}
+}
+
+func TestPackageDiff_Excluded(t *testing.T) {
+	e := packageExclusions{"apt": {"linux-headers-*"}}
+	locked := []string{"git=1:2.39.2-1", "linux-headers-amd64=6.1.76-1"}
+	live := []string{"git=1:2.39.2-1", "linux-headers-amd64=6.1.85-1", "linux-headers-6.1.0-18-amd64=6.1.76-1"}
+	if drifts := packageDiff("apt", "=", locked, live, e); drifts != nil {
+		t.Errorf("expected excluded packages to be ignored, got %v", drifts)
+	}
+	if drifts := packageDiff("apt", "=", locked, live, nil); len(drifts) == 0 {
+		t.Error("expected drift without exclusions")
+	}
+}
+
 func TestBuildReconcileActions_NoChanges(t *testing.T) {
 	pkgs := lockPackages{
 		Apt: []string{"git=1:2.39.2-1"},
 	}
-	cmds := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1"}, nil, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1"}, nil, nil, nil, nil, downgradeGuard{})
 	if len(cmds) != 0 {
 		t.Errorf("expected no commands, got %v", cmds)
 	}
@@ -327,7 +459,7 @@ func TestBuildReconcileActions_InstallMissing(t *testing.T) {
 	pkgs := lockPackages{
 		Apt: []string{"git=1:2.39.2-1", "curl=7.88.1-10"},
 	}
-	cmds := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1"}, nil, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1"}, nil, nil, nil, nil, downgradeGuard{})
 	if len(cmds) == 0 {
 		t.Fatal("expected install commands")
 	}
@@ -346,7 +478,7 @@ func TestBuildReconcileActions_RemoveExtra(t *testing.T) {
 	pkgs := lockPackages{
 		Apt: []string{"git=1:2.39.2-1"},
 	}
-	cmds := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1", "vim=9.0.1-1"}, nil, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1", "vim=9.0.1-1"}, nil, nil, nil, nil, downgradeGuard{})
 	hasRemove := false
 	for _, c := range cmds {
 		if strings.Contains(c, "apt-get remove") && strings.Contains(c, "vim") {
@@ -362,7 +494,7 @@ func TestBuildReconcileActions_PipInstallAndUninstall(t *testing.T) {
 	pkgs := lockPackages{
 		Pip: []string{"flask==2.3.0"},
 	}
-	cmds := buildReconcileActions(pkgs, nil, []string{"requests==2.31.0"}, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, nil, []string{"requests==2.31.0"}, nil, nil, nil, downgradeGuard{})
 	hasInstall := false
 	hasUninstall := false
 	for _, c := range cmds {
@@ -387,7 +519,7 @@ func TestBuildReconcileActions_NpmAndYarnAndPnpm(t *testing.T) {
 		Yarn: []string{"lodash@4.17.21"},
 		Pnpm: []string{"typescript@5.1.6"},
 	}
-	cmds := buildReconcileActions(pkgs, nil, nil, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, nil, nil, nil, nil, nil, downgradeGuard{})
 	hasNpm := false
 	hasYarn := false
 	hasPnpm := false
@@ -417,7 +549,7 @@ func TestBuildReconcileActions_VersionUpgrade(t *testing.T) {
 	pkgs := lockPackages{
 		Pip: []string{"flask==2.4.0"},
 	}
-	cmds := buildReconcileActions(pkgs, nil, []string{"flask==2.3.0"}, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, nil, []string{"flask==2.3.0"}, nil, nil, nil, downgradeGuard{})
 	hasUpgrade := false
 	for _, c := range cmds {
 		if strings.Contains(c, "pip install flask==2.4.0") {
@@ -433,7 +565,7 @@ func TestBuildReconcileActions_BatchedAptRemove(t *testing.T) {
 	pkgs := lockPackages{
 		Apt: []string{"git=1:2.39.2-1"},
 	}
-	cmds := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1", "vim=9.0.1-1", "nano=7.2-1"}, nil, nil, nil, nil)
+	cmds, _ := buildReconcileActions(pkgs, []string{"git=1:2.39.2-1", "vim=9.0.1-1", "nano=7.2-1"}, nil, nil, nil, nil, downgradeGuard{})
 
 	removeCount := 0
 	for _, c := range cmds {
@@ -448,3 +580,2626 @@ func TestBuildReconcileActions_BatchedAptRemove(t *testing.T) {
 		t.Errorf("expected 1 batched apt-get remove call, got %d", removeCount)
 	}
 }
+
+func TestBuildReconcileActions_ChunkedAptInstall(t *testing.T) {
+	var apt []string
+	for i := 0; i < aptInstallChunkSize+5; i++ {
+		apt = append(apt, fmt.Sprintf("pkg%02d=1.0", i))
+	}
+	cmds, _ := buildReconcileActions(lockPackages{Apt: apt}, nil, nil, nil, nil, nil, downgradeGuard{})
+
+	installs := 0
+	updates := 0
+	for _, c := range cmds {
+		if strings.Contains(c, "apt-get install") {
+			installs++
+		}
+		if c == "apt update -y" {
+			updates++
+		}
+	}
+	if installs != 2 {
+		t.Errorf("expected 2 apt install chunks, got %d: %v", installs, cmds)
+	}
+	if updates != 1 {
+		t.Errorf("expected a single apt update, got %d", updates)
+	}
+}
+
+func TestBuildReconcileActions_DowngradeGuard(t *testing.T) {
+	pkgs := lockPackages{
+		Apt: []string{"libc6=2.36-9", "curl=7.88.1-10", "git=1:2.39.2-1", "jq=1.6-2"},
+	}
+	cur := []string{"libc6=2.36-9+deb12u4", "curl=7.88.1-10+deb12u5", "git=1:2.39.2-1", "jq=1.6-1"}
+	protected := map[string]bool{"libc6": true}
+
+	installs := func(cmds []string) string {
+		var out []string
+		for _, c := range cmds {
+			if strings.Contains(c, "apt-get install") {
+				out = append(out, c)
+			}
+		}
+		return strings.Join(out, "\n")
+	}
+
+	cmds, downgrades := buildReconcileActions(pkgs, cur, nil, nil, nil, nil, downgradeGuard{Protected: protected})
+	if len(downgrades) != 2 || downgrades[0].Name != "curl" || downgrades[1].Name != "libc6" {
+		t.Fatalf("expected curl and libc6 downgrades, got %+v", downgrades)
+	}
+	if !downgrades[0].Held || downgrades[0].Protected {
+		t.Errorf("curl should be held without --allow-downgrade, got %+v", downgrades[0])
+	}
+	if !downgrades[1].Held || !downgrades[1].Protected {
+		t.Errorf("libc6 should be held as protected, got %+v", downgrades[1])
+	}
+	got := installs(cmds)
+	if !strings.Contains(got, "jq=1.6-2") || strings.Contains(got, "curl=") || strings.Contains(got, "libc6=") {
+		t.Errorf("expected only the jq upgrade to be installed, got %q", got)
+	}
+
+	cmds, downgrades = buildReconcileActions(pkgs, cur, nil, nil, nil, nil, downgradeGuard{Protected: protected, Allow: true})
+	if len(downgrades) != 2 || downgrades[0].Held || !downgrades[1].Held {
+		t.Errorf("expected curl allowed and libc6 still held, got %+v", downgrades)
+	}
+	got = installs(cmds)
+	if !strings.Contains(got, "curl=7.88.1-10") || strings.Contains(got, "libc6=") {
+		t.Errorf("expected curl downgrade but not libc6, got %q", got)
+	}
+}
+
+func TestNewDowngradeGuard(t *testing.T) {
+	g := newDowngradeGuard(&config.GlobalSettings{ProtectedPackages: []string{" openssl ", ""}}, false)
+	for _, name := range []string{"libc6", "dpkg", "openssl"} {
+		if !g.Protected[name] {
+			t.Errorf("expected %s to be protected", name)
+		}
+	}
+	if g.Protected[""] || g.Protected["curl"] {
+		t.Errorf("unexpected protected entries: %v", g.Protected)
+	}
+	if g := newDowngradeGuard(nil, true); !g.Allow || !g.Protected["apt"] {
+		t.Errorf("expected built-in list with nil settings, got %+v", g)
+	}
+}
+
+func TestSortListRows(t *testing.T) {
+	row := func(name, state, created string, uptime time.Duration) listRow {
+		return listRow{Project: &config.Project{Name: name, CreatedAt: created}, State: state, Uptime: uptime}
+	}
+	rows := []listRow{
+		row("delta", listStateMissing, "", 0),
+		row("alpha", listStateStopped, "2026-01-02T00:00:00Z", 0),
+		row("charlie", listStateRunning, "2026-03-01T00:00:00Z", time.Minute),
+		row("bravo", listStateRunning, "2026-02-01T00:00:00Z", time.Hour),
+	}
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"name", []string{"alpha", "bravo", "charlie", "delta"}},
+		{"status", []string{"bravo", "charlie", "alpha", "delta"}},
+		{"uptime", []string{"bravo", "charlie", "alpha", "delta"}},
+		{"created", []string{"charlie", "bravo", "alpha", "delta"}},
+	}
+	for _, tt := range tests {
+		sorted := append([]listRow(nil), rows...)
+		sortListRows(sorted, tt.key)
+		var got []string
+		for _, r := range sorted {
+			got = append(got, r.Project.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort by %s = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	py := listRow{Project: &config.Project{Name: "api", Stack: "python"}, State: listStateRunning}
+	goStopped := listRow{Project: &config.Project{Name: "cli", Stack: "go"}, State: listStateStopped}
+	none := listRow{Project: &config.Project{Name: "old"}, State: listStateMissing}
+
+	tests := []struct {
+		name  string
+		specs []string
+		want  []bool
+	}{
+		{"no filters", nil, []bool{true, true, true}},
+		{"status", []string{"status=running"}, []bool{true, false, false}},
+		{"stack is case-insensitive", []string{"stack=Python"}, []bool{true, false, false}},
+		{"same key is either", []string{"stack=python", "stack=go"}, []bool{true, true, false}},
+		{"different keys are both", []string{"stack=go", "status=running"}, []bool{false, false, false}},
+		{"missing", []string{"status=missing"}, []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		filter, err := parseListFilters(tt.specs)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, row := range []listRow{py, goStopped, none} {
+			if got := filter.match(row); got != tt.want[i] {
+				t.Errorf("%s: match(%s) = %v, want %v", tt.name, row.Project.Name, got, tt.want[i])
+			}
+		}
+	}
+
+	for _, bad := range []string{"status", "status=paused", "owner=me", "stack="} {
+		if _, err := parseListFilters([]string{bad}); err == nil {
+			t.Errorf("expected an error for --filter %q", bad)
+		}
+	}
+}
+
+func TestListIslandState(t *testing.T) {
+	for status, want := range map[string]string{
+		"Up 3 hours":             listStateRunning,
+		"Up 2 minutes (healthy)": listStateRunning,
+		"Exited (0) 2 days ago":  listStateStopped,
+		"Created":                listStateStopped,
+		"":                       listStateMissing,
+	} {
+		if got := listIslandState(status); got != want {
+			t.Errorf("listIslandState(%q) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+// fakeSnapshotEngine records the calls an apply snapshot makes
+type fakeSnapshotEngine struct {
+	calls     []string
+	commitErr error
+	createErr error
+}
+
+func (f *fakeSnapshotEngine) CommitContainer(name, tag string) (string, error) {
+	f.calls = append(f.calls, "commit "+name)
+	return "sha256:abc", f.commitErr
+}
+func (f *fakeSnapshotEngine) StopIsland(name string) error {
+	f.calls = append(f.calls, "stop "+name)
+	return nil
+}
+func (f *fakeSnapshotEngine) RemoveIsland(name string) error {
+	f.calls = append(f.calls, "remove "+name)
+	return nil
+}
+func (f *fakeSnapshotEngine) CreateIslandWithConfig(name, image, host, island string, cfg interface{}) (string, error) {
+	f.calls = append(f.calls, fmt.Sprintf("create %s from %s at %s:%s", name, strings.SplitN(image, ":", 2)[0], filepath.Base(host), island))
+	return "id", f.createErr
+}
+func (f *fakeSnapshotEngine) StartIsland(id string) error {
+	f.calls = append(f.calls, "start "+id)
+	return nil
+}
+func (f *fakeSnapshotEngine) WaitForIsland(name string, timeout time.Duration) error {
+	f.calls = append(f.calls, "wait "+name)
+	return nil
+}
+func (f *fakeSnapshotEngine) RunDockerCommand(args []string) error {
+	f.calls = append(f.calls, strings.Join(args[:1], " "))
+	return nil
+}
+
+func TestApplySnapshotLifecycle(t *testing.T) {
+	cm, err := config.NewConfigManagerWithPath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := configManager
+	configManager = cm
+	defer func() { configManager = saved }()
+
+	workspace := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workspace, "coderaft.json"), []byte(`{"name":"app","working_dir":"/src"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project := &config.Project{Name: "app", IslandName: "coderaft_app", WorkspacePath: workspace}
+	stepErr := fmt.Errorf("failed to reconcile packages: exit 100")
+	created := fmt.Sprintf("create coderaft_app from coderaft-snapshot/app at %s:/src", filepath.Base(workspace))
+
+	tests := []struct {
+		name      string
+		commitErr error
+		createErr error
+		succeed   bool
+		rollback  bool
+		wantCalls []string
+		wantErr   string
+	}{
+		{"success discards snapshot", nil, nil, true, true, []string{"commit coderaft_app", "rmi"}, ""},
+		{"failure rolls back", nil, nil, false, true,
+			[]string{"commit coderaft_app", "stop coderaft_app", "remove coderaft_app", created, "start id", "wait coderaft_app"},
+			"the island was rolled back"},
+		{"failure without auto-rollback keeps snapshot", nil, nil, false, false, []string{"commit coderaft_app"}, "exit 100"},
+		{"no snapshot, nothing to roll back", fmt.Errorf("commit failed"), nil, false, true, []string{"commit coderaft_app"}, "exit 100"},
+		{"rollback failure keeps snapshot", nil, fmt.Errorf("no space left"), false, true,
+			[]string{"commit coderaft_app", "stop coderaft_app", "remove coderaft_app", created},
+			"rollback failed: failed to create island from snapshot: no space left"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSnapshotEngine{commitErr: tt.commitErr, createErr: tt.createErr}
+			snapshot := takeApplySnapshot(fake, project)
+			if (snapshot.Tag == "") != (tt.commitErr != nil) {
+				t.Fatalf("unexpected snapshot tag %q", snapshot.Tag)
+			}
+			if tt.succeed {
+				snapshot.discard()
+			} else {
+				err := snapshot.fail("package reconciliation", stepErr, tt.rollback)
+				if !errors.Is(err, stepErr) {
+					t.Errorf("expected the step error to be wrapped, got %v", err)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %q should contain %q", err, tt.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(fake.calls, tt.wantCalls) {
+				t.Errorf("calls = %q, want %q", fake.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1:1.0", "2.0", 1},
+		{"2.36-9", "2.36-9+deb12u4", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1.0a", "1.0+", -1},
+		{"7.88.1-10+deb12u5", "7.88.1-10", 1},
+	}
+	for _, tt := range tests {
+		if got := compareDebianVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareDebianVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestReconcilePackageCount(t *testing.T) {
+	tests := []struct {
+		action string
+		want   int
+	}{
+		{"apt update -y", 0},
+		{"apt-get autoremove -y", 0},
+		{"DEBIAN_FRONTEND=noninteractive apt-get install -y git=1:2.39 curl=7.88", 2},
+		{"apt-get remove -y vim nano", 2},
+		{"python3 -m pip install flask==2.3.0", 1},
+		{"python3 -m pip uninstall -y requests", 1},
+		{"npm i -g express@4.18.2", 1},
+		{"pnpm remove -g typescript", 1},
+	}
+	for _, tt := range tests {
+		if got := reconcilePackageCount(tt.action); got != tt.want {
+			t.Errorf("reconcilePackageCount(%q) = %d, want %d", tt.action, got, tt.want)
+		}
+	}
+}
+
+// fakeReconcileEngine finishes the first ok actions it's given and fails the rest
+type fakeReconcileEngine struct {
+	DockerEngine
+	ok      int
+	calls   [][]string
+	workers int
+}
+
+func (f *fakeReconcileEngine) ExecuteSetupCommandsWithProgress(islandName string, commands []string, workers int, onDone func(command string)) error {
+	f.calls = append(f.calls, commands)
+	f.workers = workers
+	for i, c := range commands {
+		if i == f.ok {
+			return fmt.Errorf("command failed: %s: exit code 1", c)
+		}
+		onDone(c)
+	}
+	return nil
+}
+
+func TestReconcileWithProgress(t *testing.T) {
+	saved := dockerClient
+	defer func() { dockerClient = saved }()
+
+	actions := []string{
+		"apt update -y",
+		"DEBIAN_FRONTEND=noninteractive apt-get install -y jq=1.6-2 ripgrep=13.0.0-4",
+		"python3 -m pip install flask==3.0.0",
+		"npm i -g typescript@5.2.2",
+		"go install golang.org/x/tools/gopls@v0.14.2",
+	}
+
+	fake := &fakeReconcileEngine{ok: len(actions)}
+	dockerClient = fake
+	if err := reconcileWithProgress("coderaft_app", actions, 2); err != nil {
+		t.Fatalf("reconcileWithProgress: %v", err)
+	}
+	if len(fake.calls) != 1 || !reflect.DeepEqual(fake.calls[0], actions) || fake.workers != 2 {
+		t.Errorf("expected every action in one call with 2 workers, got %q with %d workers", fake.calls, fake.workers)
+	}
+
+	fake = &fakeReconcileEngine{ok: 3}
+	dockerClient = fake
+	err := reconcileWithProgress("coderaft_app", actions, 2)
+	if err == nil || !strings.Contains(err.Error(), "reconcile stopped after 3/5 packages") {
+		t.Errorf("expected the failure to report 3/5 packages, got %v", err)
+	}
+	if len(fake.calls) != 1 {
+		t.Errorf("expected no retry after a failure, got %d calls", len(fake.calls))
+	}
+}
+
+func TestBuildToolReconcileActions(t *testing.T) {
+	pkgs := lockPackages{
+		Go:    []string{"github.com/BurntSushi/toml/cmd/tomlv@v1.3.2", "golang.org/x/tools/gopls@v0.14.2"},
+		Cargo: []string{"ripgrep=v13.0.0"},
+	}
+	cmds := buildToolReconcileActions(pkgs,
+		[]string{"github.com/mikefarah/yq/v4@v4.40.5", "golang.org/x/tools/gopls@v0.14.2", "mvdan.cc/gofumpt@v0.5.0"},
+		[]string{"ripgrep=v12.1.1", "bat=v0.24.0"},
+		map[string]string{"github.com/mikefarah/yq/v4": "yq", "mvdan.cc/gofumpt": "gofumpt"},
+	)
+
+	want := []string{
+		"go install github.com/BurntSushi/toml/cmd/tomlv@v1.3.2",
+		`rm -f "$(go env GOPATH)/bin/yq"`,
+		`rm -f "$(go env GOPATH)/bin/gofumpt"`,
+		"cargo install --force --version 13.0.0 ripgrep",
+		"cargo uninstall bat",
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("expected %d commands, got %v", len(want), cmds)
+	}
+	for i := range want {
+		if cmds[i] != want[i] {
+			t.Errorf("command %d = %q, want %q", i, cmds[i], want[i])
+		}
+	}
+	for _, c := range cmds {
+		if reconcilePackageCount(c) != 1 {
+			t.Errorf("reconcilePackageCount(%q) = %d, want 1", c, reconcilePackageCount(c))
+		}
+	}
+}
+
+func TestGoBinaryName(t *testing.T) {
+	files := map[string]string{"example.com/tool/cmd/run": "tool-run"}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"example.com/tool/cmd/run", "tool-run"},
+		{"golang.org/x/tools/gopls", "gopls"},
+		{"github.com/mikefarah/yq/v4", "yq"},
+		{"github.com/golang-migrate/migrate/v4/cmd/migrate", "migrate"},
+		{"example.com/v2", "example.com"},
+		{"example.com/tool/vet", "vet"},
+		{"example.com/tool/v1", "v1"},
+	}
+	for _, tt := range tests {
+		if got := goBinaryName(tt.path, files); got != tt.want {
+			t.Errorf("goBinaryName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseVSCodeExtensions(t *testing.T) {
+	cli := "ms-python.python@2024.2.1\nGitHub.copilot@1.160.0\n"
+	got := parseVSCodeExtensions(cli)
+	want := []string{"github.copilot@1.160.0", "ms-python.python@2024.2.1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("parseVSCodeExtensions(cli) = %v, want %v", got, want)
+	}
+
+	dirs := "dbaeumer.vscode-eslint-2.4.4\nms-python.python-2024.2.1-linux-x64\nextensions.json\n.obsolete\n"
+	got = parseVSCodeExtensions(dirs)
+	want = []string{"dbaeumer.vscode-eslint@2.4.4", "ms-python.python@2024.2.1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("parseVSCodeExtensions(dirs) = %v, want %v", got, want)
+	}
+}
+
+func TestBuildVSCodeReconcileActions(t *testing.T) {
+	cmds := buildVSCodeReconcileActions(
+		[]string{"golang.go@0.41.0", "ms-python.python@2024.2.1"},
+		[]string{"golang.go@0.40.0", "ms-python.python@2024.2.1", "esbenp.prettier-vscode@10.1.0"},
+	)
+	if len(cmds) != 2 {
+		t.Fatalf("expected 2 commands, got %v", cmds)
+	}
+	if !strings.Contains(cmds[0], "--install-extension 'golang.go@0.41.0' --force") {
+		t.Errorf("unexpected install command: %s", cmds[0])
+	}
+	if !strings.Contains(cmds[1], "--uninstall-extension 'esbenp.prettier-vscode'") {
+		t.Errorf("unexpected uninstall command: %s", cmds[1])
+	}
+	for _, c := range cmds {
+		if reconcilePackageCount(c) != 1 {
+			t.Errorf("reconcilePackageCount(%q) = %d, want 1", c, reconcilePackageCount(c))
+		}
+	}
+}
+
+func TestComputeLockChecksum_VSCodeExtensionsOptional(t *testing.T) {
+	lf := &lockFile{BaseImage: lockImage{Name: "ubuntu:22.04"}}
+	before := computeLockChecksum(lf)
+	lf.VSCodeExtensions = []string{}
+	if computeLockChecksum(lf) != before {
+		t.Error("an empty vscode_extensions section should not change the checksum")
+	}
+	lf.VSCodeExtensions = []string{"golang.go@0.41.0"}
+	if computeLockChecksum(lf) == before {
+		t.Error("vscode extensions should be part of the checksum")
+	}
+}
+
+func TestPackageDiff_GoAndCargo(t *testing.T) {
+	if drifts := packageDiff("cargo", "=", []string{"ripgrep=v13.0.0"}, []string{"ripgrep=13.0.0"}, nil); drifts != nil {
+		t.Errorf("expected cargo v-prefix to be ignored, got %v", drifts)
+	}
+
+	drifts := packageDiff("go", "@", []string{"github.com/BurntSushi/toml/cmd/tomlv@v1.3.2"}, []string{"github.com/BurntSushi/toml/cmd/tomlv@v1.3.0"}, nil)
+	found := false
+	for _, d := range drifts {
+		if strings.Contains(d, "github.com/BurntSushi/toml/cmd/tomlv: v1.3.2 → v1.3.0") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected case-preserving go drift entry, got %v", drifts)
+	}
+}
+
+func TestDotfilesCacheDir(t *testing.T) {
+	dir, err := dotfilesCacheDir("https://github.com/user/dotfiles")
+	if err != nil {
+		t.Fatalf("dotfilesCacheDir() error = %v", err)
+	}
+	if !strings.HasSuffix(dir, "github.com-user-dotfiles") {
+		t.Errorf("unexpected cache dir: %s", dir)
+	}
+
+	ssh, err := dotfilesCacheDir("git@github.com:user/dotfiles.git")
+	if err != nil {
+		t.Fatalf("dotfilesCacheDir() error = %v", err)
+	}
+	if ssh != dir {
+		t.Errorf("expected SSH and HTTPS URLs to share a cache dir, got %s and %s", ssh, dir)
+	}
+}
+
+func TestPrependDotfiles(t *testing.T) {
+	m := prependDotfiles(map[string]interface{}{"dotfiles": []interface{}{"~/.project-dotfiles"}}, "/cache/dotfiles")
+	arr, ok := m["dotfiles"].([]interface{})
+	if !ok || len(arr) != 2 || arr[0] != "/cache/dotfiles" {
+		t.Errorf("expected repo dotfiles first, got %v", m["dotfiles"])
+	}
+
+	if m := prependDotfiles(nil, "/cache/dotfiles"); len(m["dotfiles"].([]interface{})) != 1 {
+		t.Errorf("expected a single dotfiles entry, got %v", m["dotfiles"])
+	}
+}
+
+func TestResolveDotfilesSource_LocalDir(t *testing.T) {
+	dir := t.TempDir()
+	path, fromRepo, err := resolveDotfilesSource(dir, nil, false)
+	if err != nil {
+		t.Fatalf("resolveDotfilesSource() error = %v", err)
+	}
+	if path != dir || fromRepo {
+		t.Errorf("expected local dir to be used as-is, got %s (fromRepo=%v)", path, fromRepo)
+	}
+
+	path, _, err = resolveDotfilesSource("", nil, false)
+	if err != nil || path != "" {
+		t.Errorf("expected no dotfiles without a source, got %q, %v", path, err)
+	}
+}
+
+func TestSearchManagersForStack(t *testing.T) {
+	tests := map[string][]string{
+		"python": {"pip", "apt"},
+		"nodejs": {"npm", "apt"},
+		"go":     {"apt"},
+		"":       {"apt"},
+	}
+	for stack, want := range tests {
+		got := searchManagersForStack(stack)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("searchManagersForStack(%q) = %v, want %v", stack, got, want)
+		}
+	}
+}
+
+func TestSearchCommandQuotesQuery(t *testing.T) {
+	cmd := searchCommand("apt", "foo'; rm -rf /")
+	if !strings.Contains(cmd, `'foo'\''; rm -rf /'`) {
+		t.Errorf("query not shell-quoted: %s", cmd)
+	}
+}
+
+func TestParseSearchOutput(t *testing.T) {
+	apt := parseSearchOutput("apt", "redis - Persistent key-value database\nredis-tools - Persistent key-value database (client)\n")
+	if len(apt) != 2 || apt[0].Name != "redis" || apt[1].Description != "Persistent key-value database (client)" {
+		t.Errorf("unexpected apt results: %+v", apt)
+	}
+
+	pip := parseSearchOutput("pip", "requests (2.31.0)\nAvailable versions: 2.31.0, 2.30.0\n")
+	if len(pip) != 1 || pip[0].Name != "requests" || pip[0].Description != "latest 2.31.0" {
+		t.Errorf("unexpected pip results: %+v", pip)
+	}
+
+	npm := parseSearchOutput("npm", "eslint\tAn AST-based pattern checker\t=nzakas\t2024-01-01\t8.56.0\tlint\n")
+	if len(npm) != 1 || npm[0].Name != "eslint" || npm[0].Description != "An AST-based pattern checker (8.56.0)" {
+		t.Errorf("unexpected npm results: %+v", npm)
+	}
+}
+
+func TestSplitPortSpec(t *testing.T) {
+	tests := []struct {
+		spec                       string
+		ip, host, container, proto string
+		ok                         bool
+	}{
+		{"8080:80", "", "8080", "80", "tcp", true},
+		{"127.0.0.1:5432:5432", "127.0.0.1", "5432", "5432", "tcp", true},
+		{"5353:53/udp", "", "5353", "53", "udp", true},
+		{"3000", "", "", "", "", false},
+		{"8000-8010:8000-8010", "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		ip, host, container, proto, ok := splitPortSpec(tt.spec)
+		if ok != tt.ok || ip != tt.ip || host != tt.host || container != tt.container || proto != tt.proto {
+			t.Errorf("splitPortSpec(%q) = %q %q %q %q %v", tt.spec, ip, host, container, proto, ok)
+		}
+	}
+}
+
+func TestHostPortAvailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	if hostPortAvailable("127.0.0.1", port, "tcp") {
+		t.Errorf("expected port %s to be reported in use", port)
+	}
+}
+
+func TestResolvePortConflicts(t *testing.T) {
+	busy := func(ip, port, proto string) bool { return port != "8080" }
+	owner := func(port string) string { return "island 'coderaft_other'" }
+
+	_, _, err := resolvePortConflicts([]string{"3000:3000", "8080:80"}, false, busy, owner)
+	if err == nil || !strings.Contains(err.Error(), "port 8080 is already in use by island 'coderaft_other'") {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+
+	ports, remaps, err := resolvePortConflicts([]string{"3000:3000", "8080:80", "9000"}, true, busy, owner)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(remaps) != 1 || remaps[0].OldHost != "8080" || remaps[0].NewHost == "" {
+		t.Fatalf("unexpected remaps: %+v", remaps)
+	}
+	if ports[0] != "3000:3000" || ports[1] != remaps[0].NewHost+":80" || ports[2] != "9000" {
+		t.Errorf("unexpected ports: %v", ports)
+	}
+
+	_, _, err = resolvePortConflicts([]string{"3000:3000", "3000:4000"}, false, func(string, string, string) bool { return true }, nil)
+	if err == nil || !strings.Contains(err.Error(), "another entry in coderaft.json") {
+		t.Errorf("expected duplicate port error, got %v", err)
+	}
+}
+
+func TestClassifyLogLine(t *testing.T) {
+	tests := map[string]string{
+		"E: Unable to locate package foo":        "error",
+		"npm ERR! code ENOENT":                   "error",
+		"Traceback (most recent call last):":     "error",
+		"<== exit 100":                           "error",
+		"<== exit 0":                             "",
+		"W: Some index files failed to download": "error",
+		"W: GPG key expired":                     "warning",
+		"npm WARN deprecated request@2.88.2":     "warning",
+		"Setting up git (1:2.39.2-1) ...":        "",
+	}
+	for line, want := range tests {
+		if got := classifyLogLine(line); got != want {
+			t.Errorf("classifyLogLine(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestFilterLogLines(t *testing.T) {
+	lines := []string{
+		"==> $ apt install -y foo",
+		"Reading package lists...",
+		"E: Unable to locate package foo",
+		"<== exit 100",
+		"==> $ npm install",
+		"added 10 packages",
+		"npm WARN deprecated bar@1.0.0",
+		"<== exit 0",
+	}
+
+	errs := filterLogLines(lines, nil, "error", 0)
+	if len(errs) != 2 || errs[0].Number != 3 || errs[1].Number != 4 {
+		t.Errorf("unexpected error lines: %+v", errs)
+	}
+
+	warns := filterLogLines(lines, nil, "warning", 0)
+	if len(warns) != 3 {
+		t.Errorf("expected errors and warnings, got %+v", warns)
+	}
+
+	ctx := filterLogLines(lines, regexp.MustCompile(`WARN`), "", 1)
+	if len(ctx) != 3 || ctx[0].Number != 6 || !ctx[1].Match || ctx[2].Match {
+		t.Errorf("unexpected context lines: %+v", ctx)
+	}
+
+	sep := filterLogLines(lines, regexp.MustCompile(`^==>`), "", 1)
+	var separators int
+	for _, l := range sep {
+		if l.Separator {
+			separators++
+		}
+	}
+	if separators != 1 {
+		t.Errorf("expected one separator between non-adjacent groups, got %d", separators)
+	}
+
+	grouped := filterLogLines(lines, regexp.MustCompile(`Reading|added`), "", 0)
+	if len(grouped) != 2 {
+		t.Errorf("unexpected grep result: %+v", grouped)
+	}
+}
+
+func TestResetCorruptConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := resetCorruptConfig(path)
+	if err != nil {
+		t.Fatalf("resetCorruptConfig: %v", err)
+	}
+	if data, err := os.ReadFile(backup); err != nil || string(data) != "{not json" {
+		t.Errorf("backup should keep the original contents, got %q (%v)", data, err)
+	}
+
+	cm, err := config.NewConfigManagerWithPath(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.Load(); err != nil {
+		t.Errorf("reset config should load cleanly: %v", err)
+	}
+}
+
+func TestDoctorProjectIssues_MissingWorkspace(t *testing.T) {
+	saved := dockerClient
+	dockerClient = nil
+	defer func() { dockerClient = saved }()
+
+	missing := filepath.Join(t.TempDir(), "gone")
+	cfg := &config.Config{Projects: map[string]*config.Project{
+		"app": {Name: "app", IslandName: "coderaft_app", WorkspacePath: missing},
+	}}
+
+	issues := doctorProjectIssues(cfg)
+	if len(issues) != 1 || issues[0].Fix == nil {
+		t.Fatalf("expected one fixable issue, got %+v", issues)
+	}
+	if _, err := issues[0].Fix(); err != nil {
+		t.Fatalf("fix failed: %v", err)
+	}
+	if info, err := os.Stat(missing); err != nil || !info.IsDir() {
+		t.Errorf("expected workspace to be created: %v", err)
+	}
+}
+
+// fakeIslandProber answers in-island probes: a command containing one of
+// fail's keys fails, and output is returned for commands containing its key
+type fakeIslandProber struct {
+	status string
+	fail   []string
+	output map[string]string
+}
+
+func (f *fakeIslandProber) GetIslandStatus(string) (string, error) { return f.status, nil }
+
+func (f *fakeIslandProber) ExecCapture(_, command string) (string, string, error) {
+	for _, key := range f.fail {
+		if strings.Contains(command, key) {
+			return "", "", fmt.Errorf("exit status 1")
+		}
+	}
+	for key, out := range f.output {
+		if strings.Contains(command, key) {
+			return out, "", nil
+		}
+	}
+	return "", "", nil
+}
+
+func TestDoctorIslandIssues(t *testing.T) {
+	project := &config.Project{Name: "app", IslandName: "coderaft_app", WorkspacePath: "/home/me/coderaft/app"}
+	checks := func(issues []doctorIssue) []string {
+		var out []string
+		for _, issue := range issues {
+			out = append(out, issue.Check)
+		}
+		return out
+	}
+
+	if issues := doctorIslandIssues(&fakeIslandProber{status: "running"}, project, nil, "python"); len(issues) != 0 {
+		t.Errorf("healthy island: unexpected issues %+v", issues)
+	}
+
+	stopped := doctorIslandIssues(&fakeIslandProber{status: "exited"}, project, nil, "python")
+	if len(stopped) != 1 || stopped[0].Fix == nil {
+		t.Errorf("stopped island: expected one fixable issue, got %+v", stopped)
+	}
+	if missing := doctorIslandIssues(&fakeIslandProber{status: "not found"}, project, nil, "go"); len(missing) != 1 || missing[0].Fix != nil {
+		t.Errorf("missing island: expected one issue with a hint, got %+v", missing)
+	}
+
+	broken := &fakeIslandProber{
+		status: "running",
+		fail:   []string{"/etc/coderaft-initialized", "curl"},
+		output: map[string]string{"mountinfo": "readonly", "command -v 'npm'": "npm"},
+	}
+	issues := doctorIslandIssues(broken, project, &config.ProjectConfig{WorkingDir: "/src"}, "nodejs")
+	if got, want := checks(issues), []string{"wrapper", "workspace", "network", "toolchain"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("checks = %v, want %v", got, want)
+	}
+	if !strings.Contains(issues[1].Problem, "/src") || !strings.Contains(issues[3].Problem, "npm") || strings.Contains(issues[3].Problem, "node,") {
+		t.Errorf("unexpected problems: %+v", issues)
+	}
+
+	noDNS := &fakeIslandProber{status: "running", fail: []string{"getent"}}
+	issues = doctorIslandIssues(noDNS, project, &config.ProjectConfig{Network: "none"}, "")
+	if len(issues) != 1 || !strings.Contains(issues[0].Problem, "DNS") || !strings.Contains(issues[0].Hint, "none") {
+		t.Errorf("expected a single DNS issue pointing at network none, got %+v", issues)
+	}
+}
+
+func TestMissingToolsScript(t *testing.T) {
+	got := missingToolsScript([]string{"python3", "pip3|pip"})
+	want := "{ command -v 'python3' >/dev/null 2>&1; } || echo 'python3'; { command -v 'pip3' >/dev/null 2>&1 || command -v 'pip' >/dev/null 2>&1; } || echo 'pip3|pip'"
+	if got != want {
+		t.Errorf("missingToolsScript() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInstallCommand(t *testing.T) {
+	tests := []struct {
+		manager string
+		pkgs    []string
+		dev     bool
+		want    string
+		wantErr bool
+	}{
+		{"apt", []string{"htop", "jq"}, false, "apt-get install -y htop jq", false},
+		{"pip", []string{"flask>=2.0"}, false, "pip install 'flask>=2.0'", false},
+		{"npm", []string{"eslint"}, true, "npm install --save-dev eslint", false},
+		{"yarn", []string{"@types/node"}, true, "yarn add --dev @types/node", false},
+		{"pnpm", []string{"vite"}, false, "pnpm add vite", false},
+		{"pip", []string{"pytest"}, true, "", true},
+		{"apt", []string{"x; rm -rf /"}, false, "apt-get install -y 'x; rm -rf /'", false},
+	}
+	for _, tt := range tests {
+		got, err := installCommand(tt.manager, tt.pkgs, tt.dev)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("installCommand(%s, %v, %v) error = %v", tt.manager, tt.pkgs, tt.dev, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("installCommand(%s, %v, %v) = %q, want %q", tt.manager, tt.pkgs, tt.dev, got, tt.want)
+		}
+		if got != "" && !isAllowedHistoryCommand(got) {
+			t.Errorf("%q would be skipped when replaying coderaft.history", got)
+		}
+	}
+}
+
+func TestInstallManagerForWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	if got := installManagerForWorkspace(dir); got != "apt" {
+		t.Errorf("empty workspace: got %s, want apt", got)
+	}
+	os.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644)
+	if got := installManagerForWorkspace(dir); got != "npm" {
+		t.Errorf("package.json: got %s, want npm", got)
+	}
+	os.WriteFile(filepath.Join(dir, "pnpm-lock.yaml"), nil, 0644)
+	if got := installManagerForWorkspace(dir); got != "pnpm" {
+		t.Errorf("pnpm-lock.yaml: got %s, want pnpm", got)
+	}
+}
+
+func TestAppendHistoryDeduplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coderaft.history")
+	for i := 0; i < 2; i++ {
+		if err := appendHistory(path, "apt-get install -y htop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendHistory(path, "pip install flask"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "apt-get install -y htop\npip install flask\n" {
+		t.Errorf("unexpected history: %q", data)
+	}
+}
+
+func TestResolvePullPolicy(t *testing.T) {
+	cfg := &config.Config{Settings: &config.GlobalSettings{}}
+	if got := resolvePullPolicy("", cfg); got != "missing" {
+		t.Errorf("default: got %s, want missing", got)
+	}
+	cfg.Settings.PullPolicy = "never"
+	if got := resolvePullPolicy("", cfg); got != "never" {
+		t.Errorf("settings: got %s, want never", got)
+	}
+	if got := resolvePullPolicy("always", cfg); got != "always" {
+		t.Errorf("flag: got %s, want always", got)
+	}
+}
+
+func TestParseShellMount(t *testing.T) {
+	dir := t.TempDir()
+
+	got, err := parseShellMount(dir + ":/data/:ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != dir+":/data:ro" {
+		t.Errorf("got %s", got)
+	}
+
+	for _, spec := range []string{
+		dir,
+		dir + ":data",
+		":/data",
+		filepath.Join(dir, "missing") + ":/data",
+	} {
+		if _, err := parseShellMount(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestComputeLockChecksum_AptPreferencesOptional(t *testing.T) {
+	lf := &lockFile{BaseImage: lockImage{Name: "debian:bookworm"}}
+	before := computeLockChecksum(lf)
+	lf.AptSources.Preferences = map[string]string{}
+	if computeLockChecksum(lf) != before {
+		t.Error("empty apt preferences should not change the checksum")
+	}
+	lf.AptSources.Preferences = map[string]string{"/etc/apt/preferences.d/hold": "Package: curl\nPin: version 7.*\nPin-Priority: 1001"}
+	if computeLockChecksum(lf) == before {
+		t.Error("apt preferences should be part of the checksum")
+	}
+}
+
+func TestAptPreferencesCommands(t *testing.T) {
+	if cmds, err := aptPreferencesCommands(nil); err != nil || cmds != nil {
+		t.Errorf("no preferences should leave the island alone, got %v (%v)", cmds, err)
+	}
+
+	cmds, err := aptPreferencesCommands(map[string]string{
+		"/etc/apt/preferences.d/hold": "Package: curl\nPin-Priority: 1001",
+		"/etc/apt/preferences":        "Package: *\nPin: release n=bookworm",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 3 || !strings.HasPrefix(cmds[0], "rm -f ") {
+		t.Fatalf("unexpected commands: %v", cmds)
+	}
+	if !strings.HasSuffix(cmds[1], "> '/etc/apt/preferences'") || !strings.HasSuffix(cmds[2], "> '/etc/apt/preferences.d/hold'") {
+		t.Errorf("files should be written in path order: %v", cmds)
+	}
+
+	for _, bad := range []string{"/etc/passwd", "/etc/apt/preferences.d/../../shadow", "/etc/apt/preferences.d/a b"} {
+		if _, err := aptPreferencesCommands(map[string]string{bad: "x"}); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAptPreferencesDiff(t *testing.T) {
+	locked := map[string]string{"/etc/apt/preferences.d/hold": "Pin-Priority: 1001", "/etc/apt/preferences.d/gone": "x"}
+	live := map[string]string{"/etc/apt/preferences.d/hold": "Pin-Priority: 500\n", "/etc/apt/preferences.d/new": "y"}
+	got := aptPreferencesDiff(locked, live)
+	want := []string{
+		"APT preferences drifted:",
+		"  + /etc/apt/preferences.d/new",
+		"  - /etc/apt/preferences.d/gone",
+		"  ~ /etc/apt/preferences.d/hold",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if aptPreferencesDiff(locked, locked) != nil {
+		t.Error("identical preferences should not drift")
+	}
+}
+
+func TestSortTopRows(t *testing.T) {
+	rows := []topRow{
+		{Project: "b", CPU: "1.50%", MemPct: "40.00%", PIDs: "3"},
+		{Project: "a", CPU: "12.00%", MemPct: "5.00%", PIDs: "30"},
+		{Project: "c", CPU: "-", MemPct: "-", PIDs: "-"},
+		{Project: "d", CPU: "1.50%", MemPct: "10.00%", PIDs: "7"},
+	}
+	order := func() string {
+		names := make([]string, len(rows))
+		for i, r := range rows {
+			names[i] = r.Project
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct{ key, want string }{
+		{"cpu", "a,b,d,c"},
+		{"mem", "b,d,a,c"},
+		{"pids", "a,d,b,c"},
+		{"name", "a,b,c,d"},
+	}
+	for _, tt := range tests {
+		sortTopRows(rows, tt.key)
+		if got := order(); got != tt.want {
+			t.Errorf("sortTopRows(%s) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateLockData(t *testing.T) {
+	v1 := []byte(`{"version":1,"project":"p","ISLAND_NAME":"coderaft_p","base_image":{"name":"ubuntu:22.04"},"packages":{"apt":["curl=7.0"]}}`)
+
+	out, changes, err := migrateLockData(v1)
+	if err != nil {
+		t.Fatalf("migrateLockData: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected checksum and version changes, got %v", changes)
+	}
+	var lf lockFile
+	if err := json.Unmarshal(out, &lf); err != nil {
+		t.Fatalf("migrated lock doesn't parse: %v", err)
+	}
+	if lf.Version != currentLockVersion || lf.Checksum != computeLockChecksum(&lf) {
+		t.Errorf("lock not upgraded: version=%d checksum=%q", lf.Version, lf.Checksum)
+	}
+
+	again, changes, err := migrateLockData(out)
+	if err != nil || len(changes) != 0 || string(again) != string(out) {
+		t.Errorf("migrating a current lock should be a no-op, got changes %v err %v", changes, err)
+	}
+
+	if _, _, err := migrateLockData([]byte(`{"version":3}`)); err == nil {
+		t.Error("expected an error for a lock from a newer release")
+	}
+}
+
+func TestSecretInjectTargets(t *testing.T) {
+	stored := []string{"API_KEY", "DB_PASSWORD", "prod_db_pass"}
+
+	got, err := secretInjectTargets(nil, []string{"prod_db_pass=PROD_DB"}, stored)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"API_KEY": "API_KEY", "DB_PASSWORD": "DB_PASSWORD", "prod_db_pass": "PROD_DB"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("all keys: got %v, want %v", got, want)
+	}
+
+	got, err = secretInjectTargets([]string{"API_KEY"}, []string{"prod_db_pass=DB_PASSWORD"}, stored)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = map[string]string{"API_KEY": "API_KEY", "prod_db_pass": "DB_PASSWORD"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scoped keys: got %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		keys, maps []string
+	}{
+		{[]string{"my-key"}, nil},
+		{nil, []string{"API_KEY=1BAD"}},
+		{nil, []string{"API_KEY"}},
+		{[]string{"API_KEY"}, []string{"DB_PASSWORD=API_KEY"}},
+	} {
+		if _, err := secretInjectTargets(tt.keys, tt.maps, stored); err == nil {
+			t.Errorf("secretInjectTargets(%v, %v) expected an error", tt.keys, tt.maps)
+		}
+	}
+}
+
+func TestSecretsEnvFile(t *testing.T) {
+	got := secretsEnvFile(map[string]string{"B": "it's", "A": "$HOME"})
+	want := "export A='$HOME'\nexport B='it'\\''s'\n"
+	if got != want {
+		t.Errorf("secretsEnvFile() = %q, want %q", got, want)
+	}
+}
+
+func TestComputeLockChecksum_SystemOptional(t *testing.T) {
+	lf := &lockFile{BaseImage: lockImage{Name: "debian:bookworm"}}
+	before := computeLockChecksum(lf)
+	if lockSystemFrom(docker.SystemSettings{}) != nil {
+		t.Error("default system settings should not produce a system section")
+	}
+	lf.System = lockSystemFrom(docker.SystemSettings{Timezone: "Europe/Berlin"})
+	withTZ := computeLockChecksum(lf)
+	if withTZ == before {
+		t.Error("system settings should be part of the checksum")
+	}
+	lf.System.Ulimits = map[string]string{"nofile": "1024:4096"}
+	if computeLockChecksum(lf) == withTZ {
+		t.Error("ulimits should be part of the checksum")
+	}
+}
+
+func TestSystemSettingsCommands(t *testing.T) {
+	if cmds, err := systemSettingsCommands(nil); err != nil || cmds != nil {
+		t.Errorf("nil section should produce no commands, got %v, %v", cmds, err)
+	}
+
+	cmds, err := systemSettingsCommands(&lockSystem{Locale: "de_DE.UTF-8", Timezone: "Europe/Berlin", Ulimits: map[string]string{"nofile": "1024:4096"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cmds) != 3 {
+		t.Fatalf("expected timezone, localedef and profile commands, got %v", cmds)
+	}
+	if !strings.Contains(cmds[0], "/usr/share/zoneinfo/'Europe/Berlin'") {
+		t.Errorf("unexpected timezone command: %s", cmds[0])
+	}
+	if !strings.HasPrefix(cmds[1], "localedef -i 'de_DE' -f 'UTF-8' 'de_DE.UTF-8'") {
+		t.Errorf("unexpected locale command: %s", cmds[1])
+	}
+
+	for _, sys := range []*lockSystem{{Timezone: "../../etc/passwd"}, {Timezone: "Europe/Berlin; rm -rf /"}, {Locale: "en_US.UTF-8'; id"}} {
+		if _, err := systemSettingsCommands(sys); err == nil {
+			t.Errorf("expected an error for %+v", sys)
+		}
+	}
+}
+
+func TestSystemDiff(t *testing.T) {
+	locked := &lockSystem{Locale: "de_DE.UTF-8", Timezone: "Europe/Berlin", Ulimits: map[string]string{"nofile": "1024:4096", "nproc": "512:512"}}
+	live := &lockSystem{Locale: "de_DE.UTF-8", Ulimits: map[string]string{"nofile": "1024:1024"}}
+
+	got := systemDiff(locked, live)
+	want := []string{
+		"timezone mismatch: lock=Europe/Berlin current=(default)",
+		"ulimit 'nofile' mismatch: lock=1024:4096 current=1024:1024",
+		"ulimit 'nproc' not set in live island (lock=512:512)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("systemDiff() = %v, want %v", got, want)
+	}
+	if d := systemDiff(nil, live); d != nil {
+		t.Errorf("no system section should mean no drift, got %v", d)
+	}
+}
+
+func TestValidateRunEnv(t *testing.T) {
+	if err := validateRunEnv([]string{"DEBUG=1", "EMPTY=", "URL=a=b"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, pair := range []string{"DEBUG", "=1", "1BAD=x", "MY-VAR=x"} {
+		if err := validateRunEnv([]string{pair}); err == nil {
+			t.Errorf("validateRunEnv(%q) expected an error", pair)
+		}
+	}
+}
+
+func TestRunWithRetry(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	if exitErr == nil {
+		t.Skip("sh not available")
+	}
+
+	// fails twice, then succeeds
+	calls, sleeps := 0, 0
+	sleep := func(d time.Duration) {
+		sleeps++
+		if d != 5*time.Second {
+			t.Errorf("slept %s, want 5s", d)
+		}
+	}
+	err := runWithRetry(3, 5*time.Second, sleep, func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("failed to run command: %w", exitErr)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || sleeps != 2 {
+		t.Errorf("got err=%v calls=%d sleeps=%d, want success after 3 calls and 2 sleeps", err, calls, sleeps)
+	}
+
+	// gives up after retries+1 attempts with the last error
+	calls = 0
+	err = runWithRetry(2, 0, func(time.Duration) {}, func() error { calls++; return exitErr })
+	if !errors.Is(err, exitErr) || calls != 3 {
+		t.Errorf("got err=%v calls=%d, want the exit error after 3 calls", err, calls)
+	}
+
+	// errors other than the command's exit status aren't retried
+	calls = 0
+	err = runWithRetry(2, 0, func(time.Duration) {}, func() error { calls++; return fmt.Errorf("invalid command") })
+	if err == nil || calls != 1 {
+		t.Errorf("got err=%v calls=%d, want a single attempt", err, calls)
+	}
+}
+
+func TestRunVerifyBaseline(t *testing.T) {
+	cm, err := config.NewConfigManagerWithPath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := configManager
+	configManager = cm
+	defer func() { configManager = saved }()
+
+	dir := t.TempDir()
+	write := func(name string, lf lockFile) string {
+		data, err := json.Marshal(lf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	base := lockFile{
+		BaseImage: lockImage{Name: "debian:bookworm"},
+		Container: lockContainer{Environment: map[string]string{"MODE": "dev"}},
+		Packages:  lockPackages{Pip: []string{"flask==3.0.0", "requests==2.31.0"}},
+	}
+	branch := base
+	branch.Container = lockContainer{Environment: map[string]string{"MODE": "prod"}}
+	branch.Packages = lockPackages{Pip: []string{"flask==3.0.2", "rich==13.7.0"}}
+
+	basePath, branchPath := write("main.lock.json", base), write("branch.lock.json", branch)
+
+	report, err := runVerifyBaseline(basePath, basePath)
+	if err != nil || !report.Matches {
+		t.Fatalf("a lock should match itself, got %+v, %v", report, err)
+	}
+
+	report, err = runVerifyBaseline(basePath, branchPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"env var 'MODE' mismatch: lock=dev current=prod",
+		"pip packages drifted: +1 added, -1 removed, ~1 changed",
+		"  + rich==13.7.0",
+		"  - requests==2.31.0",
+		"  ~ flask: 3.0.0 → 3.0.2",
+	}
+	if report.Matches || !reflect.DeepEqual(report.Drifts, want) {
+		t.Errorf("drifts = %v, want %v", report.Drifts, want)
+	}
+
+	if _, err := runVerifyBaseline(filepath.Join(dir, "missing.json"), branchPath); err == nil {
+		t.Error("expected an error for a missing baseline")
+	}
+}
+
+func TestSetupStateLabel(t *testing.T) {
+	tests := []struct {
+		state docker.SetupState
+		want  string
+	}{
+		{docker.SetupState{}, ""},
+		{docker.SetupState{State: docker.SetupStateRunning}, "setting up"},
+		{docker.SetupState{State: docker.SetupStateDone}, "done"},
+		{docker.SetupState{State: docker.SetupStateFailed, ExitCode: 2}, "failed (exit 2)"},
+	}
+	for _, tt := range tests {
+		if got := setupStateLabel(tt.state); got != tt.want {
+			t.Errorf("setupStateLabel(%+v) = %q, want %q", tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestPendingSetupCommands(t *testing.T) {
+	commands := []string{
+		"apt-get install -y jq",
+		"pip install -r requirements.txt",
+		"npm ci",
+		"make build",
+	}
+	doneWhen := map[string]string{
+		"apt-get install -y jq": "command -v jq",
+		"npm ci":                "test -d node_modules",
+	}
+	markers := parseSetupMarkers(setupCommandHash("pip install -r requirements.txt") + "\n\n" + setupCommandHash("apt-get install -y jq") + "\n")
+	var checked []string
+	isDone := func(check string) bool {
+		checked = append(checked, check)
+		return check == "command -v jq"
+	}
+
+	pending, skipped := pendingSetupCommands(commands, doneWhen, markers, isDone)
+	if want := []string{"npm ci", "make build"}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("pending = %v, want %v", pending, want)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+	if want := []string{"command -v jq", "test -d node_modules"}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checks run = %v, want %v", checked, want)
+	}
+
+	// A failing check wins over a marker, and an edited command no longer matches its marker
+	pending, _ = pendingSetupCommands([]string{"apt-get install -y jq", "pip install -r requirements-dev.txt"}, doneWhen, markers, func(string) bool { return false })
+	if len(pending) != 2 {
+		t.Errorf("expected both commands to run, got %v", pending)
+	}
+
+	pending, skipped = pendingSetupCommands(commands, nil, nil, isDone)
+	if !reflect.DeepEqual(pending, commands) || skipped != 0 {
+		t.Errorf("without checks or markers everything should run, got %v (%d skipped)", pending, skipped)
+	}
+}
+
+func TestRunAttachStdin(t *testing.T) {
+	tests := []struct {
+		name                          string
+		flagSet, flag, stdinTerm, out bool
+		want                          bool
+	}{
+		{"piped input", false, false, false, false, true},
+		{"piped input to terminal", false, false, false, true, true},
+		{"interactive terminal", false, false, true, true, true},
+		{"terminal piped into a pager", false, false, true, false, false},
+		{"forced on", true, true, true, false, true},
+		{"forced off", true, false, false, false, false},
+	}
+	for _, tt := range tests {
+		if got := runAttachStdin(tt.flagSet, tt.flag, tt.stdinTerm, tt.out); got != tt.want {
+			t.Errorf("%s: runAttachStdin() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRunArtifacts(t *testing.T) {
+	artifacts, err := parseRunArtifacts([]string{"/tmp/coverage.xml:./coverage.xml", "/tmp/reports/*.xml:out", "/tmp/build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []runArtifact{
+		{Source: "/tmp/coverage.xml", Dest: "./coverage.xml"},
+		{Source: "/tmp/reports/*.xml", Dest: "out"},
+		{Source: "/tmp/build", Dest: "."},
+	}
+	if !reflect.DeepEqual(artifacts, want) {
+		t.Errorf("parseRunArtifacts() = %+v, want %+v", artifacts, want)
+	}
+
+	for _, bad := range []string{"coverage.xml", "/tmp/$(id)", "/tmp/my report.xml:out", ":out"} {
+		if _, err := parseRunArtifacts([]string{bad}); err == nil {
+			t.Errorf("expected error for --artifact %q", bad)
+		}
+	}
+
+	dir := t.TempDir()
+	tests := []struct {
+		artifact runArtifact
+		src      string
+		want     string
+	}{
+		{runArtifact{Source: "/tmp/coverage.xml", Dest: filepath.Join(dir, "cov.xml")}, "/tmp/coverage.xml", filepath.Join(dir, "cov.xml")},
+		{runArtifact{Source: "/tmp/coverage.xml", Dest: dir}, "/tmp/coverage.xml", filepath.Join(dir, "coverage.xml")},
+		{runArtifact{Source: "/tmp/coverage.xml", Dest: "out/"}, "/tmp/coverage.xml", filepath.Join("out", "coverage.xml")},
+		{runArtifact{Source: "/tmp/reports/*.xml", Dest: "reports"}, "/tmp/reports/unit.xml", filepath.Join("reports", "unit.xml")},
+	}
+	for _, tt := range tests {
+		if got := tt.artifact.destination(tt.src); got != tt.want {
+			t.Errorf("destination(%+v, %s) = %q, want %q", tt.artifact, tt.src, got, tt.want)
+		}
+	}
+}
+
+type fakeHealthProber struct {
+	statuses []docker.HealthStatus
+	calls    int
+}
+
+func (f *fakeHealthProber) GetHealthStatus(string) (docker.HealthStatus, error) {
+	h := f.statuses[len(f.statuses)-1]
+	if f.calls < len(f.statuses) {
+		h = f.statuses[f.calls]
+	}
+	f.calls++
+	return h, nil
+}
+
+func TestWaitForHealthy(t *testing.T) {
+	f := &fakeHealthProber{statuses: []docker.HealthStatus{{Status: "starting"}, {Status: "starting"}, {Status: "healthy"}}}
+	if err := waitForHealthy(f, "coderaft_app", time.Second, time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.calls != 3 {
+		t.Errorf("expected 3 polls, got %d", f.calls)
+	}
+
+	f = &fakeHealthProber{statuses: []docker.HealthStatus{{}}}
+	if err := waitForHealthy(f, "coderaft_app", time.Second, time.Millisecond); err == nil || !strings.Contains(err.Error(), "no healthcheck") {
+		t.Errorf("expected a missing healthcheck error, got %v", err)
+	}
+
+	f = &fakeHealthProber{statuses: []docker.HealthStatus{{Status: "starting"}, {Status: "unhealthy", FailingStreak: 3, LastOutput: "connection refused"}}}
+	if err := waitForHealthy(f, "coderaft_app", time.Second, time.Millisecond); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected an unhealthy error with the check output, got %v", err)
+	}
+
+	f = &fakeHealthProber{statuses: []docker.HealthStatus{{Status: "starting"}}}
+	if err := waitForHealthy(f, "coderaft_app", 20*time.Millisecond, time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestOverrideSetupConcurrencyValidation(t *testing.T) {
+	if err := overrideSetupConcurrency(-1, false); err == nil {
+		t.Error("expected an error for a negative worker count")
+	}
+	if err := overrideSetupConcurrency(4, true); err == nil {
+		t.Error("expected an error for --setup-workers with --no-parallel-setup")
+	}
+}
+
+func TestLockChecksumCoversWorkspace(t *testing.T) {
+	lf := lockFile{BaseImage: lockImage{Name: "debian:bookworm"}}
+	without := computeLockChecksum(&lf)
+	lf.Workspace = &lockWorkspace{Commit: "abc123"}
+	with := computeLockChecksum(&lf)
+	if with == without {
+		t.Error("expected the workspace section to change the checksum")
+	}
+	lf.Workspace.Dirty = true
+	if computeLockChecksum(&lf) == with {
+		t.Error("expected the dirty state to change the checksum")
+	}
+	if validateWorkspaceMode("content") != nil || validateWorkspaceMode("head") == nil {
+		t.Error("unexpected --record-workspace validation")
+	}
+}
+
+func TestResolveMultiplexer(t *testing.T) {
+	cfg := &config.Config{Settings: &config.GlobalSettings{}}
+	tests := []struct {
+		name            string
+		tmux, screen    string
+		none            bool
+		setting         string
+		wantMux, wantID string
+		wantErr         bool
+	}{
+		{name: "plain shell"},
+		{name: "tmux default session", tmux: "coderaft", wantMux: "tmux", wantID: "coderaft"},
+		{name: "named screen", screen: "build", wantMux: "screen", wantID: "build"},
+		{name: "setting", setting: "tmux", wantMux: "tmux", wantID: "coderaft"},
+		{name: "flag over setting", screen: "work", setting: "tmux", wantMux: "screen", wantID: "work"},
+		{name: "setting turned off", none: true, setting: "tmux"},
+		{name: "both flags", tmux: "a", screen: "b", wantErr: true},
+		{name: "no-multiplexer with flag", tmux: "a", none: true, wantErr: true},
+		{name: "bad setting", setting: "zellij", wantErr: true},
+		{name: "bad session name", tmux: "a; rm -rf /", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg.Settings.ShellMultiplexer = tt.setting
+		mux, session, err := resolveMultiplexer(tt.tmux, tt.screen, tt.none, cfg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil || mux != tt.wantMux || session != tt.wantID {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q)", tt.name, mux, session, err, tt.wantMux, tt.wantID)
+		}
+	}
+}
+
+func TestMultiplexerAttachCommand(t *testing.T) {
+	if got := multiplexerAttachCommand("tmux", "work"); got != "exec tmux new-session -A -s work" {
+		t.Errorf("tmux: got %q", got)
+	}
+	if got := multiplexerAttachCommand("screen", "work"); got != "exec screen -D -R -S work" {
+		t.Errorf("screen: got %q", got)
+	}
+	if script := islandInstallScript("tmux"); !strings.Contains(script, "apt-get install -y tmux") || !strings.Contains(script, "apk add --no-cache tmux") {
+		t.Errorf("unexpected install script: %s", script)
+	}
+}
+
+func TestApproveActions(t *testing.T) {
+	actions := []string{"apt-get install -y curl=8.0", "python3 -m pip uninstall -y six", "npm i -g typescript@5.4.0"}
+
+	in := bufio.NewReader(strings.NewReader("y\nmaybe\ns\nyes\n"))
+	approved, skipped, err := approveActions(actions, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(approved, []string{actions[0], actions[2]}) || !reflect.DeepEqual(skipped, []string{actions[1]}) {
+		t.Errorf("got approved=%v skipped=%v", approved, skipped)
+	}
+
+	if _, _, err := approveActions(actions, bufio.NewReader(strings.NewReader("y\na\n"))); !errors.Is(err, errApplyCancelled) {
+		t.Errorf("abort: expected errApplyCancelled, got %v", err)
+	}
+	if _, _, err := approveActions(actions, bufio.NewReader(strings.NewReader("y\n"))); !errors.Is(err, errApplyCancelled) {
+		t.Errorf("end of input: expected errApplyCancelled, got %v", err)
+	}
+}
+
+func TestResolveConfigFile(t *testing.T) {
+	cm, err := config.NewConfigManagerWithPath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := configManager
+	configManager = cm
+	defer func() { configManager = saved }()
+
+	workspace := t.TempDir()
+	configPath := filepath.Join(workspace, "coderaft.json")
+	if err := os.WriteFile(configPath, []byte(`{"name": "svc"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := cm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AddProject(&config.Project{Name: "svc", WorkspacePath: workspace})
+	if err := cm.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{configPath, workspace, "svc"} {
+		if got, err := resolveConfigFile(target); err != nil || got != configPath {
+			t.Errorf("resolveConfigFile(%q) = %q, %v; want %q", target, got, err, configPath)
+		}
+	}
+	if _, err := resolveConfigFile("other"); err == nil {
+		t.Error("expected an error for an unknown project")
+	}
+	if _, err := resolveConfigFile(t.TempDir()); err == nil {
+		t.Error("expected an error for a directory without coderaft.json")
+	}
+}
+
+func TestResolvePrebuiltRegistry(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"ghcr.io/acme/coderaft/", "ghcr.io/acme/coderaft", false},
+		{"localhost:5000", "localhost:5000", false},
+		{"localhost:5000/envs", "localhost:5000/envs", false},
+		{"https://ghcr.io/acme", "", true},
+		{"ghcr.io/acme/coderaft:latest", "", true},
+		{"ghcr.io/acme@sha256:abc", "", true},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{Settings: &config.GlobalSettings{PrebuiltRegistry: tt.setting}}
+		got, err := resolvePrebuiltRegistry(cfg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolvePrebuiltRegistry(%q) = %q, %v; want %q, error %v", tt.setting, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if got, err := resolvePrebuiltRegistry(&config.Config{}); got != "" || err != nil {
+		t.Errorf("expected no registry without settings, got %q, %v", got, err)
+	}
+}
+
+type fakePrebuiltPuller struct {
+	local  map[string]bool
+	remote map[string]bool
+	pulled []string
+}
+
+func (f *fakePrebuiltPuller) ImageExists(ref string) bool { return f.local[ref] }
+func (f *fakePrebuiltPuller) PullImage(ref string) error {
+	f.pulled = append(f.pulled, ref)
+	if !f.remote[ref] {
+		return fmt.Errorf("manifest for %s not found", ref)
+	}
+	return nil
+}
+
+func TestPullPrebuiltImage(t *testing.T) {
+	buildCfg := &docker.BuildImageConfig{BaseImage: "ubuntu:22.04", SetupCommands: []string{"apt install -y git"}, ProjectName: "app"}
+	ref := "ghcr.io/acme/app:" + buildCfg.Fingerprint()
+
+	f := &fakePrebuiltPuller{remote: map[string]bool{ref: true}}
+	if got := pullPrebuiltImage(f, "ghcr.io/acme", buildCfg); got != ref {
+		t.Errorf("expected the prebuilt image %s, got %q", ref, got)
+	}
+
+	f = &fakePrebuiltPuller{}
+	if got := pullPrebuiltImage(f, "ghcr.io/acme", buildCfg); got != "" {
+		t.Errorf("expected a local build when the registry has no image, got %q", got)
+	}
+	if len(f.pulled) != 1 {
+		t.Errorf("expected one pull attempt, got %v", f.pulled)
+	}
+
+	f = &fakePrebuiltPuller{local: map[string]bool{buildCfg.CacheTag(): true}, remote: map[string]bool{ref: true}}
+	if got := pullPrebuiltImage(f, "ghcr.io/acme", buildCfg); got != "" || len(f.pulled) != 0 {
+		t.Errorf("expected the local cache to win without a pull, got %q after %v", got, f.pulled)
+	}
+
+	f = &fakePrebuiltPuller{remote: map[string]bool{ref: true}}
+	if got := pullPrebuiltImage(f, "", buildCfg); got != "" || len(f.pulled) != 0 {
+		t.Errorf("expected nothing without a registry, got %q after %v", got, f.pulled)
+	}
+}
+
+func TestHistoryPackages(t *testing.T) {
+	history := strings.Join([]string{
+		"apt-get install -y jq htop=3.2.2-2",
+		"DEBIAN_FRONTEND=noninteractive apt install -y ripgrep",
+		"pip install requests==2.31.0 'flask>=2'",
+		"python3 -m pip install -r requirements.txt",
+		"npm install eslint",
+		"npm i -g typescript@5 @types/node",
+		"yarn global add prettier",
+		"pnpm add -g turbo",
+		"go install golang.org/x/tools/gopls@latest",
+		"cargo install --version 0.9.0 just",
+		"curl -fsSL https://example.com/install.sh | sh",
+		"apt-get install -y ./local.deb",
+		"apk add --no-cache --virtual .build-deps gcc musl-dev curl=8.5.0-r0",
+	}, "\n")
+	want := map[string][]string{
+		"apt":   {"htop", "jq", "ripgrep"},
+		"apk":   {"curl", "gcc", "musl-dev"},
+		"pip":   {"flask", "requests"},
+		"npm":   {"@types/node", "typescript"},
+		"yarn":  {"prettier"},
+		"pnpm":  {"turbo"},
+		"go":    {"golang.org/x/tools/gopls"},
+		"cargo": {"just"},
+	}
+	if got := historyPackages(history); !reflect.DeepEqual(got, want) {
+		t.Errorf("historyPackages() = %v, want %v", got, want)
+	}
+}
+
+func TestMinimalPackages(t *testing.T) {
+	live := lockPackages{
+		Apt: []string{"bash=5.2-1", "jq=1.6-2", "libc6=2.36-9"},
+		Pip: []string{"pip==23.0", "requests==2.31.0"},
+		Npm: []string{"npm@10.2.0"},
+	}
+	prev := lockPackages{
+		Apt: []string{"jq=1.6-1", "make=4.3-4"},
+		Npm: []string{"typescript@5.2.2"},
+	}
+	explicit := map[string][]string{"apt": {"jq"}, "pip": {"requests"}, "cargo": {"just"}}
+
+	got := minimalPackages(explicit, prev, live)
+	want := lockPackages{
+		Apt: []string{"jq=1.6-2", "make=4.3-4"},
+		Pip: []string{"requests==2.31.0"},
+		Npm: []string{"typescript@5.2.2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("minimalPackages() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMinimalLockFileOmitsInventory(t *testing.T) {
+	full := lockFile{
+		Version:     currentLockVersion,
+		Project:     "app",
+		BaseImage:   lockImage{Name: "ubuntu:22.04", Digest: "ubuntu@sha256:abc", ID: "sha256:def"},
+		Container:   lockContainer{WorkingDir: "/island", Environment: map[string]string{"PATH": "/usr/bin"}},
+		Packages:    lockPackages{Apt: []string{"bash=5.2-1", "jq=1.6-2"}},
+		Registries:  lockRegistries{NpmRegistry: "https://npm.example.com"},
+		AptSources:  lockAptSources{SourcesLists: []string{"deb http://archive.ubuntu.com/ubuntu jammy main"}},
+		System:      &lockSystem{Timezone: "UTC"},
+		SetupScript: []string{"apt-get install -y jq"},
+	}
+	lf := minimalLockFile(full, map[string][]string{"apt": {"jq"}}, nil)
+	if !lf.Minimal || lf.BaseImage.ID != "" || lf.System != nil || len(lf.AptSources.SourcesLists) > 0 {
+		t.Errorf("expected only the hand-authorable sections, got %+v", lf)
+	}
+	if !reflect.DeepEqual(lf.Packages.Apt, []string{"jq=1.6-2"}) || !reflect.DeepEqual(lf.Registries, full.Registries) || len(lf.SetupScript) != 1 {
+		t.Errorf("expected the explicit packages, registries and setup commands, got %+v", lf)
+	}
+	data, err := json.Marshal(lf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "sources_lists") || strings.Contains(string(data), "working_dir") {
+		t.Errorf("minimal lock still carries captured metadata: %s", data)
+	}
+	if computeLockChecksum(&lf) == computeLockChecksum(&lockFile{BaseImage: lf.BaseImage, Packages: lf.Packages, Registries: lf.Registries, SetupScript: lf.SetupScript}) {
+		t.Error("expected the minimal flag to be part of the checksum")
+	}
+}
+
+func TestMinimalLockApplyLeavesUnlistedPackages(t *testing.T) {
+	locked := lockPackages{
+		Apt: []string{"jq=1.6-2", "ripgrep=13.0.0-4"},
+		Pip: []string{"requests==2.31.0"},
+	}
+	live := lockPackages{
+		Apt:  []string{"bash=5.2-1", "jq=1.6-1", "libc6=2.36-9"},
+		Pip:  []string{"pip==23.0", "requests==2.31.0"},
+		Npm:  []string{"npm@10.2.0", "typescript@5.2.2"},
+		Yarn: []string{"prettier@3.0.0"},
+	}
+
+	cur := restrictToLock(locked, live)
+	cmds, _ := buildReconcileActions(locked, cur.Apt, cur.Pip, cur.Npm, cur.Yarn, cur.Pnpm, downgradeGuard{})
+	want := []string{
+		"apt update -y",
+		"DEBIAN_FRONTEND=noninteractive apt-get install -y jq=1.6-2 ripgrep=13.0.0-4",
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("minimal lock actions = %q, want %q", cmds, want)
+	}
+
+	tools := restrictToLock(locked, lockPackages{Go: []string{"golang.org/x/tools/gopls@v0.14.0"}, Cargo: []string{"just=v1.0.0"}})
+	if got := buildToolReconcileActions(locked, tools.Go, tools.Cargo, nil); len(got) != 0 {
+		t.Errorf("expected no go or cargo actions for a lock that doesn't list them, got %q", got)
+	}
+
+	lf := &lockFile{Minimal: true, Packages: locked}
+	if drifts := lockDrifts(lf, &lockFile{Packages: restrictToLock(locked, live)}, packageExclusions{}); len(drifts) != 3 {
+		t.Errorf("expected only the listed apt packages to drift, got %q", drifts)
+	}
+}
+
+func TestApplyLockConcurrentApplies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks", "coderaft_app.apply.lock")
+
+	// several applies race for the lock: exactly one gets it
+	const racers = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var held []*applyLock
+	busy := 0
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := acquireApplyLock(path, "coderaft apply app", 0)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				held = append(held, lock)
+			case errors.Is(err, errApplyInProgress):
+				busy++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(held) != 1 || busy != racers-1 {
+		t.Fatalf("got %d holders and %d busy, want 1 and %d", len(held), busy, racers-1)
+	}
+	if _, err := acquireApplyLock(path, "coderaft apply app", 0); err == nil || !strings.Contains(err.Error(), "coderaft apply app") {
+		t.Errorf("the error should name the running apply, got %v", err)
+	}
+
+	// a waiting apply gets the lock once the first one releases it
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held[0].Release()
+	}()
+	lock, err := acquireApplyLock(path, "coderaft up app", 5*time.Second)
+	if err != nil {
+		t.Fatalf("waiting apply should get the lock after release: %v", err)
+	}
+	lock.Release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Release should remove the lock file, stat err = %v", err)
+	}
+}
+
+func TestCloneLockConcurrentClones(t *testing.T) {
+	t.Setenv("CODERAFT_HOME", t.TempDir())
+
+	// two clones of the same project race: one clones, the other is told why not
+	const racers = 4
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var held []*applyLock
+	var busy []error
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := lockProjectForClone("repo", "coderaft clone user/repo", 0)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				held = append(held, lock)
+			} else {
+				busy = append(busy, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(held) != 1 || len(busy) != racers-1 {
+		t.Fatalf("got %d holders and %d refused, want 1 and %d", len(held), len(busy), racers-1)
+	}
+	for _, err := range busy {
+		if !strings.Contains(err.Error(), "clone already in progress for project 'repo'") || !strings.Contains(err.Error(), "coderaft clone user/repo") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	// another project isn't held up
+	other, err := lockProjectForClone("other", "coderaft clone user/other", 0)
+	if err != nil {
+		t.Fatalf("a clone of another project should not wait: %v", err)
+	}
+	other.Release()
+
+	// with --lock-wait the second clone goes ahead once the first is done
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held[0].Release()
+	}()
+	lock, err := lockProjectForClone("repo", "coderaft clone user/repo", 5*time.Second)
+	if err != nil {
+		t.Fatalf("waiting clone should get the lock after release: %v", err)
+	}
+	lock.Release()
+}
+
+func TestApplyLockStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coderaft_app.apply.lock")
+	if err := os.WriteFile(path, []byte(`{"pid":1,"host":"ci","command":"coderaft apply app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh lock from another process is respected
+	if _, err := acquireApplyLock(path, "coderaft apply app", 0); !errors.Is(err, errApplyInProgress) {
+		t.Fatalf("expected errApplyInProgress, got %v", err)
+	}
+
+	// one its crashed holder stopped touching is taken over
+	old := time.Now().Add(-applyLockStaleAfter - time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := acquireApplyLock(path, "coderaft apply app", 0)
+	if err != nil {
+		t.Fatalf("stale lock should be taken over: %v", err)
+	}
+	defer lock.Release()
+	data, _ := os.ReadFile(path)
+	var info applyLockInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.PID != os.Getpid() {
+		t.Errorf("lock file should now record this process, got %s", data)
+	}
+}
+
+func TestApplyLockStaleTakeoverRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coderaft_app.apply.lock")
+	old := time.Now().Add(-applyLockStaleAfter - time.Minute)
+
+	for round := 0; round < 20; round++ {
+		if err := os.WriteFile(path, []byte(`{"pid":1,"host":"ci","command":"coderaft apply app"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		// several waiters see the same stale lock: only one may take it over
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var held []*applyLock
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				lock, err := acquireApplyLock(path, "coderaft apply app", 0)
+				if err != nil && !errors.Is(err, errApplyInProgress) {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if err == nil {
+					mu.Lock()
+					held = append(held, lock)
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if len(held) != 1 {
+			t.Fatalf("round %d: %d waiters hold the lock, want 1", round, len(held))
+		}
+		held[0].Release()
+	}
+
+	// The race step by step: both waiters read the stale lock, one takes it
+	// over, then the other gets to removing what it saw
+	stale := []byte(`{"pid":1,"host":"ci","command":"coderaft apply app"}`)
+	if err := os.WriteFile(path, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	first, err := acquireApplyLock(path, "coderaft apply app", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removeLockFile(path, stale) {
+		t.Error("the second waiter removed the lock the first one just took")
+	}
+	if _, err := acquireApplyLock(path, "coderaft apply app", 0); !errors.Is(err, errApplyInProgress) {
+		t.Errorf("expected the new lock to be held, got %v", err)
+	}
+	first.Release()
+
+	// Release leaves alone a lock that is no longer its own
+	lock, err := acquireApplyLock(path, "coderaft apply app", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := []byte(`{"pid":2,"host":"ci","command":"coderaft up app","token":"other"}`)
+	if err := os.WriteFile(path, other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock.Release()
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, other) {
+		t.Errorf("Release removed another holder's lock: %s, %v", data, err)
+	}
+}
+
+func TestAuditSecrets(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	inventory := map[string]map[string]secrets.SecretMeta{
+		"app": {
+			"API_KEY":     {CreatedAt: days(200), AccessedAt: days(5)},
+			"OLD_TOKEN":   {CreatedAt: days(400), AccessedAt: days(120)},
+			"db-password": {CreatedAt: days(10)},
+			"unusedKey":   {CreatedAt: days(100)},
+			"LEGACY":      {},
+		},
+		"gone":           {"TOKEN": {CreatedAt: days(1), AccessedAt: days(1)}},
+		"git:github.com": {"username": {CreatedAt: days(1)}, "token": {CreatedAt: days(1)}},
+	}
+	report := auditSecrets(inventory, map[string]bool{"app": true}, 90*24*time.Hour, now)
+
+	if len(report) != 3 || report[0].Project != "app" || report[1].Project != "git:github.com" || report[2].Project != "gone" {
+		t.Fatalf("unexpected projects %+v", report)
+	}
+
+	app := report[0]
+	if app.Count != 5 || app.Orphaned || app.Credentials {
+		t.Errorf("unexpected app entry %+v", app)
+	}
+	if want := []string{"db-password", "unusedKey"}; !reflect.DeepEqual(sortedKeys(app.Misnamed), want) {
+		t.Errorf("misnamed = %v, want %v", sortedKeys(app.Misnamed), want)
+	}
+	if !strings.Contains(app.Misnamed["db-password"], "--map") {
+		t.Errorf("an invalid variable name should point at --map, got %q", app.Misnamed["db-password"])
+	}
+	if want := []string{"LEGACY", "OLD_TOKEN", "unusedKey"}; !reflect.DeepEqual(sortedKeys(app.Stale), want) {
+		t.Errorf("stale = %v, want %v", sortedKeys(app.Stale), want)
+	}
+	if app.Stale["LEGACY"] != "no usage recorded" || !strings.Contains(app.Stale["OLD_TOKEN"], "120 days ago") || !strings.Contains(app.Stale["unusedKey"], "never read") {
+		t.Errorf("unexpected staleness reasons %v", app.Stale)
+	}
+
+	if creds := report[1]; !creds.Credentials || creds.Orphaned || len(creds.Misnamed) != 0 {
+		t.Errorf("git credentials should be neither orphaned nor misnamed: %+v", creds)
+	}
+	if gone := report[2]; !gone.Orphaned || len(gone.Stale) != 0 {
+		t.Errorf("unregistered project should be orphaned: %+v", gone)
+	}
+}
+
+func TestDirenvDetection(t *testing.T) {
+	dir := t.TempDir()
+	if hasDirenvFile(dir) {
+		t.Error("no .envrc should not be detected")
+	}
+	os.Mkdir(filepath.Join(dir, ".envrc"), 0755)
+	if hasDirenvFile(dir) {
+		t.Error("a directory named .envrc should not be detected")
+	}
+	withEnvrc := t.TempDir()
+	os.WriteFile(filepath.Join(withEnvrc, ".envrc"), []byte("export DB_URL=postgres://localhost\n"), 0644)
+	if !hasDirenvFile(withEnvrc) {
+		t.Error(".envrc should be detected")
+	}
+
+	pc := &config.ProjectConfig{SetupCommands: []string{"pip install -r requirements.txt"}}
+	if !addDirenvSetup(pc) || addDirenvSetup(pc) {
+		t.Error("addDirenvSetup should add the install once")
+	}
+	if len(pc.SetupCommands) != 2 || pc.SetupCommands[0] != "pip install -r requirements.txt" {
+		t.Errorf("setup commands = %v", pc.SetupCommands)
+	}
+	if cmd := pc.SetupCommands[1]; !strings.HasPrefix(cmd, "command -v direnv") || !strings.Contains(cmd, "apt-get install -y direnv") {
+		t.Errorf("unexpected direnv setup command %q", cmd)
+	}
+
+	if got := direnvAllowCommand("/island/my app"); got != "cd '/island/my app' && direnv allow ." {
+		t.Errorf("direnvAllowCommand() = %q", got)
+	}
+}
+
+func TestWithinAutoStopGrace(t *testing.T) {
+	tests := []struct {
+		uptime time.Duration
+		want   bool
+	}{
+		{0, true},
+		{5 * time.Second, true},
+		{autoStopGrace - time.Second, true},
+		{autoStopGrace, false},
+		{time.Hour, false},
+	}
+	for _, tt := range tests {
+		if got := withinAutoStopGrace(tt.uptime, autoStopGrace); got != tt.want {
+			t.Errorf("withinAutoStopGrace(%s) = %v, want %v", tt.uptime, got, tt.want)
+		}
+	}
+	if withinAutoStopGrace(time.Second, 0) {
+		t.Error("a zero grace period should let a running island be stopped")
+	}
+}
+
+func TestUpAutoStops(t *testing.T) {
+	defer func() { keepRunningUpFlag, upNoAutoStop = false, false }()
+	cfg := &config.Config{Settings: &config.GlobalSettings{AutoStopOnExit: true}}
+	if !upAutoStops(cfg) {
+		t.Error("auto_stop_on_exit should auto-stop")
+	}
+	keepRunningUpFlag = true
+	if upAutoStops(cfg) {
+		t.Error("--keep-running should not auto-stop")
+	}
+	keepRunningUpFlag, upNoAutoStop = false, true
+	if upAutoStops(cfg) {
+		t.Error("--no-auto-stop should not auto-stop")
+	}
+	upNoAutoStop = false
+	cfg.Settings.AutoStopOnExit = false
+	if upAutoStops(cfg) {
+		t.Error("auto_stop_on_exit=false should not auto-stop")
+	}
+}
+
+func TestBuildSystemReconcileActions(t *testing.T) {
+	apk := docker.SystemPackagesFor(docker.OSFamilyAlpine)
+	locked := []string{"curl=8.5.0-r0", "git=2.43.0-r0", "jq=1.7.1-r0"}
+	current := []string{"curl=8.4.0-r0", "jq=1.7.1-r0", "vim=9.0.2073-r0"}
+	want := []string{"apk add --no-cache curl=8.5.0-r0 git=2.43.0-r0", "apk del vim"}
+	if got := buildSystemReconcileActions(apk, locked, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildSystemReconcileActions() = %q, want %q", got, want)
+	}
+	if got := buildSystemReconcileActions(apk, locked, locked); len(got) != 0 {
+		t.Errorf("an island matching the lock should need no actions, got %q", got)
+	}
+}
+
+func TestApplyBackupRestoreCommands(t *testing.T) {
+	files := map[string]string{
+		"/etc/pip.conf":         "[global]\nindex-url = https://pypi.example\n",
+		"/etc/apt/sources.list": "deb http://deb.debian.org/debian bookworm main\n",
+	}
+	present := []string{"/etc/pip.conf", "/etc/apt/preferences.d/coderaft", "/etc/shadow"}
+	cmds, err := applyBackupRestoreCommands(files, present)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"mkdir -p '/etc/apt' && printf '%s' 'ZGViIGh0dHA6Ly9kZWIuZGViaWFuLm9yZy9kZWJpYW4gYm9va3dvcm0gbWFpbgo=' | base64 -d > '/etc/apt/sources.list'",
+		"mkdir -p '/etc' && printf '%s' 'W2dsb2JhbF0KaW5kZXgtdXJsID0gaHR0cHM6Ly9weXBpLmV4YW1wbGUK' | base64 -d > '/etc/pip.conf'",
+		"rm -f '/etc/apt/preferences.d/coderaft'",
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("applyBackupRestoreCommands =\n%q\nwant\n%q", cmds, want)
+	}
+
+	for _, p := range []string{"/etc/shadow", "/etc/apt/preferences.d/../../shadow", "/etc/apt/sources.list.d/x.sources"} {
+		if _, err := applyBackupRestoreCommands(map[string]string{p: "x"}, nil); err == nil {
+			t.Errorf("expected %s to be refused", p)
+		}
+	}
+}
+
+func TestReadApplyBackup(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := readApplyBackup(dir); err == nil {
+		t.Error("expected an error for a directory without a backup")
+	}
+
+	data := `{"version":1,"project":"web","island":"coderaft_web","packages":{"apt":["curl=7.88.1-10"]},"files":{"/etc/pip.conf":"[global]\n"}}`
+	if err := os.WriteFile(filepath.Join(dir, applyBackupFile), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readApplyBackup(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Project != "web" || b.dir != dir || !reflect.DeepEqual(b.Packages.Apt, []string{"curl=7.88.1-10"}) || b.Files["/etc/pip.conf"] != "[global]\n" {
+		t.Errorf("unexpected backup: %+v", b)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, applyBackupFile), []byte(`{"version":2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readApplyBackup(dir); err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func TestValidateLogTail(t *testing.T) {
+	for _, tail := range []string{"all", "0", "100"} {
+		if err := validateLogTail(tail); err != nil {
+			t.Errorf("validateLogTail(%q) = %v", tail, err)
+		}
+	}
+	for _, tail := range []string{"", "-1", "ten", "10m"} {
+		if err := validateLogTail(tail); err == nil {
+			t.Errorf("validateLogTail(%q) should fail", tail)
+		}
+	}
+}
+
+func TestVerifyCacheKey(t *testing.T) {
+	lock := []byte(`{"version":2}`)
+	key := verifyCacheKey("abc@2024-01-01T00:00:00Z", "ffee", lock, nil)
+	if key != verifyCacheKey("abc@2024-01-01T00:00:00Z", "ffee", lock, nil) {
+		t.Error("expected the same inputs to give the same key")
+	}
+	for name, other := range map[string]string{
+		"restarted":        verifyCacheKey("abc@2024-01-02T00:00:00Z", "ffee", lock, nil),
+		"packages changed": verifyCacheKey("abc@2024-01-01T00:00:00Z", "ffef", lock, nil),
+		"lock changed":     verifyCacheKey("abc@2024-01-01T00:00:00Z", "ffee", []byte(`{"version":3}`), nil),
+		"exclusions":       verifyCacheKey("abc@2024-01-01T00:00:00Z", "ffee", lock, &config.GlobalSettings{LockExcludePackages: map[string][]string{"pip": {"*"}}}),
+	} {
+		if other == key {
+			t.Errorf("%s: expected a different key", name)
+		}
+	}
+}
+
+func TestVerifyCacheReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verify-cache", "coderaft_web.json")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, _, ok := readVerifyCache(path, "k1", now, verifyCacheTTL); ok {
+		t.Fatal("expected a miss without a cache file")
+	}
+
+	report := &verifyReport{Project: "web", Drifts: []string{"apt: curl added"}, Checksum: "sha256:abc"}
+	writeVerifyCache(path, "k1", report, now)
+
+	got, age, ok := readVerifyCache(path, "k1", now.Add(time.Minute), verifyCacheTTL)
+	if !ok || age != time.Minute || !reflect.DeepEqual(got, report) {
+		t.Errorf("readVerifyCache = %+v, %v, %v", got, age, ok)
+	}
+	if _, _, ok := readVerifyCache(path, "k2", now.Add(time.Minute), verifyCacheTTL); ok {
+		t.Error("expected a miss for a different key")
+	}
+	if _, _, ok := readVerifyCache(path, "k1", now.Add(verifyCacheTTL), verifyCacheTTL); ok {
+		t.Error("expected a miss once the TTL has passed")
+	}
+	if _, _, ok := readVerifyCache(path, "k1", now.Add(-time.Minute), verifyCacheTTL); ok {
+		t.Error("expected a miss for a result from the future")
+	}
+}
+
+func TestRunWorkdirPath(t *testing.T) {
+	tests := []struct {
+		base, dir, want string
+	}{
+		{"/island", "packages/api", "/island/packages/api"},
+		{"/island/app", "../lib", "/island/lib"},
+		{"/island", "/tmp/build/", "/tmp/build"},
+		{"/island", ".", "/island"},
+	}
+	for _, tt := range tests {
+		if got := runWorkdirPath(tt.base, tt.dir); got != tt.want {
+			t.Errorf("runWorkdirPath(%q, %q) = %q, want %q", tt.base, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestWithSecretEnv(t *testing.T) {
+	configMap := map[string]interface{}{
+		"environment": map[string]interface{}{"MODE": "dev", "API_KEY": "placeholder"},
+	}
+	configMap = withSecretEnv(configMap, map[string]string{"API_KEY": "s3cret", "DB_PASSWORD": "hunter2"})
+
+	env := configMap["environment"].(map[string]interface{})
+	if env["MODE"] != "dev" || env["API_KEY"] != "s3cret" || env["DB_PASSWORD"] != "hunter2" {
+		t.Errorf("unexpected environment: %v", env)
+	}
+	labels := configMap["labels"].(map[string]interface{})
+	if labels[secretEnvLabel] != "API_KEY,DB_PASSWORD" {
+		t.Errorf("label = %v, want API_KEY,DB_PASSWORD", labels[secretEnvLabel])
+	}
+
+	if got := withSecretEnv(nil, nil); got != nil {
+		t.Errorf("expected no config map without secrets, got %v", got)
+	}
+}
+
+func TestWithoutSecretEnv(t *testing.T) {
+	env := map[string]string{"MODE": "dev", "API_KEY": "s3cret", "DB_PASSWORD": "hunter2"}
+	labels := map[string]string{"team": "web", secretEnvLabel: "API_KEY,DB_PASSWORD"}
+
+	gotEnv, gotLabels := withoutSecretEnv(env, labels)
+	if !reflect.DeepEqual(gotEnv, map[string]string{"MODE": "dev"}) {
+		t.Errorf("env = %v, want only MODE", gotEnv)
+	}
+	if !reflect.DeepEqual(gotLabels, map[string]string{"team": "web"}) {
+		t.Errorf("labels = %v, want only team", gotLabels)
+	}
+	if len(env) != 3 || len(labels) != 2 {
+		t.Error("the island's maps should be left as they are")
+	}
+
+	// islands created without secrets are unchanged
+	plain := map[string]string{"API_KEY": "from-coderaft-json"}
+	if gotEnv, _ := withoutSecretEnv(plain, map[string]string{"team": "web"}); !reflect.DeepEqual(gotEnv, plain) {
+		t.Errorf("env = %v, want %v", gotEnv, plain)
+	}
+}
+
+func TestParseCacheAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"0d":  0,
+		"0":   0,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	}
+	for in, want := range cases {
+		got, err := parseCacheAge(in)
+		if err != nil || got != want {
+			t.Errorf("parseCacheAge(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "d", "-1d", "1.5d", "-2h", "soon"} {
+		if _, err := parseCacheAge(in); err == nil {
+			t.Errorf("parseCacheAge(%q) should fail", in)
+		}
+	}
+}
+
+func TestSelectCacheCategories(t *testing.T) {
+	all, err := selectCacheCategories(nil)
+	if err != nil || len(all) != len(cacheCategories) {
+		t.Fatalf("selectCacheCategories(nil) = %d categories, %v", len(all), err)
+	}
+	got, err := selectCacheCategories([]string{"recipes", " images"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "images" || got[1].Name != "recipes" {
+		t.Errorf("selected %v, want images and recipes in registry order", got)
+	}
+	if _, err := selectCacheCategories([]string{"images", "layers"}); err == nil || !strings.Contains(err.Error(), "layers") {
+		t.Errorf("expected an unknown category error, got %v", err)
+	}
+}
+
+func TestStaleCacheEntries(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	entries := []cacheEntry{
+		{Name: "fresh", LastUsed: now.Add(-time.Hour)},
+		{Name: "week", LastUsed: now.Add(-7 * 24 * time.Hour)},
+		{Name: "ancient", LastUsed: now.Add(-400 * 24 * time.Hour)},
+	}
+	var names []string
+	for _, e := range staleCacheEntries(entries, 7*24*time.Hour, now) {
+		names = append(names, e.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"ancient", "week"}) {
+		t.Errorf("stale = %v, want [ancient week]", names)
+	}
+	if got := staleCacheEntries(entries, 0, now); len(got) != 3 {
+		t.Errorf("a zero age should select everything, got %d", len(got))
+	}
+}
+
+func TestCacheDirEntries(t *testing.T) {
+	base := t.TempDir()
+	baseFn := func(elem ...string) (string, error) {
+		return filepath.Join(append([]string{base}, elem...)...), nil
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(rel, data string, mtime time.Time) {
+		p := filepath.Join(base, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dotfiles/abc/.bashrc", "12345", old)
+	write("dotfiles/abc/.vimrc", "123", old)
+	write("recipes/node/1.0.0.json", "{}", old)
+	write("recipes/node/2.0.0.json", "{\"x\":1}", old)
+	for _, d := range []string{"dotfiles/abc", "dotfiles", "recipes/node", "recipes"} {
+		if err := os.Chtimes(filepath.Join(base, d), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inUse := map[string]string{filepath.Join(base, "dotfiles", "abc"): "coderaft_web"}
+	dirs, err := cacheDirEntries(baseFn, "dotfiles", false, inUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0].Name != "abc" || dirs[0].Size != 8 || dirs[0].InUse != "coderaft_web" {
+		t.Fatalf("dotfiles entries = %+v", dirs)
+	}
+	if !dirs[0].LastUsed.Equal(old) {
+		t.Errorf("last used %v, want %v", dirs[0].LastUsed, old)
+	}
+
+	files, err := cacheDirEntries(baseFn, "recipes", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range files {
+		names = append(names, e.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"node/1.0.0.json", "node/2.0.0.json"}) {
+		t.Fatalf("recipe entries = %v", names)
+	}
+	if err := files[0].Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "recipes", "node", "1.0.0.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the recipe to be removed, got %v", err)
+	}
+
+	if missing, err := cacheDirEntries(baseFn, "verify-cache", false, nil); err != nil || len(missing) != 0 {
+		t.Errorf("a missing cache directory should be empty, got %v, %v", missing, err)
+	}
+}
+
+func TestGitWorkTreeOf(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	worktree := filepath.Join(root, "worktree")
+	if err := os.MkdirAll(filepath.Join(worktree, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: ../repo/.git/worktrees/wt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(root, "backups")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := gitWorkTreeOf(filepath.Join(repo, "sub", ".env")); !ok || got != repo {
+		t.Errorf("gitWorkTreeOf(repo/sub/.env) = %q, %v, want %q", got, ok, repo)
+	}
+	if got, ok := gitWorkTreeOf(filepath.Join(worktree, "config", ".env")); !ok || got != worktree {
+		t.Errorf("gitWorkTreeOf(worktree/config/.env) = %q, %v, want %q", got, ok, worktree)
+	}
+	// t.TempDir() is never inside a repository on its own
+	if got, ok := gitWorkTreeOf(filepath.Join(outside, "app.env")); ok {
+		t.Errorf("gitWorkTreeOf(backups/app.env) = %q, want none", got)
+	}
+}
+
+func TestJUnitCommand(t *testing.T) {
+	const report = "/tmp/report.xml"
+	cases := []struct {
+		command []string
+		want    []string
+	}{
+		{[]string{"pytest", "-q", "tests/"}, []string{"pytest", "--junitxml=/tmp/report.xml", "-q", "tests/"}},
+		{[]string{"python3", "-m", "pytest"}, []string{"python3", "-m", "pytest", "--junitxml=/tmp/report.xml"}},
+		{[]string{"npx", "vitest", "run"}, []string{"npx", "vitest", "--reporter=default", "--reporter=junit", "--outputFile.junit=/tmp/report.xml", "run"}},
+		{[]string{"vendor/bin/phpunit", "tests"}, []string{"vendor/bin/phpunit", "--log-junit", "/tmp/report.xml", "tests"}},
+		{[]string{"gotestsum", "--", "-race", "./..."}, []string{"gotestsum", "--junitfile", "/tmp/report.xml", "--", "-race", "./..."}},
+	}
+	for _, tc := range cases {
+		got, err := junitCommand(tc.command, report)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("junitCommand(%q) = %q, %v, want %q", tc.command, got, err, tc.want)
+		}
+	}
+
+	// the command itself is left alone
+	command := []string{"pytest", "tests/"}
+	if _, err := junitCommand(command, report); err != nil || len(command) != 2 {
+		t.Errorf("junitCommand changed its input: %q", command)
+	}
+
+	for _, command := range [][]string{{"make", "test"}, {"sh", "-c", "pytest"}, {"echo", "pytest"}} {
+		if _, err := junitCommand(command, report); err == nil {
+			t.Errorf("junitCommand(%q) should fail", command)
+		}
+	}
+	if _, err := junitCommand([]string{"go", "test", "./..."}, report); err == nil || !strings.Contains(err.Error(), "gotestsum") {
+		t.Errorf("expected a gotestsum hint for go test, got %v", err)
+	}
+}
+
+func TestParseVaultIdleTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":   secrets.DefaultIdleTimeout,
+		"0":  0,
+		"0s": 0,
+		"5m": 5 * time.Minute,
+		"1h": time.Hour,
+	}
+	for in, want := range cases {
+		got, err := parseVaultIdleTimeout(in)
+		if err != nil || got != want {
+			t.Errorf("parseVaultIdleTimeout(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"15", "-1m", "soon"} {
+		if _, err := parseVaultIdleTimeout(in); err == nil {
+			t.Errorf("parseVaultIdleTimeout(%q) should fail", in)
+		}
+	}
+}
+
+func TestResolveIslandConflictMode(t *testing.T) {
+	if mode, err := resolveIslandConflictMode("", nil); err != nil || mode != islandConflictPrompt {
+		t.Errorf("default mode = %q, %v, want prompt", mode, err)
+	}
+	cfg := &config.Config{Settings: &config.GlobalSettings{IslandConflict: "new"}}
+	if mode, _ := resolveIslandConflictMode("", cfg); mode != islandConflictNew {
+		t.Errorf("mode = %q, want the setting's new", mode)
+	}
+	if mode, _ := resolveIslandConflictMode("reuse", cfg); mode != islandConflictReuse {
+		t.Errorf("mode = %q, want the flag's reuse", mode)
+	}
+	if _, err := resolveIslandConflictMode("replace", nil); err == nil {
+		t.Error("expected an invalid mode to be refused")
+	}
+}
+
+func TestParseMountSpec(t *testing.T) {
+	cases := []struct {
+		in, source, destination string
+		ok                      bool
+	}{
+		{"bind /home/me/app -> /island (rw=true)", "/home/me/app", "/island", true},
+		{"bind /home/me/My Projects/app -> /work space (rw=false)", "/home/me/My Projects/app", "/work space", true},
+		{"volume coderaft_cache -> /root/.cache (rw=true)", "coderaft_cache", "/root/.cache", true},
+		{"bind /home/me/app", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tc := range cases {
+		source, destination, ok := parseMountSpec(tc.in)
+		if source != tc.source || destination != tc.destination || ok != tc.ok {
+			t.Errorf("parseMountSpec(%q) = %q, %q, %v, want %q, %q, %v", tc.in, source, destination, ok, tc.source, tc.destination, tc.ok)
+		}
+	}
+}
+
+func TestSuffixedProjectName(t *testing.T) {
+	taken := map[string]bool{"app-2": true, "app-3": true}
+	if got, err := suffixedProjectName("app", func(name string) (bool, error) { return taken[name], nil }); err != nil || got != "app-4" {
+		t.Errorf("suffixedProjectName() = %q, %v, want app-4", got, err)
+	}
+	if got, err := suffixedProjectName("app", func(string) (bool, error) { return false, nil }); err != nil || got != "app-2" {
+		t.Errorf("suffixedProjectName() = %q, %v, want app-2", got, err)
+	}
+	// a check that keeps failing, e.g. with the daemon gone, ends the search
+	daemonGone := errors.New("cannot connect to the Docker daemon")
+	if _, err := suffixedProjectName("app", func(string) (bool, error) { return false, daemonGone }); !errors.Is(err, daemonGone) {
+		t.Errorf("expected the check's error, got %v", err)
+	}
+}
+
+func TestSameDirectory(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if !sameDirectory(dir, link) || !sameDirectory(dir+"/", dir) || !sameDirectory(filepath.Join(dir, "sub", ".."), dir) {
+		t.Error("the same directory reached another way should match")
+	}
+	if sameDirectory(dir, other) {
+		t.Error("different directories shouldn't match")
+	}
+	if !sameDirectory("/no/such/dir/", "/no/such/dir") || sameDirectory("/no/such/dir", dir) {
+		t.Error("missing directories should be compared by their cleaned path")
+	}
+}
+
+func TestSuffixedProjectFor(t *testing.T) {
+	cfg := &config.Config{Projects: map[string]*config.Project{
+		"app":       {Name: "app", WorkspacePath: "/src/app"},
+		"app-2":     {Name: "app-2", WorkspacePath: "/tmp/app-copy"},
+		"app-tools": {Name: "app-tools", WorkspacePath: "/src/app-tools"},
+		"app-1":     {Name: "app-1", WorkspacePath: "/src/app-one"},
+	}}
+	if got, ok := suffixedProjectFor(cfg, "app", "/tmp/app-copy/"); !ok || got != "app-2" {
+		t.Errorf("suffixedProjectFor(app copy) = %q, %v, want app-2", got, ok)
+	}
+	for _, dir := range []string{"/src/app", "/src/app-tools", "/src/app-one", "/elsewhere"} {
+		if got, ok := suffixedProjectFor(cfg, "app", dir); ok {
+			t.Errorf("suffixedProjectFor(%s) = %q, want none", dir, got)
+		}
+	}
+}
+
+func TestChooseIslandConflict(t *testing.T) {
+	for _, mode := range []string{islandConflictReuse, islandConflictNew} {
+		if got, err := chooseIslandConflict(mode, "coderaft_app", "/src/app", false, nil); err != nil || got != mode {
+			t.Errorf("chooseIslandConflict(%s) = %q, %v", mode, got, err)
+		}
+	}
+	if _, err := chooseIslandConflict(islandConflictPrompt, "coderaft_app", "/src/app", false, nil); err == nil || !strings.Contains(err.Error(), "--on-conflict") {
+		t.Errorf("expected prompting without a terminal to fail naming --on-conflict, got %v", err)
+	}
+	answers := map[string]string{"r\n": islandConflictReuse, "new\n": islandConflictNew}
+	for answer, want := range answers {
+		got, err := chooseIslandConflict(islandConflictPrompt, "coderaft_app", "/src/app", true, bufio.NewReader(strings.NewReader(answer)))
+		if err != nil || got != want {
+			t.Errorf("answer %q: got %q, %v, want %q", answer, got, err, want)
+		}
+	}
+	if _, err := chooseIslandConflict(islandConflictPrompt, "coderaft_app", "/src/app", true, bufio.NewReader(strings.NewReader("\n"))); err == nil {
+		t.Error("an empty answer should abort")
+	}
+}
+
+// fakeLockEngine serves the island state lock and verify read. Anything else
+// panics through the nil DockerEngine.
+type fakeLockEngine struct {
+	DockerEngine
+	env  map[string]string
+	pkgs docker.PackageLists
+}
+
+func (f *fakeLockEngine) IslandExists(name string) (bool, error)      { return true, nil }
+func (f *fakeLockEngine) GetIslandStatus(name string) (string, error) { return "running", nil }
+func (f *fakeLockEngine) GetImageDigestInfo(ref string) (string, string, error) {
+	return "sha256:base", "sha256:id", nil
+}
+func (f *fakeLockEngine) GetMounts(name string) ([]string, error) {
+	return []string{"bind /src/app -> /island (rw=true)"}, nil
+}
+func (f *fakeLockEngine) GetPortMappings(name string) ([]string, error) {
+	return []string{"3000/tcp -> 0.0.0.0:3000"}, nil
+}
+func (f *fakeLockEngine) GetContainerMeta(name string) (map[string]string, string, string, string, map[string]string, []string, map[string]string, string) {
+	env := map[string]string{}
+	for k, v := range f.env {
+		env[k] = v
+	}
+	return env, "/island", "root", "no", map[string]string{"coderaft.project": "app"}, nil, map[string]string{"memory": "4g"}, "bridge"
+}
+func (f *fakeLockEngine) QueryAllPackages(name string) *docker.PackageLists {
+	// a fresh copy each time, in the order the package managers list them
+	pkgs := f.pkgs
+	pkgs.Apt = append([]string(nil), f.pkgs.Apt...)
+	pkgs.Gem = append([]string(nil), f.pkgs.Gem...)
+	return &pkgs
+}
+func (f *fakeLockEngine) GetAptSources(name string) (string, []string, string) {
+	return "", []string{"deb http://deb.debian.org/debian bookworm main"}, ""
+}
+func (f *fakeLockEngine) GetAptPreferences(name string) map[string]string { return nil }
+func (f *fakeLockEngine) GetSystemSettings(name string) docker.SystemSettings {
+	return docker.SystemSettings{Timezone: "Europe/Berlin"}
+}
+func (f *fakeLockEngine) GetPipRegistries(name string) (string, []string) { return "", nil }
+func (f *fakeLockEngine) GetNodeRegistries(name string) (string, string, string) {
+	return "https://registry.npmjs.org/", "", ""
+}
+func (f *fakeLockEngine) GetFileChecksums(name string, patterns []string) map[string]string {
+	return nil
+}
+func (f *fakeLockEngine) ExecCapture(name, command string) (string, string, error) {
+	return "", "", fmt.Errorf("no VS Code server")
+}
+
+func TestLockThenVerifyUsesChecksum(t *testing.T) {
+	cm, err := config.NewConfigManagerWithPath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedCM, savedClient, savedNoCache := configManager, dockerClient, verifyNoCache
+	configManager = cm
+	dockerClient = &fakeLockEngine{
+		env: map[string]string{"PATH": "/usr/bin", "API_TOKEN": "s3cret"},
+		pkgs: docker.PackageLists{
+			Apt: []string{"git=1:2.39.2-1", "curl=7.88.1-10"},
+			Gem: []string{"rake@13.1.0", "bundler@2.5.6"},
+		},
+	}
+	verifyNoCache = true
+	defer func() { configManager, dockerClient, verifyNoCache = savedCM, savedClient, savedNoCache }()
+
+	workspace := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workspace, "coderaft.json"), []byte(`{"name":"app","gpus":"all"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := cm.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj := &config.Project{Name: "app", IslandName: "coderaft_app", BaseImage: "debian:bookworm", WorkspacePath: workspace}
+	cfg.AddProject(proj)
+	if err := cm.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteLockFileForProject("app", ""); err != nil {
+		t.Fatalf("WriteLockFileForProject() error = %v", err)
+	}
+	lf, err := readLockFile(filepath.Join(workspace, "coderaft.lock.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf.Version != currentLockVersion || lf.Checksum == "" || lf.Checksum != computeLockChecksum(lf) {
+		t.Fatalf("lock written as version %d with checksum %q", lf.Version, lf.Checksum)
+	}
+
+	live := readLiveLock(proj, lf, newPackageExclusions(cfg.Settings))
+	if got := computeLockChecksum(&live); got != lf.Checksum {
+		t.Errorf("live checksum %s, want the lock's %s", got, lf.Checksum)
+	}
+	report, err := runVerify("app")
+	if err != nil {
+		t.Fatalf("runVerify() error = %v", err)
+	}
+	if !report.Matches || len(report.Drifts) != 0 {
+		t.Errorf("a just-locked island should verify, got drifts %v", report.Drifts)
+	}
+}
@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/errdefs"
+	"coderaft/internal/security"
+	"coderaft/internal/ui"
+)
+
+var (
+	rebuildNoUpdate bool
+	rebuildFromLock bool
+	rebuildForce    bool
+)
+
+var rebuildCmd = &cobra.Command{
+	Use:   "rebuild <project>",
+	Short: "Destroy and recreate one project's island",
+	Long: `Rebuild a single project's island: stop and remove it, pull the base
+image, recreate it, upgrade system packages, and run the project's setup
+commands. This is the per-project version of 'coderaft maintenance --rebuild'.
+
+The workspace on the host is untouched; anything installed inside the island
+that isn't in setup_commands or the lock file is lost.
+
+Examples:
+  coderaft rebuild myproject
+  coderaft rebuild myproject --no-update
+  coderaft rebuild myproject --from-lock --force`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName := args[0]
+
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+
+		cfg, err := configManager.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+
+		project, exists := cfg.GetProject(projectName)
+		if !exists {
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
+		}
+
+		if rebuildFromLock {
+			lockPath := filepath.Join(project.WorkspacePath, "coderaft.lock.json")
+			if _, err := os.Stat(lockPath); err != nil {
+				return fmt.Errorf("--from-lock needs %s: %w", security.SanitizePathForError(lockPath), err)
+			}
+		}
+
+		if !rebuildForce {
+			ui.Prompt("This will destroy and recreate island '%s'. Continue? (y/N): ", project.IslandName)
+			reader := bufio.NewReader(os.Stdin)
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read confirmation: %w", err)
+			}
+			response = strings.ToLower(strings.TrimSpace(response))
+			if response != "y" && response != "yes" {
+				ui.Info("rebuild cancelled.")
+				return nil
+			}
+		}
+
+		ui.Status("rebuilding %s...", projectName)
+		if err := rebuildProjectIsland(cfg, projectName, project, !rebuildNoUpdate); err != nil {
+			return err
+		}
+
+		if rebuildFromLock {
+			ui.Status("applying coderaft.lock.json...")
+			ctx, cancel := context.WithTimeout(context.Background(), security.Timeouts.Apply)
+			defer cancel()
+			if _, err := runApply(ctx, projectName); err != nil {
+				return fmt.Errorf("island rebuilt but applying the lock file failed: %w", err)
+			}
+		}
+
+		project.Status = "running"
+		if err := configManager.Save(cfg); err != nil {
+			ui.Warning("failed to save configuration: %v", err)
+		}
+
+		ui.Success("%s rebuilt", projectName)
+		return nil
+	},
+}
+
+func init() {
+	rebuildCmd.Flags().BoolVar(&rebuildNoUpdate, "no-update", false, "Skip upgrading system packages after recreating the island")
+	rebuildCmd.Flags().BoolVar(&rebuildFromLock, "from-lock", false, "Apply coderaft.lock.json after the rebuild")
+	rebuildCmd.Flags().BoolVarP(&rebuildForce, "force", "f", false, "Rebuild without a confirmation prompt")
+}
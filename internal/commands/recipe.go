@@ -0,0 +1,316 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+const recipeIndexFile = "index.json"
+
+var (
+	recipeNamePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*/[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	recipeVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// recipeIndex is the index.json published at the root of a recipe source
+type recipeIndex struct {
+	Recipes map[string]recipeIndexEntry `json:"recipes"`
+}
+
+type recipeIndexEntry struct {
+	Latest   string                        `json:"latest"`
+	Versions map[string]recipeIndexVersion `json:"versions"`
+}
+
+type recipeIndexVersion struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// parseRecipeRef splits "owner/name[@version]" into its parts; version
+// defaults to "latest"
+func parseRecipeRef(ref string) (name, version string, err error) {
+	name, version, _ = strings.Cut(strings.TrimSpace(ref), "@")
+	if version == "" {
+		version = "latest"
+	}
+	if !recipeNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("invalid recipe name '%s' (expected owner/name)", name)
+	}
+	if !recipeVersionPattern.MatchString(version) {
+		return "", "", fmt.Errorf("invalid recipe version '%s'", version)
+	}
+	return name, version, nil
+}
+
+// recipeCacheDir returns recipes/ in coderaft's data directory,
+// ~/.coderaft/recipes by default
+func recipeCacheDir() (string, error) {
+	return config.DataPath("recipes")
+}
+
+// loadRecipe resolves a recipe reference against the configured recipe source.
+// Pinned versions are served from the local cache once fetched; "latest" is
+// re-resolved every time and falls back to the cache when the source is
+// unreachable.
+func loadRecipe(ref string, cfg *config.Config) (*config.Recipe, error) {
+	name, version, err := parseRecipeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDir, err := recipeCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if version != "latest" {
+		if recipe, err := readCachedRecipe(cacheDir, name, version); err == nil {
+			ui.Status("using cached recipe %s@%s", name, version)
+			return recipe, nil
+		}
+	}
+
+	source := ""
+	if cfg != nil && cfg.Settings != nil {
+		source = cfg.Settings.RecipeSource
+	}
+	if source == "" {
+		return nil, fmt.Errorf("no recipe source configured; set 'recipe_source' in ~/.coderaft/config.json")
+	}
+
+	data, resolved, err := fetchRecipe(source, name, version)
+	if err != nil {
+		if version == "latest" {
+			if recipe, cacheErr := readCachedRecipe(cacheDir, name, version); cacheErr == nil {
+				ui.Warning("failed to fetch recipe, using cached copy: %v", err)
+				return recipe, nil
+			}
+		}
+		return nil, err
+	}
+
+	recipe, err := parseRecipe(data, name, resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCachedRecipe(cacheDir, name, resolved, data); err != nil {
+		ui.Warning("failed to cache recipe: %v", err)
+	}
+	if version == "latest" {
+		if err := writeCachedRecipe(cacheDir, name, "latest", data); err != nil {
+			ui.Warning("failed to cache recipe: %v", err)
+		}
+	}
+	return recipe, nil
+}
+
+// fetchRecipe reads the source index, resolves the version, and returns the
+// recipe bytes after checking them against the index checksum
+func fetchRecipe(source, name, version string) ([]byte, string, error) {
+	read, err := recipeSourceReader(source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	indexData, err := read(recipeIndexFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read recipe index: %w", err)
+	}
+	var index recipeIndex
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, "", fmt.Errorf("invalid recipe index: %w", err)
+	}
+
+	entry, ok := index.Recipes[name]
+	if !ok {
+		return nil, "", fmt.Errorf("recipe '%s' not found in %s", name, source)
+	}
+	resolved := version
+	if resolved == "latest" {
+		resolved = entry.Latest
+		if resolved == "" {
+			return nil, "", fmt.Errorf("recipe '%s' has no latest version", name)
+		}
+	}
+	v, ok := entry.Versions[resolved]
+	if !ok {
+		return nil, "", fmt.Errorf("recipe '%s' has no version '%s'", name, resolved)
+	}
+	if v.Path == "" || v.SHA256 == "" {
+		return nil, "", fmt.Errorf("recipe index entry for %s@%s is missing path or sha256", name, resolved)
+	}
+
+	data, err := read(v.Path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read recipe %s@%s: %w", name, resolved, err)
+	}
+	if err := verifyRecipeChecksum(data, v.SHA256); err != nil {
+		return nil, "", fmt.Errorf("recipe %s@%s failed integrity check: %w", name, resolved, err)
+	}
+	return data, resolved, nil
+}
+
+// recipeSourceReader returns a function that reads files relative to the
+// root of an HTTP(S) recipe index or a git repository of recipes
+func recipeSourceReader(source string) (func(path string) ([]byte, error), error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if !strings.HasSuffix(source, ".git") {
+			base, err := url.Parse(strings.TrimSuffix(source, "/") + "/")
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipe source: %w", err)
+			}
+			client := &http.Client{Timeout: 30 * time.Second}
+			return func(path string) ([]byte, error) {
+				ref, err := url.Parse(path)
+				if err != nil {
+					return nil, err
+				}
+				resp, err := client.Get(base.ResolveReference(ref).String())
+				if err != nil {
+					return nil, err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return nil, fmt.Errorf("request returned %s", resp.Status)
+				}
+				return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			}, nil
+		}
+	}
+
+	dir, err := syncRecipeRepo(source)
+	if err != nil {
+		return nil, err
+	}
+	return func(path string) ([]byte, error) {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		if !strings.HasPrefix(filepath.Clean(full), filepath.Clean(dir)+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("recipe path '%s' escapes the recipe repository", path)
+		}
+		return os.ReadFile(full)
+	}, nil
+}
+
+// syncRecipeRepo clones a git recipe source into the cache, or fast-forwards
+// an existing clone
+func syncRecipeRepo(source string) (string, error) {
+	repoURL, err := normalizeRepoURL(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipe source: %w", err)
+	}
+	cacheDir, err := recipeCacheDir()
+	if err != nil {
+		return "", err
+	}
+	host, path := splitRepoHostPath(repoURL)
+	dest := filepath.Join(cacheDir, ".sources", strings.ReplaceAll(host+"/"+path, "/", "-"))
+
+	if _, err := os.Stat(filepath.Join(dest, ".git")); err == nil {
+		ui.Status("updating recipe source...")
+		cmd := exec.Command("git", "-C", dest, "pull", "--ff-only", "--quiet")
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("failed to update recipe source: %w", err)
+		}
+		return dest, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", fmt.Errorf("failed to create recipe cache: %w", err)
+	}
+	ui.Status("cloning recipe source %s...", repoURL)
+	cmd := exec.Command("git", "clone", "--depth", "1", "--quiet", repoURL, dest)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dest)
+		return "", formatGitError(err, repoURL, "")
+	}
+	return dest, nil
+}
+
+// verifyRecipeChecksum compares data against a hex sha256 (optionally
+// prefixed with "sha256:")
+func verifyRecipeChecksum(data []byte, want string) error {
+	sum := sha256.Sum256(data)
+	got := hex.EncodeToString(sum[:])
+	want = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(want), "sha256:"))
+	if got != want {
+		return fmt.Errorf("sha256 mismatch (expected %s, got %s)", want, got)
+	}
+	return nil
+}
+
+// parseRecipe decodes a recipe and checks it is the one that was requested
+// and that its config passes project config validation
+func parseRecipe(data []byte, name, version string) (*config.Recipe, error) {
+	var recipe config.Recipe
+	if err := json.Unmarshal(data, &recipe); err != nil {
+		return nil, fmt.Errorf("invalid recipe %s@%s: %w", name, version, err)
+	}
+	if recipe.Name != name {
+		return nil, fmt.Errorf("recipe name mismatch: requested '%s', got '%s'", name, recipe.Name)
+	}
+	if version != "latest" && recipe.Version != version {
+		return nil, fmt.Errorf("recipe version mismatch: requested '%s', got '%s'", version, recipe.Version)
+	}
+
+	check := recipe.Config
+	if check.Name == "" {
+		check.Name = "recipe"
+	}
+	cm := configManager
+	if cm == nil {
+		cm = &config.ConfigManager{}
+	}
+	if err := cm.ValidateProjectConfig(&check); err != nil {
+		return nil, fmt.Errorf("recipe %s@%s has an invalid config: %w", name, version, err)
+	}
+	return &recipe, nil
+}
+
+func readCachedRecipe(cacheDir, name, version string) (*config.Recipe, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, filepath.FromSlash(name), version+".json"))
+	if err != nil {
+		return nil, err
+	}
+	return parseRecipe(data, name, version)
+}
+
+func writeCachedRecipe(cacheDir, name, version string, data []byte) error {
+	dir := filepath.Join(cacheDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, version+".json"), data, 0644)
+}
+
+// applyRecipe builds a project config from a recipe, tagging the island with
+// the recipe it came from
+func applyRecipe(recipe *config.Recipe, projectName string) *config.ProjectConfig {
+	data, _ := json.Marshal(recipe.Config)
+	var pc config.ProjectConfig
+	_ = json.Unmarshal(data, &pc)
+	pc.Name = projectName
+
+	if pc.Labels == nil {
+		pc.Labels = map[string]string{}
+	}
+	pc.Labels["coderaft.recipe"] = recipe.Name + "@" + recipe.Version
+	return &pc
+}
@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/errdefs"
+	"coderaft/internal/ui"
+)
+
+var (
+	recloneForce  bool
+	recloneLatest bool
+)
+
+var recloneCmd = &cobra.Command{
+	Use:   "reclone <project>",
+	Short: "Recreate a cloned project from the state recorded when it was cloned",
+	Long: `Recreate a project exactly as 'coderaft clone' first made it, from the
+.coderaft/state.json clone writes into the workspace: the same repository,
+the same commit, the same base image (by digest when it was recorded), the
+same stack and the same clone flags.
+
+The workspace and the island are removed and cloned again, so uncommitted
+changes and anything installed by hand in the island are lost. The commit is
+checked out detached; create a branch from it to keep working.
+
+Pass --latest to reclone the recorded branch as it is now, with the image
+tag's current version, using only the recorded flags.
+
+Examples:
+  coderaft reclone myproject
+  coderaft reclone myproject --force
+  coderaft reclone myproject --latest`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName := args[0]
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+
+		cfg, err := configManager.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		project, exists := cfg.GetProject(projectName)
+		if !exists {
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+		}
+
+		state, err := readCloneState(project.WorkspacePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("project '%s' has no %s; only projects made by 'coderaft clone' can be recloned", projectName, filepath.Join(project.WorkspacePath, cloneStateFile))
+		} else if err != nil {
+			return err
+		}
+
+		ui.Detail("repository", state.Repo)
+		if state.Commit != "" && !recloneLatest {
+			ui.Detail("commit", state.Commit)
+		} else if state.Branch != "" {
+			ui.Detail("branch", state.Branch)
+		}
+		if state.Image != "" {
+			ui.Detail("image", recloneImage(state, recloneLatest))
+		}
+		if len(state.Flags) > 0 {
+			ui.Detail("flags", strings.Join(state.Flags, " "))
+		}
+
+		if !recloneForce {
+			if ws, err := readWorkspaceState(project.WorkspacePath, workspaceModeCommit); err == nil && ws.Dirty {
+				ui.Warning("%s has uncommitted changes", project.WorkspacePath)
+			}
+			ui.Prompt("This will delete '%s' and island '%s' and clone them again. Continue? (y/N): ", project.WorkspacePath, project.IslandName)
+			response, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read confirmation: %w", err)
+			}
+			response = strings.ToLower(strings.TrimSpace(response))
+			if response != "y" && response != "yes" {
+				ui.Info("reclone cancelled.")
+				return nil
+			}
+		}
+
+		if err := cloneCmd.ParseFlags(recloneArgs(state)); err != nil {
+			return fmt.Errorf("invalid flags in %s: %w", cloneStateFile, err)
+		}
+		if err := cloneCmd.Flags().Set("force", "true"); err != nil {
+			return err
+		}
+		if err := cloneCmd.Flags().Set("name", projectName); err != nil {
+			return err
+		}
+		if !recloneLatest {
+			clonePinCommit = state.Commit
+			clonePinImage = recloneImage(state, false)
+		}
+
+		// --from-pr names the repository itself
+		cloneArgs := []string{state.Repo}
+		if hasCloneFlag(state.Flags, "from-pr") {
+			cloneArgs = nil
+		}
+		ui.Status("recloning %s...", projectName)
+		return cloneCmd.RunE(cloneCmd, cloneArgs)
+	},
+}
+
+func init() {
+	recloneCmd.Flags().BoolVarP(&recloneForce, "force", "f", false, "Reclone without a confirmation prompt")
+	recloneCmd.Flags().BoolVar(&recloneLatest, "latest", false, "Use the recorded branch's current commit and the image tag's current version instead of the recorded ones")
+}
+
+// recloneArgs are the clone flags that recreate state: the recorded flags,
+// plus the branch and stack when clone worked them out rather than being
+// told, so a newer coderaft detecting differently doesn't change them
+func recloneArgs(state *cloneState) []string {
+	args := append([]string{}, state.Flags...)
+	if state.Branch != "" && !hasCloneFlag(args, "branch") {
+		args = append(args, "--branch="+state.Branch)
+	}
+	if state.Stack != "" && !hasCloneFlag(args, "template", "env-stack", "recipe") {
+		if len(state.Stacks) > 1 {
+			args = append(args, "--env-stack="+strings.Join(state.Stacks, ","))
+		} else {
+			args = append(args, "--template="+state.Stack)
+		}
+	}
+	return args
+}
+
+// recloneImage is the image to recreate the island from: the recorded
+// digest, else the recorded name. latest uses the name, to pick up what the
+// tag points at now.
+func recloneImage(state *cloneState, latest bool) string {
+	if state.ImageDigest != "" && !latest {
+		return state.ImageDigest
+	}
+	return state.Image
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
@@ -35,7 +36,7 @@ var restoreCmd = &cobra.Command{
 		}
 		proj, ok := cfg.GetProject(projectName)
 		if !ok {
-			return fmt.Errorf("project '%s' not found", projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 		}
 
 		imageTar := filepath.Join(backupDir, "image.tar")
@@ -81,11 +82,17 @@ var restoreCmd = &cobra.Command{
 		}
 
 		workspaceIsland := "/island"
-		if pcfg, err := configManager.LoadProjectConfig(proj.WorkspacePath); err == nil && pcfg != nil && strings.TrimSpace(pcfg.WorkingDir) != "" {
-			workspaceIsland = pcfg.WorkingDir
+		workspaceHost := proj.WorkspacePath
+		if pcfg, err := configManager.LoadProjectConfig(proj.WorkspacePath); err == nil && pcfg != nil {
+			if strings.TrimSpace(pcfg.WorkingDir) != "" {
+				workspaceIsland = pcfg.WorkingDir
+			}
+			if workspaceHost, err = workspaceHostPath(proj.WorkspacePath, pcfg.WorkspaceSubdir); err != nil {
+				return err
+			}
 		}
 
-		islandID, err := dockerClient.CreateIslandWithConfig(proj.IslandName, imageRef, proj.WorkspacePath, workspaceIsland, nil)
+		islandID, err := dockerClient.CreateIslandWithConfig(proj.IslandName, imageRef, workspaceHost, workspaceIsland, nil)
 		if err != nil {
 			return fmt.Errorf("failed to create island from image: %w", err)
 		}
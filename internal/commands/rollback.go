@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// snapshotEngine is the part of the Docker client that taking an apply
+// snapshot and rolling back to it needs
+type snapshotEngine interface {
+	CommitContainer(containerName, imageTag string) (string, error)
+	StopIsland(islandName string) error
+	RemoveIsland(islandName string) error
+	CreateIslandWithConfig(name, image, workspaceHost, workspaceIsland string, projectConfig interface{}) (string, error)
+	StartIsland(islandID string) error
+	WaitForIsland(islandName string, timeout time.Duration) error
+	RunDockerCommand(args []string) error
+}
+
+// applyUndo is how a failed apply is undone: the snapshot image, or the
+// backup --backup-dir writes instead
+type applyUndo interface {
+	fail(step string, err error, autoRollback bool) error
+	discard()
+}
+
+// applySnapshot is the image apply commits before it changes the island.
+// An empty Tag means the commit failed and there is nothing to roll back to.
+type applySnapshot struct {
+	client  snapshotEngine
+	project *config.Project
+	Tag     string
+}
+
+// takeApplySnapshot commits the island so a failed apply can be undone
+func takeApplySnapshot(client snapshotEngine, project *config.Project) *applySnapshot {
+	ui.Status("creating pre-apply snapshot for rollback safety...")
+	s := &applySnapshot{
+		client:  client,
+		project: project,
+		Tag:     fmt.Sprintf("coderaft-snapshot/%s:pre-apply-%d", project.Name, time.Now().Unix()),
+	}
+	if _, err := client.CommitContainer(project.IslandName, s.Tag); err != nil {
+		ui.Warning("failed to create rollback snapshot: %v (continuing without rollback support)", err)
+		s.Tag = ""
+	}
+	return s
+}
+
+// discard removes the snapshot once apply has succeeded
+func (s *applySnapshot) discard() {
+	if s.Tag == "" {
+		return
+	}
+	ui.Status("cleaning up pre-apply snapshot...")
+	_ = s.client.RunDockerCommand([]string{"rmi", s.Tag})
+}
+
+// fail handles a failed apply step. With autoRollback the island is
+// recreated from the snapshot; otherwise, or if that doesn't work, the
+// snapshot is kept and named for a manual rollback.
+func (s *applySnapshot) fail(step string, err error, autoRollback bool) error {
+	if s.Tag == "" {
+		return err
+	}
+	if !autoRollback {
+		ui.Warning("%s failed, snapshot available at %s for manual rollback", step, s.Tag)
+		return err
+	}
+
+	ui.Warning("%s failed, rolling the island back to %s...", step, s.Tag)
+	if rbErr := s.rollback(); rbErr != nil {
+		ui.Warning("rollback failed, snapshot available at %s for manual rollback", s.Tag)
+		return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+	}
+	ui.Info("island '%s' is back to its state before apply; it now runs from %s", s.project.IslandName, s.Tag)
+	return fmt.Errorf("%w; the island was rolled back", err)
+}
+
+// rollback replaces the island with one created from the snapshot image,
+// using the same workspace mount and project config as 'coderaft up'
+func (s *applySnapshot) rollback() error {
+	workspaceIsland, workspaceHost, configMap, err := islandRecreateSpec(s.project)
+	if err != nil {
+		return err
+	}
+
+	_ = s.client.StopIsland(s.project.IslandName)
+	if err := s.client.RemoveIsland(s.project.IslandName); err != nil {
+		return fmt.Errorf("failed to remove island: %w", err)
+	}
+	islandID, err := s.client.CreateIslandWithConfig(s.project.IslandName, s.Tag, workspaceHost, workspaceIsland, configMap)
+	if err != nil {
+		return fmt.Errorf("failed to create island from snapshot: %w", err)
+	}
+	if err := s.client.StartIsland(islandID); err != nil {
+		return fmt.Errorf("failed to start island: %w", err)
+	}
+	if err := s.client.WaitForIsland(s.project.IslandName, 30*time.Second); err != nil {
+		return fmt.Errorf("island failed to become ready: %w", err)
+	}
+	return nil
+}
+
+// islandRecreateSpec reads what creating a project's island again needs from
+// its coderaft.json: the mount target, the host directory and the config map
+func islandRecreateSpec(project *config.Project) (workspaceIsland, workspaceHost string, configMap map[string]interface{}, err error) {
+	workspaceIsland = "/island"
+	workspaceHost = project.WorkspacePath
+
+	projectConfig, err := configManager.LoadProjectConfig(project.WorkspacePath)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to load project config: %w", err)
+	}
+	if projectConfig == nil {
+		return workspaceIsland, workspaceHost, nil, nil
+	}
+
+	if projectConfig.WorkingDir != "" {
+		workspaceIsland = projectConfig.WorkingDir
+	}
+	if workspaceHost, err = workspaceHostPath(project.WorkspacePath, projectConfig.WorkspaceSubdir); err != nil {
+		return "", "", nil, err
+	}
+	data, err := json.Marshal(projectConfig)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to marshal project config: %w", err)
+	}
+	if err := json.Unmarshal(data, &configMap); err != nil {
+		return "", "", nil, fmt.Errorf("failed to convert project config: %w", err)
+	}
+	return workspaceIsland, workspaceHost, configMap, nil
+}
@@ -5,12 +5,14 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/spf13/cobra"
 
 	"coderaft/internal/config"
 	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
@@ -48,7 +50,24 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("failed to initialize config: %w", err)
 		}
 
+		if cmd.Name() == "clone" && cloneConfigOnly {
+			// clone --config-only never talks to Docker
+			return nil
+		}
+		if cmd.Name() == "verify" && verifyBaseline != "" {
+			// verify --baseline only reads two files
+			return nil
+		}
+		if cmd.Name() == "config" && len(args) > 0 && args[0] == "validate" {
+			// config validate only reads coderaft.json
+			return nil
+		}
+
 		if err := docker.EnsureDockerRunning(security.Timeouts.DockerStartup); err != nil {
+			if cmd.Name() == "doctor" {
+				// doctor reports a missing Docker itself
+				return nil
+			}
 			hint := ""
 			switch runtime.GOOS {
 			case "windows":
@@ -58,12 +77,16 @@ var rootCmd = &cobra.Command{
 			default:
 				hint = " Please ensure Docker is installed and its daemon is running."
 			}
-			return fmt.Errorf("docker is not available.%s\n  %w", hint, err)
+			return errdefs.Errorf(errdefs.ErrDockerUnavailable, "docker is not available.%s\n  %w", hint, err)
 		}
 
 		dockerClient, err = docker.NewClient()
 		if err != nil {
-			return fmt.Errorf("failed to create Docker client: %w", err)
+			dockerClient = nil
+			if cmd.Name() == "doctor" {
+				return nil
+			}
+			return errdefs.Errorf(errdefs.ErrDockerUnavailable, "failed to create Docker client: %w", err)
 		}
 
 		return nil
@@ -89,13 +112,18 @@ func init() {
 
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(cloneCmd)
+	rootCmd.AddCommand(recloneCmd)
 	rootCmd.AddCommand(upCmd)
 	rootCmd.AddCommand(shellCmd)
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(installCmd)
 	rootCmd.AddCommand(stopCmd)
 	rootCmd.AddCommand(destroyCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(topCmd)
+	rootCmd.AddCommand(logsCmd)
 
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(templatesCmd)
@@ -108,7 +136,10 @@ func init() {
 	rootCmd.AddCommand(restoreCmd)
 
 	rootCmd.AddCommand(cleanupCmd)
+	rootCmd.AddCommand(pruneCacheCmd)
 	rootCmd.AddCommand(maintenanceCmd)
+	rootCmd.AddCommand(rebuildCmd)
+	rootCmd.AddCommand(doctorCmd)
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(completionCmd)
@@ -129,3 +160,63 @@ func getWorkspacePath(projectName string) (string, error) {
 
 	return filepath.Join(homeDir, "coderaft", projectName), nil
 }
+
+// workspaceHostPath is the host directory mounted into a project's island:
+// the workspace itself, or its workspace_subdir, which has to exist and must
+// not lead back out of the workspace through a symlink
+func workspaceHostPath(workspacePath, subdir string) (string, error) {
+	if subdir == "" {
+		return workspacePath, nil
+	}
+	clean, err := config.CleanWorkspaceSubdir(subdir)
+	if err != nil {
+		return "", fmt.Errorf("invalid workspace_subdir: %w", err)
+	}
+
+	hostPath := filepath.Join(workspacePath, filepath.FromSlash(clean))
+	if info, err := os.Stat(hostPath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("workspace_subdir '%s' is not a directory in %s", clean, workspacePath)
+	}
+	root, err := filepath.EvalSymlinks(workspacePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace_subdir: %w", err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("workspace_subdir '%s' resolves outside %s", clean, workspacePath)
+	}
+	return hostPath, nil
+}
+
+func ensureProjectIslandRunning(projectName string) (*config.Project, error) {
+	cfg, err := configManager.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	project, exists := cfg.GetProject(projectName)
+	if !exists {
+		return nil, errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
+	}
+
+	exists, err = dockerClient.IslandExists(project.IslandName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check island status: %w", err)
+	}
+	if !exists {
+		return nil, errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", project.IslandName, projectName)
+	}
+	status, err := dockerClient.GetIslandStatus(project.IslandName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get island status: %w", err)
+	}
+	if status != "running" {
+		ui.Status("starting island '%s'...", project.IslandName)
+		if err := dockerClient.StartIsland(project.IslandName); err != nil {
+			return nil, fmt.Errorf("failed to start island: %w", err)
+		}
+	}
+	return project, nil
+}
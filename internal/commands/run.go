@@ -1,21 +1,96 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
-var keepRunningRunFlag bool
+var (
+	keepRunningRunFlag bool
+	runEnvPairs        []string
+	runStdin           bool
+	runRetry           int
+	runRetryDelay      time.Duration
+	runTimeout         time.Duration
+	runArtifacts       []string
+	runArtifactAlways  bool
+	runWorkdir         string
+	runOutputFile      string
+	runJUnitOut        string
+)
 
 var runCmd = &cobra.Command{
-	Use:   "run <project> <command> [args...]",
-	Short: "Run a command in the project island",
-	Long:  `Execute an arbitrary command inside the specified project's island.`,
-	Args:  cobra.MinimumNArgs(2),
+	Use:     "run <project> <command> [args...]",
+	Aliases: []string{"exec"},
+	Short:   "Run a command in the project island",
+	Long: `Execute an arbitrary command inside the specified project's island.
+
+Use --env to set environment variables for this invocation only; nothing is
+written to the project config. A TTY is allocated only when run from a
+terminal, so output can be piped. Use --workdir to run in another directory;
+a relative one is taken from the island's working directory.
+
+When the command fails, coderaft exits with the command's own exit status,
+so scripts and CI steps can tell failures apart as if the command ran on the
+host.
+
+Piped input is streamed to the command until it ends. From a terminal,
+stdin is attached only when output goes to the terminal too, so a command
+piped into a pager doesn't compete with it for keystrokes. Use --stdin to
+always attach it, or --stdin=false to give the command no input, e.g. inside
+a 'while read' loop.
+
+Use --retry to re-run a flaky command when it exits non-zero, waiting
+--retry-delay between attempts. Each attempt is reported, and run fails if
+the last attempt does. Retried commands get no stdin, since piped input can
+only be read once.
+
+Use --timeout to bound how long the command may run. When it runs out, the
+command is sent SIGTERM in the island, then SIGKILL 5 seconds later, and run
+exits with status 124. A timed-out attempt is not retried.
+
+Use --artifact to copy files the command wrote outside the workspace, such
+as coverage reports in /tmp, to the host once it finishes: SRC is an
+absolute island path, globs allowed, and DEST a host path (default: the
+current directory). A glob copies every match into the DEST directory.
+Artifacts are only copied when the command succeeds, unless
+--artifact-always is set.
+
+For CI, --output-file writes a copy of everything the command prints to a
+host file, which is replaced on each run; no TTY is allocated then. With
+--junit-out, run adds the test runner's own JUnit XML option to the command
+and copies the report to the given host path, whether or not the tests
+pass. It knows pytest, vitest, phpunit and gotestsum, also behind launchers
+such as 'python -m' or 'npx'; for other runners, write the report yourself
+and use --artifact.
+
+Examples:
+  coderaft run myproject python3 --version
+  cat data.csv | coderaft exec myproject -- wc -l
+  coderaft run myproject --env DEBUG=1 -- npm test
+  coderaft run myproject --env A=1 --env B=2 -- env | grep '^[AB]='
+  coderaft exec myproject --workdir packages/api -- npm test
+  coderaft run myproject --retry 3 --retry-delay 5s -- npm test
+  coderaft run myproject --timeout 10m -- make test
+  coderaft run myproject --artifact /tmp/coverage.xml:./coverage.xml -- run-tests
+  coderaft run myproject --artifact '/tmp/reports/*.xml:./reports' --artifact-always -- make test
+  coderaft run myproject --junit-out results.xml --output-file test.log -- pytest`,
+	Args: cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		projectName := args[0]
 		command := args[1:]
@@ -23,6 +98,29 @@ var runCmd = &cobra.Command{
 		if err := validateProjectName(projectName); err != nil {
 			return err
 		}
+		if err := validateRunEnv(runEnvPairs); err != nil {
+			return err
+		}
+		if runRetry < 0 || runRetryDelay < 0 || runTimeout < 0 {
+			return fmt.Errorf("--retry, --retry-delay and --timeout cannot be negative")
+		}
+		if runRetry > 0 && runStdin {
+			return fmt.Errorf("--retry cannot be used with --stdin: input can't be replayed to a retried command")
+		}
+		artifacts, err := parseRunArtifacts(runArtifacts)
+		if err != nil {
+			return err
+		}
+		if runArtifactAlways && len(artifacts) == 0 {
+			return fmt.Errorf("--artifact-always requires --artifact")
+		}
+		junitReport := ""
+		if runJUnitOut != "" {
+			junitReport = junitIslandPath()
+			if command, err = junitCommand(command, junitReport); err != nil {
+				return err
+			}
+		}
 
 		cfg, err := configManager.Load()
 		if err != nil {
@@ -31,7 +129,7 @@ var runCmd = &cobra.Command{
 
 		project, exists := cfg.GetProject(projectName)
 		if !exists {
-			return fmt.Errorf("project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
 		}
 
 		exists, err = dockerClient.IslandExists(project.IslandName)
@@ -40,7 +138,16 @@ var runCmd = &cobra.Command{
 		}
 
 		if !exists {
-			return fmt.Errorf("island '%s' not found. Run 'coderaft init %s' to recreate", project.IslandName, projectName)
+			return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found. Run 'coderaft init %s' to recreate", project.IslandName, projectName)
+		}
+
+		workdir := ""
+		if runWorkdir != "" {
+			base := "/island"
+			if projectConfig, _ := configManager.LoadProjectConfig(project.WorkspacePath); projectConfig != nil && projectConfig.WorkingDir != "" {
+				base = projectConfig.WorkingDir
+			}
+			workdir = runWorkdirPath(base, runWorkdir)
 		}
 
 		status, err := dockerClient.GetIslandStatus(project.IslandName)
@@ -55,8 +162,36 @@ var runCmd = &cobra.Command{
 			}
 		}
 
-		if err := docker.RunCommand(project.IslandName, command); err != nil {
-			return fmt.Errorf("failed to run command: %w", err)
+		var output io.Writer
+		if runOutputFile != "" {
+			f, err := os.Create(runOutputFile)
+			if err != nil {
+				return fmt.Errorf("failed to create output file: %w", err)
+			}
+			defer f.Close()
+			output = f
+		}
+
+		attach := runRetry == 0 && runAttachStdin(cmd.Flags().Changed("stdin"), runStdin, term.IsTerminal(int(os.Stdin.Fd())), term.IsTerminal(int(os.Stdout.Fd())))
+		runErr := runWithRetry(runRetry, runRetryDelay, time.Sleep, func() error {
+			return docker.RunCommand(project.IslandName, command, runEnvPairs, workdir, attach, runTimeout, output)
+		})
+		if junitReport != "" {
+			copyJUnitReport(project.IslandName, junitReport, runJUnitOut)
+		}
+		if len(artifacts) > 0 {
+			if runErr == nil || runArtifactAlways {
+				copyRunArtifacts(project.IslandName, artifacts)
+			} else {
+				ui.Info("hint: the command failed, so no artifacts were copied; --artifact-always copies them anyway")
+			}
+		}
+		if runErr != nil {
+			var exitErr *exec.ExitError
+			if errors.As(runErr, &exitErr) && exitErr.ExitCode() > 0 {
+				return errdefs.WithExitStatus(exitErr.ExitCode(), fmt.Errorf("command exited with status %d", exitErr.ExitCode()))
+			}
+			return fmt.Errorf("failed to run command: %w", runErr)
 		}
 
 		if !keepRunningRunFlag {
@@ -80,4 +215,156 @@ var runCmd = &cobra.Command{
 
 func init() {
 	runCmd.Flags().BoolVar(&keepRunningRunFlag, "keep-running", false, "Keep the island running after the command finishes")
+	runCmd.Flags().StringArrayVar(&runEnvPairs, "env", nil, "Set an environment variable for this command only (KEY=VALUE, repeatable)")
+	runCmd.Flags().StringVarP(&runWorkdir, "workdir", "w", "", "Run the command in this directory (relative paths start at the island's working directory)")
+	runCmd.Flags().BoolVarP(&runStdin, "stdin", "i", false, "Stream stdin to the command (default: when stdin is piped, or a terminal with output to the terminal)")
+	runCmd.Flags().IntVar(&runRetry, "retry", 0, "Re-run the command up to this many times while it exits non-zero")
+	runCmd.Flags().DurationVar(&runRetryDelay, "retry-delay", time.Second, "Time to wait between attempts with --retry")
+	runCmd.Flags().StringArrayVar(&runArtifacts, "artifact", nil, "Copy an island path to the host after the command, SRC[:DEST] (globs allowed in SRC, repeatable)")
+	runCmd.Flags().BoolVar(&runArtifactAlways, "artifact-always", false, "Copy --artifact paths even when the command fails")
+	runCmd.Flags().StringVar(&runOutputFile, "output-file", "", "Also write the command's output to this host file")
+	runCmd.Flags().StringVar(&runJUnitOut, "junit-out", "", "Have the test runner write a JUnit XML report and copy it to this host path")
+	runCmd.Flags().DurationVar(&runTimeout, "timeout", 0, "Terminate the command if it runs longer than this, exiting with status 124 (0 means no limit)")
+}
+
+// runWithRetry calls run, and calls it again up to retries more times while
+// the command exits non-zero, sleeping delay in between. Failures that aren't
+// the command's own exit status, such as docker not starting it, aren't
+// retried. The returned error is the last attempt's.
+func runWithRetry(retries int, delay time.Duration, sleep func(time.Duration), run func() error) error {
+	attempts := retries + 1
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil {
+			if attempt > 1 {
+				ui.Success("command succeeded on attempt %d/%d", attempt, attempts)
+			}
+			return nil
+		}
+		var exitErr *exec.ExitError
+		if retries == 0 || !errors.As(err, &exitErr) {
+			return err
+		}
+		if attempt == attempts {
+			ui.Error("command failed on attempt %d/%d (exit code %d), giving up", attempt, attempts, exitErr.ExitCode())
+			return err
+		}
+		ui.Warning("command failed on attempt %d/%d (exit code %d), retrying in %s", attempt, attempts, exitErr.ExitCode(), delay)
+		sleep(delay)
+	}
+}
+
+// runWorkdirPath resolves --workdir, taking a relative dir from base, the
+// island's working directory
+func runWorkdirPath(base, dir string) string {
+	if path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	return path.Join(base, dir)
+}
+
+// runAttachStdin decides whether run connects its stdin to the command. An
+// explicit --stdin wins; otherwise piped input is always passed on, and a
+// terminal only when the command's output goes to a terminal too.
+func runAttachStdin(flagSet, flag, stdinTerminal, stdoutTerminal bool) bool {
+	if flagSet {
+		return flag
+	}
+	if stdinTerminal {
+		return stdoutTerminal
+	}
+	return true
+}
+
+// validateRunEnv checks that each --env value is KEY=VALUE with a valid name
+func validateRunEnv(pairs []string) error {
+	for _, pair := range pairs {
+		name, _, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid --env '%s': expected KEY=VALUE", pair)
+		}
+		if !envVarNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid --env '%s': '%s' is not a valid variable name", pair, name)
+		}
+	}
+	return nil
+}
+
+// runArtifact is an --artifact: an island path or glob and where on the host
+// to copy it
+type runArtifact struct {
+	Source string
+	Dest   string
+}
+
+// artifactSourcePattern is an absolute island path made of characters the
+// island's shell can expand as a glob without quoting
+var artifactSourcePattern = regexp.MustCompile(`^/[A-Za-z0-9_.@+*?\[\]/-]+$`)
+
+// parseRunArtifacts parses --artifact SRC[:DEST] values. DEST defaults to the
+// current directory.
+func parseRunArtifacts(specs []string) ([]runArtifact, error) {
+	var artifacts []runArtifact
+	for _, spec := range specs {
+		src, dest, _ := strings.Cut(spec, ":")
+		if !artifactSourcePattern.MatchString(src) {
+			return nil, fmt.Errorf("invalid --artifact '%s': SRC must be an absolute island path, with optional * ? or [] globs", spec)
+		}
+		if dest == "" {
+			dest = "."
+		}
+		artifacts = append(artifacts, runArtifact{Source: src, Dest: dest})
+	}
+	return artifacts, nil
+}
+
+// isGlob reports whether the artifact's source can match several paths
+func (a runArtifact) isGlob() bool {
+	return strings.ContainsAny(a.Source, "*?[")
+}
+
+// destination is where src, the artifact's source or one of its glob
+// matches, is copied: into Dest when it's a directory, a glob, or ends in a
+// slash, otherwise to Dest itself
+func (a runArtifact) destination(src string) string {
+	if a.isGlob() || strings.HasSuffix(a.Dest, "/") || strings.HasSuffix(a.Dest, string(filepath.Separator)) {
+		return filepath.Join(a.Dest, path.Base(src))
+	}
+	if info, err := os.Stat(a.Dest); err == nil && info.IsDir() {
+		return filepath.Join(a.Dest, path.Base(src))
+	}
+	return a.Dest
+}
+
+// copyRunArtifacts copies each artifact out of the island. A missing or
+// failed artifact is a warning, so it doesn't hide the command's own result.
+func copyRunArtifacts(islandName string, artifacts []runArtifact) {
+	for _, a := range artifacts {
+		sources := []string{a.Source}
+		if a.isGlob() {
+			matches, err := dockerClient.ExpandIslandPaths(islandName, a.Source)
+			if err != nil {
+				ui.Warning("failed to expand artifact %s: %v", a.Source, err)
+				continue
+			}
+			if len(matches) == 0 {
+				ui.Warning("no artifacts match %s", a.Source)
+				continue
+			}
+			sources = matches
+		}
+		for _, src := range sources {
+			dest := a.destination(src)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				ui.Warning("failed to copy artifact %s: %v", src, err)
+				continue
+			}
+			n, err := dockerClient.CopyFromIsland(islandName, src, dest)
+			if err != nil {
+				ui.Warning("failed to copy artifact %s: %v", src, err)
+				continue
+			}
+			ui.Status("copied artifact %s -> %s (%d file(s))", src, dest, n)
+		}
+	}
 }
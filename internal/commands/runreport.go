@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"coderaft/internal/ui"
+)
+
+// junitFrameworks are the test runners --junit-out knows, by executable name,
+// and the arguments that have them write a JUnit XML report to a path. Each
+// has the report built in, so nothing needs installing in the island.
+var junitFrameworks = map[string]func(report string) []string{
+	"pytest":  func(report string) []string { return []string{"--junitxml=" + report} },
+	"py.test": func(report string) []string { return []string{"--junitxml=" + report} },
+	"vitest": func(report string) []string {
+		return []string{"--reporter=default", "--reporter=junit", "--outputFile.junit=" + report}
+	},
+	"phpunit":   func(report string) []string { return []string{"--log-junit", report} },
+	"gotestsum": func(report string) []string { return []string{"--junitfile", report} },
+}
+
+// junitLaunchers may come before a test runner, as in 'python -m pytest' or
+// 'npx vitest run'
+var junitLaunchers = map[string]bool{
+	"python": true, "python3": true, "-m": true,
+	"npx": true, "bunx": true, "pnpm": true, "yarn": true, "exec": true,
+	"uv": true, "poetry": true, "pipenv": true, "run": true,
+}
+
+// junitCommand returns command with the arguments that make its test runner
+// write a JUnit report to report, added right after the runner's name so
+// they come before anything it passes on, such as gotestsum's go test flags
+func junitCommand(command []string, report string) ([]string, error) {
+	for i, arg := range command {
+		name := path.Base(arg)
+		if flags, ok := junitFrameworks[name]; ok {
+			out := append([]string{}, command[:i+1]...)
+			out = append(out, flags(report)...)
+			return append(out, command[i+1:]...), nil
+		}
+		if !junitLaunchers[name] {
+			break
+		}
+	}
+
+	known := make([]string, 0, len(junitFrameworks))
+	for name := range junitFrameworks {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	hint := ""
+	if len(command) > 1 && path.Base(command[0]) == "go" && command[1] == "test" {
+		hint = "; for go test, run it through gotestsum"
+	}
+	return nil, fmt.Errorf("--junit-out doesn't know how to get a JUnit report from '%s' (supported: %s)%s. Have the command write the report and copy it out with --artifact instead",
+		strings.Join(command, " "), strings.Join(known, ", "), hint)
+}
+
+// junitIslandPath is a fresh path in the island for a run's JUnit report
+func junitIslandPath() string {
+	return fmt.Sprintf("/tmp/coderaft-junit-%d.xml", time.Now().UnixNano())
+}
+
+// copyJUnitReport copies the report the test runner wrote to dest on the
+// host and removes it from the island. It is copied whether the tests passed
+// or not, since failures are what CI wants to show; a missing report, e.g.
+// when the runner couldn't start, is a warning.
+func copyJUnitReport(islandName, report, dest string) {
+	defer dockerClient.ExecCapture(islandName, "rm -f "+shellQuote(report))
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		ui.Warning("failed to copy JUnit report: %v", err)
+		return
+	}
+	if _, err := dockerClient.CopyFromIsland(islandName, report, dest); err != nil {
+		ui.Warning("no JUnit report was written, so %s wasn't created: %v", dest, err)
+		return
+	}
+	ui.Status("copied JUnit report to %s", dest)
+}
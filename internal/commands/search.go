@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/ui"
+)
+
+var (
+	searchManager string
+	searchLimit   int
+)
+
+var searchManagers = []string{"apt", "pip", "npm"}
+
+type searchResult struct {
+	Manager     string
+	Name        string
+	Description string
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <project> <query>",
+	Short: "Search package managers inside the island",
+	Long: `Search the package managers available in a project's island and print
+matching packages with their descriptions.
+
+Managers are picked from the detected project stack (apt always, plus pip for
+Python and npm for Node.js). Use --manager to search a single one.
+
+Examples:
+  coderaft search myproject redis
+  coderaft search myproject requests --manager pip
+  coderaft search myproject eslint --manager npm --limit 5`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName, query := args[0], strings.TrimSpace(args[1])
+
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+		if query == "" {
+			return fmt.Errorf("search query cannot be empty")
+		}
+		if searchLimit < 0 {
+			return fmt.Errorf("--limit cannot be negative")
+		}
+
+		project, err := ensureProjectIslandRunning(projectName)
+		if err != nil {
+			return err
+		}
+
+		var managers []string
+		if searchManager != "" {
+			if !isSearchManager(searchManager) {
+				return fmt.Errorf("unsupported manager '%s' (supported: %s)", searchManager, strings.Join(searchManagers, ", "))
+			}
+			managers = []string{searchManager}
+		} else {
+			managers = searchManagersForStack(detectProjectStack(project.WorkspacePath))
+		}
+
+		var results []searchResult
+		for _, manager := range managers {
+			ui.Status("searching %s for '%s'...", manager, query)
+			stdout, stderr, err := dockerClient.ExecCapture(project.IslandName, searchCommand(manager, query))
+			if err != nil {
+				ui.Warning("%s search failed: %v", manager, err)
+				if msg := strings.TrimSpace(stderr); msg != "" {
+					ui.Detail("stderr", msg)
+				}
+				continue
+			}
+			found := parseSearchOutput(manager, stdout)
+			if searchLimit > 0 && len(found) > searchLimit {
+				found = found[:searchLimit]
+			}
+			results = append(results, found...)
+		}
+
+		if len(results) == 0 {
+			ui.Info("no packages matching '%s' found in %s", query, strings.Join(managers, ", "))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MANAGER\tPACKAGE\tDESCRIPTION")
+		fmt.Fprintln(w, "-------\t-------\t-----------")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Manager, r.Name, r.Description)
+		}
+		w.Flush()
+
+		ui.Blank()
+		ui.Info("install with 'coderaft install %s <package> --manager <manager>'", projectName)
+		return nil
+	},
+}
+
+func init() {
+	searchCmd.Flags().StringVar(&searchManager, "manager", "", "Search only this package manager (apt, pip, npm)")
+	searchCmd.Flags().IntVar(&searchLimit, "limit", 20, "Maximum results per manager (0 for no limit)")
+}
+
+func isSearchManager(manager string) bool {
+	for _, m := range searchManagers {
+		if m == manager {
+			return true
+		}
+	}
+	return false
+}
+
+// searchManagersForStack returns the managers worth searching for a detected stack
+func searchManagersForStack(stack string) []string {
+	switch stack {
+	case "python":
+		return []string{"pip", "apt"}
+	case "nodejs":
+		return []string{"npm", "apt"}
+	default:
+		return []string{"apt"}
+	}
+}
+
+// searchCommand builds the in-island shell command for a manager's search.
+// PyPI no longer supports `pip search`, so pip looks up the exact package name.
+func searchCommand(manager, query string) string {
+	q := shellQuote(query)
+	switch manager {
+	case "pip":
+		return fmt.Sprintf("(pip3 index versions %s || pip index versions %s) 2>/dev/null || true", q, q)
+	case "npm":
+		return fmt.Sprintf("npm search --parseable -- %s 2>/dev/null || true", q)
+	default:
+		return fmt.Sprintf("apt-cache search -- %s 2>/dev/null || true", q)
+	}
+}
+
+// parseSearchOutput turns raw search output into results
+func parseSearchOutput(manager, output string) []searchResult {
+	var results []searchResult
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		switch manager {
+		case "apt":
+			name, desc, ok := strings.Cut(line, " - ")
+			if !ok {
+				continue
+			}
+			results = append(results, searchResult{Manager: manager, Name: strings.TrimSpace(name), Description: strings.TrimSpace(desc)})
+		case "pip":
+			// "requests (2.31.0)" followed by "Available versions: ..."
+			name, rest, ok := strings.Cut(line, " (")
+			if !ok || strings.Contains(name, ":") {
+				continue
+			}
+			version := strings.TrimSuffix(rest, ")")
+			results = append(results, searchResult{Manager: manager, Name: name, Description: "latest " + version})
+		case "npm":
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 || fields[0] == "" {
+				continue
+			}
+			desc := strings.TrimSpace(fields[1])
+			if len(fields) >= 5 && strings.TrimSpace(fields[4]) != "" {
+				desc = strings.TrimSpace(desc + " (" + strings.TrimSpace(fields[4]) + ")")
+			}
+			results = append(results, searchResult{Manager: manager, Name: fields[0], Description: desc})
+		}
+	}
+	return results
+}
@@ -2,20 +2,39 @@ package commands
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
+	"coderaft/internal/config"
 	"coderaft/internal/secrets"
 	"coderaft/internal/ui"
 )
 
 var secretsVault *secrets.Vault
 
+var (
+	secretsInjectKeys      []string
+	secretsInjectMaps      []string
+	secretsImportOverwrite bool
+	secretsExportForce     bool
+)
+
+// envVarNamePattern is what a shell accepts as an environment variable name
+var envVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretsEnvPath is the file in the island that injected secrets are written to
+const secretsEnvPath = "/root/.coderaft-secrets"
+
 var secretsCmd = &cobra.Command{
 	Use:   "secrets",
 	Short: "Manage encrypted secrets for coderaft projects",
@@ -34,15 +53,27 @@ Daily usage:
   coderaft secrets list <project>                # List secret keys
   coderaft secrets remove <project> <KEY>        # Remove a secret
   coderaft secrets import <project> .env         # Import from .env file
-
-Secrets are automatically injected when running 'coderaft up' or 'coderaft shell'.`,
+  coderaft secrets export <project> <file>       # Write secrets to a .env file
+  coderaft secrets inject <project>              # Push secrets into the running island
+  coderaft secrets audit                         # Secret counts, naming and staleness
+  coderaft secrets rotate                        # Change the master password
+
+Set inject_secrets in coderaft.json to have 'coderaft up' and 'coderaft clone'
+pass a project's secrets to its island as environment variables when they
+create it.`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Name() == "init" {
 			return nil
 		}
+		if cmd.Name() == "inject" {
+			// inject talks to the island, so it needs the root setup as well
+			if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
+				return err
+			}
+		}
 
 		var err error
-		secretsVault, err = secrets.NewVault()
+		secretsVault, err = openVault()
 		if err != nil {
 			return fmt.Errorf("failed to load secrets vault: %w", err)
 		}
@@ -50,6 +81,11 @@ Secrets are automatically injected when running 'coderaft up' or 'coderaft shell
 		if !secretsVault.IsInitialized() {
 			return fmt.Errorf("secrets vault not initialized. Run 'coderaft secrets init' first")
 		}
+		if cmd.Name() == "audit" || cmd.Name() == "rotate" {
+			// audit only reads timestamps, never values, and rotate asks for
+			// the current password itself
+			return nil
+		}
 
 		password, err := promptPassword("Enter vault password: ")
 		if err != nil {
@@ -69,7 +105,7 @@ var secretsInitCmd = &cobra.Command{
 	Short: "Initialize the secrets vault with a master password",
 	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		vault, err := secrets.NewVault()
+		vault, err := openVault()
 		if err != nil {
 			return err
 		}
@@ -111,6 +147,60 @@ var secretsInitCmd = &cobra.Command{
 	},
 }
 
+var secretsRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Change the vault's master password",
+	Long: `Change the vault's master password without losing any secrets.
+
+Every secret is decrypted with the current password and encrypted again
+under the new one with a fresh salt. If the current password can't decrypt
+all of them, nothing changes. The vault file is replaced in a single atomic
+write, so an interrupted rotation leaves it readable with the old password.
+
+Example:
+  coderaft secrets rotate`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		current, err := promptPassword("Enter current vault password: ")
+		if err != nil {
+			return err
+		}
+		password, err := promptPassword("Enter new master password: ")
+		if err != nil {
+			return err
+		}
+		confirm, err := promptPassword("Confirm new password: ")
+		if err != nil {
+			return err
+		}
+
+		if password != confirm {
+			return fmt.Errorf("passwords do not match")
+		}
+		if len(password) < 8 {
+			return fmt.Errorf("password must be at least 8 characters")
+		}
+		if password == current {
+			return fmt.Errorf("the new password is the same as the current one")
+		}
+
+		count := 0
+		for _, project := range secretsVault.ListProjects() {
+			count += len(secretsVault.List(project))
+		}
+		if count == 0 {
+			ui.Warning("the vault holds no secrets, so the current password can't be checked")
+		}
+		if err := secretsVault.ChangePassword(current, password); err != nil {
+			return fmt.Errorf("failed to change vault password: %w", err)
+		}
+
+		ui.Success("vault password changed")
+		ui.Detail("secrets re-encrypted", fmt.Sprintf("%d", count))
+		return nil
+	},
+}
+
 var secretsSetCmd = &cobra.Command{
 	Use:   "set <project> <KEY>[=value]",
 	Short: "Set a secret for a project",
@@ -226,9 +316,12 @@ var secretsImportCmd = &cobra.Command{
 	Short: "Import secrets from a .env file",
 	Long: `Import key-value pairs from a .env file into the encrypted vault.
 
+Keys the project already has a secret for are skipped; use --overwrite to
+replace them with the file's values.
+
 Example:
   coderaft secrets import myproject .env
-  coderaft secrets import myproject .env.production`,
+  coderaft secrets import myproject .env.production --overwrite`,
 	Args: cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		project := args[0]
@@ -244,29 +337,60 @@ Example:
 			return nil
 		}
 
-		imported := 0
-		for k, v := range env {
-			if err := secretsVault.Set(project, k, v); err != nil {
+		existing := map[string]bool{}
+		for _, k := range secretsVault.List(project) {
+			existing[k] = true
+		}
+		keys := sortedKeys(env)
+
+		added, updated, skipped, failed := 0, 0, 0, 0
+		for _, k := range keys {
+			if existing[k] && !secretsImportOverwrite {
+				ui.Status("skipping %s, already set", k)
+				skipped++
+				continue
+			}
+			if err := secretsVault.Set(project, k, env[k]); err != nil {
 				ui.Warning("failed to import %s: %v", k, err)
+				failed++
 				continue
 			}
-			imported++
+			if existing[k] {
+				updated++
+			} else {
+				added++
+			}
 		}
 
-		ui.Success("imported %d secrets from %s into project '%s'", imported, envFile, project)
+		ui.Success("imported %s into project '%s'", envFile, project)
+		ui.Summary("%d added, %d overwritten, %d skipped, %d failed", added, updated, skipped, failed)
+		if skipped > 0 {
+			ui.Info("hint: use --overwrite to replace the %d secret(s) already set", skipped)
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to import %d secret(s)", failed)
+		}
 		return nil
 	},
 }
 
 var secretsExportCmd = &cobra.Command{
-	Use:   "export <project>",
-	Short: "Export secrets as environment variables (for piping)",
-	Long: `Export secrets in shell-compatible format.
+	Use:   "export <project> [envfile]",
+	Short: "Export secrets as environment variables or a .env file",
+	Long: `Export secrets in shell-compatible format, or write them to a .env file.
+
+Without a file the secrets are printed as export statements. With one they
+are written as a .env file that 'coderaft secrets import' reads back,
+readable by you only (0600). An existing file is replaced.
+
+To keep secrets out of commits, export refuses to write a file inside a git
+working tree unless --force is given.
 
 Example:
   eval $(coderaft secrets export myproject)
-  coderaft secrets export myproject > .env.local`,
-	Args: cobra.ExactArgs(1),
+  coderaft secrets export myproject ~/backups/myproject.env
+  coderaft secrets export myproject .env.local --force`,
+	Args: cobra.RangeArgs(1, 2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		project := args[0]
 
@@ -275,6 +399,10 @@ Example:
 			return err
 		}
 
+		if len(args) == 2 {
+			return exportSecretsEnvFile(project, args[1], secrets)
+		}
+
 		if len(secrets) == 0 {
 			return nil
 		}
@@ -291,14 +419,231 @@ Example:
 	},
 }
 
+// exportSecretsEnvFile writes a project's secrets to a .env file, unless it
+// is inside a git working tree and --force isn't set
+func exportSecretsEnvFile(project, path string, values map[string]string) error {
+	if len(values) == 0 {
+		ui.Info("project '%s' has no secrets to export", project)
+		return nil
+	}
+	if !secretsExportForce {
+		if repo, ok := gitWorkTreeOf(path); ok {
+			return fmt.Errorf("%s is inside the git working tree %s, where it could be committed; write it elsewhere or use --force", path, repo)
+		}
+	}
+
+	for _, k := range sortedKeys(values) {
+		if strings.ContainsAny(values[k], "\r\n") {
+			ui.Warning("not exporting %s: its value spans several lines, which a .env file can't hold", k)
+			delete(values, k)
+		}
+	}
+	if err := secrets.WriteEnvFile(path, values); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	ui.Success("exported %d secret(s) from project '%s' to %s", len(values), project, path)
+	return nil
+}
+
+// gitWorkTreeOf returns the git working tree path would be written into, by
+// looking for a .git entry in its directory and each parent
+func gitWorkTreeOf(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		// .git is a directory, or a file in worktrees and submodules
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, true
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
+
+var secretsInjectCmd = &cobra.Command{
+	Use:   "inject <project>",
+	Short: "Write a project's secrets into its running island",
+	Long: `Write a project's secrets into its running island as environment variables.
+
+The secrets are written to ` + secretsEnvPath + ` (readable by root only), which
+the island's shell sources, so new 'coderaft shell' and 'coderaft run'
+sessions see them. Each inject replaces the previous file.
+
+By default every secret stored for the project is injected. Use --key to
+inject only some of them, and --map to inject a secret under a different
+environment variable name than its vault key.
+
+Examples:
+  coderaft secrets inject myproject
+  coderaft secrets inject myproject --key DB_PASSWORD --key API_KEY
+  coderaft secrets inject myproject --key prod_db_pass --map prod_db_pass=DB_PASSWORD`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectName := args[0]
+
+		if err := validateProjectName(projectName); err != nil {
+			return err
+		}
+
+		targets, err := secretInjectTargets(secretsInjectKeys, secretsInjectMaps, secretsVault.List(projectName))
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			ui.Info("no secrets for project '%s'.", projectName)
+			return nil
+		}
+
+		values := make(map[string]string, len(targets))
+		for key, envName := range targets {
+			value, err := secretsVault.Get(projectName, key)
+			if err != nil {
+				return err
+			}
+			values[envName] = value
+		}
+
+		project, err := ensureProjectIslandRunning(projectName)
+		if err != nil {
+			return err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString([]byte(secretsEnvFile(values)))
+		script := fmt.Sprintf("umask 077; printf %%s %s | base64 -d > %s && "+
+			"(grep -qF %s /root/.bashrc 2>/dev/null || echo '[ -f %s ] && . %s' >> /root/.bashrc)",
+			encoded, secretsEnvPath, secretsEnvPath, secretsEnvPath, secretsEnvPath)
+		if _, stderr, err := dockerClient.ExecCapture(project.IslandName, script); err != nil {
+			if msg := strings.TrimSpace(stderr); msg != "" {
+				ui.Detail("stderr", msg)
+			}
+			return fmt.Errorf("failed to inject secrets: %w", err)
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ui.Success("injected %d secret(s) into '%s': %s", len(names), project.IslandName, strings.Join(names, ", "))
+		ui.Info("new shells pick them up; restart running processes to see them")
+		return nil
+	},
+}
+
+// secretInjectTargets maps each vault key to inject onto the environment
+// variable it becomes. Without --key every stored key is injected; --map
+// renames keys and implies the key when --key is used.
+func secretInjectTargets(keys, maps, stored []string) (map[string]string, error) {
+	renames := map[string]string{}
+	for _, m := range maps {
+		key, envName, ok := strings.Cut(m, "=")
+		key, envName = strings.TrimSpace(key), strings.TrimSpace(envName)
+		if !ok || key == "" || envName == "" {
+			return nil, fmt.Errorf("invalid --map '%s' (expected vaultKey=ENV_VAR)", m)
+		}
+		renames[key] = envName
+	}
+
+	selected := stored
+	if len(keys) > 0 {
+		selected = append([]string{}, keys...)
+		for key := range renames {
+			selected = append(selected, key)
+		}
+	}
+
+	targets := map[string]string{}
+	used := map[string]string{}
+	for _, key := range selected {
+		envName := key
+		if renamed, ok := renames[key]; ok {
+			envName = renamed
+		}
+		if !envVarNamePattern.MatchString(envName) {
+			return nil, fmt.Errorf("'%s' is not a valid environment variable name; use --map %s=NAME", envName, key)
+		}
+		if other, ok := used[envName]; ok && other != key {
+			return nil, fmt.Errorf("secrets '%s' and '%s' would both be injected as %s", other, key, envName)
+		}
+		used[envName] = key
+		targets[key] = envName
+	}
+	return targets, nil
+}
+
+// secretsEnvFile renders values as a sourceable shell file, sorted by name
+func secretsEnvFile(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "export %s=%s\n", name, shellQuote(values[name]))
+	}
+	return b.String()
+}
+
 func init() {
+	secretsInjectCmd.Flags().StringArrayVar(&secretsInjectKeys, "key", nil, "Inject only this secret (repeatable)")
+	secretsInjectCmd.Flags().StringArrayVar(&secretsInjectMaps, "map", nil, "Inject a secret under another variable name (vaultKey=ENV_VAR, repeatable)")
+	secretsImportCmd.Flags().BoolVar(&secretsImportOverwrite, "overwrite", false, "Replace secrets the project already has with the file's values")
+	secretsExportCmd.Flags().BoolVar(&secretsExportForce, "force", false, "Write the file even inside a git working tree")
+
 	secretsCmd.AddCommand(secretsInitCmd)
+	secretsCmd.AddCommand(secretsRotateCmd)
 	secretsCmd.AddCommand(secretsSetCmd)
 	secretsCmd.AddCommand(secretsGetCmd)
 	secretsCmd.AddCommand(secretsListCmd)
 	secretsCmd.AddCommand(secretsRemoveCmd)
 	secretsCmd.AddCommand(secretsImportCmd)
 	secretsCmd.AddCommand(secretsExportCmd)
+	secretsCmd.AddCommand(secretsInjectCmd)
+}
+
+// openVault loads the secrets vault with settings.vault_idle_timeout applied
+func openVault() (*secrets.Vault, error) {
+	vault, err := secrets.NewVault()
+	if err != nil {
+		return nil, err
+	}
+	// the secrets commands skip the root setup, so configManager may be unset
+	cm := configManager
+	if cm == nil {
+		if cm, err = config.NewConfigManager(); err != nil {
+			return vault, nil
+		}
+	}
+	if cfg, err := cm.Load(); err == nil && cfg.Settings != nil {
+		timeout, err := parseVaultIdleTimeout(cfg.Settings.VaultIdleTimeout)
+		if err != nil {
+			ui.Warning("%v; locking the vault after %s instead", err, secrets.DefaultIdleTimeout)
+			timeout = secrets.DefaultIdleTimeout
+		}
+		vault.SetIdleTimeout(timeout)
+	}
+	return vault, nil
+}
+
+// parseVaultIdleTimeout parses settings.vault_idle_timeout. Unset means
+// secrets.DefaultIdleTimeout, and 0 turns the auto-lock off.
+func parseVaultIdleTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return secrets.DefaultIdleTimeout, nil
+	}
+	if value == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid vault_idle_timeout '%s' (expected a duration such as 15m, or 0)", value)
+	}
+	return d, nil
 }
 
 func promptPassword(prompt string) (string, error) {
@@ -0,0 +1,175 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/config"
+	"coderaft/internal/secrets"
+	"coderaft/internal/ui"
+)
+
+var secretsAuditStaleDays int
+
+// secretKeyConvention is the UPPER_SNAKE_CASE naming secrets are expected to
+// follow, as environment variable names
+var secretKeyConvention = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+var secretsAuditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Report secret counts, naming and staleness per project",
+	Long: `Report on the secrets in the vault without decrypting any of them.
+
+For each project the audit lists how many secrets it has, keys that don't
+follow the UPPER_SNAKE_CASE environment variable convention, and secrets
+that haven't been read (by get, export, inject, up or shell) for
+--stale-days days. Projects in the vault that aren't registered with
+coderaft are flagged as orphaned; remove their secrets with
+'coderaft secrets remove' once they're no longer needed.
+
+Read times are only recorded from this version on, so secrets stored
+earlier show as "no usage recorded" until they are next read. The audit
+only reads timestamps, so it doesn't ask for the vault password.
+
+Examples:
+  coderaft secrets audit
+  coderaft secrets audit --stale-days 30`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if secretsAuditStaleDays < 1 {
+			return fmt.Errorf("--stale-days must be at least 1")
+		}
+		// the secrets commands skip the root setup, so the config is loaded here
+		cm, err := config.NewConfigManager()
+		if err != nil {
+			return fmt.Errorf("failed to initialize config: %w", err)
+		}
+		cfg, err := cm.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		registered := map[string]bool{}
+		for name := range cfg.Projects {
+			registered[name] = true
+		}
+
+		staleAfter := time.Duration(secretsAuditStaleDays) * 24 * time.Hour
+		report := auditSecrets(secretsVault.Inventory(), registered, staleAfter, time.Now())
+		if len(report) == 0 {
+			ui.Info("no secrets stored.")
+			return nil
+		}
+		printSecretsAudit(report, secretsAuditStaleDays)
+		return nil
+	},
+}
+
+func init() {
+	secretsAuditCmd.Flags().IntVar(&secretsAuditStaleDays, "stale-days", 90, "Flag secrets that haven't been read for this many days")
+	secretsCmd.AddCommand(secretsAuditCmd)
+}
+
+// secretsAuditProject is the audit of one project's secrets
+type secretsAuditProject struct {
+	Project string
+	Count   int
+	// Credentials is set for the git credentials clone --retry-auth keeps,
+	// which belong to a host rather than a project
+	Credentials bool
+	Orphaned    bool
+	// Misnamed maps keys that break the naming convention to the reason
+	Misnamed map[string]string
+	// Stale maps keys that weren't read recently to when they last were
+	Stale map[string]string
+}
+
+// auditSecrets builds the audit of a vault inventory, sorted by project.
+// registered holds the names of the projects coderaft knows about.
+func auditSecrets(inventory map[string]map[string]secrets.SecretMeta, registered map[string]bool, staleAfter time.Duration, now time.Time) []secretsAuditProject {
+	var report []secretsAuditProject
+	for project, keys := range inventory {
+		entry := secretsAuditProject{
+			Project:     project,
+			Count:       len(keys),
+			Credentials: strings.HasPrefix(project, gitCredentialsVaultProject("")),
+			Misnamed:    map[string]string{},
+			Stale:       map[string]string{},
+		}
+		entry.Orphaned = !entry.Credentials && !registered[project]
+
+		for key, meta := range keys {
+			if !entry.Credentials {
+				switch {
+				case !envVarNamePattern.MatchString(key):
+					entry.Misnamed[key] = "not a valid environment variable name; inject needs --map"
+				case !secretKeyConvention.MatchString(key):
+					entry.Misnamed[key] = "not UPPER_SNAKE_CASE"
+				}
+			}
+
+			switch {
+			case !meta.AccessedAt.IsZero():
+				if age := now.Sub(meta.AccessedAt); age >= staleAfter {
+					entry.Stale[key] = fmt.Sprintf("last read %s (%d days ago)", meta.AccessedAt.Format("2006-01-02"), int(age.Hours()/24))
+				}
+			case !meta.CreatedAt.IsZero():
+				if age := now.Sub(meta.CreatedAt); age >= staleAfter {
+					entry.Stale[key] = fmt.Sprintf("never read since it was stored on %s", meta.CreatedAt.Format("2006-01-02"))
+				}
+			default:
+				entry.Stale[key] = "no usage recorded"
+			}
+		}
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Project < report[j].Project })
+	return report
+}
+
+// printSecretsAudit prints the audit, project by project, then a summary
+func printSecretsAudit(report []secretsAuditProject, staleDays int) {
+	total, orphaned, misnamed, stale := 0, 0, 0, 0
+	for _, p := range report {
+		total += p.Count
+		misnamed += len(p.Misnamed)
+		stale += len(p.Stale)
+
+		label := p.Project
+		switch {
+		case p.Credentials:
+			label += " (git credentials)"
+		case p.Orphaned:
+			label += " (orphaned: no registered project)"
+			orphaned++
+		}
+		ui.Header("%s: %d secret(s)", label, p.Count)
+		for _, key := range sortedKeys(p.Misnamed) {
+			ui.Item("%s: %s", key, p.Misnamed[key])
+		}
+		for _, key := range sortedKeys(p.Stale) {
+			ui.Item("%s: %s", key, p.Stale[key])
+		}
+	}
+
+	ui.Blank()
+	ui.Summary("%d project(s), %d secret(s), %d orphaned project(s), %d misnamed key(s), %d not read in %d days",
+		len(report), total, orphaned, misnamed, stale, staleDays)
+	if orphaned > 0 {
+		ui.Info("hint: remove an orphaned project's secrets with 'coderaft secrets remove <project> <KEY>'")
+	}
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
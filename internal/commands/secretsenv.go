@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"coderaft/internal/docker"
+	"coderaft/internal/ui"
+)
+
+// secretEnvLabel names, without values, the environment variables up and
+// clone set from the vault, so lock, verify and diff can leave them out and
+// committed images carry them blank
+const secretEnvLabel = docker.SecretEnvLabel
+
+// loadSecretEnv unlocks the vault and returns the project's secrets, keyed by
+// variable name, for a project with inject_secrets. Without a vault or any
+// secrets for the project it returns nil without asking for the password.
+func loadSecretEnv(projectName string) (map[string]string, error) {
+	vault, err := openVault()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets vault: %w", err)
+	}
+	if !vault.IsInitialized() {
+		ui.Warning("inject_secrets is set but the secrets vault isn't initialized; run 'coderaft secrets init'")
+		return nil, nil
+	}
+	keys := vault.List(projectName)
+	if len(keys) == 0 {
+		ui.Status("no secrets stored for project '%s'", projectName)
+		return nil, nil
+	}
+	if _, err := secretInjectTargets(nil, nil, keys); err != nil {
+		return nil, err
+	}
+
+	password, err := promptPassword(fmt.Sprintf("Enter vault password to inject %d secret(s): ", len(keys)))
+	if err != nil {
+		return nil, fmt.Errorf("%w; use --no-secrets to start the island without them", err)
+	}
+	if err := vault.Unlock(password); err != nil {
+		return nil, fmt.Errorf("failed to unlock vault: %w", err)
+	}
+	return vault.GetAll(projectName)
+}
+
+// withSecretEnv adds the secrets to the island's environment, over any
+// coderaft.json value of the same name, and lists their names in
+// secretEnvLabel
+func withSecretEnv(configMap map[string]interface{}, values map[string]string) map[string]interface{} {
+	if len(values) == 0 {
+		return configMap
+	}
+	if configMap == nil {
+		configMap = map[string]interface{}{}
+	}
+	env, _ := configMap["environment"].(map[string]interface{})
+	if env == nil {
+		env = map[string]interface{}{}
+	}
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		env[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configMap["environment"] = env
+
+	labels, _ := configMap["labels"].(map[string]interface{})
+	if labels == nil {
+		labels = map[string]interface{}{}
+	}
+	labels[secretEnvLabel] = strings.Join(names, ",")
+	configMap["labels"] = labels
+	return configMap
+}
+
+// withoutSecretEnv returns an island's environment and labels without the
+// variables secretEnvLabel names or the label itself, so secret values never
+// reach a lock file or diff
+func withoutSecretEnv(env, labels map[string]string) (map[string]string, map[string]string) {
+	names, ok := labels[secretEnvLabel]
+	if !ok {
+		return env, labels
+	}
+	secret := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		secret[name] = true
+	}
+	keptEnv := make(map[string]string, len(env))
+	for k, v := range env {
+		if !secret[k] {
+			keptEnv[k] = v
+		}
+	}
+	keptLabels := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != secretEnvLabel {
+			keptLabels[k] = v
+		}
+	}
+	return keptEnv, keptLabels
+}
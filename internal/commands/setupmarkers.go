@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// setupMarkerFile lists, one hash per line, the setup commands that have
+// succeeded in the island when setup_markers is on
+const setupMarkerFile = "/var/lib/coderaft/setup-markers"
+
+// setupRunner is the part of the Docker client that running a project's
+// setup commands needs
+type setupRunner interface {
+	ExecCapture(islandName, command string) (string, string, error)
+	ExecuteSetupCommandsWithOutput(islandName string, commands []string, showOutput bool) error
+}
+
+func setupCommandHash(command string) string {
+	sum := sha256.Sum256([]byte(command))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSetupMarkers reads the contents of setupMarkerFile
+func parseSetupMarkers(out string) map[string]bool {
+	markers := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			markers[line] = true
+		}
+	}
+	return markers
+}
+
+// pendingSetupCommands drops the setup commands that are already satisfied:
+// those whose setup_done_when check passes, and, with markers, those that
+// succeeded before with exactly the same text. A command with a check is
+// judged by the check alone.
+func pendingSetupCommands(commands []string, doneWhen map[string]string, markers map[string]bool, isDone func(check string) bool) (pending []string, skipped int) {
+	for _, command := range commands {
+		if check, ok := doneWhen[command]; ok {
+			if isDone(check) {
+				skipped++
+				continue
+			}
+		} else if markers[setupCommandHash(command)] {
+			skipped++
+			continue
+		}
+		pending = append(pending, command)
+	}
+	return pending, skipped
+}
+
+// runProjectSetupCommands runs a project's setup_commands in the island,
+// skipping satisfied ones when setup_done_when or setup_markers are set
+func runProjectSetupCommands(client setupRunner, islandName string, projectConfig *config.ProjectConfig) error {
+	commands := projectConfig.SetupCommands
+	if !projectConfig.SetupMarkers && len(projectConfig.SetupDoneWhen) == 0 {
+		return client.ExecuteSetupCommandsWithOutput(islandName, commands, false)
+	}
+
+	markers := map[string]bool{}
+	if projectConfig.SetupMarkers {
+		out, _, _ := client.ExecCapture(islandName, "cat "+setupMarkerFile+" 2>/dev/null || true")
+		markers = parseSetupMarkers(out)
+	}
+	pending, skipped := pendingSetupCommands(commands, projectConfig.SetupDoneWhen, markers, func(check string) bool {
+		_, _, err := client.ExecCapture(islandName, check)
+		return err == nil
+	})
+	if skipped > 0 {
+		ui.Status("skipping %d of %d setup commands that are already done", skipped, len(commands))
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := client.ExecuteSetupCommandsWithOutput(islandName, pending, false); err != nil {
+		return err
+	}
+
+	if projectConfig.SetupMarkers {
+		var hashes []string
+		for _, command := range pending {
+			if _, ok := projectConfig.SetupDoneWhen[command]; !ok {
+				hashes = append(hashes, setupCommandHash(command))
+			}
+		}
+		if len(hashes) > 0 {
+			record := fmt.Sprintf("mkdir -p /var/lib/coderaft && printf '%%s\\n' %s >> %s", strings.Join(hashes, " "), setupMarkerFile)
+			if _, _, err := client.ExecCapture(islandName, record); err != nil {
+				ui.Warning("failed to record setup markers: %v", err)
+			}
+		}
+	}
+	return nil
+}
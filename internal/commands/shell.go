@@ -2,20 +2,51 @@ package commands
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
 
-var keepRunningFlag bool
+var (
+	keepRunningFlag    bool
+	shellMounts        []string
+	shellTmux          string
+	shellScreen        string
+	shellNoMultiplexer bool
+)
 
 var shellCmd = &cobra.Command{
 	Use:   "shell <project>",
 	Short: "Open an interactive shell in the project island",
-	Long:  `Attach an interactive bash shell to the specified project's island.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Attach an interactive bash shell to the specified project's island.
+
+With --mount, the shell runs in a short-lived sibling container instead, since
+Docker can't add mounts to a running island. The sibling starts from a snapshot
+of the island, shares its volumes (including the workspace) and network, and
+adds the extra mounts. Changes outside mounted paths are discarded on exit.
+
+With --tmux or --screen, the shell runs in a named multiplexer session that
+outlives the connection: it is created the first time and attached to after
+that, so work survives a dropped connection and can be picked up again. The
+multiplexer is installed in the island if it is missing. Set
+settings.shell_multiplexer to use one by default.
+
+Examples:
+  coderaft shell myproject
+  coderaft shell myproject --mount ~/datasets:/data
+  coderaft shell myproject --mount ~/models:/models:ro
+  coderaft shell myproject --tmux
+  coderaft shell myproject --tmux=build
+  coderaft shell myproject --screen`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		projectName := args[0]
 
@@ -23,14 +54,34 @@ var shellCmd = &cobra.Command{
 			return err
 		}
 
+		mounts := make([]string, 0, len(shellMounts))
+		for _, spec := range shellMounts {
+			m, err := parseShellMount(spec)
+			if err != nil {
+				return err
+			}
+			mounts = append(mounts, m)
+		}
+
 		cfg, err := configManager.Load()
 		if err != nil {
 			return fmt.Errorf("failed to load configuration: %w", err)
 		}
 
+		mux, session, err := resolveMultiplexer(shellTmux, shellScreen, shellNoMultiplexer, cfg)
+		if err != nil {
+			return err
+		}
+		if mux != "" && len(mounts) > 0 {
+			if shellTmux != "" || shellScreen != "" {
+				return fmt.Errorf("--%s can't be combined with --mount: the sibling shell is removed on exit, so its session can't be reattached", mux)
+			}
+			mux = ""
+		}
+
 		project, exists := cfg.GetProject(projectName)
 		if !exists {
-			return fmt.Errorf("project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
 		}
 
 		exists, err = dockerClient.IslandExists(project.IslandName)
@@ -39,7 +90,7 @@ var shellCmd = &cobra.Command{
 		}
 
 		if !exists {
-			return fmt.Errorf("island '%s' not found. Run 'coderaft init %s' to recreate", project.IslandName, projectName)
+			return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found. Run 'coderaft init %s' to recreate", project.IslandName, projectName)
 		}
 
 		status, err := dockerClient.GetIslandStatus(project.IslandName)
@@ -61,29 +112,107 @@ var shellCmd = &cobra.Command{
 			}
 		}
 
-		if err := docker.AttachShell(project.IslandName, projectName); err != nil {
+		if len(mounts) > 0 {
+			ui.Status("starting a sibling shell with %d extra mount(s)...", len(mounts))
+			if err := docker.AttachSiblingShell(project.IslandName, projectName, mounts); err != nil {
+				return err
+			}
+		} else if mux != "" {
+			if err := ensureMultiplexer(project.IslandName, mux); err != nil {
+				return err
+			}
+			ui.Status("attaching to %s session '%s'...", mux, session)
+			if err := docker.AttachShellCommand(project.IslandName, projectName, multiplexerAttachCommand(mux, session)); err != nil {
+				return fmt.Errorf("failed to attach %s session: %w", mux, err)
+			}
+		} else if err := docker.AttachShell(project.IslandName, projectName); err != nil {
 			return fmt.Errorf("failed to attach shell: %w", err)
 		}
 
 		if !keepRunningFlag {
-			cfg, err := configManager.Load()
-			if err == nil && cfg.Settings != nil && cfg.Settings.AutoStopOnExit {
-				idle, idleErr := dockerClient.IsContainerIdle(project.IslandName)
-				if idleErr != nil {
-					ui.Warning("failed to check island idle status: %v", idleErr)
-				} else if idle {
-					ui.Status("stopping island '%s' (auto-stop: idle)...", project.IslandName)
-					if err := dockerClient.StopIsland(project.IslandName); err != nil {
-						ui.Warning("failed to stop island: %v", err)
-					}
-				}
-			}
+			autoStopAfterShell(project.IslandName)
 		}
 
 		return nil
 	},
 }
 
+// autoStopAfterShell stops an island once its shell has exited, when
+// settings.auto_stop_on_exit is on and nothing else keeps the island busy
+func autoStopAfterShell(islandName string) {
+	cfg, err := configManager.Load()
+	if err != nil || cfg.Settings == nil || !cfg.Settings.AutoStopOnExit {
+		return
+	}
+	idle, err := dockerClient.IsContainerIdle(islandName)
+	if err != nil {
+		ui.Warning("failed to check island idle status: %v", err)
+	} else if idle {
+		ui.Status("stopping island '%s' (auto-stop: idle)...", islandName)
+		if err := dockerClient.StopIsland(islandName); err != nil {
+			ui.Warning("failed to stop island: %v", err)
+		}
+	}
+}
+
 func init() {
 	shellCmd.Flags().BoolVar(&keepRunningFlag, "keep-running", false, "Keep the island running after exiting the shell")
+	shellCmd.Flags().StringArrayVar(&shellMounts, "mount", nil, "Extra bind mount for this shell only, host:container[:ro] (repeatable)")
+	shellCmd.Flags().StringVar(&shellTmux, "tmux", "", "Start or attach to a tmux session, --tmux[=session] (default session: coderaft)")
+	shellCmd.Flags().Lookup("tmux").NoOptDefVal = defaultMuxSession
+	shellCmd.Flags().StringVar(&shellScreen, "screen", "", "Start or attach to a screen session, --screen[=session] (default session: coderaft)")
+	shellCmd.Flags().Lookup("screen").NoOptDefVal = defaultMuxSession
+	shellCmd.Flags().BoolVar(&shellNoMultiplexer, "no-multiplexer", false, "Open a plain shell even if settings.shell_multiplexer is set")
+}
+
+// ensureMultiplexer installs mux in the island if it isn't there yet
+func ensureMultiplexer(islandName, mux string) error {
+	if _, _, err := dockerClient.ExecCapture(islandName, "command -v "+mux); err == nil {
+		return nil
+	}
+	ui.Status("installing %s in island '%s'...", mux, islandName)
+	if err := dockerClient.ExecuteSetupCommandsWithOutput(islandName, []string{islandInstallScript(mux)}, false); err != nil {
+		return fmt.Errorf("failed to install %s: %w", mux, err)
+	}
+	return nil
+}
+
+// parseShellMount validates a --mount spec and returns it with the host path
+// made absolute. The host path must exist.
+func parseShellMount(spec string) (string, error) {
+	rest, mode := spec, ""
+	for _, m := range []string{":ro", ":rw"} {
+		if strings.HasSuffix(rest, m) {
+			rest, mode = strings.TrimSuffix(rest, m), m
+			break
+		}
+	}
+
+	// split at the last ":/" so Windows drive letters stay in the host path
+	i := strings.LastIndex(rest, ":/")
+	if i <= 0 {
+		return "", fmt.Errorf("invalid --mount '%s' (expected host:container[:ro], with an absolute container path)", spec)
+	}
+	host, target := rest[:i], rest[i+1:]
+
+	if strings.HasPrefix(host, "~") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand home directory: %w", err)
+		}
+		host = filepath.Join(home, host[1:])
+	}
+	host, err := filepath.Abs(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid --mount '%s': %w", spec, err)
+	}
+	if _, err := os.Stat(host); err != nil {
+		return "", fmt.Errorf("invalid --mount '%s': %w", spec, err)
+	}
+
+	m := host + ":" + path.Clean(target) + mode
+	if err := security.ValidateVolumePath(m); err != nil {
+		return "", err
+	}
+	return m, nil
 }
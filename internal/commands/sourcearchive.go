@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"coderaft/internal/ui"
+)
+
+// sourceArchiveExts maps the file extensions clone treats as a release
+// archive rather than a git repository to their format
+var sourceArchiveExts = []struct {
+	ext    string
+	format string
+}{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// sourceArchiveFormat returns the archive format of an http(s) URL whose path
+// ends in a known archive extension, or "" for anything else
+func sourceArchiveFormat(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ""
+	}
+	p := strings.ToLower(u.Path)
+	for _, e := range sourceArchiveExts {
+		if strings.HasSuffix(p, e.ext) {
+			return e.format
+		}
+	}
+	return ""
+}
+
+// sourceArchiveName derives a project name from an archive URL's file name,
+// e.g. release-1.2.3 from https://example.com/release-1.2.3.tar.gz
+func sourceArchiveName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := u.Path[strings.LastIndex(u.Path, "/")+1:]
+	for _, e := range sourceArchiveExts {
+		if strings.HasSuffix(strings.ToLower(name), e.ext) {
+			return name[:len(name)-len(e.ext)]
+		}
+	}
+	return name
+}
+
+// gitOnlyCloneFlags don't mean anything for a source archive, which has no
+// git repository behind it
+var gitOnlyCloneFlags = []string{
+	"branch", "new-branch", "track", "depth", "filter", "lfs", "sparse",
+	"sparse-from-gitattributes", "single-branch", "submodule",
+	"skip-submodule", "mirror-submodules", "no-submodules",
+	"resolve-default-branch", "expect-branch", "on-branch-mismatch",
+	"hooks-dir", "github-token-from-gh", "archive", "config-only", "path",
+	"quiet-git",
+}
+
+// downloadSourceArchive downloads a release tarball or zip and extracts it
+// into destPath. The format is taken from the file's content rather than the
+// URL, so an HTML error or login page served with a 200 is rejected instead
+// of being extracted. When every entry sits under one top-level directory, as
+// in most release archives, that directory is dropped.
+func downloadSourceArchive(ctx context.Context, archiveURL, destPath string) error {
+	client := &http.Client{Timeout: 30 * time.Minute}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("archive request returned %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp("", "coderaft-source-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download archive: %w", err)
+	}
+	ui.Status("downloaded %s", units.HumanSize(float64(size)))
+
+	format, err := sniffArchiveFormat(tmp)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		return fmt.Errorf("download is not a tar.gz, tar or zip archive (content type %s)", resp.Header.Get("Content-Type"))
+	}
+	return extractSourceArchive(tmp, size, format, destPath)
+}
+
+// sniffArchiveFormat reads the file's magic bytes: gzip, zip, or a ustar
+// header for a plain tar
+func sniffArchiveFormat(f *os.File) (string, error) {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read archive: %w", err)
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar", nil
+	}
+	return "", nil
+}
+
+// extractSourceArchive unpacks a downloaded archive of the given format
+func extractSourceArchive(f *os.File, size int64, format, destPath string) error {
+	if format == "zip" {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return fmt.Errorf("invalid zip archive: %w", err)
+		}
+		var names []string
+		for _, zf := range zr.File {
+			name := zf.Name
+			if zf.Mode().IsDir() && !strings.HasSuffix(name, "/") {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		return extractZip(zr, destPath, archiveStrip(names))
+	}
+
+	open := func() (io.Reader, error) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if format == "tar" {
+			return bufio.NewReader(f), nil
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		return gz, nil
+	}
+
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := hdr.Name
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+
+	if r, err = open(); err != nil {
+		return err
+	}
+	return extractTar(r, destPath, archiveStrip(names))
+}
+
+// archiveStrip returns 1 when every entry is under the same top-level
+// directory, and 0 otherwise. Directory names end in '/'.
+func archiveStrip(names []string) int {
+	root := ""
+	for _, name := range names {
+		name = strings.TrimPrefix(name, "./")
+		top, _, nested := strings.Cut(name, "/")
+		if top == "" {
+			continue
+		}
+		if !nested {
+			// a file at the top level
+			return 0
+		}
+		if root == "" {
+			root = top
+		} else if top != root {
+			return 0
+		}
+	}
+	if root == "" {
+		return 0
+	}
+	return 1
+}
+
+// extractZip unpacks a zip archive into destPath, dropping the first strip
+// path components. Like extractTar it refuses entries that would land
+// outside destPath. Unlike extractTar, which keeps symlinks that stay inside
+// destPath, it skips symlinks altogether.
+func extractZip(zr *zip.Reader, destPath string, strip int) error {
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+
+	for _, zf := range zr.File {
+		parts := strings.Split(strings.TrimPrefix(filepath.ToSlash(zf.Name), "./"), "/")
+		if len(parts) <= strip {
+			continue
+		}
+		rel := filepath.Join(parts[strip:]...)
+		if rel == "" || rel == "." {
+			continue
+		}
+
+		target := filepath.Join(destPath, rel)
+		if !strings.HasPrefix(target, filepath.Clean(destPath)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry escapes workspace: %s", zf.Name)
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := extractZipFile(zf, target, mode.Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func extractZipFile(zf *zip.File, target string, perm os.FileMode) error {
+	if perm == 0 {
+		perm = 0644
+	}
+	in, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
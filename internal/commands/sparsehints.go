@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// sparseHintFiles are the files a repository can list its recommended sparse
+// checkout in, one directory per line, most specific first
+var sparseHintFiles = []string{bootstrapDir + "/sparse-paths", ".sparse-checkout"}
+
+// parseSparseHints reads a sparse hint file: one directory per line relative
+// to the repository root, with blank lines and # comments ignored. Cone mode
+// only takes directories, so patterns and paths leaving the repository are
+// rejected.
+func parseSparseHints(data string) ([]string, error) {
+	var dirs []string
+	seen := map[string]bool{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, "*?[!\\") {
+			return nil, fmt.Errorf("line %d: '%s' is a pattern; list directories only", i+1, line)
+		}
+		dir := path.Clean(strings.Trim(line, "/"))
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			return nil, fmt.Errorf("line %d: '%s' is not a directory inside the repository", i+1, line)
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// sparseCheckoutSet is what 'git sparse-checkout set' gets: the hinted
+// directories plus the --workspace-subdir the island needs. An empty set
+// checks out the top-level files only.
+func sparseCheckoutSet(hints []string, subdir string) []string {
+	set := append([]string{}, hints...)
+	if subdir == "" {
+		return set
+	}
+	subdir = path.Clean(strings.Trim(subdir, "/"))
+	for _, dir := range set {
+		if dir == subdir || strings.HasPrefix(subdir, dir+"/") {
+			return set
+		}
+	}
+	return append(set, subdir)
+}
+
+// monorepoSparseDirs picks the workspace directories findWorkspaceDirectories
+// would find from the repository's top-level directories, for a checkout
+// where they aren't on disk yet
+func monorepoSparseDirs(topDirs []string) []string {
+	present := map[string]bool{}
+	for _, dir := range topDirs {
+		present[dir] = true
+	}
+	var dirs []string
+	for _, dir := range workspaceDirNames {
+		if present[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// readSparseHints returns the directories listed in the first hint file the
+// commit checked out at HEAD has, and the file's name. It reads the files
+// from git, since a sparse clone hasn't checked them out yet.
+func readSparseHints(ctx context.Context, repoPath string) ([]string, string, error) {
+	for _, file := range sparseHintFiles {
+		cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "show", "HEAD:"+file)
+		applyGitEnv(cmd)
+		out, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		dirs, err := parseSparseHints(string(out))
+		if err != nil {
+			return nil, file, fmt.Errorf("invalid %s: %w", file, err)
+		}
+		return dirs, file, nil
+	}
+	return nil, "", nil
+}
+
+// gitTopLevelDirs lists the directories at the root of HEAD's tree
+func gitTopLevelDirs(ctx context.Context, repoPath string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "ls-tree", "-d", "--name-only", "HEAD").Output()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"coderaft/internal/config"
+)
+
+// islandSSHAuthSock is where the host's SSH agent socket is mounted in the
+// island, and what SSH_AUTH_SOCK points at there
+const islandSSHAuthSock = "/run/coderaft/ssh-agent.sock"
+
+// dockerDesktopSSHAuthSock is the socket Docker Desktop for Mac forwards the
+// host's agent to inside its VM. The macOS socket under /private/tmp can't be
+// bind mounted, so this path is mounted instead.
+const dockerDesktopSSHAuthSock = "/run/host-services/ssh-auth.sock"
+
+// resolveSSHAgentSocket returns the host socket --mount-ssh-agent mounts. On
+// macOS that's Docker Desktop's forwarded socket; elsewhere it's
+// $SSH_AUTH_SOCK, which has to exist and be a socket.
+func resolveSSHAgentSocket(goos string, getenv func(string) string, stat func(string) (os.FileInfo, error)) (string, error) {
+	if goos == "darwin" {
+		return dockerDesktopSSHAuthSock, nil
+	}
+	sock := getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", fmt.Errorf("SSH_AUTH_SOCK is not set, so there is no SSH agent to forward (start one with 'eval $(ssh-agent)' and 'ssh-add')")
+	}
+	info, err := stat(sock)
+	if err != nil {
+		return "", fmt.Errorf("SSH agent socket %s is not reachable: %w", sock, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("SSH_AUTH_SOCK %s is not a socket", sock)
+	}
+	return sock, nil
+}
+
+// sshAgentEnabled picks --mount-ssh-agent over settings.mount_ssh_agent
+func sshAgentEnabled(flag, flagSet bool, cfg *config.Config) bool {
+	if flagSet {
+		return flag
+	}
+	return cfg != nil && cfg.Settings != nil && cfg.Settings.MountSSHAgent
+}
+
+// withSSHAgent mounts the host's agent socket into the island and points
+// SSH_AUTH_SOCK at it. Only the socket is shared; the keys stay on the host.
+func withSSHAgent(configMap map[string]interface{}, hostSocket string) map[string]interface{} {
+	if configMap == nil {
+		configMap = map[string]interface{}{}
+	}
+	volumes, _ := configMap["volumes"].([]interface{})
+	configMap["volumes"] = append(volumes, hostSocket+":"+islandSSHAuthSock)
+	env, _ := configMap["environment"].(map[string]interface{})
+	if env == nil {
+		env = map[string]interface{}{}
+	}
+	env["SSH_AUTH_SOCK"] = islandSSHAuthSock
+	configMap["environment"] = env
+	return configMap
+}
+
+// hostSSHAgentSocket resolves the agent socket for the running platform
+func hostSSHAgentSocket() (string, error) {
+	return resolveSSHAgentSocket(runtime.GOOS, os.Getenv, os.Stat)
+}
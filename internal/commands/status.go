@@ -7,13 +7,15 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
 var statusCmd = &cobra.Command{
 	Use:   "status [project]",
 	Short: "Show detailed status for a coderaft project",
-	Long:  "Displays island state, resource usage, uptime, ports, mounts, and other diagnostics for the project's island.",
+	Long:  "Displays island state, resource usage, uptime, ports, mounts, background setup progress, and other diagnostics for the project's island.",
 	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var projectName string
@@ -53,7 +55,7 @@ var statusCmd = &cobra.Command{
 
 		project, ok := cfg.GetProject(projectName)
 		if !ok {
-			return fmt.Errorf("project '%s' not found", projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 		}
 
 		island := project.IslandName
@@ -85,6 +87,11 @@ var statusCmd = &cobra.Command{
 		ui.Detail("island", island)
 		ui.Detail("image", project.BaseImage)
 		ui.Detail("state", status)
+		if status == "running" {
+			if setup := setupStateLabel(dockerClient.GetSetupState(island)); setup != "" {
+				ui.Detail("setup", setup)
+			}
+		}
 		if uptime > 0 {
 			ui.Detail("uptime", humanizeDuration(uptime))
 		} else {
@@ -125,6 +132,22 @@ var statusCmd = &cobra.Command{
 	},
 }
 
+// setupStateLabel describes a background setup for status, or returns "" when
+// the island never ran one
+func setupStateLabel(state docker.SetupState) string {
+	switch state.State {
+	case docker.SetupStateRunning:
+		return "setting up"
+	case docker.SetupStateDone:
+		return "done"
+	case docker.SetupStateFailed:
+		return fmt.Sprintf("failed (exit %d)", state.ExitCode)
+	case docker.SetupStateInterrupted:
+		return "interrupted (island stopped during setup)"
+	}
+	return ""
+}
+
 func humanizeDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	hours := int(d.Hours())
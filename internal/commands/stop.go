@@ -5,6 +5,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
@@ -27,7 +28,7 @@ var stopCmd = &cobra.Command{
 
 		project, exists := cfg.GetProject(projectName)
 		if !exists {
-			return fmt.Errorf("project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
+			return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found. Run 'coderaft init %s' first", projectName, projectName)
 		}
 
 		exists, err = dockerClient.IslandExists(project.IslandName)
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"sort"
+
+	"coderaft/internal/docker"
+)
+
+// systemReconcileActions returns the commands that bring the system packages
+// of an island whose package manager isn't apt, such as an Alpine island's
+// apk, in line with the lock. apt islands are reconciled by
+// buildReconcileActions.
+func systemReconcileActions(islandName string, lockPkgs lockPackages, exclude packageExclusions, minimal bool) []string {
+	sys, current := dockerClient.QuerySystemPackages(islandName)
+	if sys.Manager != "apk" {
+		return nil
+	}
+	var live lockPackages
+	*live.list(sys.Manager) = exclude.filter(sys.Manager, sys.Sep, current)
+	if minimal {
+		live = restrictToLock(lockPkgs, live)
+	}
+	return buildSystemReconcileActions(sys, *lockPkgs.list(sys.Manager), *live.list(sys.Manager))
+}
+
+// buildSystemReconcileActions installs the locked versions of packages that
+// are missing or at another version, and removes packages the lock doesn't
+// list
+func buildSystemReconcileActions(sys docker.SystemPackages, locked, current []string) []string {
+	lockS := parsePackageList(sys.Manager, locked, sys.Sep)
+	curS := parsePackageList(sys.Manager, current, sys.Sep)
+
+	var install []string
+	for name, ver := range lockS {
+		if curVer, ok := curS[name]; !ok || curVer != ver {
+			install = append(install, name+sys.Sep+ver)
+		}
+	}
+	sort.Strings(install)
+	extra := keysNotIn(curS, lockS)
+	sort.Strings(extra)
+	return append(sys.InstallCommands(install), sys.RemoveCommands(extra)...)
+}
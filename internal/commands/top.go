@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"coderaft/internal/parallel"
+	"coderaft/internal/ui"
+)
+
+var (
+	topOnce     bool
+	topSort     string
+	topInterval int
+)
+
+var topSortKeys = []string{"cpu", "mem", "pids", "name"}
+
+// topRow is one island's line in the dashboard
+type topRow struct {
+	Project  string
+	Island   string
+	CPU      string
+	MemUsage string
+	MemPct   string
+	PIDs     string
+	Uptime   time.Duration
+}
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show live resource usage for all running islands",
+	Long: `Show a continuously refreshing table of every running island with its
+CPU, memory, process count, and uptime, labeled by project name. Like
+'docker stats', but limited to coderaft islands.
+
+Stats are collected from all islands concurrently. Rows are sorted by CPU
+usage unless --sort is given. Press Ctrl+C to exit.
+
+Examples:
+  coderaft top
+  coderaft top --sort mem
+  coderaft top --once --sort name`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isTopSortKey(topSort) {
+			return fmt.Errorf("unsupported --sort '%s' (supported: %s)", topSort, strings.Join(topSortKeys, ", "))
+		}
+		if topInterval <= 0 {
+			return fmt.Errorf("--interval must be a positive number of seconds")
+		}
+
+		for {
+			rows, err := collectTopRows()
+			if err != nil {
+				return err
+			}
+			sortTopRows(rows, topSort)
+
+			if topOnce {
+				if len(rows) == 0 {
+					ui.Info("no running coderaft islands found.")
+					return nil
+				}
+				printTopTable(rows)
+				return nil
+			}
+
+			// Clear the screen and redraw from the top-left corner
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("coderaft top - %s (every %ds, sorted by %s)\n\n", time.Now().Format("15:04:05"), topInterval, topSort)
+			if len(rows) == 0 {
+				fmt.Println("no running coderaft islands found.")
+			} else {
+				printTopTable(rows)
+			}
+			time.Sleep(time.Duration(topInterval) * time.Second)
+		}
+	},
+}
+
+func init() {
+	topCmd.Flags().BoolVar(&topOnce, "once", false, "Print a single snapshot and exit")
+	topCmd.Flags().StringVar(&topSort, "sort", "cpu", "Sort rows by cpu, mem, pids, or name")
+	topCmd.Flags().IntVar(&topInterval, "interval", 2, "Seconds between refreshes")
+}
+
+func isTopSortKey(key string) bool {
+	for _, k := range topSortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// collectTopRows gathers stats for every running island in parallel
+func collectTopRows() ([]topRow, error) {
+	islands, err := dockerClient.ListIslands()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list islands: %w", err)
+	}
+
+	// Label islands with the project that owns them where we know it
+	projectByIsland := map[string]string{}
+	if cfg, err := configManager.Load(); err == nil {
+		for name, project := range cfg.GetProjects() {
+			projectByIsland[project.IslandName] = name
+		}
+	}
+
+	var running []string
+	for _, island := range islands {
+		if len(island.Names) > 0 && strings.HasPrefix(island.Status, "Up") {
+			running = append(running, island.Names[0])
+		}
+	}
+
+	rows := make([]topRow, len(running))
+	tasks := make([]parallel.Task, len(running))
+	for i, island := range running {
+		i, island := i, island
+		tasks[i] = func() error {
+			project, ok := projectByIsland[island]
+			if !ok {
+				project = strings.TrimPrefix(island, "coderaft_")
+			}
+			row := topRow{Project: project, Island: island, CPU: "-", MemUsage: "-", MemPct: "-", PIDs: "-"}
+			if stats, err := dockerClient.GetContainerStats(island); err == nil && stats != nil {
+				row.CPU, row.MemUsage, row.MemPct, row.PIDs = stats.CPUPercent, stats.MemUsage, stats.MemPercent, stats.PIDs
+			}
+			row.Uptime, _ = dockerClient.GetUptime(island)
+			rows[i] = row
+			return nil
+		}
+	}
+	parallel.NewWorkerPool(parallel.LoadConfig().MaxWorkers, 30*time.Second).Execute(tasks)
+
+	// Drop islands whose task timed out before filling in its row
+	collected := rows[:0]
+	for _, row := range rows {
+		if row.Island != "" {
+			collected = append(collected, row)
+		}
+	}
+	return collected, nil
+}
+
+// sortTopRows orders rows by the given key, highest usage first; ties and
+// "name" sort by project name
+func sortTopRows(rows []topRow, key string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		var a, b float64
+		switch key {
+		case "cpu":
+			a, b = parsePercent(rows[i].CPU), parsePercent(rows[j].CPU)
+		case "mem":
+			a, b = parsePercent(rows[i].MemPct), parsePercent(rows[j].MemPct)
+		case "pids":
+			a, b = parsePercent(rows[i].PIDs), parsePercent(rows[j].PIDs)
+		}
+		if a != b {
+			return a > b
+		}
+		return rows[i].Project < rows[j].Project
+	})
+}
+
+// parsePercent reads a number like "12.50%" or "7", treating anything
+// unparseable as 0
+func parsePercent(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func printTopTable(rows []topRow) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tISLAND\tCPU\tMEMORY\tMEM %\tPIDS\tUPTIME")
+	for _, r := range rows {
+		uptime := "-"
+		if r.Uptime > 0 {
+			uptime = humanizeDuration(r.Uptime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Project, r.Island, r.CPU, r.MemUsage, r.MemPct, r.PIDs, uptime)
+	}
+	w.Flush()
+}
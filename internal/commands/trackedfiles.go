@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"sort"
+)
+
+// trackedFilePatterns are the paths to checksum when checking a lock: the
+// project's tracked_files, so files newly matching a glob show up, plus every
+// path the lock recorded, so files dropped from the config are still checked
+func trackedFilePatterns(configured []string, locked map[string]string) []string {
+	seen := map[string]bool{}
+	var patterns []string
+	for _, p := range configured {
+		if !seen[p] {
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}
+	for _, p := range sortedKeys(locked) {
+		if !seen[p] {
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// trackedFileChanges lists the tracked files whose checksum differs from the
+// lock as "~ path", that are gone as "- path", and that newly match a
+// tracked pattern as "+ path", sorted by path
+func trackedFileChanges(locked, live map[string]string) []string {
+	var changes []string
+	for path, sum := range locked {
+		liveSum, ok := live[path]
+		switch {
+		case !ok:
+			changes = append(changes, "- "+path)
+		case liveSum != sum:
+			changes = append(changes, "~ "+path)
+		}
+	}
+	for path := range live {
+		if _, ok := locked[path]; !ok {
+			changes = append(changes, "+ "+path)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i][2:] < changes[j][2:] })
+	return changes
+}
+
+// trackedFilesDiff reports tracked files that changed since the lock was
+// written
+func trackedFilesDiff(locked, live map[string]string) []string {
+	if len(locked) == 0 {
+		return nil
+	}
+	changes := trackedFileChanges(locked, live)
+	if len(changes) == 0 {
+		return nil
+	}
+	drifts := []string{"tracked files drifted:"}
+	for _, c := range changes {
+		drifts = append(drifts, "  "+c)
+	}
+	return drifts
+}
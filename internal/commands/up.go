@@ -6,30 +6,132 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
 var (
-	upDotfilesPath string
+	upDotfilesPath   string
+	upDotfilesUpdate bool
+	upProgress       string
+
+	upRecreate               bool
+	upRecreateIfImageChanged bool
+	upAutoPort               bool
+	upPullPolicy             string
+	upEnv                    string
+	upDetachSetup            bool
+	upWaitHealthy            bool
+	upHealthTimeout          time.Duration
+	upSetupWorkers           int
+	upSequentialSetup        bool
+	upNoPrebuilt             bool
+	upOverrides              []string
+	upPostSetupCommand       string
+	upPostSetupRequired      bool
+	upOnConflict             string
 )
 
-var keepRunningUpFlag bool
+var (
+	keepRunningUpFlag bool
+	upNoAutoStop      bool
+	upNoSecrets       bool
+)
 
 var upCmd = &cobra.Command{
 	Use:   "up",
 	Short: "Start a coderaft island from the current folder's coderaft.json",
-	Long:  "Reads coderaft.json in the current directory and boots the island so new teammates can simply run 'coderaft up'.",
-	Args:  cobra.NoArgs,
+	Long: `Reads coderaft.json in the current directory and boots the island so new teammates can simply run 'coderaft up'.
+
+With --detach-setup, a newly created island's setup_commands run in the
+background inside the island and 'up' returns as soon as the island has
+started. 'coderaft status <project>' shows "setting up" until they finish and
+'coderaft logs <project> --setup -f' follows their output. The lock file is
+not written and the island is not auto-stopped while setup is in progress.
+
+With --wait-healthy, 'up' doesn't return until the island's healthcheck
+(health_check in coderaft.json) reports healthy, so scripts can rely on the
+service being ready. It fails if the island has no healthcheck, turns
+unhealthy, or isn't healthy within --health-timeout.
+
+When settings.prebuilt_registry is set, a new island first looks for an
+environment image CI already built for the exact same config, tagged
+<registry>/<project>:<fingerprint>, and pulls it instead of running the setup
+commands locally. Without one it falls back to a local build; --no-prebuilt
+always builds locally.
+
+With --override, a coderaft.json value is changed for this run only, without
+editing the file: the key is dotted (resources.memory, environment.DEBUG,
+health_check.retries) and the value is converted to the field's type, with
+lists given comma separated. Overrides apply on top of any --env overlay and
+are always listed, with the values they replace. They only take effect when
+the island is created, so combine them with --recreate for an existing one.
+
+When settings.auto_stop_on_exit is on (the default), 'up' stops an island it
+finds idle: no published ports and no process besides init. An island that
+started less than two minutes ago is never judged idle. --keep-running skips
+the stop for this run; --no-auto-stop also keeps a new island's restart
+policy from defaulting to "no".
+
+--post-setup-command runs a one-off command in the island's working
+directory once setup has finished, such as seeding a database or a codegen
+step, without adding it to setup_commands. It runs after the lock file is
+written and isn't recorded anywhere. A failure is a warning unless
+--post-setup-required is given.
+
+With inject_secrets in coderaft.json, a new island gets the project's vault
+secrets ('coderaft secrets set') as environment variables. 'up' asks for the
+vault password, or reads it from stdin when that isn't a terminal. Secret
+values are never written to coderaft.lock.json. --no-secrets starts the
+island without them.
+
+When the project's island already mounts another checkout of the project,
+such as the same repository cloned to a second directory, 'up' asks whether
+to reuse it, recreating it with this directory mounted, or to create a new
+island for this directory under a suffixed project name (<name>-2). The
+suffixed project is registered for the directory, so later runs there use it
+without asking. --on-conflict, or settings.island_conflict, makes the choice
+up front: reuse, new or prompt (the default). Without a terminal, prompt
+fails instead.
+
+Examples:
+  coderaft up
+  coderaft up --post-setup-command "make seed"
+  coderaft up --env ci
+  coderaft up --recreate --override resources.memory=8g --override environment.DEBUG=1
+  coderaft up --detach-setup
+  coderaft up --wait-healthy --health-timeout 5m`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := ui.SetProgressMode(upProgress); err != nil {
+			return err
+		}
+		if err := overrideSetupConcurrency(upSetupWorkers, upSequentialSetup); err != nil {
+			return err
+		}
+		if upPostSetupCommand != "" && upDetachSetup {
+			return fmt.Errorf("--post-setup-command cannot be used with --detach-setup, since setup hasn't finished when 'up' returns")
+		} else if upPostSetupRequired && upPostSetupCommand == "" {
+			return fmt.Errorf("--post-setup-required requires --post-setup-command")
+		}
+
 		cwd, err := os.Getwd()
 		if err != nil {
 			return fmt.Errorf("failed to get current directory: %w", err)
 		}
 
+		if upEnv != "" {
+			if err := configManager.SetEnv(upEnv); err != nil {
+				return err
+			}
+		}
+
 		projectConfig, err := configManager.LoadProjectConfig(cwd)
 		if err != nil {
 			return fmt.Errorf("failed to load coderaft.json: %w", err)
@@ -37,8 +139,24 @@ var upCmd = &cobra.Command{
 		if projectConfig == nil {
 			return fmt.Errorf("no coderaft.json found in %s", cwd)
 		}
+		if env := configManager.Env(); env != "" {
+			if _, err := os.Stat(config.OverlayPath(cwd, env)); err == nil {
+				ui.Status("using coderaft.%s.json overlay", env)
+			} else if upEnv != "" {
+				ui.Warning("no coderaft.%s.json in %s, using coderaft.json as is", env, cwd)
+			}
+		}
+
+		if len(upOverrides) > 0 {
+			if err := applyConfigOverrides(projectConfig, upOverrides); err != nil {
+				return err
+			}
+		}
 
 		if err := configManager.ValidateProjectConfig(projectConfig); err != nil {
+			if len(upOverrides) > 0 {
+				return fmt.Errorf("invalid coderaft.json with --override: %w", err)
+			}
 			return fmt.Errorf("invalid coderaft.json: %w", err)
 		}
 
@@ -56,6 +174,35 @@ var upCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("failed to load global config: %w", err)
 		}
+		conflictMode, err := resolveIslandConflictMode(upOnConflict, cfg)
+		if err != nil {
+			return err
+		}
+		if name, ok := suffixedProjectFor(cfg, projectName, cwd); ok {
+			ui.Status("using project '%s', registered for this directory", name)
+			projectName = name
+		}
+
+		// Refresh the shared git hooks clone installed from --hooks-dir
+		if proj, ok := cfg.GetProject(projectName); ok && proj.HooksDir != "" && filepath.Clean(proj.WorkspacePath) == filepath.Clean(cwd) {
+			if hooks, err := installSharedHooks(cwd, proj.HooksDir); err != nil {
+				ui.Warning("failed to reinstall shared git hooks from %s: %v", proj.HooksDir, err)
+			} else {
+				ui.Status("reinstalled %d shared git hook(s) from %s", len(hooks), proj.HooksDir)
+			}
+		}
+
+		pullPolicy := resolvePullPolicy(upPullPolicy, cfg)
+		if err := docker.ValidatePullPolicy(pullPolicy); err != nil {
+			return err
+		}
+		prebuiltRegistry, err := resolvePrebuiltRegistry(cfg)
+		if err != nil {
+			return err
+		}
+		if upNoPrebuilt || pullPolicy == docker.PullNever {
+			prebuiltRegistry = ""
+		}
 
 		IslandName := fmt.Sprintf("coderaft_%s", projectName)
 		baseImage := cfg.GetEffectiveBaseImage(&config.Project{Name: projectName, BaseImage: projectConfig.BaseImage}, projectConfig)
@@ -64,6 +211,10 @@ var upCmd = &cobra.Command{
 		if projectConfig.WorkingDir != "" {
 			workspaceIsland = projectConfig.WorkingDir
 		}
+		workspaceHost, err := workspaceHostPath(cwd, projectConfig.WorkspaceSubdir)
+		if err != nil {
+			return err
+		}
 
 		exists, err := dockerClient.IslandExists(IslandName)
 		if err != nil {
@@ -71,6 +222,44 @@ var upCmd = &cobra.Command{
 		}
 
 		if exists {
+			if otherDir, err := islandWorkspaceSource(IslandName, workspaceIsland); err != nil {
+				ui.Warning("failed to check which directory island '%s' serves: %v", IslandName, err)
+			} else if otherDir != "" && !sameDirectory(otherDir, workspaceHost) {
+				if projectName, IslandName, err = resolveIslandConflict(cfg, conflictMode, projectName, IslandName, otherDir, cwd, baseImage); err != nil {
+					return err
+				}
+				exists = false
+			}
+		}
+
+		if exists && (upRecreate || upRecreateIfImageChanged) {
+			recreate := upRecreate
+			if !recreate {
+				changed, locked, pulled, err := baseImageDigestChanged(cwd, baseImage)
+				if err != nil {
+					ui.Warning("could not check base image digest: %v", err)
+				} else if changed {
+					ui.Info("base image digest changed, recreating island")
+					ui.Detail("lock", locked)
+					ui.Detail("pulled", pulled)
+					recreate = true
+					_ = docker.NewImageCacheWithSDK(dockerClient.ImageExists).CleanupImageCache(projectName)
+				}
+			}
+			if recreate {
+				ui.Status("removing island '%s' for recreation...", IslandName)
+				if err := dockerClient.RemoveIsland(IslandName); err != nil {
+					return fmt.Errorf("failed to remove island for recreation: %w", err)
+				}
+				exists = false
+			}
+		}
+
+		if exists {
+			if len(upOverrides) > 0 {
+				ui.Warning("island '%s' already exists; --override only applies when the island is created", IslandName)
+				ui.Info("hint: add --recreate to rebuild it with the overrides")
+			}
 			status, err := dockerClient.GetIslandStatus(IslandName)
 			if err != nil {
 				return fmt.Errorf("failed to get island status: %w", err)
@@ -86,27 +275,60 @@ var upCmd = &cobra.Command{
 					return fmt.Errorf("failed to setup coderaft in existing island: %w", err)
 				}
 			}
+			if upWaitHealthy {
+				if err := waitForHealthy(dockerClient, IslandName, upHealthTimeout, time.Second); err != nil {
+					return err
+				}
+			}
+			settingUp := dockerClient.GetSetupState(IslandName).State == docker.SetupStateRunning
+			if !settingUp {
+				ui.Event("ready", map[string]interface{}{
+					"project":   projectName,
+					"island":    IslandName,
+					"workspace": cwd,
+					"image":     baseImage,
+				})
+			}
 			ui.Success("island is up")
 			ui.Detail("workspace", cwd)
 			ui.Detail("island", IslandName)
 			ui.Detail("image", baseImage)
+			if settingUp {
+				ui.Warning("setup is still running in the background")
+				ui.Info("hint: follow it with 'coderaft logs %s --setup -f'", projectName)
+				if upPostSetupCommand != "" {
+					ui.Warning("skipped --post-setup-command; run it with 'coderaft run %s' once setup is done", projectName)
+				}
+				return nil
+			}
 			ui.Info("hint: run 'coderaft shell %s' to enter the island.", projectName)
 
-			if cfg.Settings != nil && cfg.Settings.AutoStopOnExit && !keepRunningUpFlag {
-				if idle, err := dockerClient.IsContainerIdle(IslandName); err == nil && idle {
-					ui.Status("stopping island '%s' (auto-stop: idle)...", IslandName)
-					if err := dockerClient.StopIsland(IslandName); err != nil {
-						ui.Warning("failed to stop island: %v", err)
-					}
+			if upPostSetupCommand != "" {
+				if err := runPostSetupCommand(IslandName, workspaceIsland, upPostSetupCommand, upPostSetupRequired); err != nil {
+					return errdefs.Wrap(errdefs.ErrSetupFailed, err)
 				}
 			}
+
+			if upAutoStops(cfg) {
+				autoStopIdleIsland(IslandName)
+			}
 			return nil
 		}
 
+		var secretEnv map[string]string
+		if projectConfig.InjectSecrets {
+			if upNoSecrets {
+				ui.Status("not injecting vault secrets (--no-secrets)")
+			} else if secretEnv, err = loadSecretEnv(projectName); err != nil {
+				return err
+			}
+		}
+
 		ui.Status("setting up island '%s' with image '%s'...", IslandName, baseImage)
-		if err := dockerClient.PullImage(baseImage); err != nil {
+		if err := dockerClient.PullImageWithPolicy(baseImage, pullPolicy); err != nil {
 			return fmt.Errorf("failed to pull base image: %w", err)
 		}
+		ui.Event("image_pulled", map[string]interface{}{"image": baseImage})
 
 		var configMap map[string]interface{}
 		if projectConfig != nil {
@@ -119,7 +341,7 @@ var upCmd = &cobra.Command{
 			}
 		}
 
-		if cfg.Settings != nil && cfg.Settings.AutoStopOnExit {
+		if cfg.Settings != nil && cfg.Settings.AutoStopOnExit && !upNoAutoStop {
 			if configMap == nil {
 				configMap = map[string]interface{}{}
 			}
@@ -128,12 +350,20 @@ var upCmd = &cobra.Command{
 			}
 		}
 
+		dotfilesPath, dotfilesFromRepo, err := resolveDotfilesSource(upDotfilesPath, cfg, upDotfilesUpdate)
+		if err != nil {
+			return fmt.Errorf("failed to prepare dotfiles: %w", err)
+		}
+
 		var dotfiles []string
+		if dotfilesFromRepo {
+			dotfiles = append(dotfiles, dotfilesPath)
+		}
 		if len(projectConfig.Dotfiles) > 0 {
 			dotfiles = append(dotfiles, projectConfig.Dotfiles...)
 		}
-		if upDotfilesPath != "" {
-			dotfiles = append(dotfiles, upDotfilesPath)
+		if dotfilesPath != "" && !dotfilesFromRepo {
+			dotfiles = append(dotfiles, dotfilesPath)
 		}
 		if len(dotfiles) > 0 {
 			arr := make([]interface{}, 0, len(dotfiles))
@@ -146,11 +376,81 @@ var upCmd = &cobra.Command{
 			configMap["dotfiles"] = arr
 		}
 
+		if len(projectConfig.Ports) > 0 {
+			ports, remaps, err := resolvePortConflicts(projectConfig.Ports, upAutoPort, nil, islandPortOwner)
+			if err != nil {
+				ui.Info("hint: free the port, change it in coderaft.json, or use --auto-port to pick a free one.")
+				return err
+			}
+			for _, r := range remaps {
+				ui.Warning("port %s is in use by %s, mapped to %s instead", r.OldHost, r.Owner, r.NewHost)
+			}
+			if len(remaps) > 0 {
+				arr := make([]interface{}, 0, len(ports))
+				for _, p := range ports {
+					arr = append(arr, p)
+				}
+				if configMap == nil {
+					configMap = map[string]interface{}{}
+				}
+				configMap["ports"] = arr
+			}
+		}
+
+		configMap = withSecretEnv(configMap, secretEnv)
+
+		// With --detach-setup the island starts without setup_commands, which
+		// then run in the background instead of in the cached image build
+		setupConfig := projectConfig
+		if upDetachSetup && len(projectConfig.SetupCommands) > 0 {
+			stripped := *projectConfig
+			stripped.SetupCommands = nil
+			setupConfig = &stripped
+		}
+
 		optimizedSetup := NewOptimizedSetup(dockerClient, configManager)
-		if err := optimizedSetup.FastUp(projectConfig, projectName, IslandName, baseImage, cwd, workspaceIsland, configMap); err != nil {
+		optimizedSetup.prebuiltRegistry = prebuiltRegistry
+		if err := optimizedSetup.FastUp(setupConfig, projectName, IslandName, baseImage, cwd, workspaceHost, workspaceIsland, configMap); err != nil {
 			return fmt.Errorf("failed to start island: %w", err)
 		}
+		if dotfilesFromRepo {
+			runDotfilesInstall(IslandName, dotfilesPath)
+		}
 
+		if setupConfig != projectConfig {
+			if err := dockerClient.StartBackgroundSetup(IslandName, projectConfig.SetupCommands); err != nil {
+				return errdefs.Errorf(errdefs.ErrSetupFailed, "failed to start background setup: %w", err)
+			}
+			if upWaitHealthy {
+				if err := waitForHealthy(dockerClient, IslandName, upHealthTimeout, time.Second); err != nil {
+					return err
+				}
+			}
+			ui.Event("setup_started", map[string]interface{}{
+				"project":  projectName,
+				"island":   IslandName,
+				"commands": len(projectConfig.SetupCommands),
+			})
+			ui.Success("island is up, setup is running in the background")
+			ui.Detail("workspace", cwd)
+			ui.Detail("island", IslandName)
+			ui.Detail("image", baseImage)
+			ui.Info("hint: follow setup with 'coderaft logs %s --setup -f'", projectName)
+			ui.Info("hint: run 'coderaft lock %s' once 'coderaft status %s' shows setup done", projectName, projectName)
+			return nil
+		}
+
+		if upWaitHealthy {
+			if err := waitForHealthy(dockerClient, IslandName, upHealthTimeout, time.Second); err != nil {
+				return err
+			}
+		}
+		ui.Event("ready", map[string]interface{}{
+			"project":   projectName,
+			"island":    IslandName,
+			"workspace": cwd,
+			"image":     baseImage,
+		})
 		ui.Success("island is up")
 		ui.Detail("workspace", cwd)
 		ui.Detail("island", IslandName)
@@ -170,35 +470,95 @@ var upCmd = &cobra.Command{
 
 		verifyDigestAgainstLock(cwd, baseImage)
 
-		if cfg.Settings != nil && cfg.Settings.AutoStopOnExit && !keepRunningUpFlag {
-			if idle, err := dockerClient.IsContainerIdle(IslandName); err == nil && idle {
-				ui.Status("stopping island '%s' (auto-stop: idle)...", IslandName)
-				if err := dockerClient.StopIsland(IslandName); err != nil {
-					ui.Warning("failed to stop island: %v", err)
-				}
+		if upPostSetupCommand != "" {
+			if err := runPostSetupCommand(IslandName, workspaceIsland, upPostSetupCommand, upPostSetupRequired); err != nil {
+				return errdefs.Wrap(errdefs.ErrSetupFailed, err)
 			}
 		}
+
+		if upAutoStops(cfg) {
+			autoStopIdleIsland(IslandName)
+		}
 		return nil
 	},
 }
 
 func init() {
-	upCmd.Flags().StringVar(&upDotfilesPath, "dotfiles", "", "Path to local dotfiles directory to mount into the island")
+	upCmd.Flags().StringVar(&upDotfilesPath, "dotfiles", "", "Local dotfiles directory or dotfiles repository (e.g. gh:user/dotfiles) to mount into the island")
+	upCmd.Flags().BoolVar(&upDotfilesUpdate, "update-dotfiles", false, "Pull the latest dotfiles repository before mounting it")
+	upCmd.Flags().StringVar(&upOnConflict, "on-conflict", "", "When the project's island serves another directory: reuse, new or prompt (default: settings.island_conflict, else prompt)")
 	upCmd.Flags().BoolVar(&keepRunningUpFlag, "keep-running", false, "Keep the island running after 'up' finishes")
+	upCmd.Flags().BoolVar(&upNoAutoStop, "no-auto-stop", false, "Turn auto-stop off for this island: don't stop it when idle and don't default its restart policy to 'no'")
+	upCmd.Flags().BoolVar(&upNoSecrets, "no-secrets", false, "Don't inject vault secrets into a new island, even with inject_secrets in coderaft.json")
+	upCmd.Flags().BoolVar(&upRecreate, "recreate", false, "Remove and recreate the island from the current config, keeping the workspace")
+	upCmd.Flags().BoolVar(&upRecreateIfImageChanged, "recreate-if-image-changed", false, "Recreate the island if the base image digest differs from coderaft.lock.json")
+	upCmd.Flags().BoolVar(&upAutoPort, "auto-port", false, "Remap host ports that are already in use to free ports")
+	upCmd.Flags().StringVar(&upPullPolicy, "pull", "", "Base image pull policy: always, missing or never (default: settings.pull_policy, else missing)")
+	upCmd.Flags().BoolVar(&upDetachSetup, "detach-setup", false, "Return once the island has started and run setup_commands in the background")
+	upCmd.Flags().BoolVar(&upWaitHealthy, "wait-healthy", false, "Wait until the island's healthcheck reports healthy before returning")
+	upCmd.Flags().DurationVar(&upHealthTimeout, "health-timeout", 2*time.Minute, "With --wait-healthy, how long to wait for the island to become healthy")
+	upCmd.Flags().IntVar(&upSetupWorkers, "setup-workers", 0, "Number of setup commands to run concurrently (overrides CODERAFT_SETUP_WORKERS; 0 uses the defaults)")
+	upCmd.Flags().BoolVar(&upSequentialSetup, "no-parallel-setup", false, "Run setup commands one at a time, e.g. to debug a failing setup")
+	upCmd.Flags().BoolVar(&upNoPrebuilt, "no-prebuilt", false, "Build the environment image locally instead of pulling a prebuilt one from settings.prebuilt_registry")
+	upCmd.Flags().StringArrayVar(&upOverrides, "override", nil, "Override a coderaft.json value for this run only, as a dotted key (e.g. resources.memory=8g, environment.DEBUG=1); repeatable")
+	upCmd.Flags().StringVar(&upEnv, "env", "", "Merge the coderaft.<env>.json overlay over coderaft.json (default: $CODERAFT_ENV)")
+	upCmd.Flags().StringVar(&upPostSetupCommand, "post-setup-command", "", "Run this command once in the island after setup, e.g. \"make seed\"; it isn't saved to coderaft.json, the history or the lock")
+	upCmd.Flags().BoolVar(&upPostSetupRequired, "post-setup-required", false, "Fail 'up' when the --post-setup-command fails instead of only warning")
+	upCmd.Flags().StringVar(&upProgress, "progress", ui.ProgressPretty, "Progress output format: pretty or json (one JSON event per line on stdout)")
 }
 
-func verifyDigestAgainstLock(workspacePath, baseImage string) {
-	lockPath := filepath.Join(workspacePath, "coderaft.lock.json")
-	data, err := os.ReadFile(lockPath)
+// upAutoStops reports whether 'up' should stop the island if it's idle
+func upAutoStops(cfg *config.Config) bool {
+	return cfg.Settings != nil && cfg.Settings.AutoStopOnExit && !keepRunningUpFlag && !upNoAutoStop
+}
+
+// resolvePullPolicy picks --pull over settings.pull_policy, defaulting to
+// pulling only missing images
+func resolvePullPolicy(flag string, cfg *config.Config) string {
+	if flag != "" {
+		return flag
+	}
+	if cfg != nil && cfg.Settings != nil && cfg.Settings.PullPolicy != "" {
+		return cfg.Settings.PullPolicy
+	}
+	return docker.PullMissing
+}
+
+func lockedBaseDigest(workspacePath string) string {
+	data, err := os.ReadFile(filepath.Join(workspacePath, "coderaft.lock.json"))
 	if err != nil {
-		return
+		return ""
 	}
 	var lf struct {
 		BaseImage struct {
 			Digest string `json:"digest"`
 		} `json:"base_image"`
 	}
-	if err := json.Unmarshal(data, &lf); err != nil || lf.BaseImage.Digest == "" {
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return ""
+	}
+	return lf.BaseImage.Digest
+}
+
+func baseImageDigestChanged(workspacePath, baseImage string) (changed bool, locked, pulled string, err error) {
+	locked = lockedBaseDigest(workspacePath)
+	if locked == "" {
+		return false, "", "", nil
+	}
+	ui.Status("pulling '%s' to check for a new digest...", baseImage)
+	if err := dockerClient.PullImage(baseImage); err != nil {
+		return false, locked, "", fmt.Errorf("failed to pull base image: %w", err)
+	}
+	pulled, _, _ = dockerClient.GetImageDigestInfo(baseImage)
+	if pulled == "" {
+		return false, locked, "", nil
+	}
+	return pulled != locked, locked, pulled, nil
+}
+
+func verifyDigestAgainstLock(workspacePath, baseImage string) {
+	locked := lockedBaseDigest(workspacePath)
+	if locked == "" {
 		return
 	}
 
@@ -206,9 +566,9 @@ func verifyDigestAgainstLock(workspacePath, baseImage string) {
 	if liveDigest == "" {
 		return
 	}
-	if liveDigest != lf.BaseImage.Digest {
+	if liveDigest != locked {
 		ui.Warning("base image digest mismatch!")
-		ui.Detail("lock", lf.BaseImage.Digest)
+		ui.Detail("lock", locked)
 		ui.Detail("pulled", liveDigest)
 		ui.Info("hint: the base image '%s' has been updated since the lock file was created.", baseImage)
 		ui.Info("hint: run 'coderaft lock <project>' to update, or pin the digest in coderaft.json.")
@@ -229,7 +589,7 @@ func applyLockInline(projectName, lockPath string) error {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found", proj.IslandName)
+		return errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found", proj.IslandName)
 	}
 	status, err := dockerClient.GetIslandStatus(proj.IslandName)
 	if err != nil {
@@ -241,12 +601,20 @@ func applyLockInline(projectName, lockPath string) error {
 		}
 	}
 
+	lock, err := lockIslandForApply(proj.IslandName, "coderaft up "+projectName, 0)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	invalidateVerifyCache(proj.IslandName)
+
 	data, err := os.ReadFile(lockPath)
 	if err != nil {
 		return err
 	}
 	var lf struct {
-		Packages   struct{ Apt, Pip, Npm, Yarn, Pnpm []string } `json:"packages"`
+		Minimal    bool                                              `json:"minimal"`
+		Packages   struct{ Apt, Apk, Pip, Npm, Yarn, Pnpm []string } `json:"packages"`
 		Registries struct {
 			PipIndexURL   string   `json:"pip_index_url"`
 			PipExtraIndex []string `json:"pip_extra_index_urls"`
@@ -255,9 +623,11 @@ func applyLockInline(projectName, lockPath string) error {
 			PnpmRegistry  string   `json:"pnpm_registry"`
 		} `json:"registries"`
 		AptSources struct {
-			SourcesLists  []string `json:"sources_lists"`
-			PinnedRelease string   `json:"pinned_release"`
+			SourcesLists  []string          `json:"sources_lists"`
+			PinnedRelease string            `json:"pinned_release"`
+			Preferences   map[string]string `json:"preferences"`
 		} `json:"apt_sources"`
+		System *lockSystem `json:"system"`
 	}
 	if err := json.Unmarshal(data, &lf); err != nil {
 		return err
@@ -276,6 +646,11 @@ func applyLockInline(projectName, lockPath string) error {
 	if lf.AptSources.PinnedRelease != "" {
 		cmds = append(cmds, fmt.Sprintf("echo 'APT::Default-Release \"%s\";' > /etc/apt/apt.conf.d/99defaultrelease", escapeBash(lf.AptSources.PinnedRelease)))
 	}
+	prefCmds, err := aptPreferencesCommands(lf.AptSources.Preferences)
+	if err != nil {
+		return err
+	}
+	cmds = append(cmds, prefCmds...)
 	if lf.Registries.PipIndexURL != "" || len(lf.Registries.PipExtraIndex) > 0 {
 		var b strings.Builder
 		b.WriteString("cat > /etc/pip.conf <<'EOF'\n[global]\n")
@@ -304,13 +679,56 @@ func applyLockInline(projectName, lockPath string) error {
 		return err
 	}
 
+	exclude := newPackageExclusions(cfg.Settings)
 	curApt, curPip, curNpm, curYarn, curPnpm := dockerClient.QueryPackagesParallel(proj.IslandName)
-	actions := buildReconcileActions(lockPackages{Apt: lf.Packages.Apt, Pip: lf.Packages.Pip, Npm: lf.Packages.Npm, Yarn: lf.Packages.Yarn, Pnpm: lf.Packages.Pnpm}, curApt, curPip, curNpm, curYarn, curPnpm)
+	cur := exclude.filterPackages(lockPackages{Apt: curApt, Pip: curPip, Npm: curNpm, Yarn: curYarn, Pnpm: curPnpm})
+	lockPkgs := exclude.filterPackages(lockPackages{Apt: lf.Packages.Apt, Apk: lf.Packages.Apk, Pip: lf.Packages.Pip, Npm: lf.Packages.Npm, Yarn: lf.Packages.Yarn, Pnpm: lf.Packages.Pnpm})
+	if lf.Minimal {
+		cur = restrictToLock(lockPkgs, cur)
+	}
+	actions, downgrades := buildReconcileActions(lockPkgs, cur.Apt, cur.Pip, cur.Npm, cur.Yarn, cur.Pnpm, newDowngradeGuard(cfg.Settings, false))
+	actions = append(systemReconcileActions(proj.IslandName, lockPkgs, exclude, lf.Minimal), actions...)
+	// There's no one to confirm a downgrade here, so every one is held back
+	if len(downgrades) > 0 {
+		ui.Warning("kept %d package(s) the lock would downgrade at their installed version:", len(downgrades))
+		for _, d := range downgrades {
+			ui.Item(d.String())
+		}
+		ui.Info("hint: run 'coderaft apply %s --allow-downgrade' to downgrade them.", projectName)
+	}
 	if len(actions) > 0 {
 		if err := dockerClient.ExecuteSetupCommandsWithOutput(proj.IslandName, actions, true); err != nil {
 			return err
 		}
 	}
+	systemCmds, err := systemSettingsCommands(lf.System)
+	if err != nil {
+		return err
+	}
+	if err := dockerClient.ExecuteSetupCommandsWithOutput(proj.IslandName, systemCmds, false); err != nil {
+		return err
+	}
 	ui.Success("applied coderaft.lock.json")
 	return nil
 }
+
+// applyConfigOverrides applies up's --override key=value pairs to the loaded
+// config in order and lists what each one changed
+func applyConfigOverrides(projectConfig *config.ProjectConfig, overrides []string) error {
+	ui.Info("applying %d config override(s) for this run:", len(overrides))
+	for _, arg := range overrides {
+		key, value, err := config.ParseOverride(arg)
+		if err != nil {
+			return err
+		}
+		previous, err := config.ApplyOverride(projectConfig, key, value)
+		if err != nil {
+			return fmt.Errorf("invalid --override: %w", err)
+		}
+		if previous == "" {
+			previous = "(unset)"
+		}
+		ui.Item("%s: %s -> %s", key, previous, value)
+	}
+	return nil
+}
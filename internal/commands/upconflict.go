@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// What up does when the project's island already mounts another checkout
+// of the project, as set by --on-conflict or settings.island_conflict
+const (
+	islandConflictPrompt = "prompt"
+	islandConflictReuse  = "reuse"
+	islandConflictNew    = "new"
+)
+
+// resolveIslandConflictMode picks --on-conflict over settings.island_conflict,
+// defaulting to asking
+func resolveIslandConflictMode(flag string, cfg *config.Config) (string, error) {
+	mode := flag
+	if mode == "" && cfg != nil && cfg.Settings != nil {
+		mode = cfg.Settings.IslandConflict
+	}
+	switch mode {
+	case "":
+		return islandConflictPrompt, nil
+	case islandConflictPrompt, islandConflictReuse, islandConflictNew:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid island conflict mode '%s' (expected reuse, new or prompt)", mode)
+}
+
+// parseMountSpec splits a mount as GetMounts describes it,
+// "bind <source> -> <destination> (rw=true)". Paths may contain spaces.
+func parseMountSpec(m string) (source, destination string, ok bool) {
+	_, rest, found := strings.Cut(m, " ")
+	if !found {
+		return "", "", false
+	}
+	source, rest, found = strings.Cut(rest, " -> ")
+	if !found {
+		return "", "", false
+	}
+	if i := strings.LastIndex(rest, " (rw="); i >= 0 {
+		rest = rest[:i]
+	}
+	return source, rest, source != "" && rest != ""
+}
+
+// islandWorkspaceSource returns the host directory mounted at the island's
+// working directory, or "" when nothing is
+func islandWorkspaceSource(islandName, workspaceIsland string) (string, error) {
+	mounts, err := dockerClient.GetMounts(islandName)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if source, destination, ok := parseMountSpec(m); ok && destination == workspaceIsland {
+			return source, nil
+		}
+	}
+	return "", nil
+}
+
+// suffixedProjectName returns name-2, name-3, ... whichever comes first that
+// isn't taken, or the error taken fails with
+func suffixedProjectName(name string, taken func(string) (bool, error)) (string, error) {
+	for n := 2; ; n++ {
+		candidate := name + "-" + strconv.Itoa(n)
+		isTaken, err := taken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !isTaken {
+			return candidate, nil
+		}
+	}
+}
+
+// sameDirectory reports whether a and b are the same directory, however
+// they are spelled or whichever symlinks lead there. A path that can't be
+// read is compared by its cleaned spelling.
+func sameDirectory(a, b string) bool {
+	ai, aErr := os.Stat(a)
+	bi, bErr := os.Stat(b)
+	if aErr == nil && bErr == nil {
+		return os.SameFile(ai, bi)
+	}
+	resolve := func(p string) string {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			return r
+		}
+		return filepath.Clean(p)
+	}
+	return resolve(a) == resolve(b)
+}
+
+// suffixedProjectFor returns the name-N project registered for workspace,
+// left by an earlier 'up --on-conflict new' there, so that checkout keeps
+// its own island
+func suffixedProjectFor(cfg *config.Config, name, workspace string) (string, bool) {
+	if cfg == nil {
+		return "", false
+	}
+	for projectName, proj := range cfg.Projects {
+		n, found := strings.CutPrefix(projectName, name+"-")
+		if !found || !sameDirectory(proj.WorkspacePath, workspace) {
+			continue
+		}
+		if i, err := strconv.Atoi(n); err == nil && i >= 2 {
+			return projectName, true
+		}
+	}
+	return "", false
+}
+
+// chooseIslandConflict turns prompt into reuse or new by asking. Without a
+// terminal to ask on it fails, naming the flag that decides.
+func chooseIslandConflict(mode, islandName, otherDir string, interactive bool, reader *bufio.Reader) (string, error) {
+	if mode != islandConflictPrompt {
+		return mode, nil
+	}
+	if !interactive {
+		return "", fmt.Errorf("island '%s' already serves %s; pass --on-conflict reuse to move it to this directory or --on-conflict new to create another island", islandName, otherDir)
+	}
+	ui.Prompt("[r]euse it for this directory, create a [n]ew island, or [a]bort? (r/n/A): ")
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read choice: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(response)) {
+	case "r", "reuse":
+		return islandConflictReuse, nil
+	case "n", "new":
+		return islandConflictNew, nil
+	}
+	return "", fmt.Errorf("cancelled; island '%s' still serves %s", islandName, otherDir)
+}
+
+// resolveIslandConflict handles up finding the project's island mounting
+// another checkout. Reusing it removes the island so it is created again
+// with this directory mounted; a new island gets a suffixed project name,
+// registered for this directory. Either way no island exists for the
+// returned project and island name yet.
+func resolveIslandConflict(cfg *config.Config, mode, projectName, islandName, otherDir, cwd, baseImage string) (string, string, error) {
+	ui.Warning("island '%s' already serves %s, another checkout of project '%s'", islandName, otherDir, projectName)
+	choice, err := chooseIslandConflict(mode, islandName, otherDir, term.IsTerminal(int(os.Stdin.Fd())), bufio.NewReader(os.Stdin))
+	if err != nil {
+		return "", "", err
+	}
+
+	if choice == islandConflictReuse {
+		ui.Status("removing island '%s' to mount %s instead...", islandName, cwd)
+		if err := dockerClient.RemoveIsland(islandName); err != nil {
+			return "", "", fmt.Errorf("failed to remove island: %w", err)
+		}
+		if proj, ok := cfg.GetProject(projectName); ok {
+			proj.WorkspacePath = cwd
+			if err := configManager.Save(cfg); err != nil {
+				return "", "", fmt.Errorf("failed to save configuration: %w", err)
+			}
+		}
+		return projectName, islandName, nil
+	}
+
+	newName, err := suffixedProjectName(projectName, func(name string) (bool, error) {
+		if _, ok := cfg.GetProject(name); ok {
+			return true, nil
+		}
+		exists, err := dockerClient.IslandExists("coderaft_" + name)
+		if err != nil {
+			return false, fmt.Errorf("failed to check island existence: %w", err)
+		}
+		return exists, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	newIsland := "coderaft_" + newName
+	cfg.AddProject(&config.Project{
+		Name:          newName,
+		IslandName:    newIsland,
+		BaseImage:     baseImage,
+		WorkspacePath: cwd,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	})
+	if err := configManager.Save(cfg); err != nil {
+		return "", "", fmt.Errorf("failed to save configuration: %w", err)
+	}
+	ui.Info("creating island '%s' as project '%s' for this directory", newIsland, newName)
+	return newName, newIsland, nil
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/ui"
 )
 
@@ -44,7 +45,7 @@ func updateSingleProject(projectName string) error {
 
 	project, exists := cfg.GetProject(projectName)
 	if !exists {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
 
 	projectConfig, _ := configManager.LoadProjectConfig(project.WorkspacePath)
@@ -72,6 +73,12 @@ func updateSingleProject(projectName string) error {
 	if projectConfig != nil && projectConfig.WorkingDir != "" {
 		workspaceIsland = projectConfig.WorkingDir
 	}
+	workspaceHost := project.WorkspacePath
+	if projectConfig != nil {
+		if workspaceHost, err = workspaceHostPath(project.WorkspacePath, projectConfig.WorkspaceSubdir); err != nil {
+			return err
+		}
+	}
 
 	var configMap map[string]interface{}
 	if projectConfig != nil {
@@ -81,7 +88,7 @@ func updateSingleProject(projectName string) error {
 	}
 
 	ui.Status("recreating island '%s' with image '%s'...", project.IslandName, baseImage)
-	islandID, err := dockerClient.CreateIslandWithConfig(project.IslandName, baseImage, project.WorkspacePath, workspaceIsland, configMap)
+	islandID, err := dockerClient.CreateIslandWithConfig(project.IslandName, baseImage, workspaceHost, workspaceIsland, configMap)
 	if err != nil {
 		return fmt.Errorf("failed to create island: %w", err)
 	}
@@ -98,6 +105,7 @@ func updateSingleProject(projectName string) error {
 		"apt update -y",
 		"DEBIAN_FRONTEND=noninteractive apt full-upgrade -y",
 	}
+	invalidateVerifyCache(project.IslandName)
 	if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, updateCommands, false); err != nil {
 		ui.Warning("failed to update system packages: %v", err)
 	}
@@ -130,7 +138,7 @@ func updateSingleProject(projectName string) error {
 	}
 
 	if projectConfig != nil && len(projectConfig.SetupCommands) > 0 {
-		if err := dockerClient.ExecuteSetupCommandsWithOutput(project.IslandName, projectConfig.SetupCommands, false); err != nil {
+		if err := runProjectSetupCommands(dockerClient, project.IslandName, projectConfig); err != nil {
 			ui.Warning("failed to execute setup commands: %v", err)
 		}
 	}
@@ -12,10 +12,31 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"coderaft/internal/config"
+	"coderaft/internal/docker"
+	"coderaft/internal/errdefs"
+	"coderaft/internal/security"
 	"coderaft/internal/ui"
 )
 
-var verifyTimeout int
+var (
+	verifyTimeout  int
+	verifyJSON     bool
+	verifyExitZero bool
+	verifyBaseline string
+	verifyNoCache  bool
+)
+
+// verifyReport is what --json prints
+type verifyReport struct {
+	Project  string   `json:"project,omitempty"`
+	Baseline string   `json:"baseline,omitempty"`
+	Lock     string   `json:"lock,omitempty"`
+	Matches  bool     `json:"matches"`
+	Drifts   []string `json:"drifts"`
+	Checksum string   `json:"checksum,omitempty"`
+	Cached   bool     `json:"cached,omitempty"`
+}
 
 var verifyCmd = &cobra.Command{
 	Use:   "verify <project>",
@@ -24,247 +45,484 @@ var verifyCmd = &cobra.Command{
 
 Checks base image digest, container configuration (ports, volumes, environment,
 capabilities, resources, working directory, user, restart policy, network),
-every package set (apt, pip, npm, yarn, pnpm), registry URLs, and apt sources.
+every package set (apt, pip, npm, yarn, pnpm, go, cargo), registry URLs, and
+apt sources.
 For each drifted package manager the output shows exactly which packages were
 added, removed, or changed version.
 
 If the lock file contains a checksum (v2+), it is recomputed from the live
 island state and compared first for a fast-path pass/fail.
 
-Exit code 0 means the island matches. Non-zero means drift was detected.`,
+Exit code 0 means the island matches. Non-zero means drift was detected.
+With --exit-zero, drift is still reported but the exit code stays 0; errors
+such as a missing island or lock file still fail. Combine it with --json and
+read the "matches" field to tell the two apart.
+
+With --baseline, the argument is a second lock file instead of a project and
+the two files are compared offline, with no island or Docker needed. The
+baseline takes the place of the lock and the other file the place of the
+live island, so drifts read "lock=<baseline> current=<file>". Use it to
+review an environment change in a PR before building anything.
+
+The result is cached for five minutes per island. A repeated verify reuses it
+as long as the island hasn't been restarted or recreated, its packages and
+package manager config haven't changed, and the lock file is the same; apply,
+install, update and maintenance drop it right away. Use --no-cache to check the
+island again regardless. Locks that record the workspace state aren't cached.
+
+Examples:
+  coderaft verify myproject
+  coderaft verify myproject --json --exit-zero
+  coderaft verify myproject --no-cache
+  coderaft verify --baseline main.lock.json coderaft.lock.json`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		projectName := args[0]
+		if verifyJSON {
+			// keep stdout for the report
+			if err := ui.SetProgressMode(ui.ProgressJSON); err != nil {
+				return err
+			}
+		}
+
+		var report *verifyReport
+		if verifyBaseline != "" {
+			r, err := runVerifyBaseline(verifyBaseline, args[0])
+			if err != nil {
+				return err
+			}
+			report = r
+		} else {
+			projectName := args[0]
+
+			timeout := time.Duration(verifyTimeout) * time.Second
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
 
-		timeout := time.Duration(verifyTimeout) * time.Second
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
+			type verifyResult struct {
+				report *verifyReport
+				err    error
+			}
+			resultCh := make(chan verifyResult, 1)
+			go func() {
+				report, err := runVerify(projectName)
+				resultCh <- verifyResult{report: report, err: err}
+			}()
+
+			select {
+			case res := <-resultCh:
+				if res.err != nil {
+					return res.err
+				}
+				report = res.report
+			case <-ctx.Done():
+				return fmt.Errorf("verify timed out after %d seconds", verifyTimeout)
+			}
+		}
 
-		type verifyResult struct {
-			err error
+		if verifyJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				return fmt.Errorf("failed to write report: %w", err)
+			}
 		}
-		resultCh := make(chan verifyResult, 1)
-		go func() {
-			resultCh <- verifyResult{err: runVerify(projectName)}
-		}()
-
-		select {
-		case res := <-resultCh:
-			return res.err
-		case <-ctx.Done():
-			return fmt.Errorf("verify timed out after %d seconds", verifyTimeout)
+		if !report.Matches && !verifyExitZero {
+			if verifyBaseline != "" {
+				return fmt.Errorf("lock files differ (%d drifts)", len(report.Drifts))
+			}
+			return fmt.Errorf("island does not match lockfile (%d drifts)", len(report.Drifts))
 		}
+		return nil
 	},
 }
 
-func runVerify(projectName string) error {
+// runVerifyBaseline compares two lock files on disk, treating lockPath as the
+// "live" side
+func runVerifyBaseline(baselinePath, lockPath string) (*verifyReport, error) {
+	baseline, err := readLockFile(baselinePath)
+	if err != nil {
+		return nil, err
+	}
+	lf, err := readLockFile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var exclude packageExclusions
+	if cfg, err := configManager.Load(); err == nil {
+		exclude = newPackageExclusions(cfg.Settings)
+	}
+
+	report := &verifyReport{Baseline: baselinePath, Lock: lockPath, Checksum: lf.Checksum}
+	report.Drifts = lockDrifts(baseline, lf, exclude)
+	if len(report.Drifts) > 0 {
+		ui.Error("%s differs from %s — %d drift(s) detected:", lockPath, baselinePath, len(report.Drifts))
+		for _, d := range report.Drifts {
+			ui.Item(d)
+		}
+		if verifyExitZero {
+			ui.Info("hint: --exit-zero is set, not failing on drift")
+		}
+		return report, nil
+	}
+
+	report.Matches = true
+	ui.Success("%s matches %s (0 drifts)", lockPath, baselinePath)
+	return report, nil
+}
+
+func readLockFile(path string) (*lockFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var lf lockFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %w", path, err)
+	}
+	return &lf, nil
+}
+
+func runVerify(projectName string) (*verifyReport, error) {
 	cfg, err := configManager.Load()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 	proj, ok := cfg.GetProject(projectName)
 	if !ok {
-		return fmt.Errorf("project '%s' not found", projectName)
+		return nil, errdefs.Errorf(errdefs.ErrProjectNotFound, "project '%s' not found", projectName)
 	}
+	exclude := newPackageExclusions(cfg.Settings)
 
 	lockPath := filepath.Join(proj.WorkspacePath, "coderaft.lock.json")
 	data, err := os.ReadFile(lockPath)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %w", lockPath, err)
+		return nil, fmt.Errorf("failed to read %s: %w", lockPath, err)
 	}
 	var lf lockFile
 	if err := json.Unmarshal(data, &lf); err != nil {
-		return fmt.Errorf("invalid lockfile: %w", err)
+		return nil, fmt.Errorf("invalid lockfile: %w", err)
 	}
 
 	exists, err := dockerClient.IslandExists(proj.IslandName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !exists {
-		return fmt.Errorf("island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
+		return nil, errdefs.Errorf(errdefs.ErrIslandNotFound, "island '%s' not found; run 'coderaft up %s' first", proj.IslandName, projectName)
 	}
 	status, err := dockerClient.GetIslandStatus(proj.IslandName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if status != "running" {
 		if err := dockerClient.StartIsland(proj.IslandName); err != nil {
-			return fmt.Errorf("failed to start island: %w", err)
+			return nil, fmt.Errorf("failed to start island: %w", err)
 		}
 	}
 
-	aptSnapshot, aptSources, aptRelease := dockerClient.GetAptSources(proj.IslandName)
-	npmReg, yarnReg, pnpmReg := dockerClient.GetNodeRegistries(proj.IslandName)
-	pipIndex, pipExtras := dockerClient.GetPipRegistries(proj.IslandName)
-	aptList, pipList, npmList, yarnList, pnpmList := dockerClient.QueryPackagesParallel(proj.IslandName)
-	envMap, workdir, user, restart, labels, capabilities, resources, network := dockerClient.GetContainerMeta(proj.IslandName)
-	livePorts, _ := dockerClient.GetPortMappings(proj.IslandName)
-	liveMounts, _ := dockerClient.GetMounts(proj.IslandName)
-
-	sort.Strings(aptList)
-	sort.Strings(pipList)
-	sort.Strings(npmList)
-	sort.Strings(yarnList)
-	sort.Strings(pnpmList)
-
-	if lf.Checksum != "" {
-		ui.Status("verifying lock file checksum...")
-		liveLf := lockFile{
-			BaseImage: lf.BaseImage,
-			Container: lockContainer{
-				WorkingDir:   workdir,
-				User:         user,
-				Restart:      restart,
-				Network:      network,
-				Ports:        livePorts,
-				Volumes:      liveMounts,
-				Labels:       labels,
-				Environment:  envMap,
-				Capabilities: capabilities,
-				Resources:    resources,
-			},
-			SetupScript: lf.SetupScript,
-			Packages: lockPackages{
-				Apt:  aptList,
-				Pip:  pipList,
-				Npm:  npmList,
-				Yarn: yarnList,
-				Pnpm: pnpmList,
-			},
-			Registries: lockRegistries{
-				PipIndexURL:   pipIndex,
-				PipExtraIndex: pipExtras,
-				NpmRegistry:   npmReg,
-				YarnRegistry:  yarnReg,
-				PnpmRegistry:  pnpmReg,
-			},
-			AptSources: lockAptSources{
-				SnapshotURL:   aptSnapshot,
-				SourcesLists:  aptSources,
-				PinnedRelease: aptRelease,
-			},
+	// The workspace lives on the host and changes without the island noticing,
+	// so locks that record it are always checked in full
+	var cachePath, cacheKey string
+	if !verifyNoCache && lf.Workspace == nil {
+		if cachePath, err = verifyCachePath(proj.IslandName); err == nil {
+			cacheKey = liveVerifyCacheKey(proj.IslandName, data, cfg.Settings)
 		}
-
-		if lf.BaseImage.Digest != "" {
-			if liveDigest, _, _ := dockerClient.GetImageDigestInfo(lf.BaseImage.Name); liveDigest != "" {
-				liveLf.BaseImage.Digest = liveDigest
+		if cacheKey != "" {
+			if cached, age, ok := readVerifyCache(cachePath, cacheKey, time.Now(), verifyCacheTTL); ok {
+				return cachedVerifyResult(cached, age), nil
 			}
 		}
+	}
+	remember := func(report *verifyReport) *verifyReport {
+		if cacheKey != "" {
+			writeVerifyCache(cachePath, cacheKey, report, time.Now())
+		}
+		return report
+	}
+
+	liveLf := readLiveLock(proj, &lf, exclude)
 
+	if lf.Checksum != "" {
+		ui.Status("verifying lock file checksum...")
 		liveChecksum := computeLockChecksum(&liveLf)
 		if liveChecksum == lf.Checksum {
 			ui.Success("island matches coderaft.lock.json (checksum fast-path)")
 			ui.Detail("checksum", lf.Checksum)
-			return nil
+			return remember(&verifyReport{Project: projectName, Matches: true, Drifts: []string{}, Checksum: lf.Checksum}), nil
 		}
 		ui.Status("checksum mismatch (lock=%s live=%s), performing detailed diff...", lf.Checksum[:24]+"...", liveChecksum[:24]+"...")
 	}
 
-	var drifts []string
+	drifts := lockDrifts(&lf, &liveLf, exclude)
+
+	if len(drifts) > 0 {
+		ui.Error("verification failed — %d drift(s) detected:", len(drifts))
+		for _, d := range drifts {
+			ui.Item(d)
+		}
+		if verifyExitZero {
+			ui.Info("hint: --exit-zero is set, not failing on drift")
+		}
+		return remember(&verifyReport{Project: projectName, Drifts: drifts, Checksum: lf.Checksum}), nil
+	}
+
+	ui.Success("island matches coderaft.lock.json (0 drifts)")
+	if lf.Checksum != "" {
+		ui.Detail("checksum", lf.Checksum)
+	}
+	return remember(&verifyReport{Project: projectName, Matches: true, Drifts: drifts, Checksum: lf.Checksum}), nil
+}
+
+// readLiveLock reads the island's current state the way lock records it,
+// limited to what lf records, so an island that hasn't changed since it was
+// locked has the lock's checksum
+func readLiveLock(proj *config.Project, lf *lockFile, exclude packageExclusions) lockFile {
+	aptSnapshot, aptSources, aptRelease := dockerClient.GetAptSources(proj.IslandName)
+	npmReg, yarnReg, pnpmReg := dockerClient.GetNodeRegistries(proj.IslandName)
+	pipIndex, pipExtras := dockerClient.GetPipRegistries(proj.IslandName)
+	pkgs := dockerClient.QueryAllPackages(proj.IslandName)
+	var vscodeList []string
+	if len(lf.VSCodeExtensions) > 0 {
+		vscodeList = queryVSCodeExtensions(proj.IslandName)
+	}
+	var aptPrefs map[string]string
+	if len(lf.AptSources.Preferences) > 0 {
+		aptPrefs = dockerClient.GetAptPreferences(proj.IslandName)
+	}
+	var liveSystem docker.SystemSettings
+	if lf.System != nil {
+		liveSystem = dockerClient.GetSystemSettings(proj.IslandName)
+	}
+	// The GPU request comes from coderaft.json, as lock records it
+	var gpus string
+	var configured []string
+	if pcfg, err := configManager.LoadProjectConfig(proj.WorkspacePath); err == nil && pcfg != nil {
+		gpus = pcfg.Gpus
+		configured = pcfg.TrackedFiles
+	}
+	var liveFiles map[string]string
+	if len(lf.TrackedFiles) > 0 {
+		liveFiles = dockerClient.GetFileChecksums(proj.IslandName, trackedFilePatterns(configured, lf.TrackedFiles))
+	}
+	envMap, workdir, user, restart, labels, capabilities, resources, network := dockerClient.GetContainerMeta(proj.IslandName)
+	envMap, labels = withoutSecretEnv(envMap, labels)
+	livePorts, _ := dockerClient.GetPortMappings(proj.IslandName)
+	liveMounts, _ := dockerClient.GetMounts(proj.IslandName)
+
+	liveLf := lockFile{
+		BaseImage: lf.BaseImage,
+		Container: lockContainer{
+			WorkingDir:   workdir,
+			User:         user,
+			Restart:      restart,
+			Network:      network,
+			Ports:        livePorts,
+			Volumes:      liveMounts,
+			Labels:       labels,
+			Environment:  security.FilterSensitiveEnvVars(envMap),
+			Capabilities: capabilities,
+			Resources:    resources,
+			Gpus:         gpus,
+		},
+		SetupScript: lf.SetupScript,
+		Packages:    lockPackagesFrom(pkgs),
+		Registries: lockRegistries{
+			PipIndexURL:   pipIndex,
+			PipExtraIndex: pipExtras,
+			NpmRegistry:   npmReg,
+			YarnRegistry:  yarnReg,
+			PnpmRegistry:  pnpmReg,
+		},
+		AptSources: lockAptSources{
+			SnapshotURL:   aptSnapshot,
+			SourcesLists:  aptSources,
+			PinnedRelease: aptRelease,
+			Preferences:   aptPrefs,
+		},
+		VSCodeExtensions: vscodeList,
+		TrackedFiles:     liveFiles,
+	}
+	if lf.System != nil {
+		liveLf.System = lockSystemFrom(liveSystem)
+	}
+	if lf.Workspace != nil {
+		var err error
+		if liveLf.Workspace, err = readWorkspaceState(proj.WorkspacePath, lf.Workspace.mode()); err != nil {
+			ui.Warning("failed to read the workspace state: %v", err)
+		}
+	}
+	// Excluded packages were never written to the lock, so they'd break the
+	// checksum fast path
+	liveLf.Packages = exclude.filterPackages(liveLf.Packages)
+	liveLf.VSCodeExtensions = exclude.filter("vscode", "@", liveLf.VSCodeExtensions)
+	// A minimal lock only pins what it lists, so compare just that
+	if lf.Minimal {
+		liveLf.Minimal = true
+		liveLf.Container = lockContainer{}
+		liveLf.AptSources = lockAptSources{}
+		liveLf.VSCodeExtensions = nil
+		liveLf.Packages = restrictToLock(lf.Packages, liveLf.Packages)
+	}
 
 	if lf.BaseImage.Digest != "" {
-		liveDigest, _, _ := dockerClient.GetImageDigestInfo(lf.BaseImage.Name)
-		if liveDigest != "" && liveDigest != lf.BaseImage.Digest {
-			drifts = append(drifts, fmt.Sprintf("base image digest mismatch: lock=%s current=%s", lf.BaseImage.Digest, liveDigest))
+		if liveDigest, _, _ := dockerClient.GetImageDigestInfo(lf.BaseImage.Name); liveDigest != "" {
+			liveLf.BaseImage.Digest = liveDigest
 		}
 	}
 
-	if lf.Container.WorkingDir != "" && lf.Container.WorkingDir != workdir {
-		drifts = append(drifts, fmt.Sprintf("working_dir mismatch: lock=%s current=%s", lf.Container.WorkingDir, workdir))
+	return liveLf
+}
+
+// lockDrifts compares a lock against the state in current, which is either
+// read from a live island or parsed from a second lock file. Fields the lock
+// leaves empty aren't checked.
+func lockDrifts(lf, current *lockFile, exclude packageExclusions) []string {
+	drifts := []string{}
+
+	if lf.BaseImage.Name != current.BaseImage.Name {
+		drifts = append(drifts, fmt.Sprintf("base image mismatch: lock=%s current=%s", lf.BaseImage.Name, current.BaseImage.Name))
 	}
-	if lf.Container.User != "" && lf.Container.User != user {
-		drifts = append(drifts, fmt.Sprintf("user mismatch: lock=%s current=%s", lf.Container.User, user))
+	if lf.BaseImage.Digest != "" && current.BaseImage.Digest != "" && current.BaseImage.Digest != lf.BaseImage.Digest {
+		drifts = append(drifts, fmt.Sprintf("base image digest mismatch: lock=%s current=%s", lf.BaseImage.Digest, current.BaseImage.Digest))
 	}
-	if lf.Container.Restart != "" && lf.Container.Restart != restart {
-		drifts = append(drifts, fmt.Sprintf("restart policy mismatch: lock=%s current=%s", lf.Container.Restart, restart))
+
+	live := current.Container
+	if lf.Container.WorkingDir != "" && lf.Container.WorkingDir != live.WorkingDir {
+		drifts = append(drifts, fmt.Sprintf("working_dir mismatch: lock=%s current=%s", lf.Container.WorkingDir, live.WorkingDir))
 	}
-	if lf.Container.Network != "" && lf.Container.Network != network {
-		drifts = append(drifts, fmt.Sprintf("network mismatch: lock=%s current=%s", lf.Container.Network, network))
+	if lf.Container.User != "" && lf.Container.User != live.User {
+		drifts = append(drifts, fmt.Sprintf("user mismatch: lock=%s current=%s", lf.Container.User, live.User))
 	}
-	if len(lf.Container.Ports) > 0 && !stringSetEqual(lf.Container.Ports, livePorts) {
-		drifts = append(drifts, fmt.Sprintf("ports mismatch: lock=%v current=%v", lf.Container.Ports, livePorts))
+	if lf.Container.Restart != "" && lf.Container.Restart != live.Restart {
+		drifts = append(drifts, fmt.Sprintf("restart policy mismatch: lock=%s current=%s", lf.Container.Restart, live.Restart))
 	}
-	if len(lf.Container.Volumes) > 0 && !stringSetEqual(lf.Container.Volumes, liveMounts) {
-		drifts = append(drifts, fmt.Sprintf("volumes mismatch: lock=%d entries current=%d entries", len(lf.Container.Volumes), len(liveMounts)))
+	if lf.Container.Network != "" && lf.Container.Network != live.Network {
+		drifts = append(drifts, fmt.Sprintf("network mismatch: lock=%s current=%s", lf.Container.Network, live.Network))
 	}
-	if len(lf.Container.Capabilities) > 0 && !stringSetEqual(lf.Container.Capabilities, capabilities) {
-		drifts = append(drifts, fmt.Sprintf("capabilities mismatch: lock=%v current=%v", lf.Container.Capabilities, capabilities))
+	if len(lf.Container.Ports) > 0 && !stringSetEqual(lf.Container.Ports, live.Ports) {
+		drifts = append(drifts, fmt.Sprintf("ports mismatch: lock=%v current=%v", lf.Container.Ports, live.Ports))
 	}
-	if len(lf.Container.Environment) > 0 {
-		for k, lockVal := range lf.Container.Environment {
-			if liveVal, ok := envMap[k]; !ok {
-				drifts = append(drifts, fmt.Sprintf("env var '%s' missing in live island (lock=%s)", k, lockVal))
-			} else if liveVal != lockVal {
-				drifts = append(drifts, fmt.Sprintf("env var '%s' mismatch: lock=%s current=%s", k, lockVal, liveVal))
-			}
-		}
+	if len(lf.Container.Volumes) > 0 && !stringSetEqual(lf.Container.Volumes, live.Volumes) {
+		drifts = append(drifts, fmt.Sprintf("volumes mismatch: lock=%d entries current=%d entries", len(lf.Container.Volumes), len(live.Volumes)))
 	}
-	if len(lf.Container.Resources) > 0 {
-		for k, lockVal := range lf.Container.Resources {
-			if liveVal, ok := resources[k]; !ok {
-				drifts = append(drifts, fmt.Sprintf("resource '%s' missing in live island (lock=%s)", k, lockVal))
-			} else if liveVal != lockVal {
-				drifts = append(drifts, fmt.Sprintf("resource '%s' mismatch: lock=%s current=%s", k, lockVal, liveVal))
-			}
-		}
+	if len(lf.Container.Capabilities) > 0 && !stringSetEqual(lf.Container.Capabilities, live.Capabilities) {
+		drifts = append(drifts, fmt.Sprintf("capabilities mismatch: lock=%v current=%v", lf.Container.Capabilities, live.Capabilities))
 	}
+	drifts = append(drifts, mapDrifts("env var", lf.Container.Environment, live.Environment)...)
+	drifts = append(drifts, mapDrifts("resource", lf.Container.Resources, live.Resources)...)
 
-	if lf.AptSources.SnapshotURL != "" && normalizeURL(lf.AptSources.SnapshotURL) != normalizeURL(aptSnapshot) {
-		drifts = append(drifts, fmt.Sprintf("APT snapshot mismatch: lock=%s current=%s", lf.AptSources.SnapshotURL, aptSnapshot))
+	apt := current.AptSources
+	if lf.AptSources.SnapshotURL != "" && normalizeURL(lf.AptSources.SnapshotURL) != normalizeURL(apt.SnapshotURL) {
+		drifts = append(drifts, fmt.Sprintf("APT snapshot mismatch: lock=%s current=%s", lf.AptSources.SnapshotURL, apt.SnapshotURL))
 	}
-	if lf.AptSources.PinnedRelease != "" && strings.TrimSpace(lf.AptSources.PinnedRelease) != strings.TrimSpace(aptRelease) {
-		drifts = append(drifts, fmt.Sprintf("APT release mismatch: lock=%s current=%s", lf.AptSources.PinnedRelease, aptRelease))
+	if lf.AptSources.PinnedRelease != "" && strings.TrimSpace(lf.AptSources.PinnedRelease) != strings.TrimSpace(apt.PinnedRelease) {
+		drifts = append(drifts, fmt.Sprintf("APT release mismatch: lock=%s current=%s", lf.AptSources.PinnedRelease, apt.PinnedRelease))
 	}
 	if len(lf.AptSources.SourcesLists) > 0 {
-		if !stringSetEqual(lf.AptSources.SourcesLists, aptSources) {
+		if !stringSetEqual(lf.AptSources.SourcesLists, apt.SourcesLists) {
 			drifts = append(drifts, "APT sources.list entries drifted")
 		}
 	}
 
-	if lf.Registries.PipIndexURL != "" && normalizeURL(lf.Registries.PipIndexURL) != normalizeURL(pipIndex) {
-		drifts = append(drifts, fmt.Sprintf("pip index-url mismatch: lock=%s current=%s", lf.Registries.PipIndexURL, pipIndex))
+	drifts = append(drifts, aptPreferencesDiff(lf.AptSources.Preferences, apt.Preferences)...)
+	drifts = append(drifts, systemDiff(lf.System, current.System)...)
+	drifts = append(drifts, workspaceDiff(lf.Workspace, current.Workspace)...)
+	drifts = append(drifts, trackedFilesDiff(lf.TrackedFiles, current.TrackedFiles)...)
+
+	reg := current.Registries
+	if lf.Registries.PipIndexURL != "" && normalizeURL(lf.Registries.PipIndexURL) != normalizeURL(reg.PipIndexURL) {
+		drifts = append(drifts, fmt.Sprintf("pip index-url mismatch: lock=%s current=%s", lf.Registries.PipIndexURL, reg.PipIndexURL))
 	}
 	if len(lf.Registries.PipExtraIndex) > 0 {
-		if !stringSetEqual(lf.Registries.PipExtraIndex, pipExtras) {
+		if !stringSetEqual(lf.Registries.PipExtraIndex, reg.PipExtraIndex) {
 			drifts = append(drifts, "pip extra-index-urls drifted")
 		}
 	}
 
-	if lf.Registries.NpmRegistry != "" && normalizeURL(lf.Registries.NpmRegistry) != normalizeURL(npmReg) {
-		drifts = append(drifts, fmt.Sprintf("npm registry mismatch: lock=%s current=%s", lf.Registries.NpmRegistry, npmReg))
+	if lf.Registries.NpmRegistry != "" && normalizeURL(lf.Registries.NpmRegistry) != normalizeURL(reg.NpmRegistry) {
+		drifts = append(drifts, fmt.Sprintf("npm registry mismatch: lock=%s current=%s", lf.Registries.NpmRegistry, reg.NpmRegistry))
 	}
-	if lf.Registries.YarnRegistry != "" && normalizeURL(lf.Registries.YarnRegistry) != normalizeURL(yarnReg) {
-		drifts = append(drifts, fmt.Sprintf("yarn registry mismatch: lock=%s current=%s", lf.Registries.YarnRegistry, yarnReg))
+	if lf.Registries.YarnRegistry != "" && normalizeURL(lf.Registries.YarnRegistry) != normalizeURL(reg.YarnRegistry) {
+		drifts = append(drifts, fmt.Sprintf("yarn registry mismatch: lock=%s current=%s", lf.Registries.YarnRegistry, reg.YarnRegistry))
 	}
-	if lf.Registries.PnpmRegistry != "" && normalizeURL(lf.Registries.PnpmRegistry) != normalizeURL(pnpmReg) {
-		drifts = append(drifts, fmt.Sprintf("pnpm registry mismatch: lock=%s current=%s", lf.Registries.PnpmRegistry, pnpmReg))
+	if lf.Registries.PnpmRegistry != "" && normalizeURL(lf.Registries.PnpmRegistry) != normalizeURL(reg.PnpmRegistry) {
+		drifts = append(drifts, fmt.Sprintf("pnpm registry mismatch: lock=%s current=%s", lf.Registries.PnpmRegistry, reg.PnpmRegistry))
 	}
 
-	drifts = append(drifts, packageDiff("apt", "=", lf.Packages.Apt, aptList)...)
-	drifts = append(drifts, packageDiff("pip", "==", lf.Packages.Pip, pipList)...)
-	drifts = append(drifts, packageDiff("npm", "@", lf.Packages.Npm, npmList)...)
-	drifts = append(drifts, packageDiff("yarn", "@", lf.Packages.Yarn, yarnList)...)
-	drifts = append(drifts, packageDiff("pnpm", "@", lf.Packages.Pnpm, pnpmList)...)
+	pkgs := current.Packages
+	drifts = append(drifts, packageDiff("apt", "=", lf.Packages.Apt, pkgs.Apt, exclude)...)
+	drifts = append(drifts, packageDiff("apk", "=", lf.Packages.Apk, pkgs.Apk, exclude)...)
+	drifts = append(drifts, packageDiff("pip", "==", lf.Packages.Pip, pkgs.Pip, exclude)...)
+	drifts = append(drifts, packageDiff("npm", "@", lf.Packages.Npm, pkgs.Npm, exclude)...)
+	drifts = append(drifts, packageDiff("yarn", "@", lf.Packages.Yarn, pkgs.Yarn, exclude)...)
+	drifts = append(drifts, packageDiff("pnpm", "@", lf.Packages.Pnpm, pkgs.Pnpm, exclude)...)
+	drifts = append(drifts, packageDiff("go", "@", lf.Packages.Go, pkgs.Go, exclude)...)
+	drifts = append(drifts, packageDiff("cargo", "=", lf.Packages.Cargo, pkgs.Cargo, exclude)...)
+	drifts = append(drifts, packageDiff("vscode", "@", lf.VSCodeExtensions, current.VSCodeExtensions, exclude)...)
+	return drifts
+}
 
-	if len(drifts) > 0 {
-		ui.Error("verification failed — %d drift(s) detected:", len(drifts))
-		for _, d := range drifts {
-			ui.Item(d)
+// mapDrifts reports keys of locked that are missing or different in live
+func mapDrifts(kind string, locked, live map[string]string) []string {
+	keys := make([]string, 0, len(locked))
+	for k := range locked {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var drifts []string
+	for _, k := range keys {
+		if liveVal, ok := live[k]; !ok {
+			drifts = append(drifts, fmt.Sprintf("%s '%s' missing in live island (lock=%s)", kind, k, locked[k]))
+		} else if liveVal != locked[k] {
+			drifts = append(drifts, fmt.Sprintf("%s '%s' mismatch: lock=%s current=%s", kind, k, locked[k], liveVal))
 		}
-		return fmt.Errorf("island does not match lockfile (%d drifts)", len(drifts))
 	}
+	return drifts
+}
 
-	ui.Success("island matches coderaft.lock.json (0 drifts)")
-	if lf.Checksum != "" {
-		ui.Detail("checksum", lf.Checksum)
+// systemDiff reports locale, timezone and ulimit differences from the lock
+func systemDiff(locked, live *lockSystem) []string {
+	if locked == nil {
+		return nil
+	}
+	if live == nil {
+		// a nil section means everything was left at the image defaults
+		live = &lockSystem{}
+	}
+	var drifts []string
+	if locked.Locale != "" && locked.Locale != live.Locale {
+		drifts = append(drifts, fmt.Sprintf("locale mismatch: lock=%s current=%s", locked.Locale, displayOrDefault(live.Locale)))
+	}
+	if locked.Timezone != "" && locked.Timezone != live.Timezone {
+		drifts = append(drifts, fmt.Sprintf("timezone mismatch: lock=%s current=%s", locked.Timezone, displayOrDefault(live.Timezone)))
+	}
+	names := make([]string, 0, len(locked.Ulimits))
+	for name := range locked.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if liveVal, ok := live.Ulimits[name]; !ok {
+			drifts = append(drifts, fmt.Sprintf("ulimit '%s' not set in live island (lock=%s)", name, locked.Ulimits[name]))
+		} else if liveVal != locked.Ulimits[name] {
+			drifts = append(drifts, fmt.Sprintf("ulimit '%s' mismatch: lock=%s current=%s", name, locked.Ulimits[name], liveVal))
+		}
+	}
+	return drifts
+}
+
+func displayOrDefault(s string) string {
+	if s == "" {
+		return "(default)"
 	}
-	return nil
+	return s
 }
 
-func packageDiff(manager, sep string, locked, live []string) []string {
-	lockMap := parseMap(locked, sep)
-	liveMap := parseMap(live, sep)
+func packageDiff(manager, sep string, locked, live []string, exclude packageExclusions) []string {
+	lockMap := parsePackageList(manager, exclude.filter(manager, sep, locked), sep)
+	liveMap := parsePackageList(manager, exclude.filter(manager, sep, live), sep)
 
 	var drifts []string
 	var added, removed, changed []string
@@ -304,6 +562,34 @@ func packageDiff(manager, sep string, locked, live []string) []string {
 	return drifts
 }
 
+// aptPreferencesDiff reports apt pinning files that were added, removed, or
+// edited since the lock was written
+func aptPreferencesDiff(locked, live map[string]string) []string {
+	if len(locked) == 0 {
+		return nil
+	}
+	var lines []string
+	for path, content := range locked {
+		liveContent, ok := live[path]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("  - %s", path))
+		case strings.TrimSpace(liveContent) != strings.TrimSpace(content):
+			lines = append(lines, fmt.Sprintf("  ~ %s", path))
+		}
+	}
+	for path := range live {
+		if _, ok := locked[path]; !ok {
+			lines = append(lines, fmt.Sprintf("  + %s", path))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Strings(lines)
+	return append([]string{"APT preferences drifted:"}, lines...)
+}
+
 func normalizeURL(s string) string {
 	return strings.TrimRight(strings.TrimSpace(strings.ToLower(s)), "/")
 }
@@ -336,4 +622,8 @@ func stringSetEqual(a, b []string) bool {
 
 func init() {
 	verifyCmd.Flags().IntVar(&verifyTimeout, "timeout", 300, "Timeout in seconds for the verify operation")
+	verifyCmd.Flags().BoolVar(&verifyJSON, "json", false, "Print the result as JSON on stdout (human-readable output moves to stderr)")
+	verifyCmd.Flags().BoolVar(&verifyExitZero, "exit-zero", false, "Exit 0 even when drift is detected (errors still fail)")
+	verifyCmd.Flags().StringVar(&verifyBaseline, "baseline", "", "Compare the lock file given as the argument against this one offline, without an island")
+	verifyCmd.Flags().BoolVar(&verifyNoCache, "no-cache", false, "Check the island again instead of reusing a cached result")
 }
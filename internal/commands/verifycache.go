@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"coderaft/internal/config"
+	"coderaft/internal/ui"
+)
+
+// verifyCacheTTL is how long a verify result is reused while the island's
+// generation and package state stay the same. Drift the package state marker
+// doesn't see, such as a tracked file edited by hand, shows up at the latest
+// once it expires.
+const verifyCacheTTL = 5 * time.Minute
+
+// verifyCacheEntry is the last verify result for an island
+type verifyCacheEntry struct {
+	Key       string        `json:"key"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Report    *verifyReport `json:"report"`
+}
+
+// verifyCachePath returns verify-cache/<island>.json in coderaft's state
+// directory
+func verifyCachePath(islandName string) (string, error) {
+	return config.StatePath("verify-cache", islandName+".json")
+}
+
+// verifyCacheKey ties a result to everything it was computed from: the
+// island's generation, its package state, the lock file and the exclusion
+// settings
+func verifyCacheKey(generation, packageState string, lockData []byte, settings *config.GlobalSettings) string {
+	h := sha256.New()
+	for _, part := range []string{generation, packageState} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(lockData)
+	h.Write([]byte{0})
+	if settings != nil {
+		excludes, _ := json.Marshal(settings.LockExcludePackages)
+		h.Write(excludes)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// liveVerifyCacheKey reads the island's generation and package state and
+// builds the cache key, or returns "" when either can't be read
+func liveVerifyCacheKey(islandName string, lockData []byte, settings *config.GlobalSettings) string {
+	generation, err := dockerClient.GetIslandGeneration(islandName)
+	if err != nil {
+		return ""
+	}
+	packageState, err := dockerClient.PackageStateMarker(islandName)
+	if err != nil {
+		return ""
+	}
+	return verifyCacheKey(generation, packageState, lockData, settings)
+}
+
+// readVerifyCache returns the cached report and its age when it was stored
+// under key less than ttl ago
+func readVerifyCache(path, key string, now time.Time, ttl time.Duration) (*verifyReport, time.Duration, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, false
+	}
+	var entry verifyCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Report == nil || entry.Key != key {
+		return nil, 0, false
+	}
+	age := now.Sub(entry.CheckedAt)
+	if age < 0 || age >= ttl {
+		return nil, 0, false
+	}
+	return entry.Report, age, true
+}
+
+// writeVerifyCache stores a report under key. Failing to is harmless, since
+// the next verify simply checks again.
+func writeVerifyCache(path, key string, report *verifyReport, now time.Time) {
+	data, err := json.Marshal(verifyCacheEntry{Key: key, CheckedAt: now, Report: report})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0600)
+}
+
+// invalidateVerifyCache drops an island's cached verify result. Commands that
+// install, upgrade or remove packages call it so the next verify checks the
+// island again even within the TTL.
+func invalidateVerifyCache(islandName string) {
+	path, err := verifyCachePath(islandName)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		ui.Status("failed to clear cached verify result: %v", err)
+	}
+}
+
+// cachedVerifyResult reports a cached verify result the way runVerify reports
+// a fresh one
+func cachedVerifyResult(report *verifyReport, age time.Duration) *verifyReport {
+	cached := *report
+	cached.Cached = true
+	when := age.Round(time.Second)
+	if cached.Matches {
+		ui.Success("island matches coderaft.lock.json (cached result from %s ago)", when)
+		if cached.Checksum != "" {
+			ui.Detail("checksum", cached.Checksum)
+		}
+	} else {
+		ui.Error("verification failed — %d drift(s) detected (cached result from %s ago):", len(cached.Drifts), when)
+		for _, d := range cached.Drifts {
+			ui.Item(d)
+		}
+		if verifyExitZero {
+			ui.Info("hint: --exit-zero is set, not failing on drift")
+		}
+	}
+	ui.Info("hint: use --no-cache to check the island again")
+	return &cached
+}
@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Workspace modes for 'coderaft lock --record-workspace'
+const (
+	workspaceModeCommit  = "commit"
+	workspaceModeContent = "content"
+)
+
+// lockWorkspace ties a lock to the state of the code it was taken with
+type lockWorkspace struct {
+	Commit string `json:"commit,omitempty"`
+	Dirty  bool   `json:"dirty,omitempty"`
+	// ContentHash covers every file git doesn't ignore, tracked or not
+	ContentHash string `json:"content_hash,omitempty"`
+}
+
+// mode returns the --record-workspace mode that produced w
+func (w *lockWorkspace) mode() string {
+	switch {
+	case w == nil:
+		return ""
+	case w.ContentHash != "":
+		return workspaceModeContent
+	default:
+		return workspaceModeCommit
+	}
+}
+
+func validateWorkspaceMode(mode string) error {
+	switch mode {
+	case "", workspaceModeCommit, workspaceModeContent:
+		return nil
+	}
+	return fmt.Errorf("invalid --record-workspace %q: use commit or content", mode)
+}
+
+// lockFileExclude keeps the lock file itself out of the workspace state, so
+// writing the lock doesn't change what it records
+const lockFileExclude = ":(exclude)coderaft.lock.json"
+
+// readWorkspaceState records the git HEAD commit and whether the tree has
+// uncommitted changes; in content mode it also hashes the files
+func readWorkspaceState(workspacePath, mode string) (*lockWorkspace, error) {
+	git := func(args ...string) ([]byte, error) {
+		out, err := exec.Command("git", append([]string{"-C", workspacePath}, args...)...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %s failed: %w", args[0], err)
+		}
+		return out, nil
+	}
+
+	head, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a git repository with commits: %w", workspacePath, err)
+	}
+	status, err := git("status", "--porcelain", "--", ".", lockFileExclude)
+	if err != nil {
+		return nil, err
+	}
+	w := &lockWorkspace{
+		Commit: strings.TrimSpace(string(head)),
+		Dirty:  len(bytes.TrimSpace(status)) > 0,
+	}
+	if mode != workspaceModeContent {
+		return w, nil
+	}
+
+	files, err := git("ls-files", "-z", "--cached", "--others", "--exclude-standard", "--", ".", lockFileExclude)
+	if err != nil {
+		return nil, err
+	}
+	w.ContentHash, err = hashWorkspaceFiles(workspacePath, strings.Split(string(files), "\x00"))
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// hashWorkspaceFiles hashes the path and contents of each file, in path
+// order. Missing files, such as deleted tracked ones, and directories, such
+// as submodules, are skipped; symlinks are hashed by their target.
+func hashWorkspaceFiles(root string, paths []string) (string, error) {
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		full := filepath.Join(root, filepath.FromSlash(p))
+		info, err := os.Lstat(full)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		h.Write([]byte(p + "\x00"))
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(full)
+			if err != nil {
+				return "", err
+			}
+			h.Write([]byte("link:" + target))
+		} else if err := hashFileInto(h, full); err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFileInto(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// workspaceDiff reports how the live workspace differs from the lock's
+func workspaceDiff(locked, live *lockWorkspace) []string {
+	if locked == nil {
+		return nil
+	}
+	if live == nil {
+		return []string{fmt.Sprintf("workspace state unavailable (lock records commit %s)", shortCommit(locked.Commit))}
+	}
+	var drifts []string
+	if locked.Commit != "" && locked.Commit != live.Commit {
+		drifts = append(drifts, fmt.Sprintf("workspace at different commit than lock: lock=%s current=%s", shortCommit(locked.Commit), shortCommit(live.Commit)))
+	}
+	if locked.Dirty != live.Dirty {
+		drifts = append(drifts, fmt.Sprintf("workspace dirty state mismatch: lock=%s current=%s", cleanOrDirty(locked.Dirty), cleanOrDirty(live.Dirty)))
+	}
+	if locked.ContentHash != "" && locked.ContentHash != live.ContentHash {
+		drifts = append(drifts, "workspace content differs from lock")
+	}
+	return drifts
+}
+
+func shortCommit(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+func cleanOrDirty(dirty bool) string {
+	if dirty {
+		return "dirty"
+	}
+	return "clean"
+}
@@ -10,24 +10,23 @@ import (
 
 type ConfigManager struct {
 	configPath string
+	env        string
 }
 
 func NewConfigManager() (*ConfigManager, error) {
-	homeDir, err := os.UserHomeDir()
+	configPath, err := ConfigPath("config.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
-
-	configDir := filepath.Join(homeDir, ".coderaft")
-	if err := os.MkdirAll(configDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create config directory: %w", err)
 	}
 
-	templatesDir := filepath.Join(configDir, "templates")
-	_ = os.MkdirAll(templatesDir, 0755)
+	if templatesDir, err := ConfigPath("templates"); err == nil {
+		_ = os.MkdirAll(templatesDir, 0755)
+	}
 
-	configPath := filepath.Join(configDir, "config.json")
-	return &ConfigManager{configPath: configPath}, nil
+	return &ConfigManager{configPath: configPath, env: os.Getenv("CODERAFT_ENV")}, nil
 }
 
 func NewConfigManagerWithPath(configDir string) (*ConfigManager, error) {
@@ -39,7 +38,11 @@ func NewConfigManagerWithPath(configDir string) (*ConfigManager, error) {
 	_ = os.MkdirAll(templatesDir, 0755)
 
 	configPath := filepath.Join(configDir, "config.json")
-	return &ConfigManager{configPath: configPath}, nil
+	return &ConfigManager{configPath: configPath, env: os.Getenv("CODERAFT_ENV")}, nil
+}
+
+func (cm *ConfigManager) ConfigPath() string {
+	return cm.configPath
 }
 
 func (cm *ConfigManager) Load() (*Config, error) {
@@ -94,6 +97,7 @@ func (cm *ConfigManager) Load() (*Config, error) {
 }
 
 func (cm *ConfigManager) Save(config *Config) error {
+	config.Version = CurrentConfigVersion
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
@@ -2,7 +2,10 @@ package config
 
 import (
 	"encoding/json"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -296,3 +299,405 @@ func containsAtIndex(s, substr string) bool {
 	}
 	return false
 }
+
+func TestValidateProjectConfigCommand(t *testing.T) {
+	cm := &ConfigManager{}
+
+	valid := &ProjectConfig{Name: "svc", Command: []string{"npm", "run", "dev"}}
+	if err := cm.ValidateProjectConfig(valid); err != nil {
+		t.Errorf("expected valid command, got %v", err)
+	}
+
+	invalid := &ProjectConfig{Name: "svc", Command: []string{" ", "run"}}
+	if err := cm.ValidateProjectConfig(invalid); err == nil {
+		t.Error("expected error for command with empty executable")
+	}
+}
+
+func TestValidateProjectConfigTrackedFiles(t *testing.T) {
+	cm := &ConfigManager{}
+
+	valid := &ProjectConfig{Name: "svc", TrackedFiles: []string{"/etc/pip.conf", "/etc/apt/sources.list.d/*.list", "/usr/local/share/ca-certificates/[a-z]*.crt"}}
+	if err := cm.ValidateProjectConfig(valid); err != nil {
+		t.Errorf("expected valid tracked_files, got %v", err)
+	}
+
+	for _, file := range []string{"etc/pip.conf", "/etc/$(id).conf", "/etc/my file", "/etc/../root/.ssh/id_rsa"} {
+		invalid := &ProjectConfig{Name: "svc", TrackedFiles: []string{file}}
+		if err := cm.ValidateProjectConfig(invalid); err == nil {
+			t.Errorf("expected error for tracked file %q", file)
+		}
+	}
+}
+
+func TestValidateProjectConfigSetupDoneWhen(t *testing.T) {
+	cm := &ConfigManager{}
+
+	valid := &ProjectConfig{
+		Name:          "svc",
+		SetupCommands: []string{"apt-get install -y jq"},
+		SetupDoneWhen: map[string]string{"apt-get install -y jq": "command -v jq"},
+		SetupMarkers:  true,
+	}
+	if err := cm.ValidateProjectConfig(valid); err != nil {
+		t.Errorf("expected valid setup_done_when, got %v", err)
+	}
+
+	unknown := &ProjectConfig{
+		Name:          "svc",
+		SetupCommands: []string{"apt-get install -y jq"},
+		SetupDoneWhen: map[string]string{"apt-get install -y curl": "command -v curl"},
+	}
+	if err := cm.ValidateProjectConfig(unknown); err == nil {
+		t.Error("expected error for a check on a command that isn't in setup_commands")
+	}
+
+	empty := &ProjectConfig{
+		Name:          "svc",
+		SetupCommands: []string{"apt-get install -y jq"},
+		SetupDoneWhen: map[string]string{"apt-get install -y jq": ""},
+	}
+	if err := cm.ValidateProjectConfig(empty); err == nil {
+		t.Error("expected error for an empty check")
+	}
+}
+
+func TestValidateProjectConfigFile(t *testing.T) {
+	cm := &ConfigManager{}
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "coderaft.json")
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	problems, err := cm.ValidateProjectConfigFile(write(`{"name": "svc", "ports": ["3000:3000"]}`))
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected a valid config, got %v, %v", problems, err)
+	}
+
+	// every problem is reported, from the schema and the other checks alike
+	problems, _ = cm.ValidateProjectConfigFile(write(`{
+		"name": "svc",
+		"setup_comands": ["make"],
+		"ports": ["3000"],
+		"capabilities": ["NET_ADMIN", "FLY"],
+		"user": "not a user"
+	}`))
+	if len(problems) != 4 {
+		t.Fatalf("expected 4 problems, got %d: %v", len(problems), problems)
+	}
+	for i, want := range []string{"setup_comands", "user", "FLY", "3000"} {
+		if !strings.Contains(problems[i], want) {
+			t.Errorf("problem %d: expected it to mention %q, got %q", i, want, problems[i])
+		}
+	}
+
+	problems, _ = cm.ValidateProjectConfigFile(write("{\n  \"name\": \"svc\",\n}"))
+	if len(problems) != 1 || !strings.Contains(problems[0], "line 3") {
+		t.Errorf("expected a JSON syntax error with its line, got %v", problems)
+	}
+
+	if _, err := cm.ValidateProjectConfigFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestMergeProjectConfigJSON(t *testing.T) {
+	base := `{
+		"name": "svc",
+		"base_image": "python:3.12",
+		"environment": {"DEBUG": "1", "PORT": "8000"},
+		"labels": {"team": "api"},
+		"setup_commands": ["pip install -r requirements.txt"],
+		"ports": ["8000:8000"],
+		"resources": {"cpus": "2", "memory": "4g"},
+		"health_check": {"test": ["CMD", "true"], "retries": 3},
+		"restart": "unless-stopped"
+	}`
+	overlay := `{
+		"base_image": "python:3.12-slim",
+		"environment": {"DEBUG": "0", "CI": "true"},
+		"setup_commands": ["...", "pip install -r requirements-ci.txt"],
+		"ports": [],
+		"resources": {"memory": "8g"},
+		"health_check": {"retries": 5},
+		"restart": null
+	}`
+
+	merged, err := MergeProjectConfigJSON([]byte(base), []byte(overlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pc ProjectConfig
+	if err := json.Unmarshal(merged, &pc); err != nil {
+		t.Fatal(err)
+	}
+
+	if pc.Name != "svc" {
+		t.Errorf("untouched scalar: got %q", pc.Name)
+	}
+	if pc.BaseImage != "python:3.12-slim" {
+		t.Errorf("replaced scalar: got %q", pc.BaseImage)
+	}
+	if want := map[string]string{"DEBUG": "0", "PORT": "8000", "CI": "true"}; !reflect.DeepEqual(pc.Environment, want) {
+		t.Errorf("environment should deep-merge: got %v", pc.Environment)
+	}
+	if pc.Labels["team"] != "api" {
+		t.Errorf("untouched map: got %v", pc.Labels)
+	}
+	if want := []string{"pip install -r requirements.txt", "pip install -r requirements-ci.txt"}; !reflect.DeepEqual(pc.SetupCommands, want) {
+		t.Errorf("marked array should append: got %v", pc.SetupCommands)
+	}
+	if len(pc.Ports) != 0 {
+		t.Errorf("array should be replaced: got %v", pc.Ports)
+	}
+	if pc.Resources == nil || pc.Resources.CPUs != "2" || pc.Resources.Memory != "8g" {
+		t.Errorf("nested object should deep-merge: got %+v", pc.Resources)
+	}
+	if pc.HealthCheck == nil || pc.HealthCheck.Retries != 5 || len(pc.HealthCheck.Test) != 2 {
+		t.Errorf("health_check should deep-merge: got %+v", pc.HealthCheck)
+	}
+	if pc.Restart != "" {
+		t.Errorf("null should remove the key: got %q", pc.Restart)
+	}
+}
+
+func TestLoadProjectConfigWithOverlay(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "coderaft.json"), []byte(`{"name":"svc","setup_commands":["make"]}`), 0644)
+	os.WriteFile(OverlayPath(dir, "ci"), []byte(`{"setup_commands":["make ci"]}`), 0644)
+
+	cm := &ConfigManager{}
+	pc, err := cm.LoadProjectConfig(dir)
+	if err != nil || pc.SetupCommands[0] != "make" {
+		t.Fatalf("without env: got %+v (%v)", pc, err)
+	}
+
+	if err := cm.SetEnv("ci"); err != nil {
+		t.Fatal(err)
+	}
+	pc, err = cm.LoadProjectConfig(dir)
+	if err != nil || pc.SetupCommands[0] != "make ci" {
+		t.Fatalf("with env: got %+v (%v)", pc, err)
+	}
+	if base, _ := cm.LoadBaseProjectConfig(dir); base.SetupCommands[0] != "make" {
+		t.Errorf("LoadBaseProjectConfig should ignore the overlay: got %v", base.SetupCommands)
+	}
+
+	if err := cm.SetEnv("staging"); err != nil {
+		t.Fatal(err)
+	}
+	if pc, err = cm.LoadProjectConfig(dir); err != nil || pc.SetupCommands[0] != "make" {
+		t.Errorf("missing overlay should fall back to the base: got %+v (%v)", pc, err)
+	}
+
+	if err := cm.SetEnv("../x"); err == nil {
+		t.Error("expected an invalid environment name to be rejected")
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	old := []byte(`{"projects":{"api":{"workspace_path":"/w/api"},"web":{"name":"web","island_name":"custom"}},"settings":{"recipe_source":"acme/recipes"}}`)
+
+	out, changes, err := MigrateConfig(old)
+	if err != nil {
+		t.Fatalf("MigrateConfig: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes, got %v", changes)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatalf("migrated config doesn't parse: %v", err)
+	}
+	if cfg.Version != CurrentConfigVersion {
+		t.Errorf("version = %d, want %d", cfg.Version, CurrentConfigVersion)
+	}
+	if p := cfg.Projects["api"]; p.Name != "api" || p.IslandName != "coderaft_api" {
+		t.Errorf("missing fields not filled in: %+v", p)
+	}
+	if p := cfg.Projects["web"]; p.IslandName != "custom" {
+		t.Errorf("existing island_name was changed: %+v", p)
+	}
+	if cfg.Settings == nil || cfg.Settings.RecipeSource != "acme/recipes" {
+		t.Errorf("settings not preserved: %+v", cfg.Settings)
+	}
+
+	again, changes, err := MigrateConfig(out)
+	if err != nil || len(changes) != 0 || string(again) != string(out) {
+		t.Errorf("migrating a current config should be a no-op, got changes %v err %v", changes, err)
+	}
+
+	if _, _, err := MigrateConfig([]byte(`{"version": 99, "projects": {}}`)); err == nil {
+		t.Error("expected an error for a config from a newer release")
+	}
+}
+
+func TestCleanWorkspaceSubdir(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"packages/api", "packages/api", false},
+		{"./packages/api/", "packages/api", false},
+		{"packages/../services/web", "services/web", false},
+		{"", "", true},
+		{".", "", true},
+		{"/srv/api", "", true},
+		{"../other", "", true},
+		{"packages/../..", "", true},
+	}
+	for _, tt := range tests {
+		got, err := CleanWorkspaceSubdir(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CleanWorkspaceSubdir(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CleanWorkspaceSubdir(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestApplyOverride(t *testing.T) {
+	pc := &ProjectConfig{
+		Name:        "app",
+		Environment: map[string]string{"DEBUG": "0"},
+		Ports:       []string{"3000:3000"},
+	}
+	tests := []struct {
+		key, value, previous string
+	}{
+		{"resources.memory", "8g", ""},
+		{"environment.DEBUG", "1", "0"},
+		{"environment.APP.MODE", "dev", ""},
+		{"ports", "8080:8080, 9090:9090", "3000:3000"},
+		{"setup_markers", "true", ""},
+		{"health_check.retries", "5", ""},
+		{"base_image", "ubuntu:24.04", ""},
+	}
+	for _, tt := range tests {
+		previous, err := ApplyOverride(pc, tt.key, tt.value)
+		if err != nil {
+			t.Fatalf("ApplyOverride(%s=%s) error = %v", tt.key, tt.value, err)
+		}
+		if previous != tt.previous {
+			t.Errorf("ApplyOverride(%s) previous = %q, want %q", tt.key, previous, tt.previous)
+		}
+	}
+
+	if pc.Resources == nil || pc.Resources.Memory != "8g" {
+		t.Errorf("resources.memory not set: %+v", pc.Resources)
+	}
+	if !reflect.DeepEqual(pc.Environment, map[string]string{"DEBUG": "1", "APP.MODE": "dev"}) {
+		t.Errorf("environment = %v", pc.Environment)
+	}
+	if !reflect.DeepEqual(pc.Ports, []string{"8080:8080", "9090:9090"}) {
+		t.Errorf("ports = %v", pc.Ports)
+	}
+	if !pc.SetupMarkers || pc.HealthCheck == nil || pc.HealthCheck.Retries != 5 || pc.BaseImage != "ubuntu:24.04" {
+		t.Errorf("typed overrides not applied: %+v", pc)
+	}
+
+	invalid := []struct{ key, value string }{
+		{"name", "other"},
+		{"resources.mem", "8g"},
+		{"memory", "8g"},
+		{"environment", "x"},
+		{"resources", "8g"},
+		{"setup_markers", "maybe"},
+		{"health_check.retries", "five"},
+		{"base_image.tag", "x"},
+	}
+	for _, tt := range invalid {
+		if _, err := ApplyOverride(pc, tt.key, tt.value); err == nil {
+			t.Errorf("ApplyOverride(%s=%s) should fail", tt.key, tt.value)
+		}
+	}
+}
+
+func TestParseOverride(t *testing.T) {
+	key, value, err := ParseOverride("environment.URL=http://x?a=b")
+	if err != nil || key != "environment.URL" || value != "http://x?a=b" {
+		t.Errorf("ParseOverride() = %q, %q, %v", key, value, err)
+	}
+	if _, _, err := ParseOverride("environment.DEBUG="); err != nil {
+		t.Errorf("an empty value should be allowed: %v", err)
+	}
+	for _, arg := range []string{"resources.memory", "=8g"} {
+		if _, _, err := ParseOverride(arg); err == nil {
+			t.Errorf("ParseOverride(%q) should fail", arg)
+		}
+	}
+}
+
+func TestResolveBaseDir(t *testing.T) {
+	home := "/home/me"
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"default", nil, "/home/me/.coderaft"},
+		{"xdg", map[string]string{xdgConfigEnv: "/home/me/.config"}, "/home/me/.config/coderaft"},
+		{"relative xdg is ignored", map[string]string{xdgConfigEnv: "config"}, "/home/me/.coderaft"},
+		{"other xdg variable", map[string]string{xdgDataEnv: "/home/me/.local/share"}, "/home/me/.coderaft"},
+		{"coderaft home wins", map[string]string{homeEnv: "/profiles/work/", xdgConfigEnv: "/home/me/.config"}, "/profiles/work"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(k string) string { return tt.env[k] }
+			if got := resolveBaseDir(xdgConfigEnv, getenv, home); got != tt.want {
+				t.Errorf("resolveBaseDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathsMigrateFromLegacyDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(homeEnv, "")
+	t.Setenv(xdgStateEnv, filepath.Join(home, ".local", "state"))
+
+	legacyLog := filepath.Join(home, ".coderaft", "logs", "coderaft_web", "setup.log")
+	if err := os.MkdirAll(filepath.Dir(legacyLog), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyLog, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := StatePath("logs", "coderaft_web", "setup.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(home, ".local", "state", "coderaft", "logs", "coderaft_web", "setup.log")
+	if got != want {
+		t.Fatalf("StatePath() = %q, want %q", got, want)
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != "old\n" {
+		t.Errorf("log not moved: %q, %v", data, err)
+	}
+	if _, err := os.Stat(legacyLog); !os.IsNotExist(err) {
+		t.Errorf("legacy log still exists: %v", err)
+	}
+
+	// CODERAFT_HOME is a profile of its own and takes nothing over
+	if err := os.WriteFile(filepath.Join(home, ".coderaft", "config.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	profile := filepath.Join(home, "profile")
+	t.Setenv(homeEnv, profile)
+	if got, _ := ConfigPath("config.json"); got != filepath.Join(profile, "config.json") {
+		t.Errorf("ConfigPath() = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".coderaft", "config.json")); err != nil {
+		t.Errorf("legacy config was moved: %v", err)
+	}
+}
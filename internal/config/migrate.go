@@ -0,0 +1,83 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// CurrentConfigVersion is the global config format written by this build.
+// Configs without a version field predate versioning and count as 0.
+const CurrentConfigVersion = 1
+
+// configMigrations[i] upgrades a config from version i to i+1 and returns a
+// description of each change it made
+var configMigrations = []func(raw map[string]interface{}) []string{
+	migrateConfigV0,
+}
+
+// MigrateConfig upgrades global config data to CurrentConfigVersion. It works
+// on the raw JSON so fields this build doesn't know about are kept. When the
+// config is already current it returns the input unchanged and no changes.
+func MigrateConfig(data []byte) ([]byte, []string, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return data, nil, nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	version := 0
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > CurrentConfigVersion {
+		return nil, nil, fmt.Errorf("config version %d is newer than this coderaft supports (%d); upgrade coderaft", version, CurrentConfigVersion)
+	}
+	if version == CurrentConfigVersion {
+		return data, nil, nil
+	}
+
+	var changes []string
+	for v := version; v < CurrentConfigVersion; v++ {
+		changes = append(changes, configMigrations[v](raw)...)
+	}
+	raw["version"] = CurrentConfigVersion
+	changes = append(changes, fmt.Sprintf("config version %d → %d", version, CurrentConfigVersion))
+
+	out, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return out, changes, nil
+}
+
+// migrateConfigV0 fills in project fields that older releases left out and
+// that callers otherwise have to guess: the project name and island name
+func migrateConfigV0(raw map[string]interface{}) []string {
+	var changes []string
+	projects, _ := raw["projects"].(map[string]interface{})
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		project, ok := projects[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if s, _ := project["name"].(string); s == "" {
+			project["name"] = name
+			changes = append(changes, fmt.Sprintf("project '%s': set missing name", name))
+		}
+		if s, _ := project["island_name"].(string); s == "" {
+			project["island_name"] = "coderaft_" + name
+			changes = append(changes, fmt.Sprintf("project '%s': set missing island_name to coderaft_%s", name, name))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseOverride splits a key=value override such as resources.memory=8g
+func ParseOverride(arg string) (string, string, error) {
+	key, value, ok := strings.Cut(arg, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid override %q: expected key=value, e.g. resources.memory=8g", arg)
+	}
+	return key, value, nil
+}
+
+// ApplyOverride sets the field of pc at a dotted coderaft.json key, such as
+// resources.memory or environment.DEBUG, converting value to the field's
+// type: numbers and booleans are parsed and lists are comma separated. For
+// maps, everything after the map's own key is the entry's name, so
+// environment.APP.MODE sets APP.MODE. It returns the field's previous value,
+// or "" if it was unset.
+func ApplyOverride(pc *ProjectConfig, key, value string) (string, error) {
+	if key == "name" {
+		return "", fmt.Errorf("name can't be overridden; it names the island")
+	}
+	parts := strings.Split(key, ".")
+	v := reflect.ValueOf(pc).Elem()
+	for i := 0; i < len(parts); i++ {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			field, ok := jsonField(v, parts[i])
+			if !ok {
+				parent := "coderaft.json"
+				if i > 0 {
+					parent = strings.Join(parts[:i], ".")
+				}
+				return "", fmt.Errorf("unknown key %q: %s has no field %q (known: %s)", key, parent, parts[i], strings.Join(jsonFieldNames(v.Type()), ", "))
+			}
+			v = field
+		case reflect.Map:
+			entry := strings.Join(parts[i:], ".")
+			if entry == "" {
+				return "", fmt.Errorf("invalid key %q: empty entry name", key)
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			old := v.MapIndex(reflect.ValueOf(entry))
+			previous := ""
+			if old.IsValid() {
+				previous = old.String()
+			}
+			v.SetMapIndex(reflect.ValueOf(entry), reflect.ValueOf(value))
+			return previous, nil
+		default:
+			return "", fmt.Errorf("invalid key %q: %s is not an object", key, strings.Join(parts[:i], "."))
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		return "", fmt.Errorf("invalid key %q: name an entry, e.g. %s.NAME", key, key)
+	case reflect.Struct, reflect.Ptr:
+		return "", fmt.Errorf("invalid key %q: name a field, e.g. %s.%s", key, key, jsonFieldNames(indirectType(v.Type()))[0])
+	}
+	previous := formatOverrideValue(v)
+	if err := setOverrideValue(v, value); err != nil {
+		return "", fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return previous, nil
+}
+
+// setOverrideValue converts value to v's type and stores it
+func setOverrideValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("fields of type %s can't be overridden", v.Type())
+	}
+	return nil
+}
+
+// formatOverrideValue shows a field's value the way it would be overridden
+func formatOverrideValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).String()
+		}
+		return strings.Join(items, ",")
+	}
+	if v.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// jsonField finds the field of struct v with the given json name
+func jsonField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// jsonFieldNames lists a struct's json field names, sorted
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonName(t.Field(i)); name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Where coderaft keeps its own files. By default everything is in
+// ~/.coderaft. CODERAFT_HOME puts all of it in one directory instead, e.g. for
+// a separate profile. Otherwise, when the XDG base directories are set, the
+// config goes to $XDG_CONFIG_HOME/coderaft, the vault and downloaded dotfiles
+// and recipes to $XDG_DATA_HOME/coderaft, and logs and apply locks to
+// $XDG_STATE_HOME/coderaft.
+const (
+	homeEnv      = "CODERAFT_HOME"
+	xdgConfigEnv = "XDG_CONFIG_HOME"
+	xdgDataEnv   = "XDG_DATA_HOME"
+	xdgStateEnv  = "XDG_STATE_HOME"
+)
+
+// ConfigDir holds config.json and templates
+func ConfigDir() (string, error) {
+	return baseDir(xdgConfigEnv)
+}
+
+// DataDir holds the secrets vault and downloaded dotfiles and recipes
+func DataDir() (string, error) {
+	return baseDir(xdgDataEnv)
+}
+
+// StateDir holds setup logs and apply locks
+func StateDir() (string, error) {
+	return baseDir(xdgStateEnv)
+}
+
+// ConfigPath joins elem onto ConfigDir, first moving the entry it starts
+// with over from ~/.coderaft if only the old one exists
+func ConfigPath(elem ...string) (string, error) {
+	return dirPath(xdgConfigEnv, elem)
+}
+
+// DataPath joins elem onto DataDir, migrating like ConfigPath
+func DataPath(elem ...string) (string, error) {
+	return dirPath(xdgDataEnv, elem)
+}
+
+// StatePath joins elem onto StateDir, migrating like ConfigPath
+func StatePath(elem ...string) (string, error) {
+	return dirPath(xdgStateEnv, elem)
+}
+
+func baseDir(xdgEnv string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return resolveBaseDir(xdgEnv, os.Getenv, home), nil
+}
+
+// resolveBaseDir picks a directory: CODERAFT_HOME, else the XDG variable's
+// coderaft directory, else ~/.coderaft. The XDG spec says relative values are
+// invalid and to be ignored.
+func resolveBaseDir(xdgEnv string, getenv func(string) string, home string) string {
+	if dir := getenv(homeEnv); dir != "" {
+		return filepath.Clean(dir)
+	}
+	if base := getenv(xdgEnv); base != "" && filepath.IsAbs(base) {
+		return filepath.Join(base, "coderaft")
+	}
+	return filepath.Join(home, ".coderaft")
+}
+
+func dirPath(xdgEnv string, elem []string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	dir := resolveBaseDir(xdgEnv, os.Getenv, home)
+	if len(elem) == 0 {
+		return dir, nil
+	}
+	// CODERAFT_HOME is a profile of its own, so it starts empty rather than
+	// taking the default profile's files
+	if os.Getenv(homeEnv) == "" {
+		dir = filepath.Dir(migrateLegacy(filepath.Join(home, ".coderaft", elem[0]), filepath.Join(dir, elem[0])))
+	}
+	return filepath.Join(append([]string{dir}, elem...)...), nil
+}
+
+// migrateLegacy moves a file or directory from its ~/.coderaft location to
+// its XDG one when only the old one exists, and returns where it now is. If
+// the move fails, e.g. across filesystems, the old location keeps being used.
+func migrateLegacy(legacy, current string) string {
+	if legacy == current {
+		return current
+	}
+	if _, err := os.Lstat(current); err == nil {
+		return current
+	}
+	if _, err := os.Lstat(legacy); err != nil {
+		return current
+	}
+	if err := os.MkdirAll(filepath.Dir(current), 0700); err == nil {
+		if err := os.Rename(legacy, current); err == nil {
+			fmt.Fprintf(os.Stderr, "moved %s to %s\n", legacy, current)
+			return current
+		}
+	}
+	fmt.Fprintf(os.Stderr, "warning: failed to move %s to %s; still using the old location\n", legacy, current)
+	return legacy
+}
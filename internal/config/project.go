@@ -1,12 +1,16 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -57,21 +61,75 @@ var validLinuxCapabilities = map[string]bool{
 
 var imageRefPattern = regexp.MustCompile(`^([a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?/)?([a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*)(:([\w][\w.-]{0,127}))?(@sha256:[a-f0-9]{64})?$`)
 
+var envNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// trackedFilePattern is an absolute island path made of characters that are
+// safe to expand as a glob in the island's shell
+var trackedFilePattern = regexp.MustCompile(`^/[A-Za-z0-9_.@+*?\[\]/-]+$`)
+
+// OverlayAppendMarker as the first element of an overlay array appends the
+// rest of the array to the base array instead of replacing it
+const OverlayAppendMarker = "..."
+
+// SetEnv selects the coderaft.<env>.json overlay LoadProjectConfig merges over
+// coderaft.json. An empty env disables overlays. Defaults to $CODERAFT_ENV.
+func (cm *ConfigManager) SetEnv(env string) error {
+	if env != "" {
+		if err := validateEnvName(env); err != nil {
+			return err
+		}
+	}
+	cm.env = env
+	return nil
+}
+
+func (cm *ConfigManager) Env() string {
+	return cm.env
+}
+
+func validateEnvName(env string) error {
+	if !envNamePattern.MatchString(env) || env == "project" {
+		return fmt.Errorf("invalid environment name '%s': use letters, digits, '-' and '_' (and not 'project')", env)
+	}
+	return nil
+}
+
+// OverlayPath returns the overlay file for env in projectPath
+func OverlayPath(projectPath, env string) string {
+	return filepath.Join(projectPath, "coderaft."+env+".json")
+}
+
+// LoadProjectConfig reads the project's coderaft.json and, when an environment
+// is selected, merges its coderaft.<env>.json overlay on top
 func (cm *ConfigManager) LoadProjectConfig(projectPath string) (*ProjectConfig, error) {
+	return cm.loadProjectConfig(projectPath, cm.env)
+}
 
+// LoadBaseProjectConfig reads coderaft.json without any overlay, for callers
+// that write the config back
+func (cm *ConfigManager) LoadBaseProjectConfig(projectPath string) (*ProjectConfig, error) {
+	return cm.loadProjectConfig(projectPath, "")
+}
+
+// FindProjectConfigFile returns the project config file in projectPath:
+// coderaft.json, else coderaft.project.json, else .coderaft.json. It returns
+// "" when there is none.
+func FindProjectConfigFile(projectPath string) string {
 	candidates := []string{
 		filepath.Join(projectPath, "coderaft.json"),
 		filepath.Join(projectPath, "coderaft.project.json"),
 		filepath.Join(projectPath, ".coderaft.json"),
 	}
-
-	var configPath string
 	for _, p := range candidates {
 		if _, err := os.Stat(p); err == nil {
-			configPath = p
-			break
+			return p
 		}
 	}
+	return ""
+}
+
+func (cm *ConfigManager) loadProjectConfig(projectPath, env string) (*ProjectConfig, error) {
+	configPath := FindProjectConfigFile(projectPath)
 	if configPath == "" {
 		return nil, nil
 	}
@@ -81,6 +139,22 @@ func (cm *ConfigManager) LoadProjectConfig(projectPath string) (*ProjectConfig,
 		return nil, fmt.Errorf("failed to read project config file: %w", err)
 	}
 
+	if env != "" {
+		if err := validateEnvName(env); err != nil {
+			return nil, err
+		}
+		overlayPath := OverlayPath(projectPath, env)
+		overlay, err := os.ReadFile(overlayPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(overlayPath), err)
+		}
+		if err == nil {
+			if data, err = MergeProjectConfigJSON(data, overlay); err != nil {
+				return nil, fmt.Errorf("failed to merge %s: %w", filepath.Base(overlayPath), err)
+			}
+		}
+	}
+
 	var projectConfig ProjectConfig
 	if err := json.Unmarshal(data, &projectConfig); err != nil {
 		return nil, fmt.Errorf("failed to parse project config file: %w", err)
@@ -89,6 +163,47 @@ func (cm *ConfigManager) LoadProjectConfig(projectPath string) (*ProjectConfig,
 	return &projectConfig, nil
 }
 
+// MergeProjectConfigJSON layers an overlay document over a base one. Objects
+// (environment, labels, resources, ...) are merged key by key, recursively;
+// arrays and scalars in the overlay replace the base value; a null in the
+// overlay removes the key. An array starting with OverlayAppendMarker is
+// appended to the base array instead.
+func MergeProjectConfigJSON(base, overlay []byte) ([]byte, error) {
+	var b, o map[string]interface{}
+	if err := json.Unmarshal(base, &b); err != nil {
+		return nil, fmt.Errorf("invalid base config: %w", err)
+	}
+	if err := json.Unmarshal(overlay, &o); err != nil {
+		return nil, fmt.Errorf("invalid overlay: %w", err)
+	}
+	return json.Marshal(mergeJSONObjects(b, o))
+}
+
+func mergeJSONObjects(base, overlay map[string]interface{}) map[string]interface{} {
+	if base == nil {
+		base = map[string]interface{}{}
+	}
+	for key, value := range overlay {
+		switch v := value.(type) {
+		case nil:
+			delete(base, key)
+		case map[string]interface{}:
+			existing, _ := base[key].(map[string]interface{})
+			base[key] = mergeJSONObjects(existing, v)
+		case []interface{}:
+			if len(v) > 0 && v[0] == OverlayAppendMarker {
+				existing, _ := base[key].([]interface{})
+				base[key] = append(existing, v[1:]...)
+			} else {
+				base[key] = v
+			}
+		default:
+			base[key] = v
+		}
+	}
+	return base
+}
+
 func (cm *ConfigManager) SaveProjectConfig(projectPath string, config *ProjectConfig) error {
 
 	candidates := []string{
@@ -139,6 +254,65 @@ func (cm *ConfigManager) ValidateProjectConfig(cfg *ProjectConfig) error {
 		return errors.New(strings.TrimSpace(b.String()))
 	}
 
+	if problems := projectConfigProblems(cfg); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+// ValidateProjectConfigFile checks a coderaft.json file the way
+// ValidateProjectConfig checks a loaded config, but reports every problem
+// instead of the first. The schema is applied to the file as written, so
+// unknown fields such as misspelled keys are caught too. The error is only
+// for a file that can't be read.
+func (cm *ConfigManager) ValidateProjectConfigFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return []string{describeJSONError(data, err)}, nil
+	}
+
+	var problems []string
+	res, err := gojsonschema.Validate(gojsonschema.NewStringLoader(ProjectConfigJSONSchema), gojsonschema.NewGoLoader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("schema validation error: %w", err)
+	}
+	for _, e := range res.Errors() {
+		problems = append(problems, e.String())
+	}
+
+	var cfg ProjectConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		// the schema has already reported the mistyped field
+		return problems, nil
+	}
+	for _, p := range projectConfigProblems(&cfg) {
+		problems = append(problems, p.Error())
+	}
+	return problems, nil
+}
+
+// describeJSONError adds the line and column to a JSON syntax error
+func describeJSONError(data []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return fmt.Sprintf("invalid JSON: %v", err)
+	}
+	before := data[:syntaxErr.Offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("invalid JSON at line %d, column %d: %v", line, col, err)
+}
+
+// projectConfigProblems runs the checks the schema can't express and returns
+// every failure, in field order
+func projectConfigProblems(cfg *ProjectConfig) []error {
+	var problems []error
+
 	if cfg.BaseImage != "" {
 
 		if !imageRefPattern.MatchString(strings.ToLower(cfg.BaseImage)) {
@@ -146,7 +320,7 @@ func (cm *ConfigManager) ValidateProjectConfig(cfg *ProjectConfig) error {
 			if !strings.Contains(cfg.BaseImage, "/") && !strings.Contains(cfg.BaseImage, ":") {
 
 			} else if strings.HasPrefix(cfg.BaseImage, "sha256:") {
-				return fmt.Errorf("invalid base_image '%s': use image:tag@sha256:... format instead of bare digest", cfg.BaseImage)
+				problems = append(problems, fmt.Errorf("invalid base_image '%s': use image:tag@sha256:... format instead of bare digest", cfg.BaseImage))
 			}
 		}
 	}
@@ -155,14 +329,14 @@ func (cm *ConfigManager) ValidateProjectConfig(cfg *ProjectConfig) error {
 
 		userPattern := regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_-]{0,31}(:[a-zA-Z0-9_][a-zA-Z0-9_-]{0,31})?$|^[0-9]+(:[0-9]+)?$`)
 		if !userPattern.MatchString(cfg.User) {
-			return fmt.Errorf("invalid user '%s': expected 'username', 'uid', 'uid:gid', or 'username:group'", cfg.User)
+			problems = append(problems, fmt.Errorf("invalid user '%s': expected 'username', 'uid', 'uid:gid', or 'username:group'", cfg.User))
 		}
 	}
 
 	for _, cap := range cfg.Capabilities {
 		capUpper := strings.ToUpper(cap)
 		if !validLinuxCapabilities[capUpper] {
-			return fmt.Errorf("invalid capability '%s': not a recognized Linux capability", cap)
+			problems = append(problems, fmt.Errorf("invalid capability '%s': not a recognized Linux capability", cap))
 		}
 	}
 
@@ -174,34 +348,81 @@ func (cm *ConfigManager) ValidateProjectConfig(cfg *ProjectConfig) error {
 		if !validNetworks[netMode] && !strings.HasPrefix(netMode, "container:") {
 
 			if strings.ContainsAny(cfg.Network, " \t\n") {
-				return fmt.Errorf("invalid network '%s': network name cannot contain whitespace", cfg.Network)
+				problems = append(problems, fmt.Errorf("invalid network '%s': network name cannot contain whitespace", cfg.Network))
 			}
 		}
 	}
 
+	if len(cfg.Command) > 0 && strings.TrimSpace(cfg.Command[0]) == "" {
+		problems = append(problems, fmt.Errorf("invalid command: the first element must be the executable to run"))
+	}
+
+	doneWhen := make([]string, 0, len(cfg.SetupDoneWhen))
+	for command := range cfg.SetupDoneWhen {
+		doneWhen = append(doneWhen, command)
+	}
+	sort.Strings(doneWhen)
+	for _, command := range doneWhen {
+		if !slices.Contains(cfg.SetupCommands, command) {
+			problems = append(problems, fmt.Errorf("invalid setup_done_when: '%s' is not one of the setup_commands", command))
+		}
+	}
+
+	if cfg.WorkspaceSubdir != "" {
+		if _, err := CleanWorkspaceSubdir(cfg.WorkspaceSubdir); err != nil {
+			problems = append(problems, fmt.Errorf("invalid workspace_subdir: %w", err))
+		}
+	}
+
+	for _, file := range cfg.TrackedFiles {
+		if !trackedFilePattern.MatchString(file) || strings.Contains(file, "..") {
+			problems = append(problems, fmt.Errorf("invalid tracked_files entry '%s': expected an absolute path such as /etc/pip.conf, optionally with * ? or [] globs", file))
+		}
+	}
+
 	for _, port := range cfg.Ports {
 		if !strings.Contains(port, ":") && !strings.Contains(port, "/") {
 
-			return fmt.Errorf("invalid port mapping '%s' (expected host:island or island[/proto])", port)
+			problems = append(problems, fmt.Errorf("invalid port mapping '%s' (expected host:island or island[/proto])", port))
 		}
 	}
 	for _, volume := range cfg.Volumes {
 		if !strings.Contains(volume, ":") {
-			return fmt.Errorf("invalid volume mapping '%s' (expected host:island)", volume)
+			problems = append(problems, fmt.Errorf("invalid volume mapping '%s' (expected host:island)", volume))
 		}
 	}
 	if cfg.HealthCheck != nil {
 		if len(cfg.HealthCheck.Test) > 0 && cfg.HealthCheck.Test[0] == "NONE" && len(cfg.HealthCheck.Test) > 1 {
-			return fmt.Errorf("health_check.test cannot have arguments when set to NONE")
+			problems = append(problems, fmt.Errorf("health_check.test cannot have arguments when set to NONE"))
 		}
 
 		if cfg.HealthCheck.Interval != "" {
 			if _, err := time.ParseDuration(strings.ReplaceAll(cfg.HealthCheck.Interval, "m", "m0s")); err != nil && !durationLike(cfg.HealthCheck.Interval) {
-				return fmt.Errorf("invalid health_check.interval %q: %w", cfg.HealthCheck.Interval, err)
+				problems = append(problems, fmt.Errorf("invalid health_check.interval %q: %w", cfg.HealthCheck.Interval, err))
 			}
 		}
 	}
-	return nil
+	return problems
+}
+
+// CleanWorkspaceSubdir checks that dir is a path inside the repository and
+// returns it cleaned, with forward slashes
+func CleanWorkspaceSubdir(dir string) (string, error) {
+	dir = strings.TrimSpace(dir)
+	if dir == "" {
+		return "", fmt.Errorf("path is empty")
+	}
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") {
+		return "", fmt.Errorf("'%s' must be relative to the repository root", dir)
+	}
+	clean := path.Clean(filepath.ToSlash(dir))
+	if clean == "." {
+		return "", fmt.Errorf("'%s' is the repository root; leave it unset to use the whole checkout", dir)
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("'%s' points outside the repository", dir)
+	}
+	return clean, nil
 }
 
 func durationLike(s string) bool {
@@ -253,6 +474,9 @@ func (config *Config) AddProject(project *Project) {
 	if config.Projects == nil {
 		config.Projects = make(map[string]*Project)
 	}
+	if project.CreatedAt == "" {
+		project.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
 	config.Projects[project.Name] = project
 }
 
@@ -28,11 +28,7 @@ func getGoVersion() string {
 }
 
 func (cm *ConfigManager) templatesDir() (string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", fmt.Errorf("failed to get user home directory: %w", err)
-	}
-	return filepath.Join(home, ".coderaft", "templates"), nil
+	return ConfigPath("templates")
 }
 
 func (cm *ConfigManager) CreateProjectConfigFromTemplate(templateName, projectName string) (*ProjectConfig, error) {
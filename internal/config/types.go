@@ -1,17 +1,34 @@
 package config
 
 type Config struct {
+	Version  int                 `json:"version,omitempty"`
 	Projects map[string]*Project `json:"projects"`
 	Settings *GlobalSettings     `json:"settings,omitempty"`
 }
 
 type GlobalSettings struct {
-	DefaultBaseImage    string            `json:"default_base_image,omitempty"`
-	DefaultEnvironment  map[string]string `json:"default_environment,omitempty"`
-	ConfigTemplatesPath string            `json:"config_templates_path,omitempty"`
-	AutoUpdate          bool              `json:"auto_update,omitempty"`
-	AutoStopOnExit      bool              `json:"auto_stop_on_exit,omitempty"`
-	AutoApplyLock       bool              `json:"auto_apply_lock,omitempty"`
+	DefaultBaseImage    string              `json:"default_base_image,omitempty"`
+	DefaultEnvironment  map[string]string   `json:"default_environment,omitempty"`
+	ConfigTemplatesPath string              `json:"config_templates_path,omitempty"`
+	AutoUpdate          bool                `json:"auto_update,omitempty"`
+	AutoStopOnExit      bool                `json:"auto_stop_on_exit,omitempty"`
+	AutoApplyLock       bool                `json:"auto_apply_lock,omitempty"`
+	DotfilesRepo        string              `json:"dotfiles_repo,omitempty"`
+	RecipeSource        string              `json:"recipe_source,omitempty"`
+	CloneTimeouts       map[string]string   `json:"clone_timeouts,omitempty"`
+	PullPolicy          string              `json:"pull_policy,omitempty"`
+	MakeSetupTargets    []string            `json:"make_setup_targets,omitempty"`
+	ProtectedPackages   []string            `json:"protected_packages,omitempty"`
+	NameTemplate        string              `json:"name_template,omitempty"`
+	HooksDir            string              `json:"hooks_dir,omitempty"`
+	LockExcludePackages map[string][]string `json:"lock_exclude_packages,omitempty"`
+	ShellMultiplexer    string              `json:"shell_multiplexer,omitempty"`
+	LargeFileThreshold  string              `json:"large_file_threshold,omitempty"`
+	PrebuiltRegistry    string              `json:"prebuilt_registry,omitempty"`
+	MountSSHAgent       bool                `json:"mount_ssh_agent,omitempty"`
+	DefaultBranches     []string            `json:"default_branches,omitempty"`
+	VaultIdleTimeout    string              `json:"vault_idle_timeout,omitempty"`
+	IslandConflict      string              `json:"island_conflict,omitempty"`
 }
 
 type Project struct {
@@ -21,26 +38,44 @@ type Project struct {
 	WorkspacePath string `json:"workspace_path"`
 	Status        string `json:"status,omitempty"`
 	ConfigFile    string `json:"config_file,omitempty"`
+	Archive       bool   `json:"archive,omitempty"`
+	LFS           string `json:"lfs,omitempty"`
+	Stack         string `json:"stack,omitempty"`
+	CreatedAt     string `json:"created_at,omitempty"`
+	HooksDir      string `json:"hooks_dir,omitempty"`
 }
 
 type ProjectConfig struct {
-	Name          string            `json:"name"`
-	BaseImage     string            `json:"base_image,omitempty"`
-	SetupCommands []string          `json:"setup_commands,omitempty"`
-	Environment   map[string]string `json:"environment,omitempty"`
-	Ports         []string          `json:"ports,omitempty"`
-	Volumes       []string          `json:"volumes,omitempty"`
-	Dotfiles      []string          `json:"dotfiles,omitempty"`
-	WorkingDir    string            `json:"working_dir,omitempty"`
-	Shell         string            `json:"shell,omitempty"`
-	User          string            `json:"user,omitempty"`
-	Capabilities  []string          `json:"capabilities,omitempty"`
-	Labels        map[string]string `json:"labels,omitempty"`
-	Network       string            `json:"network,omitempty"`
-	Restart       string            `json:"restart,omitempty"`
-	HealthCheck   *HealthCheck      `json:"health_check,omitempty"`
-	Resources     *Resources        `json:"resources,omitempty"`
-	Gpus          string            `json:"gpus,omitempty"`
+	Name            string            `json:"name"`
+	BaseImage       string            `json:"base_image,omitempty"`
+	SetupCommands   []string          `json:"setup_commands,omitempty"`
+	SetupDoneWhen   map[string]string `json:"setup_done_when,omitempty"`
+	SetupMarkers    bool              `json:"setup_markers,omitempty"`
+	Environment     map[string]string `json:"environment,omitempty"`
+	Ports           []string          `json:"ports,omitempty"`
+	Volumes         []string          `json:"volumes,omitempty"`
+	Dotfiles        []string          `json:"dotfiles,omitempty"`
+	WorkingDir      string            `json:"working_dir,omitempty"`
+	WorkspaceSubdir string            `json:"workspace_subdir,omitempty"`
+	Shell           string            `json:"shell,omitempty"`
+	User            string            `json:"user,omitempty"`
+	Capabilities    []string          `json:"capabilities,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Network         string            `json:"network,omitempty"`
+	Restart         string            `json:"restart,omitempty"`
+	HealthCheck     *HealthCheck      `json:"health_check,omitempty"`
+	Resources       *Resources        `json:"resources,omitempty"`
+	Gpus            string            `json:"gpus,omitempty"`
+	Command         []string          `json:"command,omitempty"`
+	TestCommand     string            `json:"test_command,omitempty"`
+	Stacks          []string          `json:"stacks,omitempty"`
+	ReadOnly        bool              `json:"read_only,omitempty"`
+	// InjectSecrets sets the project's vault secrets as environment
+	// variables when up or clone creates the island
+	InjectSecrets bool `json:"inject_secrets,omitempty"`
+	// TrackedFiles are island paths, globs allowed, whose checksums the lock
+	// records so verify catches edits the package checks miss
+	TrackedFiles []string `json:"tracked_files,omitempty"`
 }
 
 type HealthCheck struct {
@@ -62,6 +97,13 @@ type ConfigTemplate struct {
 	Config      ProjectConfig `json:"config"`
 }
 
+type Recipe struct {
+	Name        string        `json:"name"`
+	Version     string        `json:"version"`
+	Description string        `json:"description,omitempty"`
+	Config      ProjectConfig `json:"config"`
+}
+
 const ProjectConfigJSONSchema = `{
 	"$schema": "http://json-schema.org/draft-07/schema#",
 	"title": "Coderaft Project Config",
@@ -71,11 +113,16 @@ const ProjectConfigJSONSchema = `{
 		"name": {"type": "string", "minLength": 1},
 		"base_image": {"type": "string"},
 		"setup_commands": {"type": "array", "items": {"type": "string"}},
+		"setup_done_when": {"type": "object", "additionalProperties": {"type": "string", "minLength": 1}},
+		"setup_markers": {"type": "boolean"},
 		"environment": {"type": "object", "additionalProperties": {"type": "string"}},
 		"ports": {"type": "array", "items": {"type": "string"}},
 		"volumes": {"type": "array", "items": {"type": "string"}},
 		"dotfiles": {"type": "array", "items": {"type": "string"}},
 		"working_dir": {"type": "string"},
+		"workspace_subdir": {"type": "string"},
+		"read_only": {"type": "boolean"},
+		"stacks": {"type": "array", "items": {"type": "string"}},
 		"shell": {"type": "string"},
 		"user": {"type": "string"},
 		"capabilities": {"type": "array", "items": {"type": "string"}},
@@ -101,7 +148,10 @@ const ProjectConfigJSONSchema = `{
 			},
 			"additionalProperties": false
 		},
-		"gpus": {"type": "string"}
+		"gpus": {"type": "string"},
+		"command": {"type": "array", "items": {"type": "string"}, "minItems": 1},
+		"test_command": {"type": "string"},
+		"tracked_files": {"type": "array", "items": {"type": "string", "minLength": 1}}
 	},
 	"additionalProperties": false
 }`
@@ -0,0 +1,102 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Files inside the island that track a setup started with StartBackgroundSetup
+const (
+	BackgroundSetupLog   = "/var/lib/coderaft/setup.log"
+	backgroundSetupState = "/var/lib/coderaft/setup.state"
+	backgroundSetupPID   = "/var/lib/coderaft/setup.pid"
+)
+
+// Background setup states. SetupStateNone means no background setup was ever
+// started in the island.
+const (
+	SetupStateNone        = ""
+	SetupStateRunning     = "running"
+	SetupStateDone        = "done"
+	SetupStateFailed      = "failed"
+	SetupStateInterrupted = "interrupted"
+)
+
+// SetupState is the progress of a background setup
+type SetupState struct {
+	State string
+	// ExitCode is set for SetupStateFailed
+	ExitCode int
+}
+
+// BackgroundSetupScript runs commands in order, stopping at the first
+// failure, with all output going to BackgroundSetupLog. The state file says
+// "running" until the commands finish, then "done" or "failed <code>".
+func BackgroundSetupScript(commands []string) string {
+	var b strings.Builder
+	b.WriteString("mkdir -p /var/lib/coderaft\n")
+	fmt.Fprintf(&b, "echo $$ > %s\n", backgroundSetupPID)
+	fmt.Fprintf(&b, "echo running > %s\n", backgroundSetupState)
+	b.WriteString("(\n. /root/.bashrc >/dev/null 2>&1 || true\nset -e\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "printf '==> %%s\\n' \"%s\"\n", escapeShellVar(cmd))
+		b.WriteString(cmd)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, ") > %s 2>&1\n", BackgroundSetupLog)
+	b.WriteString("code=$?\n")
+	fmt.Fprintf(&b, "if [ \"$code\" -eq 0 ]; then echo done > %s; else echo \"failed $code\" > %s; fi\n", backgroundSetupState, backgroundSetupState)
+	return b.String()
+}
+
+// StartBackgroundSetup runs commands in the island with a detached exec, so
+// they keep going after coderaft exits. Use GetSetupState to check on them.
+func (c *Client) StartBackgroundSetup(islandName string, commands []string) error {
+	cmd := exec.Command(dockerCmd(), "exec", "-d", islandName, "bash", "-c", BackgroundSetupScript(commands))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// GetSetupState reports the island's background setup. A setup whose process
+// is gone while the state still says running, e.g. because the island was
+// restarted, is reported as interrupted.
+func (c *Client) GetSetupState(islandName string) SetupState {
+	out, _, err := c.ExecCapture(islandName, fmt.Sprintf(
+		`s=$(cat %s 2>/dev/null || true); if [ "$s" = running ] && ! kill -0 "$(cat %s 2>/dev/null)" 2>/dev/null; then echo %s; else echo "$s"; fi`,
+		backgroundSetupState, backgroundSetupPID, SetupStateInterrupted))
+	if err != nil {
+		return SetupState{}
+	}
+	return ParseSetupState(out)
+}
+
+// ParseSetupState reads the contents of the state file
+func ParseSetupState(out string) SetupState {
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return SetupState{}
+	}
+	state := SetupState{State: fields[0]}
+	if state.State == SetupStateFailed && len(fields) > 1 {
+		state.ExitCode, _ = strconv.Atoi(fields[1])
+	}
+	return state
+}
+
+// FollowBackgroundSetupLog prints the background setup log and keeps printing
+// new output until the setup finishes
+func FollowBackgroundSetupLog(islandName string) error {
+	script := fmt.Sprintf(`tail -n +1 -f --pid="$(cat %s)" %s`, backgroundSetupPID, BackgroundSetupLog)
+	cmd := exec.Command(dockerCmd(), "exec", islandName, "bash", "-c", script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to follow setup log: %w", err)
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 
 type Client struct {
 	sdk *sdkClient
+	ctx context.Context
 }
 
 func NewClient() (*Client, error) {
@@ -33,8 +34,28 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// WithContext returns a client sharing the same connection whose Docker calls
+// are cancelled when ctx is done
+func (c *Client) WithContext(ctx context.Context) *Client {
+	return &Client{sdk: c.sdk, ctx: ctx}
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
 func (c *Client) SDKExecFunc() func(ctx context.Context, containerID string, cmd []string, showOutput bool) (string, string, int, error) {
 	return func(ctx context.Context, containerID string, cmd []string, showOutput bool) (string, string, int, error) {
+		if c.ctx != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+			stop := context.AfterFunc(c.ctx, cancel)
+			defer stop()
+		}
 		result, err := c.sdk.containerExec(ctx, containerID, cmd, showOutput)
 		if err != nil {
 			return "", "", -1, err
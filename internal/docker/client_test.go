@@ -1,8 +1,22 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+
+	"coderaft/internal/errdefs"
 )
 
 func TestNewClient(t *testing.T) {
@@ -64,3 +78,449 @@ func TestEscapeShellVar(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAptPreferences(t *testing.T) {
+	out := aptPreferencesMarker + "/etc/apt/preferences.d/hold\nPackage: curl\nPin: version 7.*\n\n" +
+		aptPreferencesMarker + "/etc/apt/preferences.d/empty\n\n"
+	prefs := ParseAptPreferences(out)
+	if len(prefs) != 2 {
+		t.Fatalf("expected 2 files, got %v", prefs)
+	}
+	if prefs["/etc/apt/preferences.d/hold"] != "Package: curl\nPin: version 7.*" {
+		t.Errorf("unexpected contents: %q", prefs["/etc/apt/preferences.d/hold"])
+	}
+	if ParseAptPreferences("") != nil {
+		t.Error("expected nil for no files")
+	}
+}
+
+func TestParseSystemSettings(t *testing.T) {
+	got := ParseSystemSettings("locale=de_DE.UTF-8\ntimezone=Europe/Berlin\n")
+	if got.Locale != "de_DE.UTF-8" || got.Timezone != "Europe/Berlin" {
+		t.Errorf("unexpected settings: %+v", got)
+	}
+
+	got = ParseSystemSettings("locale=C\ntimezone=Etc/UTC\n")
+	if got.Locale != "" || got.Timezone != "" {
+		t.Errorf("defaults should be dropped, got %+v", got)
+	}
+
+	got = ParseSystemSettings("locale=\ntimezone=\n")
+	if got.Locale != "" || got.Timezone != "" {
+		t.Errorf("empty values should be dropped, got %+v", got)
+	}
+}
+
+func TestParseFileChecksums(t *testing.T) {
+	sum := strings.Repeat("a", 64)
+	got := ParseFileChecksums(sum + "  /etc/pip.conf\n" + sum + " */etc/ssl/certs/corp.pem\nsha256sum: /etc/missing: No such file\n")
+	if len(got) != 2 || got["/etc/pip.conf"] != "sha256:"+sum || got["/etc/ssl/certs/corp.pem"] != "sha256:"+sum {
+		t.Errorf("unexpected checksums: %v", got)
+	}
+	if ParseFileChecksums("") != nil {
+		t.Error("expected nil for no files")
+	}
+}
+
+func TestParseIslandFiles(t *testing.T) {
+	out := islandFileMarker + "/etc/pip.conf\n" + base64.StdEncoding.EncodeToString([]byte("[global]\nindex-url = https://pypi.example\n")) + "\n" +
+		islandFileMarker + "/etc/apt/preferences\n\n"
+	got, err := ParseIslandFiles(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/etc/pip.conf": "[global]\nindex-url = https://pypi.example\n", "/etc/apt/preferences": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseIslandFiles = %q, want %q", got, want)
+	}
+	if _, err := ParseIslandFiles(islandFileMarker + "/etc/pip.conf\nnot base64!\n"); err == nil {
+		t.Error("expected an error for corrupt contents")
+	}
+	if got, _ := ParseIslandFiles(""); got != nil {
+		t.Errorf("expected nil for no files, got %v", got)
+	}
+}
+
+func TestExtractCopyTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(hdr *tar.Header, body string) {
+		hdr.Size = int64(len(body))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	add(&tar.Header{Name: "reports/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	add(&tar.Header{Name: "reports/unit.xml", Typeflag: tar.TypeReg, Mode: 0644}, "<unit/>")
+	add(&tar.Header{Name: "reports/html/index.html", Typeflag: tar.TypeReg, Mode: 0644}, "<html/>")
+	add(&tar.Header{Name: "reports/latest", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, "")
+	tw.Close()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	n, err := extractCopyTar(&buf, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("copied %d files, want 2", n)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "html", "index.html")); string(data) != "<html/>" {
+		t.Errorf("unexpected index.html: %q", data)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "latest")); !os.IsNotExist(err) {
+		t.Error("symlinks should be skipped")
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	add(&tar.Header{Name: "coverage.xml", Typeflag: tar.TypeReg, Mode: 0644}, "<coverage/>")
+	tw.Close()
+	file := filepath.Join(t.TempDir(), "cov.xml")
+	if _, err := extractCopyTar(&buf, file); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "<coverage/>" {
+		t.Errorf("a single file should be written to the destination itself, got %q", data)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	add(&tar.Header{Name: "reports/../../evil", Typeflag: tar.TypeReg, Mode: 0644}, "x")
+	tw.Close()
+	if _, err := extractCopyTar(&buf, filepath.Join(t.TempDir(), "out")); err == nil {
+		t.Error("expected an error for an entry outside the destination")
+	}
+}
+
+func TestParseSetupState(t *testing.T) {
+	tests := []struct {
+		out  string
+		want SetupState
+	}{
+		{"", SetupState{}},
+		{"running\n", SetupState{State: SetupStateRunning}},
+		{"done\n", SetupState{State: SetupStateDone}},
+		{"failed 127\n", SetupState{State: SetupStateFailed, ExitCode: 127}},
+		{"interrupted\n", SetupState{State: SetupStateInterrupted}},
+	}
+	for _, tt := range tests {
+		if got := ParseSetupState(tt.out); got != tt.want {
+			t.Errorf("ParseSetupState(%q) = %+v, want %+v", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestBackgroundSetupScript(t *testing.T) {
+	script := BackgroundSetupScript([]string{"npm ci", `echo "$HOME"`})
+	for _, want := range []string{
+		"echo running > /var/lib/coderaft/setup.state\n",
+		"set -e\nprintf '==> %s\\n' \"npm ci\"\nnpm ci\n",
+		"printf '==> %s\\n' \"echo \\\"\\$HOME\\\"\"\necho \"$HOME\"\n",
+		") > " + BackgroundSetupLog + " 2>&1\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Index(script, "npm ci\n") > strings.Index(script, `echo "$HOME"`) {
+		t.Error("commands should run in the order given")
+	}
+}
+
+func TestRunCommandPipesStdin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake engine is a shell script")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	useFakeExecEngine(t)
+
+	input := strings.Repeat("line of piped input\n", 5000)
+	var stdout, stderr bytes.Buffer
+	if err := runCommandIO("island", []string{"cat"}, nil, "", false, strings.NewReader(input), &stdout, &stderr, 0); err != nil {
+		t.Fatalf("runCommandIO() error = %v (stderr: %s)", err, stderr.String())
+	}
+	if stdout.String() != input {
+		t.Errorf("cat should echo all %d bytes of input, got %d", len(input), stdout.Len())
+	}
+
+	// Without stdin attached the command sees end of input right away
+	stdout.Reset()
+	if err := runCommandIO("island", []string{"wc", "-c"}, nil, "", false, nil, &stdout, &stderr, 0); err != nil {
+		t.Fatalf("runCommandIO() error = %v (stderr: %s)", err, stderr.String())
+	}
+	if got := strings.TrimSpace(stdout.String()); got != "0" {
+		t.Errorf("expected no input without stdin, got %q", got)
+	}
+}
+
+func TestRunCommandWorkdirAndExitStatus(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake engine is a shell script")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	useFakeExecEngine(t)
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if err := runCommandIO("island", []string{"pwd", "-P"}, nil, dir, false, nil, &stdout, &stderr, 0); err != nil {
+		t.Fatalf("runCommandIO() error = %v (stderr: %s)", err, stderr.String())
+	}
+	if got := strings.TrimSpace(stdout.String()); got != dir {
+		t.Errorf("command ran in %q, want %q", got, dir)
+	}
+
+	// the command's own exit status is kept for the caller
+	err = runCommandIO("island", []string{"exit", "3"}, nil, "", false, nil, &stdout, &stderr, 0)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestRunCommandCopiesOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake engine is a shell script")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	useFakeExecEngine(t)
+
+	var output bytes.Buffer
+	if err := RunCommand("island", []string{"ls", "/nonexistent-coderaft-path", "/"}, nil, "", false, 0, &output); err == nil {
+		t.Fatal("expected ls to fail on the missing path")
+	}
+	// both streams end up in the copy
+	if got := output.String(); !strings.Contains(got, "nonexistent-coderaft-path") || !strings.Contains(got, "tmp") {
+		t.Errorf("output copy = %q, want stdout and stderr", got)
+	}
+}
+
+// useFakeExecEngine installs an engine that drops 'exec', its flags and the
+// island name, then runs the command locally with the streams it was given.
+// -w changes to the directory, as docker exec does.
+func useFakeExecEngine(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+shift
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-i|-t) shift ;;
+	-e) shift 2 ;;
+	-w) cd "$2" || exit 126; shift 2 ;;
+	*) break ;;
+	esac
+done
+shift
+exec "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "fake-engine"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("CODERAFT_ENGINE", "fake-engine")
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake engine is a shell script")
+	}
+	for _, tool := range []string{"bash", "timeout"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+	useFakeExecEngine(t)
+	// stand in for the island's bash without the host's startup files, which
+	// can take longer to load than the timeout
+	bashPath, _ := exec.LookPath("bash")
+	stubDir := t.TempDir()
+	stub := "#!/bin/sh\nshift\nexec " + bashPath + " --noprofile --norc -c \"${1#*set -e; }\"\n"
+	if err := os.WriteFile(filepath.Join(stubDir, "bash"), []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// the command writes its pid, then sleeps well past the timeout
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	err := runCommandIO("island", []string{"sh", "-c", "echo $$ > " + pidFile + "; exec sleep 30"}, nil, "", false, nil, &stdout, &stderr, time.Second)
+	if !errors.Is(err, errdefs.ErrTimeout) {
+		t.Fatalf("expected a timeout error, got %v (stderr: %s)", err, stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command should be stopped soon after the timeout, took %s", elapsed)
+	}
+
+	// the process itself is gone, not just the client
+	data, readErr := os.ReadFile(pidFile)
+	if readErr != nil {
+		t.Fatalf("command never started: %v", readErr)
+	}
+	pid := strings.TrimSpace(string(data))
+	if out, err := exec.Command("ps", "-o", "stat=", "-p", pid).Output(); err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z") {
+		t.Errorf("process %s is still running after the timeout", pid)
+	}
+
+	// a command that finishes in time is unaffected
+	stdout.Reset()
+	if err := runCommandIO("island", []string{"echo", "done"}, nil, "", false, nil, &stdout, &stderr, 5*time.Second); err != nil || strings.TrimSpace(stdout.String()) != "done" {
+		t.Errorf("got %q, %v; want done", stdout.String(), err)
+	}
+}
+
+func TestTimeoutPrefix(t *testing.T) {
+	if got := strings.Join(timeoutPrefix(1500*time.Millisecond), " "); got != "timeout -s TERM -k 5 2" {
+		t.Errorf("timeoutPrefix(1.5s) = %q", got)
+	}
+	if got := strings.Join(timeoutPrefix(10*time.Minute), " "); got != "timeout -s TERM -k 5 600" {
+		t.Errorf("timeoutPrefix(10m) = %q", got)
+	}
+}
+
+func TestIslandSetupScriptDirenvHook(t *testing.T) {
+	script := islandSetupScript("coderaft_app", "app")
+	if !strings.Contains(script, direnvHook) {
+		t.Fatal("setup script should add the direnv hook to the bashrc")
+	}
+	// re-running setup replaces the hook instead of stacking another copy
+	if !strings.Contains(script, "sed -i '/"+direnvHookStart+"/,/"+direnvHookEnd+"/d' /root/.bashrc") {
+		t.Error("setup script should remove the previous direnv hook")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+	if out, err := exec.Command("bash", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("setup script doesn't parse: %v\n%s", err, out)
+	}
+
+	// a shell that isn't interactive loads the .envrc once through 'direnv export'
+	dir := t.TempDir()
+	fake := "#!/bin/sh\n[ \"$1\" = export ] && echo 'export FROM_ENVRC=1'\n"
+	if err := os.WriteFile(filepath.Join(dir, "direnv"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("bash", "-c", direnvHook+"\necho \"$FROM_ENVRC\"")
+	cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if out, err := cmd.Output(); err != nil || strings.TrimSpace(string(out)) != "1" {
+		t.Errorf("hook with direnv installed = %q, %v; want the .envrc loaded", out, err)
+	}
+
+	// without direnv the hook does nothing
+	cmd = exec.Command("bash", "--noprofile", "--norc", "-c", direnvHook+"\necho ok")
+	cmd.Env = []string{"PATH=" + t.TempDir()}
+	if out, err := cmd.Output(); err != nil || strings.TrimSpace(string(out)) != "ok" {
+		t.Errorf("hook without direnv = %q, %v", out, err)
+	}
+}
+
+func TestParseOSFamily(t *testing.T) {
+	alpine := `NAME="Alpine Linux"
+ID=alpine
+VERSION_ID=3.19.1
+PRETTY_NAME="Alpine Linux v3.19"
+HOME_URL="https://alpinelinux.org/"
+`
+	debian := `PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+NAME="Debian GNU/Linux"
+VERSION_CODENAME=bookworm
+ID=debian
+`
+	ubuntu := "NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n"
+	postmarket := "ID=postmarketos\nID_LIKE=\"alpine\"\n"
+	tests := map[string]string{alpine: OSFamilyAlpine, debian: OSFamilyDebian, ubuntu: OSFamilyDebian, postmarket: OSFamilyAlpine, "": OSFamilyDebian}
+	for osRelease, want := range tests {
+		if got := ParseOSFamily(osRelease); got != want {
+			t.Errorf("ParseOSFamily(%q) = %q, want %q", osRelease, got, want)
+		}
+	}
+	if m := SystemPackagesFor(ParseOSFamily(alpine)).Manager; m != "apk" {
+		t.Errorf("alpine should use apk, got %q", m)
+	}
+	if m := SystemPackagesFor(ParseOSFamily(debian)).Manager; m != "apt" {
+		t.Errorf("debian should use apt, got %q", m)
+	}
+}
+
+func TestParseApkPackages(t *testing.T) {
+	out := `alpine-baselayout
+curl
+py3-pip>23
+---
+alpine-baselayout-3.4.3-r2 - Alpine base dir structure and init scripts
+curl-8.5.0-r0 - URL retrival utility and library
+musl-1.2.4_git20230717-r4 - the musl c library (libc) implementation
+py3-pip-23.3.1-r0 - Tool for installing and managing Python packages
+WARNING: opening /etc/apk/repositories: No such file or directory
+`
+	want := []string{"alpine-baselayout=3.4.3-r2", "curl=8.5.0-r0", "py3-pip=23.3.1-r0"}
+	if got := ParseApkPackages(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseApkPackages() = %v, want %v", got, want)
+	}
+
+	apk := SystemPackagesFor(OSFamilyAlpine)
+	if got := apk.InstallCommands([]string{"curl=8.5.0-r0"}); !reflect.DeepEqual(got, []string{"apk add --no-cache curl=8.5.0-r0"}) {
+		t.Errorf("InstallCommands() = %q", got)
+	}
+	if got := apk.RemoveCommands([]string{"vim"}); !reflect.DeepEqual(got, []string{"apk del vim"}) {
+		t.Errorf("RemoveCommands() = %q", got)
+	}
+	if got := apk.InstallCommands(nil); got != nil {
+		t.Errorf("InstallCommands(nil) = %q, want nil", got)
+	}
+}
+
+func TestParseCachedImages(t *testing.T) {
+	out := "coderaft-cache/web:3f2a9c\t1.2GB\t2024-03-01 12:30:45 +0000 UTC\n" +
+		"<none>:<none>\t300MB\t2024-02-01 08:00:00 +0000 UTC\n" +
+		"ghcr.io/acme/envs:node-20\t512MB\t2024-01-15 09:10:11 +0100 CET\n" +
+		"garbage\n"
+	got := ParseCachedImages(out)
+	if len(got) != 2 {
+		t.Fatalf("ParseCachedImages() = %+v, want 2 images", got)
+	}
+	if got[0].Ref != "coderaft-cache/web:3f2a9c" || got[0].Size != 1200000000 {
+		t.Errorf("first image = %+v", got[0])
+	}
+	if want := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC); !got[0].Created.Equal(want) {
+		t.Errorf("first image created %v, want %v", got[0].Created, want)
+	}
+	if got[1].Ref != "ghcr.io/acme/envs:node-20" || got[1].Size != 512000000 {
+		t.Errorf("second image = %+v", got[1])
+	}
+	if want := time.Date(2024, 1, 15, 8, 10, 11, 0, time.UTC); !got[1].Created.Equal(want) {
+		t.Errorf("second image created %v, want %v", got[1].Created, want)
+	}
+}
+
+func TestCommitConfig(t *testing.T) {
+	if got := commitConfig(&container.Config{Env: []string{"A=1"}}); got != nil {
+		t.Errorf("commitConfig without the label = %+v, want nil", got)
+	}
+
+	cfg := &container.Config{
+		Env:    []string{"PATH=/usr/bin", "API_KEY=hunter2", "TOKEN=a=b", "TOKENS=keep"},
+		Labels: map[string]string{SecretEnvLabel: "API_KEY,TOKEN"},
+	}
+	got := commitConfig(cfg)
+	want := []string{"PATH=/usr/bin", "API_KEY=", "TOKEN=", "TOKENS=keep"}
+	if got == nil || !reflect.DeepEqual(got.Env, want) {
+		t.Fatalf("commitConfig env = %v, want %v", got, want)
+	}
+	if cfg.Env[1] != "API_KEY=hunter2" {
+		t.Errorf("commitConfig changed the container's config: %v", cfg.Env)
+	}
+}
@@ -0,0 +1,86 @@
+package docker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CopyFromIsland copies srcPath, a file or a directory in the island, to
+// destPath on the host, like 'docker cp'. Directories are copied with
+// everything in them; symlinks and special files are skipped. It returns
+// the number of files copied.
+func (c *Client) CopyFromIsland(islandName, srcPath, destPath string) (int, error) {
+	rc, err := c.sdk.containerCopyFrom(c.context(), islandName, srcPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s from island: %w", srcPath, err)
+	}
+	defer rc.Close()
+	return extractCopyTar(rc, destPath)
+}
+
+// ExpandIslandPaths returns the paths in the island matching pattern, an
+// absolute path that may contain * ? and [] globs. The pattern is expanded
+// by the island's shell, so it must not need quoting.
+func (c *Client) ExpandIslandPaths(islandName, pattern string) ([]string, error) {
+	out, _, err := c.ExecCapture(islandName, `for f in `+pattern+`; do [ -e "$f" ] && printf '%s\n' "$f"; done; true`)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// extractCopyTar writes the tar stream CopyFromContainer returns to destPath.
+// The stream's top-level entry, named after the source, becomes destPath.
+func extractCopyTar(r io.Reader, destPath string) (int, error) {
+	tr := tar.NewReader(r)
+	copied := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, fmt.Errorf("failed to read copied files: %w", err)
+		}
+
+		_, rel, _ := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		rel = filepath.Clean(filepath.FromSlash(rel))
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			return copied, fmt.Errorf("refusing to write %s outside %s", hdr.Name, destPath)
+		}
+		target := filepath.Join(destPath, rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return copied, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return copied, err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777|0600)
+			if err != nil {
+				return copied, err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return copied, fmt.Errorf("failed to write %s: %w", target, err)
+			}
+			copied++
+		}
+	}
+}
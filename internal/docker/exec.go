@@ -3,11 +3,17 @@ package docker
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
 
 	"coderaft/internal/engine"
+	"coderaft/internal/errdefs"
 	"coderaft/internal/security"
 )
 
@@ -29,12 +35,18 @@ func escapeShellVar(s string) string {
 }
 
 func AttachShell(islandName string, projectName string) error {
+	return AttachShellCommand(islandName, projectName, "exec /bin/bash")
+}
 
+// AttachShellCommand is AttachShell with command in place of the bash shell,
+// such as a terminal multiplexer that starts one. The coderaft prompt is
+// exported first so shells the command starts pick it up.
+func AttachShellCommand(islandName, projectName, command string) error {
 	cmd := exec.Command(dockerCmd(), "exec", "-it",
 		"-e", fmt.Sprintf("CODERAFT_ISLAND_NAME=%s", islandName),
 		"-e", fmt.Sprintf("PROJECT_NAME=%s", projectName),
 		islandName, "/bin/bash", "-c",
-		"export PS1='coderaft(\\$PROJECT_NAME):\\w\\$ '; exec /bin/bash")
+		"export PS1='coderaft(\\$PROJECT_NAME):\\w\\$ '; "+command)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -52,9 +64,97 @@ func AttachShell(islandName string, projectName string) error {
 	return nil
 }
 
+// AttachSiblingShell opens an interactive shell in a short-lived sibling of
+// islandName with extra bind mounts, since Docker can't add mounts to a running
+// container. The sibling runs from a snapshot of the island, shares its volumes
+// and network namespace, and is removed with the snapshot when the shell exits.
+func AttachSiblingShell(islandName, projectName string, mounts []string) error {
+	snapshot := fmt.Sprintf("coderaft-shell-%s:%d", strings.ToLower(projectName), time.Now().Unix())
+	if out, err := exec.Command(dockerCmd(), "commit", islandName, snapshot).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to snapshot island: %s", strings.TrimSpace(string(out)))
+	}
+	defer exec.Command(dockerCmd(), "rmi", "--force", snapshot).Run()
+
+	args := []string{"run", "--rm", "-it",
+		"--volumes-from", islandName,
+		"--network", "container:" + islandName,
+		"-e", fmt.Sprintf("CODERAFT_ISLAND_NAME=%s", islandName),
+		"-e", fmt.Sprintf("PROJECT_NAME=%s", projectName),
+	}
+	for _, m := range mounts {
+		args = append(args, "-v", m)
+	}
+	args = append(args, snapshot, "/bin/bash", "-c",
+		"export PS1='coderaft(\\$PROJECT_NAME+):\\w\\$ '; exec /bin/bash")
+
+	cmd := exec.Command(dockerCmd(), args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code := exitErr.ExitCode()
+			if code == 130 || code == 137 || code == 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf("failed to attach shell: %w", err)
+	}
+	return nil
+}
+
 // RunCommand executes a command inside the specified island container.
-// Commands are validated for safety before execution.
-func RunCommand(islandName string, command []string) error {
+// Commands are validated for safety before execution. env holds KEY=VALUE
+// pairs set for this exec only, and a non-empty workdir is the directory it
+// runs in instead of the island's working directory. With attachStdin the command reads this
+// process's stdin until it ends; otherwise it gets no input. A TTY is
+// allocated only when stdin is attached and both stdin and stdout are
+// terminals, so the command can be piped. A non-nil output gets a copy of
+// everything the command writes to stdout and stderr; no TTY is allocated
+// then, so the copy has no terminal control sequences. A non-zero timeout
+// bounds the command's runtime; see runCommandIO.
+func RunCommand(islandName string, command []string, env []string, workdir string, attachStdin bool, timeout time.Duration, output io.Writer) error {
+	var stdin io.Reader
+	tty := false
+	if attachStdin {
+		stdin = os.Stdin
+		tty = term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+	}
+	stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if output != nil {
+		tty = false
+		output = &syncWriter{w: output}
+		stdout, stderr = io.MultiWriter(stdout, output), io.MultiWriter(stderr, output)
+	}
+	return runCommandIO(islandName, command, env, workdir, tty, stdin, stdout, stderr, timeout)
+}
+
+// syncWriter serializes writes, for a writer stdout and stderr are both
+// copied to from separate goroutines
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// commandKillGrace is how long a timed-out command gets to exit after
+// SIGTERM before it is killed
+const commandKillGrace = 5 * time.Second
+
+// runCommandIO is RunCommand with its streams passed in. A nil stdin runs the
+// exec without -i.
+//
+// With a timeout, the command runs under timeout(1) in the island, so the
+// process there is sent SIGTERM, then SIGKILL, rather than left running when
+// the client goes away. The docker exec client is killed too if it hasn't
+// returned shortly after. Either way the error is tagged errdefs.ErrTimeout.
+func runCommandIO(islandName string, command []string, env []string, workdir string, tty bool, stdin io.Reader, stdout, stderr io.Writer, timeout time.Duration) error {
 	if err := security.ValidateShellCommand(command); err != nil {
 		return fmt.Errorf("invalid command: %w", err)
 	}
@@ -67,18 +167,50 @@ func RunCommand(islandName string, command []string) error {
 
 	cmdStr := strings.Join(sanitizedParts, " ")
 	wrapped := security.WrapShellCommand(cmdStr)
-	args := []string{"exec", "-it", islandName, "bash", "-lc", wrapped}
-	cmd := exec.Command(dockerCmd(), args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	args := []string{"exec"}
+	if stdin != nil {
+		args = append(args, "-i")
+	}
+	if tty {
+		args = append(args, "-t")
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	if workdir != "" {
+		args = append(args, "-w", workdir)
+	}
+	args = append(args, islandName)
+	ctx := context.Background()
+	if timeout > 0 {
+		args = append(args, timeoutPrefix(timeout)...)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout+2*commandKillGrace)
+		defer cancel()
+	}
+	args = append(args, "bash", "-lc", wrapped)
+	cmd := exec.CommandContext(ctx, dockerCmd(), args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
+	start := time.Now()
 	if err := cmd.Run(); err != nil {
+		if timeout > 0 && time.Since(start) >= timeout {
+			return errdefs.Errorf(errdefs.ErrTimeout, "command timed out after %s and was terminated", timeout)
+		}
 		return fmt.Errorf("failed to run command: %w", err)
 	}
 	return nil
 }
 
+// timeoutPrefix runs a command under timeout(1) for d, rounded up to whole
+// seconds since busybox's timeout takes no fractions
+func timeoutPrefix(d time.Duration) []string {
+	secs := int((d + time.Second - 1) / time.Second)
+	return []string{"timeout", "-s", "TERM", "-k", fmt.Sprintf("%d", int(commandKillGrace/time.Second)), fmt.Sprintf("%d", secs)}
+}
+
 func (c *Client) RunDockerCommand(args []string) error {
 	cmd := exec.Command(dockerCmd(), args...)
 	cmd.Stdout = os.Stdout
@@ -94,7 +226,7 @@ func (c *Client) RunDockerCommand(args []string) error {
 // The command is wrapped with bashrc sourcing and pipefail for proper error handling.
 func (c *Client) ExecCapture(islandName, command string) (string, string, error) {
 	wrapped := ". /root/.bashrc >/dev/null 2>&1 || true; set -o pipefail; " + command
-	ctx, cancel := context.WithTimeout(context.Background(), security.Timeouts.ContainerExec)
+	ctx, cancel := context.WithTimeout(c.context(), security.Timeouts.ContainerExec)
 	defer cancel()
 
 	result, err := c.sdk.containerExec(ctx, islandName, []string{"bash", "-lc", wrapped}, false)
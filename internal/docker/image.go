@@ -1,20 +1,53 @@
 package docker
 
 import (
-	"context"
 	"fmt"
 	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
 
 	"coderaft/internal/ui"
 )
 
-func (c *Client) PullImage(ref string) error {
-	ctx := context.Background()
+// Pull policies, named after Kubernetes' imagePullPolicy
+const (
+	PullAlways  = "always"
+	PullMissing = "missing"
+	PullNever   = "never"
+)
 
-	exists, err := c.sdk.imageExists(ctx, ref)
-	if err == nil && exists {
+// ValidatePullPolicy reports whether policy is one PullImageWithPolicy accepts
+func ValidatePullPolicy(policy string) error {
+	switch policy {
+	case PullAlways, PullMissing, PullNever:
 		return nil
 	}
+	return fmt.Errorf("invalid pull policy '%s' (expected %s, %s or %s)", policy, PullAlways, PullMissing, PullNever)
+}
+
+func (c *Client) PullImage(ref string) error {
+	return c.PullImageWithPolicy(ref, PullMissing)
+}
+
+// PullImageWithPolicy pulls ref according to policy: always re-pulls to pick up
+// a moved tag, missing pulls only when the image isn't local, and never fails
+// instead of touching the network when it isn't.
+func (c *Client) PullImageWithPolicy(ref, policy string) error {
+	if err := ValidatePullPolicy(policy); err != nil {
+		return err
+	}
+	ctx := c.context()
+
+	if policy != PullAlways {
+		exists, err := c.sdk.imageExists(ctx, ref)
+		if err == nil && exists {
+			return nil
+		}
+		if policy == PullNever {
+			return fmt.Errorf("image %s is not present locally and pull policy is '%s'", ref, PullNever)
+		}
+	}
 
 	ui.Status("pulling image %s...", ref)
 	if err := c.sdk.pullImage(ctx, ref); err != nil {
@@ -24,13 +57,45 @@ func (c *Client) PullImage(ref string) error {
 }
 
 func (c *Client) ImageExists(ref string) bool {
-	ctx := context.Background()
+	ctx := c.context()
 	exists, err := c.sdk.imageExists(ctx, ref)
 	return err == nil && exists
 }
 
+// SecretEnvLabel names, without values, the environment variables an island
+// got from the secrets vault
+const SecretEnvLabel = "coderaft.secret_env"
+
+// commitConfig returns the config to commit a container with: its own, with
+// the variables SecretEnvLabel names blanked so their values never reach the
+// image. The daemon merges the container's environment back into a commit
+// config, so a variable can be overridden but not dropped. Without the label
+// it returns nil and the container is committed as it is.
+func commitConfig(cfg *container.Config) *container.Config {
+	if cfg == nil {
+		return nil
+	}
+	names, ok := cfg.Labels[SecretEnvLabel]
+	if !ok {
+		return nil
+	}
+	secret := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		secret[name] = true
+	}
+	blanked := *cfg
+	blanked.Env = make([]string, 0, len(cfg.Env))
+	for _, kv := range cfg.Env {
+		if name, _, _ := strings.Cut(kv, "="); secret[name] {
+			kv = name + "="
+		}
+		blanked.Env = append(blanked.Env, kv)
+	}
+	return &blanked
+}
+
 func (c *Client) CommitContainer(containerName, imageTag string) (string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	id, err := c.sdk.commitContainer(ctx, containerName, imageTag)
 	if err != nil {
 		return "", err
@@ -45,7 +110,7 @@ func (c *Client) SaveImage(imageRef, tarPath string) error {
 	}
 	defer f.Close()
 
-	ctx := context.Background()
+	ctx := c.context()
 	return c.sdk.saveImage(ctx, imageRef, f)
 }
 
@@ -56,12 +121,12 @@ func (c *Client) LoadImage(tarPath string) (string, error) {
 	}
 	defer f.Close()
 
-	ctx := context.Background()
+	ctx := c.context()
 	return c.sdk.loadImage(ctx, f)
 }
 
 func (c *Client) GetImageDigestInfo(ref string) (string, string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 
 	imgInspect, _, err := c.sdk.cli.ImageInspectWithRaw(ctx, ref)
 	if err == nil {
@@ -1,16 +1,22 @@
 package docker
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"time"
 
+	units "github.com/docker/go-units"
+
+	"coderaft/internal/parallel"
 	"coderaft/internal/ui"
 )
 
@@ -61,6 +67,11 @@ func (cfg *BuildImageConfig) Fingerprint() string {
 	return hex.EncodeToString(h.Sum(nil))[:16]
 }
 
+// CacheTag is the local tag BuildCachedImage builds cfg's image under
+func (cfg *BuildImageConfig) CacheTag() string {
+	return fmt.Sprintf("coderaft-cache/%s:%s", cfg.ProjectName, cfg.Fingerprint())
+}
+
 func (ic *ImageCache) GenerateDockerfile(cfg *BuildImageConfig) string {
 	var b strings.Builder
 
@@ -170,7 +181,7 @@ func (ic *ImageCache) GenerateDockerfile(cfg *BuildImageConfig) string {
 
 func (ic *ImageCache) BuildCachedImage(cfg *BuildImageConfig) (string, error) {
 	fingerprint := cfg.Fingerprint()
-	imageTag := fmt.Sprintf("coderaft-cache/%s:%s", cfg.ProjectName, fingerprint)
+	imageTag := cfg.CacheTag()
 
 	if ic.imageExistsFunc != nil {
 		if ic.imageExistsFunc(imageTag) {
@@ -207,10 +218,13 @@ func (ic *ImageCache) BuildCachedImage(cfg *BuildImageConfig) (string, error) {
 	ui.Status("building cached image (fingerprint: %s)...", fingerprint)
 	cmd := exec.Command(dockerCmd(), args...)
 	cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = io.MultiWriter(ui.Writer(), &stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	parallel.AppendSetupLog("coderaft_"+cfg.ProjectName, "docker build -t "+imageTag, stdout.String(), stderr.String(), cmd.ProcessState.ExitCode())
+	if err != nil {
 		return "", fmt.Errorf("failed to build cached image: %w", err)
 	}
 
@@ -237,6 +251,66 @@ func (ic *ImageCache) CleanupImageCache(projectName string) error {
 	return nil
 }
 
+// CachedImage is a local image coderaft can rebuild or pull again: an image
+// cache build or a prebuilt image pulled from settings.prebuilt_registry
+type CachedImage struct {
+	Ref     string
+	Size    int64
+	Created time.Time
+}
+
+// cachedImageFormat is the 'docker images' format ParseCachedImages reads
+const cachedImageFormat = "{{.Repository}}:{{.Tag}}\t{{.Size}}\t{{.CreatedAt}}"
+
+// ListCachedImages lists the local images whose repository matches any of
+// the patterns, such as coderaft-cache/*
+func ListCachedImages(patterns ...string) ([]CachedImage, error) {
+	args := []string{"images", "--format", cachedImageFormat}
+	for _, p := range patterns {
+		args = append(args, "--filter", "reference="+p)
+	}
+	out, err := exec.Command(dockerCmd(), args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	return ParseCachedImages(string(out)), nil
+}
+
+// ParseCachedImages reads 'docker images' output in cachedImageFormat,
+// skipping untagged images
+func ParseCachedImages(out string) []CachedImage {
+	var images []CachedImage
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 3 || strings.Contains(fields[0], "<none>") {
+			continue
+		}
+		img := CachedImage{Ref: fields[0]}
+		if size, err := units.FromHumanSize(fields[1]); err == nil {
+			img.Size = size
+		}
+		// e.g. 2024-03-01 12:30:45 +0000 UTC
+		if created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", fields[2]); err == nil {
+			img.Created = created
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// RemoveCachedImage untags ref and deletes its layers unless another image or
+// a container still uses them. It fails for images an island was created from.
+func RemoveCachedImage(ref string) error {
+	out, err := exec.Command(dockerCmd(), "rmi", ref).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
 func extractAptPackages(cmd string) []string {
 
 	cmd = strings.TrimPrefix(cmd, "DEBIAN_FRONTEND=noninteractive ")
@@ -1,7 +1,6 @@
 package docker
 
 import (
-	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -17,12 +16,12 @@ type ContainerStats struct {
 }
 
 func (c *Client) GetContainerStats(islandName string) (*ContainerStats, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	return c.sdk.containerStats(ctx, islandName)
 }
 
 func (c *Client) GetContainerID(islandName string) (string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		return "", fmt.Errorf("failed to get island ID: %w", err)
@@ -30,8 +29,22 @@ func (c *Client) GetContainerID(islandName string) (string, error) {
 	return inspect.ID, nil
 }
 
+// GetIslandGeneration identifies one run of an island: its container ID and
+// when it last started. It changes whenever the island is recreated or
+// restarted.
+func (c *Client) GetIslandGeneration(islandName string) (string, error) {
+	inspect, err := c.sdk.containerInspect(c.context(), islandName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect island: %w", err)
+	}
+	if inspect.State == nil || !inspect.State.Running {
+		return "", fmt.Errorf("island '%s' is not running", islandName)
+	}
+	return inspect.ID + "@" + inspect.State.StartedAt, nil
+}
+
 func (c *Client) GetUptime(islandName string) (time.Duration, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		return 0, fmt.Errorf("failed to inspect island: %w", err)
@@ -51,7 +64,7 @@ func (c *Client) GetUptime(islandName string) (time.Duration, error) {
 }
 
 func (c *Client) GetPortMappings(islandName string) ([]string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		return []string{}, nil
@@ -68,7 +81,7 @@ func (c *Client) GetPortMappings(islandName string) ([]string, error) {
 }
 
 func (c *Client) GetMounts(islandName string) ([]string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get mounts: %w", err)
@@ -97,7 +110,7 @@ func (c *Client) IsContainerIdle(islandName string) (bool, error) {
 }
 
 func (c *Client) GetContainerMeta(islandName string) (map[string]string, string, string, string, map[string]string, []string, map[string]string, string) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		return map[string]string{}, "", "", "", map[string]string{}, []string{}, map[string]string{}, ""
@@ -133,3 +146,29 @@ func (c *Client) GetContainerMeta(islandName string) (map[string]string, string,
 
 	return env, inspect.Config.WorkingDir, inspect.Config.User, restartPolicy, inspect.Config.Labels, capAdd, resources, networkMode
 }
+
+// HealthStatus is the state of an island's healthcheck. Status is empty when
+// the container has no healthcheck, otherwise starting, healthy or unhealthy.
+type HealthStatus struct {
+	Status        string
+	FailingStreak int
+	// LastOutput is the output of the most recent check
+	LastOutput string
+}
+
+func (c *Client) GetHealthStatus(islandName string) (HealthStatus, error) {
+	ctx := c.context()
+	inspect, err := c.sdk.containerInspect(ctx, islandName)
+	if err != nil {
+		return HealthStatus{}, fmt.Errorf("failed to inspect island: %w", err)
+	}
+	if inspect.State == nil || inspect.State.Health == nil || inspect.State.Health.Status == "none" {
+		return HealthStatus{}, nil
+	}
+	h := inspect.State.Health
+	status := HealthStatus{Status: string(h.Status), FailingStreak: h.FailingStreak}
+	if n := len(h.Log); n > 0 && h.Log[n-1] != nil {
+		status.LastOutput = strings.TrimSpace(h.Log[n-1].Output)
+	}
+	return status, nil
+}
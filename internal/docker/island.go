@@ -1,7 +1,6 @@
 package docker
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -16,7 +15,7 @@ func (c *Client) CreateIsland(name, image, workspaceHost, workspaceIsland string
 }
 
 func (c *Client) CreateIslandWithConfig(name, image, workspaceHost, workspaceIsland string, projectConfig interface{}) (string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 
 	var config map[string]interface{}
 	if projectConfig != nil {
@@ -33,7 +32,7 @@ func (c *Client) CreateIslandWithConfig(name, image, workspaceHost, workspaceIsl
 }
 
 func (c *Client) StartIsland(islandID string) error {
-	ctx := context.Background()
+	ctx := c.context()
 	if err := c.sdk.containerStart(ctx, islandID); err != nil {
 		return fmt.Errorf("failed to start island: %w", err)
 	}
@@ -48,7 +47,7 @@ func (c *Client) StopIsland(islandName string) error {
 			timeoutSec = n
 		}
 	}
-	ctx := context.Background()
+	ctx := c.context()
 	if err := c.sdk.containerStop(ctx, islandName, timeoutSec); err != nil {
 		return fmt.Errorf("failed to stop island: %w", err)
 	}
@@ -56,7 +55,7 @@ func (c *Client) StopIsland(islandName string) error {
 }
 
 func (c *Client) RemoveIsland(islandName string) error {
-	ctx := context.Background()
+	ctx := c.context()
 	if err := c.sdk.containerRemove(ctx, islandName); err != nil {
 		return fmt.Errorf("failed to remove island: %w", err)
 	}
@@ -64,7 +63,7 @@ func (c *Client) RemoveIsland(islandName string) error {
 }
 
 func (c *Client) IslandExists(islandName string) (bool, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	_, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		if dockerclient.IsErrNotFound(err) {
@@ -76,7 +75,7 @@ func (c *Client) IslandExists(islandName string) (bool, error) {
 }
 
 func (c *Client) GetIslandStatus(islandName string) (string, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	inspect, err := c.sdk.containerInspect(ctx, islandName)
 	if err != nil {
 		if dockerclient.IsErrNotFound(err) {
@@ -121,7 +120,7 @@ type IslandInfo struct {
 }
 
 func (c *Client) ListIslands() ([]IslandInfo, error) {
-	ctx := context.Background()
+	ctx := c.context()
 	containers, err := c.sdk.containerList(ctx, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list islands: %w", err)
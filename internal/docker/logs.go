@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// LogOptions selects which of an island's output IslandLogs shows
+type LogOptions struct {
+	// Follow keeps streaming new output until the island stops
+	Follow bool
+	// Tail is how many lines from the end to show, or "all"
+	Tail string
+	// Since is a duration such as 10m, or a timestamp such as
+	// 2024-01-02T15:04:05Z
+	Since string
+}
+
+// IslandLogs writes what the island's main process, or anything writing to
+// its /proc/1/fd/1 and /proc/1/fd/2, has printed. It works on a stopped
+// island too, showing the output up to when it stopped.
+func (c *Client) IslandLogs(islandName string, opts LogOptions, stdout, stderr io.Writer) error {
+	ctx := c.context()
+	inspect, err := c.sdk.containerInspect(ctx, islandName)
+	if err != nil {
+		return fmt.Errorf("failed to inspect island: %w", err)
+	}
+	tty := inspect.Config != nil && inspect.Config.Tty
+	logsOpts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+	}
+	if err := c.sdk.containerLogs(ctx, inspect.ID, logsOpts, tty, stdout, stderr); err != nil {
+		return fmt.Errorf("failed to read island logs: %w", err)
+	}
+	return nil
+}
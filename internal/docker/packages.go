@@ -1,7 +1,9 @@
 package docker
 
 import (
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 
 	"coderaft/internal/parallel"
 	"coderaft/internal/ui"
@@ -9,6 +11,24 @@ import (
 
 const yarnGlobalListQuery = `node -e "(async()=>{const cp=require('child_process');function sh(c){try{return cp.execSync(c,{stdio:['ignore','pipe','ignore']}).toString()}catch(e){return ''}}const dir=sh('yarn global dir').trim();if(!dir){process.exit(0)}const fs=require('fs'),path=require('path');const pkgLock=path.join(dir,'package.json');let deps={};try{const pkg=JSON.parse(fs.readFileSync(pkgLock,'utf8'));deps=Object.assign({},pkg.dependencies||{},pkg.devDependencies||{})}catch{}Object.keys(deps).forEach(n=>{let v='';try{const pj=JSON.parse(fs.readFileSync(path.join(dir,'node_modules',n,'package.json'),'utf8'));v=pj.version||''}catch{}if(v)console.log(n+'@'+v)});})();" 2>/dev/null || true`
 
+// packageStateQuery prints the size and modification time of the databases
+// and directories package managers change when they install, upgrade or
+// remove something, plus the registry and apt source configs. It takes
+// milliseconds, where querying the packages themselves takes seconds.
+const packageStateQuery = `for p in /var/lib/dpkg/status /lib/apk/db/installed /etc/apt /etc/apt/sources.list.d /etc/apt/preferences.d /etc/pip.conf /usr/local/etc/npmrc /usr/etc/npmrc /root/.yarnrc.yml /root/.config/pnpm/rc /usr/lib/python3/dist-packages /usr/local/lib/python3*/site-packages /usr/local/lib/python3*/dist-packages /usr/local/lib/node_modules /usr/lib/node_modules /usr/local/share/.config/yarn/global/node_modules /root/.local/share/pnpm /root/go/bin /go/bin /root/.cargo/bin /usr/local/cargo/bin; do [ -e "$p" ] && stat -c '%n %s %Y' "$p"; done; true`
+
+// PackageStateMarker returns a hash that changes whenever the island's
+// packages or package configuration likely changed, for caching results
+// derived from them
+func (c *Client) PackageStateMarker(islandName string) (string, error) {
+	result, err := c.sdk.containerExec(c.context(), islandName, []string{"sh", "-c", packageStateQuery}, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to read package state: %w", err)
+	}
+	sum := sha256.Sum256([]byte(result.Stdout))
+	return hex.EncodeToString(sum[:]), nil
+}
+
 // PackageLists holds all package manager query results
 type PackageLists struct {
 	Apt      []string
@@ -52,6 +72,13 @@ func (c *Client) QueryPackagesParallel(islandName string) (aptList, pipList, npm
 
 // QueryAllPackages queries all supported package managers and returns a comprehensive PackageLists struct
 func (c *Client) QueryAllPackages(islandName string) *PackageLists {
+	lists := c.queryAllPackages(islandName)
+	// apk needs sh and the world file, so it's asked separately
+	_, lists.Apk = c.QuerySystemPackages(islandName)
+	return lists
+}
+
+func (c *Client) queryAllPackages(islandName string) *PackageLists {
 	config := parallel.LoadConfig()
 	if !config.EnableParallel {
 		return c.queryAllPackagesSequential(islandName)
@@ -66,7 +93,6 @@ func (c *Client) QueryAllPackages(islandName string) *PackageLists {
 
 	return &PackageLists{
 		Apt:      packageLists["apt"],
-		Apk:      packageLists["apk"],
 		Dnf:      packageLists["dnf"],
 		Pacman:   packageLists["pacman"],
 		Brew:     packageLists["brew"],
@@ -102,7 +128,7 @@ func (c *Client) queryPackagesSequential(islandName string) (aptList, pipList, n
 	}
 
 	results := make(map[string][]string)
-	ctx := context.Background()
+	ctx := c.context()
 
 	for _, q := range queries {
 		result, err := c.sdk.containerExec(ctx, islandName, []string{"bash", "-c", q.command}, false)
@@ -113,6 +139,8 @@ func (c *Client) queryPackagesSequential(islandName string) (aptList, pipList, n
 
 		if q.jsonPkg {
 			results[q.name] = parallel.ParseJSONPackageList(result.Stdout)
+		} else if q.name == "go" {
+			results[q.name], _ = parallel.ParseGoBinaries(result.Stdout)
 		} else {
 			results[q.name] = parallel.ParseLineList(result.Stdout)
 		}
@@ -131,7 +159,6 @@ func (c *Client) queryAllPackagesSequential(islandName string) *PackageLists {
 	queries := []query{
 		// System package managers
 		{"apt", `dpkg-query -W -f='${Package}=${Version}\n' $(apt-mark showmanual 2>/dev/null || true) 2>/dev/null | sort`, false},
-		{"apk", `apk info -v 2>/dev/null | sed 's/-\([0-9]\)/=\1/' | sort || true`, false},
 		{"dnf", `dnf list installed 2>/dev/null | tail -n +2 | awk '{print $1"="$2}' | sort || true`, false},
 		{"pacman", `pacman -Qe 2>/dev/null | awk '{print $1"="$2}' | sort || true`, false},
 		{"brew", `brew list --versions 2>/dev/null | awk '{print $1"="$2}' | sort || true`, false},
@@ -150,14 +177,14 @@ func (c *Client) queryAllPackagesSequential(islandName string) *PackageLists {
 		{"bun", `bun pm ls -g 2>/dev/null | grep -E "^├|^└" | sed 's/[├└─ ]*//' | sort || true`, false},
 
 		// Language-specific
-		{"cargo", `cargo install --list 2>/dev/null | grep -E "^[a-z]" | awk '{print $1"="$2}' | tr -d ':' | sort || true`, false},
-		{"go", `ls $(go env GOPATH 2>/dev/null)/bin 2>/dev/null | while read f; do echo "$f"; done | sort || true`, false},
+		{"cargo", parallel.CargoInstallQuery, false},
+		{"go", parallel.GoBinariesQuery, false},
 		{"gem", `gem list --local 2>/dev/null | sed 's/ (/=/;s/)//' | sort || true`, false},
 		{"composer", `composer global show 2>/dev/null | awk '{print $1"="$2}' | sort || true`, false},
 	}
 
 	results := make(map[string][]string)
-	ctx := context.Background()
+	ctx := c.context()
 
 	for _, q := range queries {
 		result, err := c.sdk.containerExec(ctx, islandName, []string{"bash", "-c", q.command}, false)
@@ -174,7 +201,6 @@ func (c *Client) queryAllPackagesSequential(islandName string) *PackageLists {
 
 	return &PackageLists{
 		Apt:      results["apt"],
-		Apk:      results["apk"],
 		Dnf:      results["dnf"],
 		Pacman:   results["pacman"],
 		Brew:     results["brew"],
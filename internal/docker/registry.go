@@ -35,6 +35,44 @@ func (c *Client) GetAptSources(islandName string) (snapshotURL string, sources [
 	return
 }
 
+const aptPreferencesMarker = "==> coderaft-apt-preferences "
+
+// GetAptPreferences returns the contents of /etc/apt/preferences and every file
+// in /etc/apt/preferences.d, keyed by path
+func (c *Client) GetAptPreferences(islandName string) map[string]string {
+	out, _, err := c.ExecCapture(islandName, `for f in /etc/apt/preferences /etc/apt/preferences.d/*; do [ -f "$f" ] && printf '`+aptPreferencesMarker+`%s\n' "$f" && cat "$f" && echo; done; true`)
+	if err != nil {
+		return nil
+	}
+	return ParseAptPreferences(out)
+}
+
+// ParseAptPreferences splits GetAptPreferences' output into files, trimming
+// trailing blank lines from each
+func ParseAptPreferences(out string) map[string]string {
+	prefs := map[string]string{}
+	var path string
+	var body []string
+	flush := func() {
+		if path != "" {
+			prefs[path] = strings.TrimRight(strings.Join(body, "\n"), "\n \t")
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, aptPreferencesMarker) {
+			flush()
+			path, body = strings.TrimSpace(strings.TrimPrefix(line, aptPreferencesMarker)), nil
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	if len(prefs) == 0 {
+		return nil
+	}
+	return prefs
+}
+
 func (c *Client) GetPipRegistries(islandName string) (indexURL string, extra []string) {
 
 	out, _, err := c.ExecCapture(islandName, "(pip3 config debug || pip config debug) 2>/dev/null | sed -n 's/^ *index-url *= *//p; s/^ *extra-index-url *= *//p'")
@@ -120,8 +120,13 @@ func (s *sdkClient) loadImage(ctx context.Context, src io.Reader) (string, error
 }
 
 func (s *sdkClient) commitContainer(ctx context.Context, containerID, ref string) (string, error) {
+	info, err := s.containerInspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("island commit failed: %w", err)
+	}
 	resp, err := s.cli.ContainerCommit(ctx, containerID, container.CommitOptions{
 		Reference: ref,
+		Config:    commitConfig(info.Config),
 	})
 	if err != nil {
 		return "", fmt.Errorf("island commit failed: %w", err)
@@ -140,6 +145,8 @@ func (s *sdkClient) containerCreate(
 		Source: workspaceHost,
 		Target: workspaceBox,
 	}
+	// read_only keeps the island from changing the checkout, e.g. for review
+	workspaceMount.ReadOnly, _ = projectConfig["read_only"].(bool)
 
 	containerConfig := &container.Config{
 		Image:      imageName,
@@ -201,6 +208,35 @@ func (s *sdkClient) containerList(ctx context.Context, all bool) ([]container.Su
 	return s.cli.ContainerList(ctx, container.ListOptions{All: all})
 }
 
+func (s *sdkClient) containerCopyFrom(ctx context.Context, id, srcPath string) (io.ReadCloser, error) {
+	rc, _, err := s.cli.CopyFromContainer(ctx, id, srcPath)
+	return rc, err
+}
+
+// containerLogs copies a container's output to stdout and stderr. A
+// container with a TTY has a single raw stream; otherwise the streams are
+// multiplexed and split with stdcopy.
+func (s *sdkClient) containerLogs(ctx context.Context, id string, opts container.LogsOptions, tty bool, stdout, stderr io.Writer) error {
+	rc, err := s.cli.ContainerLogs(ctx, id, opts)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	stop := context.AfterFunc(ctx, func() { rc.Close() })
+	defer stop()
+
+	if tty {
+		_, err = io.Copy(stdout, rc)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, rc)
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("log read failed: %w", err)
+	}
+	return nil
+}
+
 type ExecResult struct {
 	Stdout   string
 	Stderr   string
@@ -225,14 +261,22 @@ func (s *sdkClient) containerExec(ctx context.Context, containerID string, cmd [
 	}
 	defer attachResp.Close()
 
+	// The hijacked attach connection ignores ctx; close it on cancel so the
+	// read below returns
+	stop := context.AfterFunc(ctx, attachResp.Close)
+	defer stop()
+
 	var stdout, stderr bytes.Buffer
 	if showOutput {
 
-		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, attachResp.Reader)
+		_, err = stdcopy.StdCopy(io.MultiWriter(ui.Writer(), &stdout), io.MultiWriter(os.Stderr, &stderr), attachResp.Reader)
 	} else {
 		_, err = stdcopy.StdCopy(&stdout, &stderr, attachResp.Reader)
 	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("exec cancelled: %w", ctx.Err())
+		}
 		return nil, fmt.Errorf("exec read failed: %w", err)
 	}
 
@@ -455,6 +499,18 @@ func applyProjectConfigSDK(
 		}
 	}
 
+	if command, ok := config["command"].([]interface{}); ok && len(command) > 0 {
+		var cmd []string
+		for _, item := range command {
+			if str, ok := item.(string); ok {
+				cmd = append(cmd, str)
+			}
+		}
+		if len(cmd) > 0 {
+			cc.Cmd = cmd
+		}
+	}
+
 	if workingDir, ok := config["working_dir"].(string); ok && workingDir != "" {
 		cc.WorkingDir = workingDir
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"coderaft/internal/errdefs"
 	"coderaft/internal/parallel"
 	"coderaft/internal/security"
 	"coderaft/internal/ui"
@@ -15,6 +16,10 @@ func (c *Client) ExecuteSetupCommands(islandName string, commands []string) erro
 }
 
 func (c *Client) ExecuteSetupCommandsWithOutput(islandName string, commands []string, showOutput bool) error {
+	return c.ExecuteSetupCommandsWithWorkers(islandName, commands, showOutput, 0)
+}
+
+func (c *Client) ExecuteSetupCommandsWithWorkers(islandName string, commands []string, showOutput bool, workers int) error {
 	if len(commands) == 0 {
 		return nil
 	}
@@ -24,11 +29,16 @@ func (c *Client) ExecuteSetupCommandsWithOutput(islandName string, commands []st
 	}
 
 	config := parallel.LoadConfig()
+	if workers > 0 {
+		config.SetupCommandWorkers = workers
+	}
 	if config.EnableParallel {
 
 		executor := parallel.NewSetupCommandExecutorWithSDK(islandName, showOutput, config.SetupCommandWorkers, c.SDKExecFunc())
 		if err := executor.ExecuteParallel(commands); err != nil {
-
+			if c.context().Err() != nil {
+				return err
+			}
 			ui.Warning("parallel execution failed, falling back to sequential: %v", err)
 			return c.ExecuteSetupCommandsSequential(islandName, commands, showOutput)
 		}
@@ -43,6 +53,34 @@ func (c *Client) ExecuteSetupCommandsWithOutput(islandName string, commands []st
 	return nil
 }
 
+// ExecuteSetupCommandsWithProgress runs commands in one pass, up to workers
+// at a time, and calls onDone as each one finishes. Unlike
+// ExecuteSetupCommandsWithWorkers it doesn't start over sequentially when a
+// command fails, since the ones that finished have already taken effect.
+func (c *Client) ExecuteSetupCommandsWithProgress(islandName string, commands []string, workers int, onDone func(command string)) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	ui.Status("executing setup commands on island '%s'...", islandName)
+
+	config := parallel.LoadConfig()
+	if workers <= 0 {
+		workers = config.SetupCommandWorkers
+	}
+	if !config.EnableParallel {
+		workers = 1
+	}
+	executor := parallel.NewSetupCommandExecutorWithSDK(islandName, true, workers, c.SDKExecFunc())
+	executor.OnCommandDone(onDone)
+	if err := executor.ExecuteParallel(commands); err != nil {
+		return err
+	}
+
+	ui.Success("setup commands completed")
+	return nil
+}
+
 func (c *Client) ExecuteSetupCommandsSequential(islandName string, commands []string, showOutput bool) error {
 	if len(commands) == 0 {
 		return nil
@@ -64,6 +102,13 @@ func (c *Client) ExecuteSetupCommandsSequential(islandName string, commands []st
 			ui.Step(i+1, len(commands), fmt.Sprintf("steps %d-%d", i+1, end))
 		}
 
+		for _, command := range batch {
+			ui.Event("setup_command", map[string]interface{}{
+				"island":  islandName,
+				"command": command,
+			})
+		}
+
 		var scriptBuilder strings.Builder
 		scriptBuilder.WriteString(". /root/.bashrc >/dev/null 2>&1 || true; set -e; ")
 		for j, command := range batch {
@@ -75,19 +120,23 @@ func (c *Client) ExecuteSetupCommandsSequential(islandName string, commands []st
 		}
 
 		cmd := []string{"bash", "-lc", scriptBuilder.String()}
-		ctx, cancel := context.WithTimeout(context.Background(), security.Timeouts.Apply)
+		ctx, cancel := context.WithTimeout(c.context(), security.Timeouts.Apply)
 		result, err := c.sdk.containerExec(ctx, islandName, cmd, showOutput)
 		cancel()
 
+		if result != nil {
+			parallel.AppendSetupLog(islandName, strings.Join(batch, " ; "), result.Stdout, result.Stderr, result.ExitCode)
+		}
+
 		if err != nil {
-			return fmt.Errorf("setup command batch failed (steps %d-%d): %w", i+1, end, err)
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "setup command batch failed (steps %d-%d): %w", i+1, end, err)
 		}
 		if result != nil && result.ExitCode != 0 {
 			if !showOutput && result.Stderr != "" {
 				ui.Error("command batch failed (steps %d-%d)", i+1, end)
 				ui.Detail("stderr", result.Stderr)
 			}
-			return fmt.Errorf("setup command batch failed (steps %d-%d): exit code %d", i+1, end, result.ExitCode)
+			return errdefs.Errorf(errdefs.ErrSetupFailed, "setup command batch failed (steps %d-%d): exit code %d", i+1, end, result.ExitCode)
 		}
 	}
 
@@ -97,6 +146,28 @@ func (c *Client) ExecuteSetupCommandsSequential(islandName string, commands []st
 	return nil
 }
 
+// Markers around the direnv hook in the island's bashrc, so setup can
+// replace it
+const (
+	direnvHookStart = "# Coderaft direnv hook start"
+	direnvHookEnd   = "# Coderaft direnv hook end"
+)
+
+// direnvHook loads a repository's .envrc when direnv is installed, which
+// clone does for repositories that have one. Interactive shells get direnv's
+// prompt hook, so the environment follows cd; other shells, such as the ones
+// 'coderaft run' and setup commands use, load the .envrc of the directory
+// they start in once. An .envrc that hasn't been allowed is left alone.
+const direnvHook = direnvHookStart + `
+if command -v direnv >/dev/null 2>&1; then
+	if [[ $- == *i* ]]; then
+		eval "$(direnv hook bash)"
+	else
+		eval "$(direnv export bash 2>/dev/null)"
+	fi
+fi
+` + direnvHookEnd
+
 func (c *Client) SetupCoderaftOnIsland(islandName, projectName string) error {
 	return c.setupCoderaftOnIslandWithOptions(islandName, projectName, false)
 }
@@ -106,15 +177,30 @@ func (c *Client) SetupCoderaftOnIslandWithUpdate(islandName, projectName string)
 }
 
 func (c *Client) IsIslandInitialized(islandName string) bool {
-	ctx := context.Background()
+	ctx := c.context()
 	result, err := c.sdk.containerExec(ctx, islandName, []string{"test", "-f", "/etc/coderaft-initialized"}, false)
 	return err == nil && result != nil && result.ExitCode == 0
 }
 
 func (c *Client) setupCoderaftOnIslandWithOptions(islandName, projectName string, forceUpdate bool) error {
 
-	ctx := context.Background()
+	ctx := c.context()
+	setupScript := islandSetupScript(islandName, projectName)
+
+	result, err := c.sdk.containerExec(ctx, islandName, []string{"bash", "-c", setupScript}, false)
+	if err != nil {
+		return fmt.Errorf("failed to setup coderaft on island: %w", err)
+	}
+	if result != nil && result.ExitCode != 0 {
+		return fmt.Errorf("failed to setup coderaft on island: exit code %d: %s", result.ExitCode, result.Stderr)
+	}
+
+	return nil
+}
 
+// islandSetupScript installs the in-island coderaft wrapper and the bashrc
+// additions: welcome message, dotfiles, the direnv hook and package tracking
+func islandSetupScript(islandName, projectName string) string {
 	wrapperScript := `#!/bin/bash
 
 # coderaft-wrapper.sh
@@ -234,6 +320,7 @@ sed -i '/# Coderaft welcome message/,/^$/d' /root/.bashrc 2>/dev/null || true
 sed -i '/coderaft_exit()/,/^}$/d' /root/.bashrc 2>/dev/null || true
 sed -i '/coderaft() {/,/^}$/d' /root/.bashrc 2>/dev/null || true
 sed -i '/# Coderaft package tracking start/,/# Coderaft package tracking end/d' /root/.bashrc 2>/dev/null || true
+sed -i '/` + direnvHookStart + `/,/` + direnvHookEnd + `/d' /root/.bashrc 2>/dev/null || true
 
 cat >> /root/.bashrc << 'BASHRC_EOF'
 
@@ -270,6 +357,8 @@ if [ -d "/dotfiles" ]; then
 	fi
 fi
 
+` + direnvHook + `
+
 coderaft_exit() {
 	echo "Exiting coderaft shell for project \"` + projectName + `\""
 	exit 0
@@ -605,14 +694,5 @@ curl()     { _coderaft_wrap_and_record "$CURL_BIN" curl "$@"; }
 make()     { _coderaft_wrap_and_record "$MAKE_BIN" make "$@"; }
 BASHRC_EOF
 `
-
-	result, err := c.sdk.containerExec(ctx, islandName, []string{"bash", "-c", setupScript}, false)
-	if err != nil {
-		return fmt.Errorf("failed to setup coderaft on island: %w", err)
-	}
-	if result != nil && result.ExitCode != 0 {
-		return fmt.Errorf("failed to setup coderaft on island: exit code %d: %s", result.ExitCode, result.Stderr)
-	}
-
-	return nil
+	return setupScript
 }
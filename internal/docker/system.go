@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// SystemSettings is the OS-level configuration a lock file can pin. Fields
+// left at their defaults are empty, so only meaningful settings are recorded.
+type SystemSettings struct {
+	Locale   string
+	Timezone string
+	// Ulimits maps a ulimit name (e.g. nofile) to "soft:hard", for limits set
+	// explicitly on the container
+	Ulimits map[string]string
+}
+
+// GetSystemSettings reads the island's locale, timezone and ulimits
+func (c *Client) GetSystemSettings(islandName string) SystemSettings {
+	var settings SystemSettings
+	out, _, err := c.ExecCapture(islandName, `printf 'locale=%s\n' "${LC_ALL:-${LANG:-}}"; `+
+		`printf 'timezone=%s\n' "$(cat /etc/timezone 2>/dev/null || readlink /etc/localtime 2>/dev/null | sed 's#.*/zoneinfo/##')"`)
+	if err == nil {
+		settings = ParseSystemSettings(out)
+	}
+
+	if inspect, err := c.sdk.containerInspect(c.context(), islandName); err == nil && inspect.HostConfig != nil {
+		for _, u := range inspect.HostConfig.Ulimits {
+			if u == nil || u.Name == "" {
+				continue
+			}
+			if settings.Ulimits == nil {
+				settings.Ulimits = map[string]string{}
+			}
+			settings.Ulimits[u.Name] = fmt.Sprintf("%d:%d", u.Soft, u.Hard)
+		}
+	}
+	return settings
+}
+
+// ParseSystemSettings reads GetSystemSettings' key=value output, dropping
+// values that are just the image defaults
+func ParseSystemSettings(out string) SystemSettings {
+	var settings SystemSettings
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "locale":
+			if !IsDefaultLocale(value) {
+				settings.Locale = value
+			}
+		case "timezone":
+			if !IsDefaultTimezone(value) {
+				settings.Timezone = value
+			}
+		}
+	}
+	return settings
+}
+
+// IsDefaultLocale reports whether locale is what images use when none is set
+func IsDefaultLocale(locale string) bool {
+	switch locale {
+	case "", "C", "POSIX":
+		return true
+	}
+	return false
+}
+
+// IsDefaultTimezone reports whether tz is one of the names for UTC
+func IsDefaultTimezone(tz string) bool {
+	switch tz {
+	case "", "UTC", "Etc/UTC", "Etc/Universal", "Universal", "Zulu":
+		return true
+	}
+	return false
+}
+
+// GetFileChecksums returns the SHA-256 of every regular file in the island
+// matching the given absolute paths or globs, keyed by path, as
+// "sha256:<hex>". Patterns that match nothing are left out.
+func (c *Client) GetFileChecksums(islandName string, patterns []string) map[string]string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	out, _, err := c.ExecCapture(islandName, `for f in `+strings.Join(patterns, " ")+`; do [ -f "$f" ] && sha256sum "$f"; done; true`)
+	if err != nil {
+		return nil
+	}
+	return ParseFileChecksums(out)
+}
+
+// ParseFileChecksums reads sha256sum output into GetFileChecksums' map
+func ParseFileChecksums(out string) map[string]string {
+	sums := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		sum, path, ok := strings.Cut(strings.TrimSpace(line), " ")
+		path = strings.TrimPrefix(strings.TrimLeft(path, " "), "*")
+		if !ok || len(sum) != 64 || path == "" {
+			continue
+		}
+		sums[path] = "sha256:" + sum
+	}
+	if len(sums) == 0 {
+		return nil
+	}
+	return sums
+}
+
+const islandFileMarker = "==> coderaft-file "
+
+// GetIslandFiles returns the contents of every regular file in the island
+// matching the given absolute paths or globs, keyed by path. Files travel
+// base64-encoded so their bytes, trailing newlines included, come back as
+// they are.
+func (c *Client) GetIslandFiles(islandName string, patterns []string) (map[string]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	out, _, err := c.ExecCapture(islandName, `for f in `+strings.Join(patterns, " ")+`; do [ -f "$f" ] && printf '`+islandFileMarker+`%s\n' "$f" && base64 -w0 "$f" && echo; done; true`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files from island: %w", err)
+	}
+	return ParseIslandFiles(out)
+}
+
+// ParseIslandFiles reads GetIslandFiles' output: a marker line naming each
+// file, followed by its base64-encoded contents
+func ParseIslandFiles(out string) (map[string]string, error) {
+	files := map[string]string{}
+	var path string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, islandFileMarker) {
+			path = strings.TrimSpace(strings.TrimPrefix(line, islandFileMarker))
+			files[path] = ""
+			continue
+		}
+		if path == "" || strings.TrimSpace(line) == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid contents for %s: %w", path, err)
+		}
+		files[path] = string(data)
+		path = ""
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return files, nil
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"coderaft/internal/parallel"
+)
+
+// OS families an island's base image can belong to, from /etc/os-release
+const (
+	OSFamilyDebian = "debian"
+	OSFamilyAlpine = "alpine"
+)
+
+// SystemPackages is the OS package manager of an island: apt on Debian and
+// Ubuntu bases, apk on Alpine. Lock, verify and apply use it to record and
+// reconcile system packages without assuming apt.
+type SystemPackages struct {
+	// Manager is the key the packages are locked under, "apt" or "apk"
+	Manager string
+	// Sep separates a package's name from its version in the lock
+	Sep string
+}
+
+var (
+	aptSystemPackages = SystemPackages{Manager: "apt", Sep: "="}
+	apkSystemPackages = SystemPackages{Manager: "apk", Sep: "="}
+)
+
+// apkPackagesQuery prints the packages installed on purpose (the world file)
+// and then every installed package as name-version
+const apkPackagesQuery = `cat /etc/apk/world 2>/dev/null; echo ---; apk info -vv 2>/dev/null`
+
+// ParseOSFamily reads /etc/os-release and returns the island's OS family,
+// OSFamilyAlpine or OSFamilyDebian. Anything else is treated as Debian, which
+// is what coderaft's default images are.
+func ParseOSFamily(osRelease string) string {
+	for _, line := range strings.Split(osRelease, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || (key != "ID" && key != "ID_LIKE") {
+			continue
+		}
+		for _, id := range strings.Fields(strings.Trim(value, `"'`)) {
+			if id == OSFamilyAlpine {
+				return OSFamilyAlpine
+			}
+		}
+	}
+	return OSFamilyDebian
+}
+
+// SystemPackagesFor picks the package manager of an OS family
+func SystemPackagesFor(family string) SystemPackages {
+	if family == OSFamilyAlpine {
+		return apkSystemPackages
+	}
+	return aptSystemPackages
+}
+
+// InstallCommands installs pkgs, given as name<sep>version, at those versions
+func (s SystemPackages) InstallCommands(pkgs []string) []string {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	if s.Manager == "apk" {
+		return []string{"apk add --no-cache " + strings.Join(pkgs, " ")}
+	}
+	return []string{"apt update -y", "DEBIAN_FRONTEND=noninteractive apt-get install -y " + strings.Join(pkgs, " ")}
+}
+
+// RemoveCommands uninstalls the named packages
+func (s SystemPackages) RemoveCommands(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	if s.Manager == "apk" {
+		return []string{"apk del " + strings.Join(names, " ")}
+	}
+	return []string{"apt-get remove -y " + strings.Join(names, " "), "apt-get autoremove -y"}
+}
+
+// DetectSystemPackages reads the island's /etc/os-release to pick its package
+// manager. It uses sh, since minimal Alpine images have no bash.
+func (c *Client) DetectSystemPackages(islandName string) SystemPackages {
+	result, err := c.sdk.containerExec(c.context(), islandName, []string{"sh", "-c", "cat /etc/os-release 2>/dev/null || true"}, false)
+	if err != nil {
+		return aptSystemPackages
+	}
+	return SystemPackagesFor(ParseOSFamily(result.Stdout))
+}
+
+// QuerySystemPackages returns the island's package manager and, for apk, its
+// explicitly installed packages as name=version. apt islands get a nil list:
+// their packages come from QueryPackagesParallel as before.
+func (c *Client) QuerySystemPackages(islandName string) (SystemPackages, []string) {
+	sys := c.DetectSystemPackages(islandName)
+	if sys.Manager != "apk" {
+		return sys, nil
+	}
+	result, err := c.sdk.containerExec(c.context(), islandName, []string{"sh", "-c", apkPackagesQuery}, false)
+	if err != nil {
+		return sys, nil
+	}
+	return sys, ParseApkPackages(result.Stdout)
+}
+
+// ParseApkPackages reads apkPackagesQuery's output: the world file, "---",
+// then apk info -vv lines such as "musl-1.2.4-r2 - the musl c library". It
+// returns the world's packages as name=version, sorted, the way apt locks
+// only manually installed packages.
+func ParseApkPackages(out string) []string {
+	world, info, ok := strings.Cut(out, "---\n")
+	if !ok {
+		world, info = "", out
+	}
+	wanted := map[string]bool{}
+	for _, entry := range parallel.ParseLineList(world) {
+		// World entries may carry a constraint, e.g. python3>3.11 or curl@edge
+		name := entry
+		if i := strings.IndexAny(name, "=<>~@"); i >= 0 {
+			name = name[:i]
+		}
+		wanted[name] = true
+	}
+
+	var pkgs []string
+	for _, line := range parallel.ParseLineList(info) {
+		nameVersion, _, _ := strings.Cut(line, " ")
+		name, version, ok := splitApkNameVersion(nameVersion)
+		if !ok || (len(wanted) > 0 && !wanted[name]) {
+			continue
+		}
+		pkgs = append(pkgs, fmt.Sprintf("%s=%s", name, version))
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// splitApkNameVersion splits apk's name-version-rN, where the name may itself
+// contain dashes (py3-pip-23.1.2-r0)
+func splitApkNameVersion(s string) (name, version string, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 3 || !strings.HasPrefix(parts[len(parts)-1], "r") {
+		return "", "", false
+	}
+	name = strings.Join(parts[:len(parts)-2], "-")
+	if name == "" {
+		return "", "", false
+	}
+	return name, parts[len(parts)-2] + "-" + parts[len(parts)-1], true
+}
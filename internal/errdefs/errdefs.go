@@ -0,0 +1,103 @@
+// Package errdefs defines the kinds of failure coderaft reports, so callers can
+// tell them apart with errors.Is and the CLI can exit with a distinct code.
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDockerUnavailable = errors.New("docker is not available")
+	ErrProjectNotFound   = errors.New("project not found")
+	ErrIslandNotFound    = errors.New("island not found")
+	ErrSetupFailed       = errors.New("setup failed")
+	ErrTimeout           = errors.New("timed out")
+)
+
+// Process exit codes. 1 covers every error without a more specific kind.
+const (
+	ExitError             = 1
+	ExitDockerUnavailable = 3
+	ExitProjectNotFound   = 4
+	ExitIslandNotFound    = 5
+	ExitSetupFailed       = 6
+	// ExitTimeout matches the status of coreutils' timeout(1)
+	ExitTimeout = 124
+)
+
+// Error tags an error with one of the kinds above without changing its message.
+// errors.Is matches both the kind and anything the wrapped error wraps.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// Errorf formats like fmt.Errorf (including %w) and tags the result with kind
+func Errorf(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap tags err with kind, or returns nil when err is nil
+func Wrap(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// ExitStatus carries the exit status of a command coderaft ran for the user,
+// as 'coderaft run' does, so that coderaft exits with the same status
+type ExitStatus struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitStatus) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitStatus) Unwrap() error {
+	return e.Err
+}
+
+// WithExitStatus tags err with the status coderaft should exit with, or
+// returns nil when err is nil
+func WithExitStatus(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ExitStatus{Code: code, Err: err}
+}
+
+// ExitCode maps an error to the process exit code for its kind. An
+// ExitStatus takes precedence, so a command's own status is passed on as is.
+func ExitCode(err error) int {
+	var status *ExitStatus
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &status) && status.Code > 0:
+		return status.Code
+	case errors.Is(err, ErrDockerUnavailable):
+		return ExitDockerUnavailable
+	case errors.Is(err, ErrProjectNotFound):
+		return ExitProjectNotFound
+	case errors.Is(err, ErrIslandNotFound):
+		return ExitIslandNotFound
+	case errors.Is(err, ErrSetupFailed):
+		return ExitSetupFailed
+	case errors.Is(err, ErrTimeout):
+		return ExitTimeout
+	default:
+		return ExitError
+	}
+}
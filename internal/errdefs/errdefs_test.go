@@ -0,0 +1,62 @@
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestErrorfKeepsMessageAndKind(t *testing.T) {
+	err := Errorf(ErrProjectNotFound, "project '%s' not found", "web")
+	if err.Error() != "project 'web' not found" {
+		t.Errorf("message = %q", err.Error())
+	}
+	if !errors.Is(err, ErrProjectNotFound) {
+		t.Error("expected errors.Is to match the kind")
+	}
+	if errors.Is(err, ErrIslandNotFound) {
+		t.Error("unexpected match on another kind")
+	}
+
+	var tagged *Error
+	if !errors.As(fmt.Errorf("context: %w", err), &tagged) || tagged.Kind != ErrProjectNotFound {
+		t.Error("expected errors.As to find the tagged error through wrapping")
+	}
+}
+
+func TestErrorfKeepsWrappedCause(t *testing.T) {
+	err := Errorf(ErrSetupFailed, "setup failed: %w", os.ErrPermission)
+	if !errors.Is(err, os.ErrPermission) || !errors.Is(err, ErrSetupFailed) {
+		t.Error("expected both the cause and the kind to match")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("boom"), ExitError},
+		{Wrap(ErrDockerUnavailable, errors.New("no daemon")), ExitDockerUnavailable},
+		{fmt.Errorf("outer: %w", Errorf(ErrIslandNotFound, "gone")), ExitIslandNotFound},
+		{Errorf(ErrSetupFailed, "exit code 2"), ExitSetupFailed},
+		{Errorf(ErrProjectNotFound, "missing"), ExitProjectNotFound},
+		{fmt.Errorf("failed to run command: %w", Errorf(ErrTimeout, "command timed out")), ExitTimeout},
+		{WithExitStatus(3, errors.New("command exited with status 3")), 3},
+		{fmt.Errorf("outer: %w", WithExitStatus(127, errors.New("not found"))), 127},
+		{WithExitStatus(0, errors.New("killed by a signal")), ExitError},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+	if Wrap(ErrSetupFailed, nil) != nil {
+		t.Error("Wrap(kind, nil) should be nil")
+	}
+	if WithExitStatus(2, nil) != nil {
+		t.Error("WithExitStatus(code, nil) should be nil")
+	}
+}
@@ -21,7 +21,36 @@ func DefaultConfig() *Config {
 	}
 }
 
+// Setup overrides set from command-line flags for the current invocation.
+// They take precedence over the environment.
+var (
+	setupWorkersOverride int
+	sequentialOverride   bool
+)
+
+// OverrideSetup makes LoadConfig run setup commands with workers workers, or
+// one at a time when sequential is set, for the rest of the process. A
+// workers value <= 0 leaves the worker count alone.
+func OverrideSetup(workers int, sequential bool) {
+	setupWorkersOverride = workers
+	sequentialOverride = sequential
+}
+
+// LoadConfig reads the parallel settings from the environment, then applies
+// any OverrideSetup
 func LoadConfig() *Config {
+	config := loadEnvConfig()
+	switch {
+	case sequentialOverride:
+		config.EnableParallel = false
+	case setupWorkersOverride > 0:
+		config.EnableParallel = true
+		config.SetupCommandWorkers = setupWorkersOverride
+	}
+	return config
+}
+
+func loadEnvConfig() *Config {
 	config := DefaultConfig()
 
 	if os.Getenv("CODERAFT_DISABLE_PARALLEL") == "true" {
@@ -1,7 +1,11 @@
 package parallel
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -171,3 +175,76 @@ func ExampleWorkerPool() {
 		}
 	}
 }
+
+func TestOverrideSetup(t *testing.T) {
+	defer OverrideSetup(0, false)
+	t.Setenv("CODERAFT_SETUP_WORKERS", "5")
+
+	if c := LoadConfig(); !c.EnableParallel || c.SetupCommandWorkers != 5 {
+		t.Errorf("expected the environment's 5 workers, got %+v", c)
+	}
+
+	OverrideSetup(8, false)
+	if c := LoadConfig(); !c.EnableParallel || c.SetupCommandWorkers != 8 {
+		t.Errorf("expected the override's 8 workers, got %+v", c)
+	}
+
+	t.Setenv("CODERAFT_DISABLE_PARALLEL", "true")
+	if c := LoadConfig(); !c.EnableParallel || c.SetupCommandWorkers != 8 {
+		t.Errorf("expected workers from the flag to win over CODERAFT_DISABLE_PARALLEL, got %+v", c)
+	}
+
+	t.Setenv("CODERAFT_DISABLE_PARALLEL", "")
+	OverrideSetup(0, true)
+	if c := LoadConfig(); c.EnableParallel {
+		t.Errorf("expected sequential setup, got %+v", c)
+	}
+}
+
+func TestParseGoBinaries(t *testing.T) {
+	out := "yq\tgithub.com/mikefarah/yq/v4@v4.40.5\ngopls\tgolang.org/x/tools/gopls@v0.14.2\n\n"
+	entries, files := ParseGoBinaries(out)
+
+	want := []string{"github.com/mikefarah/yq/v4@v4.40.5", "golang.org/x/tools/gopls@v0.14.2"}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %q, want %q", entries, want)
+	}
+	if files["github.com/mikefarah/yq/v4"] != "yq" || files["golang.org/x/tools/gopls"] != "gopls" {
+		t.Errorf("files = %v", files)
+	}
+}
+
+func TestSetupCommandExecutorOnCommandDone(t *testing.T) {
+	t.Setenv("CODERAFT_HOME", t.TempDir())
+
+	exec := func(ctx context.Context, id string, cmd []string, showOutput bool) (string, string, int, error) {
+		if strings.Contains(cmd[len(cmd)-1], "broken") {
+			return "", "not found", 1, nil
+		}
+		return "", "", 0, nil
+	}
+	executor := NewSetupCommandExecutorWithSDK("test-island", false, 3, exec)
+	var done []string
+	executor.OnCommandDone(func(command string) {
+		done = append(done, command)
+	})
+
+	commands := []string{"apt-get update", "npm i -g a", "npm i -g b", "npm i -g c", "go install x@v1"}
+	if err := executor.ExecuteParallel(commands); err != nil {
+		t.Fatalf("ExecuteParallel: %v", err)
+	}
+	sort.Strings(done)
+	want := append([]string(nil), commands...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(done, want) {
+		t.Errorf("done = %q, want %q", done, want)
+	}
+
+	done = nil
+	if err := executor.ExecuteParallel([]string{"apt-get update", "apt-get install broken"}); err == nil {
+		t.Fatal("expected the failing command to fail the run")
+	}
+	if !reflect.DeepEqual(done, []string{"apt-get update"}) {
+		t.Errorf("done = %q, want only the command that succeeded", done)
+	}
+}
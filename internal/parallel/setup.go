@@ -5,10 +5,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"coderaft/internal/engine"
@@ -26,6 +28,8 @@ type SetupCommandExecutor struct {
 	workerPool *WorkerPool
 	showOutput bool
 	execFunc   ExecFunc
+	onDone     func(command string)
+	onDoneMu   sync.Mutex
 }
 
 func NewSetupCommandExecutor(islandName string, showOutput bool, maxWorkers int) *SetupCommandExecutor {
@@ -46,6 +50,12 @@ func NewSetupCommandExecutorWithSDK(islandName string, showOutput bool, maxWorke
 	return e
 }
 
+// OnCommandDone sets fn to be called with each command that finishes
+// successfully. Calls come one at a time, even from parallel groups.
+func (sce *SetupCommandExecutor) OnCommandDone(fn func(command string)) {
+	sce.onDone = fn
+}
+
 type CommandGroup struct {
 	Name     string
 	Commands []string
@@ -192,25 +202,39 @@ func (sce *SetupCommandExecutor) createCommandTask(command string, step, total i
 	}
 }
 
-func (sce *SetupCommandExecutor) executeCommand(command string, step, total int, groupName string) error {
+func (sce *SetupCommandExecutor) executeCommand(command string, step, total int, groupName string) (err error) {
+	defer func() {
+		if err == nil && sce.onDone != nil {
+			sce.onDoneMu.Lock()
+			sce.onDone(command)
+			sce.onDoneMu.Unlock()
+		}
+	}()
+
 	if sce.showOutput {
 		ui.Step(step, total, command)
 	}
 
 	wrapped := ". /root/.bashrc >/dev/null 2>&1 || true; " + command
+	ui.Event("setup_command", map[string]interface{}{
+		"island":  sce.islandName,
+		"group":   groupName,
+		"command": command,
+	})
 
 	if sce.execFunc != nil {
 		ctx := context.Background()
 		stdout, stderr, exitCode, err := sce.execFunc(ctx, sce.islandName, []string{"bash", "-c", wrapped}, sce.showOutput)
 		if err != nil {
+			AppendSetupLog(sce.islandName, command, stdout, stderr+err.Error(), -1)
 			return fmt.Errorf("command failed: %s: %w", command, err)
 		}
+		AppendSetupLog(sce.islandName, command, stdout, stderr, exitCode)
 		if exitCode != 0 {
 			if !sce.showOutput && stderr != "" {
 				ui.Error("command failed: %s", command)
 				ui.Detail("stderr", stderr)
 			}
-			_ = stdout
 			return fmt.Errorf("command failed: %s: exit code %d", command, exitCode)
 		}
 		return nil
@@ -218,19 +242,23 @@ func (sce *SetupCommandExecutor) executeCommand(command string, step, total int,
 
 	cmd := exec.Command(dockerCmd(), "exec", sce.islandName, "bash", "-c", wrapped)
 
+	var stdout, stderr bytes.Buffer
 	if sce.showOutput {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = io.MultiWriter(ui.Writer(), &stdout)
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
-		if err := cmd.Run(); err != nil {
+		err := cmd.Run()
+		AppendSetupLog(sce.islandName, command, stdout.String(), stderr.String(), cmd.ProcessState.ExitCode())
+		if err != nil {
 			return fmt.Errorf("command failed: %s: %w", command, err)
 		}
 	} else {
-		var stdout, stderr bytes.Buffer
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
 
-		if err := cmd.Run(); err != nil {
+		err := cmd.Run()
+		AppendSetupLog(sce.islandName, command, stdout.String(), stderr.String(), cmd.ProcessState.ExitCode())
+		if err != nil {
 			ui.Error("command failed: %s", command)
 			if stderr.Len() > 0 {
 				ui.Detail("stderr", stderr.String())
@@ -245,6 +273,25 @@ func (sce *SetupCommandExecutor) executeCommand(command string, step, total int,
 	return nil
 }
 
+// GoBinariesQuery lists binaries in $GOPATH/bin as "file<TAB>module/path@version"
+// using the build info embedded by 'go install'. The file name is listed since
+// it can't be told from the path: Go drops a module's "/vN" suffix when naming
+// the binary. Binaries built from a local checkout report "(devel)" and are
+// skipped since they can't be reinstalled by version.
+const GoBinariesQuery = `for f in "$(go env GOPATH 2>/dev/null)"/bin/*; do [ -f "$f" ] && go version -m "$f" 2>/dev/null | awk -v f="${f##*/}" '$1=="path"{p=$2} $1=="mod"{v=$3} END{if(p!="" && v!="" && v!="(devel)")print f"\t"p"@"v}'; done | sort || true`
+
+// CargoInstallQuery lists crates installed with 'cargo install' as "name=vX.Y.Z".
+const CargoInstallQuery = `cargo install --list 2>/dev/null | grep -E '^[a-z]' | awk '{print $1"="$2}' | tr -d ':' | sort || true`
+
+// VSCodeServerCLI expands to the path of the code-server binary bundled with
+// the VS Code server, or to an empty string when VS Code never attached.
+const VSCodeServerCLI = `"$(ls -1d "$HOME"/.vscode-server/bin/*/bin/code-server "$HOME"/.vscode-server/cli/servers/*/server/bin/code-server 2>/dev/null | head -n1)"`
+
+// VSCodeExtensionsQuery lists extensions installed in the VS Code server as
+// "publisher.name@version", falling back to the extension directory names
+// ("publisher.name-version[-platform]") when the server CLI is missing.
+const VSCodeExtensionsQuery = `srv=` + VSCodeServerCLI + `; if [ -n "$srv" ]; then "$srv" --list-extensions --show-versions 2>/dev/null; else ls -1 "$HOME"/.vscode-server/extensions 2>/dev/null; fi || true`
+
 type PackageQueryExecutor struct {
 	islandName string
 	workerPool *WorkerPool
@@ -311,7 +358,6 @@ func (pqe *PackageQueryExecutor) QueryAllPackagesExtended() (map[string][]string
 	queries := []PackageQuery{
 		// System package managers
 		{"apt", "dpkg-query -W -f='${Package}=${Version}\\n' $(apt-mark showmanual 2>/dev/null || true) 2>/dev/null | sort"},
-		{"apk", "apk info -v 2>/dev/null | sed 's/-\\([0-9]\\)/=\\1/' | sort || true"},
 		{"dnf", "dnf list installed 2>/dev/null | tail -n +2 | awk '{print $1\"=\"$2}' | sort || true"},
 		{"pacman", "pacman -Qe 2>/dev/null | awk '{print $1\"=\"$2}' | sort || true"},
 		{"brew", "brew list --versions 2>/dev/null | awk '{print $1\"=\"$2}' | sort || true"},
@@ -330,8 +376,8 @@ func (pqe *PackageQueryExecutor) QueryAllPackagesExtended() (map[string][]string
 		{"bun", "bun pm ls -g 2>/dev/null | grep -E '^├|^└' | sed 's/[├└─ ]*//' | sort || true"},
 
 		// Language-specific
-		{"cargo", "cargo install --list 2>/dev/null | grep -E '^[a-z]' | awk '{print $1\"=\"$2}' | tr -d ':' | sort || true"},
-		{"go", "ls $(go env GOPATH 2>/dev/null)/bin 2>/dev/null | while read f; do echo \"$f\"; done | sort || true"},
+		{"cargo", CargoInstallQuery},
+		{"go", GoBinariesQuery},
 		{"gem", "gem list --local 2>/dev/null | sed 's/ (/=/;s/)//' | sort || true"},
 		{"composer", "composer global show 2>/dev/null | awk '{print $1\"=\"$2}' | sort || true"},
 	}
@@ -354,6 +400,8 @@ func (pqe *PackageQueryExecutor) QueryAllPackagesExtended() (map[string][]string
 		switch query.Name {
 		case "npm", "pnpm":
 			packageLists[query.Name] = ParseJSONPackageList(results[i])
+		case "go":
+			packageLists[query.Name], _ = ParseGoBinaries(results[i])
 		default:
 			packageLists[query.Name] = ParseLineList(results[i])
 		}
@@ -399,6 +447,25 @@ func ParseLineList(output string) []string {
 	return result
 }
 
+// ParseGoBinaries splits GoBinariesQuery output into "module/path@version"
+// entries and the file name each path is installed as
+func ParseGoBinaries(output string) ([]string, map[string]string) {
+	var entries []string
+	files := map[string]string{}
+	for _, line := range ParseLineList(output) {
+		file, entry, ok := strings.Cut(line, "\t")
+		if !ok {
+			file, entry = "", line
+		}
+		entries = append(entries, entry)
+		if idx := strings.LastIndex(entry, "@"); idx > 0 && file != "" {
+			files[entry[:idx]] = file
+		}
+	}
+	sort.Strings(entries)
+	return entries, files
+}
+
 func ParseJSONPackageList(output string) []string {
 	if strings.TrimSpace(output) == "" {
 		return nil
@@ -0,0 +1,70 @@
+package parallel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"coderaft/internal/config"
+)
+
+var setupLogMu sync.Mutex
+
+// SetupLogPath returns where setup command output for an island is kept:
+// logs/<island>/setup.log in coderaft's state directory, ~/.coderaft by
+// default
+func SetupLogPath(islandName string) (string, error) {
+	return config.StatePath("logs", islandName, "setup.log")
+}
+
+// ResetSetupLog truncates an island's setup log, so it only holds output from
+// the most recent island creation onwards.
+func ResetSetupLog(islandName string) error {
+	path, err := SetupLogPath(islandName)
+	if err != nil {
+		return err
+	}
+	setupLogMu.Lock()
+	defer setupLogMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, nil, 0644)
+}
+
+// AppendSetupLog records one command and everything it printed. Failures to
+// write are ignored; the log is a diagnostic aid and must never fail setup.
+func AppendSetupLog(islandName, command, stdout, stderr string, exitCode int) {
+	path, err := SetupLogPath(islandName)
+	if err != nil {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "==> %s $ %s\n", time.Now().UTC().Format(time.RFC3339), command)
+	for _, out := range []string{stdout, stderr} {
+		if out == "" {
+			continue
+		}
+		b.WriteString(out)
+		if !strings.HasSuffix(out, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "<== exit %d\n", exitCode)
+
+	setupLogMu.Lock()
+	defer setupLogMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = f.WriteString(b.String())
+}
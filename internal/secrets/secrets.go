@@ -15,8 +15,11 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/pbkdf2"
+
+	"coderaft/internal/config"
 )
 
 const (
@@ -25,34 +28,78 @@ const (
 	saltLength    = 16
 )
 
+// DefaultIdleTimeout is how long an unlocked vault goes unused before it
+// locks itself again
+const DefaultIdleTimeout = 15 * time.Minute
+
 // Vault stores encrypted secrets for coderaft projects
 type Vault struct {
 	mu       sync.RWMutex
 	path     string
-	secrets  map[string]map[string]string // project -> key -> encrypted value
+	secrets  map[string]map[string]string     // project -> key -> encrypted value
+	meta     map[string]map[string]SecretMeta // project -> key -> timestamps
 	salt     []byte
 	unlocked bool
 	key      []byte
+
+	// idleTimeout locks the vault that long after it was last unlocked or
+	// used; 0 keeps it unlocked
+	idleTimeout time.Duration
+	clock       clock
+	lockTimer   timer
+	lockAt      time.Time
+}
+
+// clock is what the vault's auto-lock reads the time from and schedules
+// itself with, so tests can drive it
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is the part of *time.Timer the auto-lock uses
+type timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+// SecretMeta records when a secret was stored, changed and last read. It is
+// not encrypted, and secrets stored before it was tracked have zero times.
+type SecretMeta struct {
+	CreatedAt  time.Time `json:"created_at,omitzero"`
+	UpdatedAt  time.Time `json:"updated_at,omitzero"`
+	AccessedAt time.Time `json:"accessed_at,omitzero"`
 }
 
 // VaultData is the on-disk format
 type VaultData struct {
-	Version  int                          `json:"version"`
-	Salt     string                       `json:"salt"`
-	Projects map[string]map[string]string `json:"projects"`
+	Version  int                              `json:"version"`
+	Salt     string                           `json:"salt"`
+	Projects map[string]map[string]string     `json:"projects"`
+	Metadata map[string]map[string]SecretMeta `json:"metadata,omitempty"`
 }
 
+// now is the clock secret timestamps are taken from
+var now = time.Now
+
 // NewVault creates or loads a secrets vault
 func NewVault() (*Vault, error) {
-	home, err := os.UserHomeDir()
+	vaultPath, err := config.DataPath("secrets.vault.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
-
-	vaultPath := filepath.Join(home, ".coderaft", "secrets.vault.json")
 	v := &Vault{
-		path:    vaultPath,
-		secrets: make(map[string]map[string]string),
+		path:        vaultPath,
+		secrets:     make(map[string]map[string]string),
+		meta:        make(map[string]map[string]SecretMeta),
+		idleTimeout: DefaultIdleTimeout,
+		clock:       realClock{},
 	}
 
 	if err := v.load(); err != nil && !os.IsNotExist(err) {
@@ -85,15 +132,16 @@ func (v *Vault) load() error {
 	if v.secrets == nil {
 		v.secrets = make(map[string]map[string]string)
 	}
+	v.meta = vd.Metadata
+	if v.meta == nil {
+		v.meta = make(map[string]map[string]SecretMeta)
+	}
 
 	return nil
 }
 
-// save writes the vault to disk
+// save writes the vault to disk. Callers hold v.mu.
 func (v *Vault) save() error {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-
 	dir := filepath.Dir(v.path)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("failed to create secrets directory: %w", err)
@@ -103,6 +151,7 @@ func (v *Vault) save() error {
 		Version:  1,
 		Salt:     base64.StdEncoding.EncodeToString(v.salt),
 		Projects: v.secrets,
+		Metadata: v.meta,
 	}
 
 	data, err := json.MarshalIndent(vd, "", "  ")
@@ -110,18 +159,51 @@ func (v *Vault) save() error {
 		return fmt.Errorf("failed to serialize vault: %w", err)
 	}
 
-	if err := os.WriteFile(v.path, data, 0600); err != nil {
+	if err := writeFileAtomic(v.path, data); err != nil {
 		return fmt.Errorf("failed to write vault: %w", err)
 	}
 
 	return nil
 }
 
-// Initialize sets up the vault with a master password
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so a crash or full disk leaves either the old vault or the
+// new one, never a mix of the two
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Initialize sets up the vault with a master password. A vault that already
+// holds secrets keeps its password; see ChangePassword.
 func (v *Vault) Initialize(password string) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
+	if len(v.secrets) > 0 {
+		return fmt.Errorf("vault already holds secrets; a new salt would make them unreadable, change the password instead")
+	}
+
 	v.salt = make([]byte, saltLength)
 	if _, err := rand.Read(v.salt); err != nil {
 		return fmt.Errorf("failed to generate salt: %w", err)
@@ -129,10 +211,70 @@ func (v *Vault) Initialize(password string) error {
 
 	v.key = pbkdf2.Key([]byte(password), v.salt, keyIterations, keyLength, sha256.New)
 	v.unlocked = true
+	v.keepUnlocked()
 
 	return v.save()
 }
 
+// ChangePassword re-encrypts every secret under newPassword with a fresh
+// salt. oldPassword must decrypt all of them; if any fails nothing changes.
+// The vault is saved in one atomic write, so an interrupted change leaves it
+// readable with the old password. The vault stays unlocked with the new one.
+func (v *Vault) ChangePassword(oldPassword, newPassword string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.salt) == 0 {
+		return fmt.Errorf("vault not initialized, run 'coderaft secrets init' first")
+	}
+
+	oldKey := v.key
+	v.key = pbkdf2.Key([]byte(oldPassword), v.salt, keyIterations, keyLength, sha256.New)
+	plain := make(map[string]map[string]string, len(v.secrets))
+	for project, keys := range v.secrets {
+		plain[project] = make(map[string]string, len(keys))
+		for key, encrypted := range keys {
+			value, err := v.decrypt(encrypted)
+			if err != nil {
+				v.key = oldKey
+				return fmt.Errorf("failed to decrypt %s/%s with the current password: %w", project, key, err)
+			}
+			plain[project][key] = value
+		}
+	}
+
+	oldSalt, oldSecrets := v.salt, v.secrets
+	restore := func() {
+		v.salt, v.secrets, v.key = oldSalt, oldSecrets, oldKey
+	}
+	v.salt = make([]byte, saltLength)
+	if _, err := rand.Read(v.salt); err != nil {
+		restore()
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	v.key = pbkdf2.Key([]byte(newPassword), v.salt, keyIterations, keyLength, sha256.New)
+	v.secrets = make(map[string]map[string]string, len(plain))
+	for project, keys := range plain {
+		v.secrets[project] = make(map[string]string, len(keys))
+		for key, value := range keys {
+			encrypted, err := v.encrypt(value)
+			if err != nil {
+				restore()
+				return fmt.Errorf("failed to encrypt secret: %w", err)
+			}
+			v.secrets[project][key] = encrypted
+		}
+	}
+
+	if err := v.save(); err != nil {
+		restore()
+		return err
+	}
+	v.unlocked = true
+	v.keepUnlocked()
+	return nil
+}
+
 // Unlock decrypts the vault with the master password
 func (v *Vault) Unlock(password string) error {
 	v.mu.Lock()
@@ -144,6 +286,7 @@ func (v *Vault) Unlock(password string) error {
 
 	v.key = pbkdf2.Key([]byte(password), v.salt, keyIterations, keyLength, sha256.New)
 	v.unlocked = true
+	v.keepUnlocked()
 
 	return nil
 }
@@ -155,9 +298,64 @@ func (v *Vault) IsInitialized() bool {
 
 // IsUnlocked checks if the vault is currently unlocked
 func (v *Vault) IsUnlocked() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
 	return v.unlocked
 }
 
+// SetIdleTimeout changes how long the vault stays unlocked without being
+// used, DefaultIdleTimeout unless set. 0 keeps it unlocked until the process
+// exits.
+func (v *Vault) SetIdleTimeout(d time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.idleTimeout = d
+	if d <= 0 {
+		if v.lockTimer != nil {
+			v.lockTimer.Stop()
+		}
+		return
+	}
+	if v.unlocked {
+		v.keepUnlocked()
+	}
+}
+
+// keepUnlocked pushes the auto-lock back to idleTimeout from now. Callers
+// hold v.mu.
+func (v *Vault) keepUnlocked() {
+	if v.idleTimeout <= 0 {
+		return
+	}
+	v.lockAt = v.clock.Now().Add(v.idleTimeout)
+	if v.lockTimer == nil {
+		v.lockTimer = v.clock.AfterFunc(v.idleTimeout, v.idleLock)
+		return
+	}
+	v.lockTimer.Reset(v.idleTimeout)
+}
+
+// idleLock runs when the auto-lock timer fires. An access that raced the
+// timer has moved lockAt on, in which case it waits out the rest.
+func (v *Vault) idleLock() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.unlocked || v.idleTimeout <= 0 {
+		return
+	}
+	if remaining := v.lockAt.Sub(v.clock.Now()); remaining > 0 {
+		v.lockTimer.Reset(remaining)
+		return
+	}
+	for i := range v.key {
+		v.key[i] = 0
+	}
+	v.key = nil
+	v.unlocked = false
+}
+
 // Set stores an encrypted secret for a project
 func (v *Vault) Set(project, key, value string) error {
 	v.mu.Lock()
@@ -166,6 +364,7 @@ func (v *Vault) Set(project, key, value string) error {
 	if !v.unlocked {
 		return fmt.Errorf("vault is locked, unlock first")
 	}
+	v.keepUnlocked()
 
 	encrypted, err := v.encrypt(value)
 	if err != nil {
@@ -177,17 +376,47 @@ func (v *Vault) Set(project, key, value string) error {
 	}
 	v.secrets[project][key] = encrypted
 
+	if v.meta[project] == nil {
+		v.meta[project] = make(map[string]SecretMeta)
+	}
+	m := v.meta[project][key]
+	t := now().UTC()
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = t
+	}
+	m.UpdatedAt = t
+	v.meta[project][key] = m
+
 	return v.save()
 }
 
+// touch records that secrets of a project were read. Failing to save the
+// time never fails the read. Callers hold v.mu.
+func (v *Vault) touch(project string, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	if v.meta[project] == nil {
+		v.meta[project] = make(map[string]SecretMeta)
+	}
+	t := now().UTC()
+	for _, key := range keys {
+		m := v.meta[project][key]
+		m.AccessedAt = t
+		v.meta[project][key] = m
+	}
+	_ = v.save()
+}
+
 // Get retrieves and decrypts a secret for a project
 func (v *Vault) Get(project, key string) (string, error) {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
 
 	if !v.unlocked {
 		return "", fmt.Errorf("vault is locked, unlock first")
 	}
+	v.keepUnlocked()
 
 	projectSecrets, ok := v.secrets[project]
 	if !ok {
@@ -199,7 +428,12 @@ func (v *Vault) Get(project, key string) (string, error) {
 		return "", fmt.Errorf("secret '%s' not found in project '%s'", key, project)
 	}
 
-	return v.decrypt(encrypted)
+	value, err := v.decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	v.touch(project, key)
+	return value, nil
 }
 
 // Remove deletes a secret from a project
@@ -219,6 +453,10 @@ func (v *Vault) Remove(project, key string) error {
 	if len(v.secrets[project]) == 0 {
 		delete(v.secrets, project)
 	}
+	delete(v.meta[project], key)
+	if len(v.meta[project]) == 0 {
+		delete(v.meta, project)
+	}
 
 	return v.save()
 }
@@ -256,12 +494,13 @@ func (v *Vault) ListProjects() []string {
 
 // GetAll returns all decrypted secrets for a project (for injection into containers)
 func (v *Vault) GetAll(project string) (map[string]string, error) {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
 
 	if !v.unlocked {
 		return nil, fmt.Errorf("vault is locked, unlock first")
 	}
+	v.keepUnlocked()
 
 	projectSecrets, ok := v.secrets[project]
 	if !ok {
@@ -269,17 +508,36 @@ func (v *Vault) GetAll(project string) (map[string]string, error) {
 	}
 
 	result := make(map[string]string, len(projectSecrets))
+	keys := make([]string, 0, len(projectSecrets))
 	for k, encrypted := range projectSecrets {
 		decrypted, err := v.decrypt(encrypted)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decrypt secret '%s': %w", k, err)
 		}
 		result[k] = decrypted
+		keys = append(keys, k)
 	}
+	v.touch(project, keys...)
 
 	return result, nil
 }
 
+// Inventory returns the timestamps of every stored secret, by project and
+// key. It needs no password, since no value is decrypted.
+func (v *Vault) Inventory() map[string]map[string]SecretMeta {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	inv := make(map[string]map[string]SecretMeta, len(v.secrets))
+	for project, keys := range v.secrets {
+		inv[project] = make(map[string]SecretMeta, len(keys))
+		for key := range keys {
+			inv[project][key] = v.meta[project][key]
+		}
+	}
+	return inv
+}
+
 // encrypt uses AES-GCM to encrypt a value
 func (v *Vault) encrypt(plaintext string) (string, error) {
 	block, err := aes.NewCipher(v.key)
@@ -381,6 +639,38 @@ func LoadEnvFile(path string) (map[string]string, error) {
 	return env, nil
 }
 
+// WriteEnvFile writes values to path as a .env file LoadEnvFile reads back,
+// sorted by key and readable by the owner only. Values can't span lines.
+func WriteEnvFile(path string, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("value of %s spans several lines, which a .env file can't hold", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", k, values[k])
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The mode above only applies to a new file; tighten an existing one
+	// before the secrets go in
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // MergeEnvFiles loads multiple .env files and merges them (later files override earlier)
 func MergeEnvFiles(paths ...string) (map[string]string, error) {
 	merged := make(map[string]string)
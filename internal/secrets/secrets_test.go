@@ -0,0 +1,312 @@
+package secrets
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVaultRecordsTimestamps(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	defer func(old func() time.Time) { now = old }(now)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	v, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Initialize("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("app", "API_KEY", "sk-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock = clock.Add(24 * time.Hour)
+	if err := v.Set("app", "API_KEY", "sk-2"); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(24 * time.Hour)
+	if _, err := v.GetAll("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the timestamps survive a reload, and need no password to read
+	reloaded, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := reloaded.Inventory()["app"]["API_KEY"]
+	if !meta.CreatedAt.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!meta.UpdatedAt.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) ||
+		!meta.AccessedAt.Equal(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected timestamps %+v", meta)
+	}
+
+	if err := reloaded.Unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Remove("app", "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Inventory()) != 0 || len(reloaded.meta) != 0 {
+		t.Error("removing the last secret should drop its metadata too")
+	}
+}
+
+func TestVaultLoadsWithoutMetadata(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	// a vault written before timestamps were tracked
+	legacy := VaultData{Version: 1, Salt: "c2FsdHNhbHRzYWx0c2FsdA==", Projects: map[string]map[string]string{"app": {"TOKEN": "x"}}}
+	data, _ := json.Marshal(legacy)
+	path := filepath.Join(home, ".coderaft", "secrets.vault.json")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := v.Inventory()
+	if meta, ok := inv["app"]["TOKEN"]; !ok || !meta.CreatedAt.IsZero() || !meta.AccessedAt.IsZero() {
+		t.Errorf("legacy secret should be listed with zero timestamps, got %v", inv)
+	}
+}
+
+func TestWriteEnvFileRoundTrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("OLD=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"API_KEY":  "sk-123",
+		"GREETING": `say "hi" to $USER`,
+		"PADDED":   "  spaced  ",
+		"EMPTY":    "",
+		"URL":      "postgres://u:p@db/app?sslmode=disable#x",
+	}
+	if err := WriteEnvFile(path, values); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	got, err := LoadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(values) {
+		t.Errorf("read back %v, want %v", got, values)
+	}
+	for k, v := range values {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	if err := WriteEnvFile(path, map[string]string{"CERT": "line1\nline2"}); err == nil {
+		t.Error("expected multi-line values to be refused")
+	}
+}
+
+func TestVaultChangePassword(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	v, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Initialize("old password"); err != nil {
+		t.Fatal(err)
+	}
+	for k, val := range map[string]string{"API_KEY": "sk-1", "DB_PASSWORD": "hunter2"} {
+		if err := v.Set("app", k, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Set("web", "TOKEN", "t0k"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(v.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong current password changes nothing
+	if err := v.ChangePassword("wrong password", "new password"); err == nil {
+		t.Fatal("expected the wrong current password to be refused")
+	}
+	if after, _ := os.ReadFile(v.path); string(after) != string(before) {
+		t.Error("a failed change should leave the vault file alone")
+	}
+	if got, err := v.Get("app", "API_KEY"); err != nil || got != "sk-1" {
+		t.Errorf("after a failed change Get() = %q, %v", got, err)
+	}
+
+	oldSalt := string(v.salt)
+	if err := v.ChangePassword("old password", "new password"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reloaded.salt) == oldSalt {
+		t.Error("the salt should be regenerated")
+	}
+	if err := reloaded.Unlock("old password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.GetAll("app"); err == nil {
+		t.Error("the old password should no longer decrypt the secrets")
+	}
+	if err := reloaded.Unlock("new password"); err != nil {
+		t.Fatal(err)
+	}
+	app, err := reloaded.GetAll("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app["API_KEY"] != "sk-1" || app["DB_PASSWORD"] != "hunter2" {
+		t.Errorf("app secrets = %v", app)
+	}
+	if got, err := reloaded.Get("web", "TOKEN"); err != nil || got != "t0k" {
+		t.Errorf("web TOKEN = %q, %v", got, err)
+	}
+
+	// only the vault itself is left, no temporary files
+	entries, err := os.ReadDir(filepath.Dir(v.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "secrets.vault.json" {
+			t.Errorf("unexpected file %s next to the vault", e.Name())
+		}
+	}
+	info, err := os.Stat(v.path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("vault mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	if err := reloaded.Initialize("another password"); err == nil {
+		t.Error("Initialize should refuse a vault that holds secrets")
+	}
+}
+
+// fakeClock fires its timers when Advance moves it past their deadline
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.at.After(c.now) {
+			t.active = false
+			t.f()
+		}
+	}
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	was := t.active
+	t.at, t.active = t.clock.now.Add(d), true
+	return was
+}
+
+func (t *fakeTimer) Stop() bool {
+	was := t.active
+	t.active = false
+	return was
+}
+
+func TestVaultLocksWhenIdle(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	v, err := NewVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.clock = clk
+	if v.idleTimeout != DefaultIdleTimeout {
+		t.Errorf("idle timeout = %s, want %s by default", v.idleTimeout, DefaultIdleTimeout)
+	}
+	if err := v.Initialize("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("app", "API_KEY", "sk-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// each access pushes the lock back
+	clk.Advance(10 * time.Minute)
+	if _, err := v.Get("app", "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(10 * time.Minute)
+	if !v.IsUnlocked() {
+		t.Fatal("vault locked although it was used 10 minutes ago")
+	}
+
+	key := v.key
+	clk.Advance(5 * time.Minute)
+	if v.IsUnlocked() {
+		t.Fatal("vault should lock after 15 idle minutes")
+	}
+	if v.key != nil {
+		t.Error("the key should be dropped")
+	}
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("the key should be zeroed")
+		}
+	}
+	if _, err := v.GetAll("app"); err == nil {
+		t.Error("a locked vault should refuse reads")
+	}
+
+	// unlocking again works as before
+	if err := v.Unlock("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := v.Get("app", "API_KEY"); err != nil || got != "sk-1" {
+		t.Errorf("Get() after unlocking again = %q, %v", got, err)
+	}
+
+	// 0 turns the auto-lock off
+	v.SetIdleTimeout(0)
+	clk.Advance(24 * time.Hour)
+	if !v.IsUnlocked() {
+		t.Error("vault locked with the auto-lock off")
+	}
+}
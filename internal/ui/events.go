@@ -0,0 +1,70 @@
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ProgressPretty = "pretty"
+	ProgressJSON   = "json"
+)
+
+var (
+	progressMode = ProgressPretty
+	eventMu      sync.Mutex
+	eventOut     io.Writer = os.Stdout
+)
+
+func SetProgressMode(mode string) error {
+	switch mode {
+	case "", ProgressPretty:
+		progressMode = ProgressPretty
+	case ProgressJSON:
+		progressMode = ProgressJSON
+	default:
+		return fmt.Errorf("invalid progress mode '%s' (expected '%s' or '%s')", mode, ProgressPretty, ProgressJSON)
+	}
+	return nil
+}
+
+func JSONProgress() bool {
+	return progressMode == ProgressJSON
+}
+
+// Writer returns where human-oriented output goes. In json progress mode
+// stdout is reserved for the event stream, so everything else moves to stderr.
+func Writer() io.Writer {
+	if JSONProgress() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Event emits a single newline-delimited JSON object when json progress mode
+// is enabled. It is a no-op in pretty mode.
+func Event(name string, fields map[string]interface{}) {
+	if !JSONProgress() {
+		return
+	}
+
+	ev := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		ev[k] = v
+	}
+	ev["event"] = name
+	ev["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	fmt.Fprintln(eventOut, string(data))
+}
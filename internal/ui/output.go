@@ -3,6 +3,7 @@ package ui
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 var Verbose bool
@@ -11,57 +12,63 @@ func Status(msg string, args ...interface{}) {
 	if !Verbose {
 		return
 	}
-	fmt.Printf(msg+"\n", args...)
+	fmt.Fprintf(Writer(), msg+"\n", args...)
 }
 
 func Statusf(format string, args ...interface{}) {
 	if !Verbose {
 		return
 	}
-	fmt.Printf(format+"\n", args...)
+	fmt.Fprintf(Writer(), format+"\n", args...)
 }
 
 func Step(current, total int, msg string, args ...interface{}) {
 	prefix := fmt.Sprintf("[%d/%d] ", current, total)
-	fmt.Printf(prefix+msg+"\n", args...)
+	line := fmt.Sprintf(prefix+msg, args...)
+	Event("step", map[string]interface{}{"current": current, "total": total, "message": strings.TrimPrefix(line, prefix)})
+	fmt.Fprintln(Writer(), line)
 }
 
 func Success(msg string, args ...interface{}) {
-	fmt.Printf("done: "+msg+"\n", args...)
+	fmt.Fprintf(Writer(), "done: "+msg+"\n", args...)
 }
 
 func Warning(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "warning: "+msg+"\n", args...)
+	line := fmt.Sprintf("warning: "+msg, args...)
+	Event("warning", map[string]interface{}{"message": strings.TrimPrefix(line, "warning: ")})
+	fmt.Fprintln(os.Stderr, line)
 }
 
 func Error(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "error: "+msg+"\n", args...)
+	line := fmt.Sprintf("error: "+msg, args...)
+	Event("error", map[string]interface{}{"message": strings.TrimPrefix(line, "error: ")})
+	fmt.Fprintln(os.Stderr, line)
 }
 
 func Info(msg string, args ...interface{}) {
-	fmt.Printf(msg+"\n", args...)
+	fmt.Fprintf(Writer(), msg+"\n", args...)
 }
 
 func Detail(key, value string) {
-	fmt.Printf("  %s: %s\n", key, value)
+	fmt.Fprintf(Writer(), "  %s: %s\n", key, value)
 }
 
 func Item(msg string, args ...interface{}) {
-	fmt.Printf("  - "+msg+"\n", args...)
+	fmt.Fprintf(Writer(), "  - "+msg+"\n", args...)
 }
 
 func Header(msg string, args ...interface{}) {
-	fmt.Printf(msg+"\n", args...)
+	fmt.Fprintf(Writer(), msg+"\n", args...)
 }
 
 func Blank() {
-	fmt.Println()
+	fmt.Fprintln(Writer())
 }
 
 func Prompt(msg string, args ...interface{}) {
-	fmt.Printf("? "+msg, args...)
+	fmt.Fprintf(Writer(), "? "+msg, args...)
 }
 
 func Summary(label string, counts ...interface{}) {
-	fmt.Printf("summary: "+label+"\n", counts...)
+	fmt.Fprintf(Writer(), "summary: "+label+"\n", counts...)
 }